@@ -0,0 +1,341 @@
+// addrman.go
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	mathrand "math/rand"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	AddrBucketCount           = 64                  // Buckets addresses are spread across.
+	AddrBucketSize            = 64                  // Addresses each bucket can hold.
+	AddrBucketsPerSourceGroup = 8                   // Buckets a single source group can fill, limiting how much of the table one network can own.
+	MaxAddrPerMessage         = 1000                // Most addresses in a single addr message.
+	AddrRelayLimit            = 10                  // Addr messages this small are assumed fresh and relayed on.
+	AddrRelayFanout           = 2                   // Peers each fresh address is relayed to.
+	AddrHorizon               = 30 * 24 * time.Hour // Addresses not seen for this long are forgotten.
+	AddrMaxFailures           = 3                   // Failed attempts before an address that never worked is given up on.
+	AddrMinFailDuration       = 7 * 24 * time.Hour  // Addresses that haven't worked for this long are given up on after AddrMaxFailures.
+	DefaultAddrFile           = "peers.json"        // Where known addresses are kept between runs.
+)
+
+// KnownAddress is a peer address the node has heard about, with what it knows of its history.
+type KnownAddress struct {
+	Address     string
+	Services    ServiceFlag
+	Source      string // Group of the peer that told us about the address.
+	LastSeen    int64  // When the address was last advertised, as a Unix time.
+	LastAttempt int64  // When we last tried to connect.
+	LastSuccess int64  // When a connection last succeeded.
+	Attempts    int    // Failed attempts since the last success.
+}
+
+// NetAddress is an address as it is gossiped in addr messages.
+type NetAddress struct {
+	Address   string
+	Services  ServiceFlag
+	Timestamp int64
+}
+
+// isTerrible reports whether an address is no longer worth keeping or handing out.
+func (ka *KnownAddress) isTerrible(now time.Time) bool {
+	if ka.LastAttempt >= now.Add(-time.Minute).Unix() {
+		return false // Being tried right now
+	}
+	if ka.LastSeen < now.Add(-AddrHorizon).Unix() {
+		return true
+	}
+	return ka.Attempts >= AddrMaxFailures && ka.LastSuccess < now.Add(-AddrMinFailDuration).Unix()
+}
+
+// AddrManager keeps the addresses the node can connect to. Addresses are placed in buckets by a
+// keyed hash of the group they were learned from, so peers from one network can only ever fill
+// a few buckets and can't crowd out everyone else.
+type AddrManager struct {
+	key       [32]byte // Secret mixed into bucket selection so it can't be predicted.
+	buckets   [AddrBucketCount]map[string]*KnownAddress
+	addresses map[string]*KnownAddress // Every address, whichever bucket it is in.
+	path      string
+	lock      sync.Mutex
+}
+
+// addrFile is the on-disk form of the address manager.
+type addrFile struct {
+	Key       string
+	Addresses []*KnownAddress
+}
+
+// NewAddrManager creates an empty address manager saved to path. An empty path keeps it in memory.
+func NewAddrManager(path string) *AddrManager {
+	am := &AddrManager{addresses: make(map[string]*KnownAddress), path: path}
+	rand.Read(am.key[:])
+	for i := range am.buckets {
+		am.buckets[i] = make(map[string]*KnownAddress)
+	}
+	return am
+}
+
+// LoadAddrManager reads the addresses saved at path. A missing file gives an empty manager.
+func LoadAddrManager(path string) (*AddrManager, error) {
+	am := NewAddrManager(path)
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return am, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var file addrFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("failed to decode %s: %w", path, err)
+	}
+	key, err := hex.DecodeString(file.Key)
+	if err != nil || len(key) != len(am.key) {
+		return nil, fmt.Errorf("invalid bucket key in %s", path)
+	}
+	copy(am.key[:], key)
+	for _, ka := range file.Addresses {
+		am.insert(ka)
+	}
+	return am, nil
+}
+
+// Save writes the known addresses to disk.
+func (am *AddrManager) Save() error {
+	if am.path == "" {
+		return nil
+	}
+
+	am.lock.Lock()
+	file := addrFile{Key: hex.EncodeToString(am.key[:])}
+	for _, ka := range am.addresses {
+		copied := *ka
+		file.Addresses = append(file.Addresses, &copied)
+	}
+	am.lock.Unlock()
+
+	data, err := json.Marshal(file)
+	if err != nil {
+		return err
+	}
+	tmp := am.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, am.path)
+}
+
+// AddAddresses records addresses learned from source, which is the address of the peer that sent
+// them, or "local" for ones we were configured with. It returns the addresses that
+// were not known before.
+func (am *AddrManager) AddAddresses(addresses []NetAddress, source string) []NetAddress {
+	am.lock.Lock()
+	defer am.lock.Unlock()
+
+	now := time.Now()
+	var added []NetAddress
+	for _, na := range addresses {
+		if na.Address == "" {
+			continue
+		}
+		if na.Timestamp <= 0 || na.Timestamp > now.Add(10*time.Minute).Unix() {
+			na.Timestamp = now.Add(-5 * 24 * time.Hour).Unix() // Don't trust timestamps from the future
+		}
+
+		if ka, exists := am.addresses[na.Address]; exists {
+			if na.Timestamp > ka.LastSeen {
+				ka.LastSeen = na.Timestamp
+			}
+			ka.Services |= na.Services
+			continue
+		}
+		ka := &KnownAddress{Address: na.Address, Services: na.Services, Source: addressGroup(source), LastSeen: na.Timestamp}
+		if am.insert(ka) {
+			added = append(added, na)
+		}
+	}
+	return added
+}
+
+// insert places an address in its bucket, evicting the bucket's worst entry if it is full.
+// Callers must hold the lock, or own the manager exclusively.
+func (am *AddrManager) insert(ka *KnownAddress) bool {
+	bucket := am.buckets[am.bucketFor(ka)]
+	if len(bucket) >= AddrBucketSize {
+		now := time.Now()
+		var worst *KnownAddress
+		for _, candidate := range bucket {
+			if candidate.isTerrible(now) {
+				worst = candidate
+				break
+			}
+			if worst == nil || candidate.LastSeen < worst.LastSeen {
+				worst = candidate
+			}
+		}
+		if worst.LastSeen >= ka.LastSeen && !worst.isTerrible(now) {
+			return false
+		}
+		delete(bucket, worst.Address)
+		delete(am.addresses, worst.Address)
+	}
+	bucket[ka.Address] = ka
+	am.addresses[ka.Address] = ka
+	return true
+}
+
+// bucketFor picks the bucket for an address. The source group decides which few buckets are
+// available and the address group picks among them.
+func (am *AddrManager) bucketFor(ka *KnownAddress) int {
+	sourceGroup := ka.Source
+	addrHash := sha256.Sum256(append(am.key[:], addressGroup(ka.Address)+"|"+sourceGroup...))
+	slot := binary.BigEndian.Uint64(addrHash[:8]) % AddrBucketsPerSourceGroup
+
+	var buf []byte
+	buf = append(buf, am.key[:]...)
+	buf = append(buf, sourceGroup...)
+	buf = binary.BigEndian.AppendUint64(buf, slot)
+	bucketHash := sha256.Sum256(buf)
+	return int(binary.BigEndian.Uint64(bucketHash[:8]) % AddrBucketCount)
+}
+
+// Attempt records that we are about to try connecting to an address.
+func (am *AddrManager) Attempt(address string) {
+	am.lock.Lock()
+	defer am.lock.Unlock()
+	if ka, exists := am.addresses[address]; exists {
+		ka.LastAttempt = time.Now().Unix()
+		ka.Attempts++
+	}
+}
+
+// Good records a successful connection to an address, adding it if it was unknown.
+func (am *AddrManager) Good(address string, services ServiceFlag) {
+	am.lock.Lock()
+	defer am.lock.Unlock()
+
+	now := time.Now().Unix()
+	ka, exists := am.addresses[address]
+	if !exists {
+		ka = &KnownAddress{Address: address, Source: addressGroup(address)}
+		if !am.insert(ka) {
+			return
+		}
+	}
+	ka.Services = services
+	ka.LastSeen = now
+	ka.LastAttempt = now
+	ka.LastSuccess = now
+	ka.Attempts = 0
+}
+
+// Select picks a random address worth connecting to for which skip returns false. Addresses that
+// keep failing are picked less often. Returns nil if there is nothing suitable.
+func (am *AddrManager) Select(skip func(*KnownAddress) bool) *KnownAddress {
+	am.lock.Lock()
+	defer am.lock.Unlock()
+
+	now := time.Now()
+	var candidates []*KnownAddress
+	for _, bucket := range am.buckets {
+		for _, ka := range bucket {
+			if !ka.isTerrible(now) && !skip(ka) {
+				candidates = append(candidates, ka)
+			}
+		}
+	}
+	if len(candidates) == 0 {
+		return nil
+	}
+
+	// Weight each candidate by how often it has failed lately, so a few bad entries can't keep
+	// getting picked ahead of working ones
+	for tries := 0; tries < 4*len(candidates); tries++ {
+		ka := candidates[mathrand.Intn(len(candidates))]
+		if mathrand.Float64() < 1/float64(1+ka.Attempts) {
+			copied := *ka
+			return &copied
+		}
+	}
+	copied := *candidates[mathrand.Intn(len(candidates))]
+	return &copied
+}
+
+// GetAddresses returns a random sample of up to max addresses to share with a peer.
+func (am *AddrManager) GetAddresses(max int) []NetAddress {
+	am.lock.Lock()
+	defer am.lock.Unlock()
+
+	now := time.Now()
+	var result []NetAddress
+	for _, ka := range am.addresses {
+		if !ka.isTerrible(now) {
+			result = append(result, NetAddress{Address: ka.Address, Services: ka.Services, Timestamp: ka.LastSeen})
+		}
+	}
+	mathrand.Shuffle(len(result), func(i, j int) { result[i], result[j] = result[j], result[i] })
+	if len(result) > max {
+		result = result[:max]
+	}
+	return result
+}
+
+// Size returns the number of known addresses.
+func (am *AddrManager) Size() int {
+	am.lock.Lock()
+	defer am.lock.Unlock()
+	return len(am.addresses)
+}
+
+// addressGroup returns the network group an address belongs to: the /16 for IPv4, the /32 for
+// IPv6, or the host itself for names. Addresses in the same group are treated as one source.
+func addressGroup(address string) string {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		host = address
+	}
+	ip := net.ParseIP(host)
+	switch {
+	case host == "localhost":
+		return "local"
+	case ip == nil:
+		return "host:" + host
+	case ip.IsLoopback() || ip.IsUnspecified():
+		return "local"
+	case ip.To4() != nil:
+		return "ipv4:" + ip.To4().Mask(net.CIDRMask(16, 32)).String()
+	default:
+		return "ipv6:" + ip.Mask(net.CIDRMask(32, 128)).String()
+	}
+}
+
+// peerListenAddress works out where an inbound peer can be reached. Peers that listen on every
+// interface advertise an address with no host, so the host they connected from is used instead.
+func peerListenAddress(advertised string, remote net.Addr) string {
+	if advertised == "" {
+		return remote.String()
+	}
+	host, port, err := net.SplitHostPort(advertised)
+	if err != nil {
+		return advertised
+	}
+	if ip := net.ParseIP(host); host == "" || (ip != nil && ip.IsUnspecified()) {
+		remoteHost, _, err := net.SplitHostPort(remote.String())
+		if err != nil {
+			return advertised
+		}
+		return net.JoinHostPort(remoteHost, port)
+	}
+	return advertised
+}
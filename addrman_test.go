@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestAddrManagerPersistsAddresses(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "peers.json")
+	am := NewAddrManager(path)
+	now := time.Now().Unix()
+	added := am.AddAddresses([]NetAddress{
+		{Address: "198.51.100.1:8090", Services: ServiceFull, Timestamp: now},
+		{Address: "203.0.113.1:8090", Services: ServicePruned, Timestamp: now},
+	}, "192.0.2.1:8090")
+	if len(added) != 2 {
+		t.Fatalf("added %d new addresses, want 2", len(added))
+	}
+	if again := am.AddAddresses([]NetAddress{{Address: "198.51.100.1:8090", Timestamp: now}}, "192.0.2.1:8090"); len(again) != 0 {
+		t.Fatal("a known address was reported as new")
+	}
+	if err := am.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded, err := LoadAddrManager(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.Size() != 2 || loaded.key != am.key {
+		t.Fatalf("loaded %d addresses, want 2 with the same bucket key", loaded.Size())
+	}
+	if ka := loaded.addresses["203.0.113.1:8090"]; ka == nil || ka.Services != ServicePruned || ka.Source != addressGroup("192.0.2.1:8090") {
+		t.Fatalf("address came back as %+v", ka)
+	}
+
+	if err := os.WriteFile(path, []byte(`{"Key":"short"}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadAddrManager(path); err == nil {
+		t.Fatal("loaded a file with an invalid bucket key")
+	}
+}
+
+func TestAddrManagerLimitsOneSourceGroup(t *testing.T) {
+	am := NewAddrManager("")
+	var flood []NetAddress
+	for i := 0; i < 4*AddrBucketsPerSourceGroup*AddrBucketSize; i++ {
+		flood = append(flood, NetAddress{Address: fmt.Sprintf("10.%d.%d.1:8090", i/256, i%256), Timestamp: time.Now().Unix()})
+	}
+	am.AddAddresses(flood, "192.0.2.1:8090")
+	used := 0
+	for _, bucket := range am.buckets {
+		if len(bucket) > 0 {
+			used++
+		}
+	}
+	if used > AddrBucketsPerSourceGroup {
+		t.Fatalf("one source group spread across %d buckets, more than its %d", used, AddrBucketsPerSourceGroup)
+	}
+
+	// The buckets the flood can't reach still take addresses from other networks
+	for i := 0; i < 256; i++ {
+		ka := &KnownAddress{Address: "198.51.100.1:8090", Source: addressGroup(fmt.Sprintf("%d.0.113.9:8090", i+1))}
+		if len(am.buckets[am.bucketFor(ka)]) > 0 {
+			continue
+		}
+		if added := am.AddAddresses([]NetAddress{{Address: ka.Address, Timestamp: time.Now().Unix()}}, fmt.Sprintf("%d.0.113.9:8090", i+1)); len(added) != 1 {
+			t.Fatal("a flood from one network crowded out another")
+		}
+		return
+	}
+	t.Fatal("every source group shares a bucket with the flood")
+}
+
+func TestAddrManagerDropsTerribleAddresses(t *testing.T) {
+	am := NewAddrManager("")
+	stale := time.Now().Add(-2 * AddrHorizon).Unix()
+	am.AddAddresses([]NetAddress{
+		{Address: "198.51.100.1:8090", Timestamp: stale},
+		{Address: "203.0.113.1:8090", Timestamp: time.Now().Add(time.Hour).Unix()},
+	}, "192.0.2.1:8090")
+
+	// A timestamp from the future is not believed, but the address is still fresh enough to share
+	shared := am.GetAddresses(10)
+	if len(shared) != 1 || shared[0].Address != "203.0.113.1:8090" || shared[0].Timestamp > time.Now().Unix() {
+		t.Fatalf("shared %+v, want only the fresh address with a past timestamp", shared)
+	}
+	if ka := am.Select(func(*KnownAddress) bool { return false }); ka == nil || ka.Address != "203.0.113.1:8090" {
+		t.Fatalf("selected %+v, want the fresh address", ka)
+	}
+	if ka := am.Select(func(ka *KnownAddress) bool { return ka.Address == "203.0.113.1:8090" }); ka != nil {
+		t.Fatalf("selected %s, which has not been seen for longer than the horizon", ka.Address)
+	}
+}
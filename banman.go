@@ -0,0 +1,196 @@
+// banman.go
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultBanDuration = 24 * time.Hour // How long a misbehaving peer is banned for.
+	DefaultBanFile     = "banlist.json" // Where bans are kept between runs.
+	BanPrefixIPv4      = 24             // Bits of a misbehaving IPv4 host's address its ban covers.
+	BanPrefixIPv6      = 64             // Bits of a misbehaving IPv6 host's address its ban covers.
+)
+
+// BanEntry is a ban on a single address or a whole subnet.
+type BanEntry struct {
+	Subnet  string // CIDR notation, e.g. 203.0.113.7/32 or 198.51.100.0/24.
+	Reason  string
+	Created int64 // When the ban was made, as a Unix time.
+	Until   int64 // When the ban expires, as a Unix time.
+}
+
+// BanManager keeps the subnets the node refuses to talk to.
+type BanManager struct {
+	bans map[string]*BanEntry // By subnet.
+	path string
+	lock sync.Mutex
+}
+
+// NewBanManager creates an empty ban list saved to path. An empty path keeps it in memory.
+func NewBanManager(path string) *BanManager {
+	return &BanManager{bans: make(map[string]*BanEntry), path: path}
+}
+
+// LoadBanManager reads the ban list saved at path, dropping bans that have expired. A missing
+// file gives an empty list.
+func LoadBanManager(path string) (*BanManager, error) {
+	bm := NewBanManager(path)
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return bm, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []*BanEntry
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return nil, fmt.Errorf("failed to decode %s: %w", path, err)
+	}
+	now := time.Now().Unix()
+	for _, entry := range entries {
+		if _, _, err := net.ParseCIDR(entry.Subnet); err != nil {
+			return nil, fmt.Errorf("invalid subnet %q in %s", entry.Subnet, path)
+		}
+		if entry.Until > now {
+			bm.bans[entry.Subnet] = entry
+		}
+	}
+	return bm, nil
+}
+
+// Save writes the ban list to disk.
+func (bm *BanManager) Save() error {
+	if bm.path == "" {
+		return nil
+	}
+
+	data, err := json.Marshal(bm.List())
+	if err != nil {
+		return err
+	}
+	tmp := bm.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, bm.path)
+}
+
+// Ban bans a subnet for the given duration and saves the list. A longer existing ban on the same
+// subnet is kept.
+func (bm *BanManager) Ban(subnet *net.IPNet, duration time.Duration, reason string) error {
+	now := time.Now()
+	entry := &BanEntry{Subnet: subnet.String(), Reason: reason, Created: now.Unix(), Until: now.Add(duration).Unix()}
+
+	bm.lock.Lock()
+	if existing, exists := bm.bans[entry.Subnet]; !exists || existing.Until < entry.Until {
+		bm.bans[entry.Subnet] = entry
+	}
+	bm.lock.Unlock()
+	return bm.Save()
+}
+
+// Unban lifts the ban on a subnet and saves the list. It reports whether there was such a ban.
+func (bm *BanManager) Unban(subnet *net.IPNet) (bool, error) {
+	bm.lock.Lock()
+	_, exists := bm.bans[subnet.String()]
+	delete(bm.bans, subnet.String())
+	bm.lock.Unlock()
+
+	if !exists {
+		return false, nil
+	}
+	return true, bm.Save()
+}
+
+// IsBanned reports whether the host of an address falls within a current ban. Addresses whose
+// host isn't an IP can't be banned.
+func (bm *BanManager) IsBanned(address string) bool {
+	ip := net.ParseIP(addressHost(address))
+	if ip == nil {
+		return false
+	}
+
+	bm.lock.Lock()
+	defer bm.lock.Unlock()
+	now := time.Now().Unix()
+	for key, entry := range bm.bans {
+		if entry.Until <= now {
+			delete(bm.bans, key)
+			continue
+		}
+		_, subnet, _ := net.ParseCIDR(entry.Subnet)
+		if subnet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// List returns the current bans, sorted by subnet.
+func (bm *BanManager) List() []BanEntry {
+	bm.lock.Lock()
+	defer bm.lock.Unlock()
+
+	now := time.Now().Unix()
+	entries := make([]BanEntry, 0, len(bm.bans))
+	for key, entry := range bm.bans {
+		if entry.Until <= now {
+			delete(bm.bans, key)
+			continue
+		}
+		entries = append(entries, *entry)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Subnet < entries[j].Subnet
+	})
+	return entries
+}
+
+// ParseSubnet accepts a subnet in CIDR notation or a single IP, which is treated as a /32 or /128.
+func ParseSubnet(value string) (*net.IPNet, error) {
+	if _, subnet, err := net.ParseCIDR(value); err == nil {
+		return subnet, nil
+	}
+	ip := net.ParseIP(value)
+	if ip == nil {
+		return nil, fmt.Errorf("%q is not an IP address or subnet", value)
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}, nil
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+}
+
+// misbehaviorSubnet returns the subnet banned for a misbehaving host: its /24 for IPv4 or its /64
+// for IPv6. Whoever runs a host usually holds the addresses around it too, so banning the host
+// alone would only make them switch address.
+func misbehaviorSubnet(host string) (*net.IPNet, error) {
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return nil, fmt.Errorf("%q is not an IP address", host)
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		mask := net.CIDRMask(BanPrefixIPv4, 32)
+		return &net.IPNet{IP: ip4.Mask(mask), Mask: mask}, nil
+	}
+	mask := net.CIDRMask(BanPrefixIPv6, 128)
+	return &net.IPNet{IP: ip.Mask(mask), Mask: mask}, nil
+}
+
+// addressHost returns the host part of a host:port address, or the address itself if it has no port.
+func addressHost(address string) string {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return address
+	}
+	return host
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMisbehaviorBansCoverTheSubnet(t *testing.T) {
+	bm := NewBanManager("")
+	for _, host := range []string{"203.0.113.7", "2001:db8:1:2:3:4:5:6"} {
+		subnet, err := misbehaviorSubnet(host)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := bm.Ban(subnet, time.Hour, "test"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for address, banned := range map[string]bool{
+		"203.0.113.7:8333":               true,
+		"203.0.113.200:8333":             true,
+		"203.0.114.7:8333":               false,
+		"[2001:db8:1:2:ffff::1]:8333":    true,
+		"[2001:db8:1:3:3:4:5:6]:8333":    false,
+		"[2001:db8:1:2:3:4:5:6]:8333":    true,
+		"198.51.100.7:8333":              false,
+		"[2001:db8:ffff:2:3:4:5:6]:8333": false,
+	} {
+		if bm.IsBanned(address) != banned {
+			t.Errorf("IsBanned(%s) = %v, want %v", address, !banned, banned)
+		}
+	}
+
+	if _, err := misbehaviorSubnet("pipe"); err == nil {
+		t.Fatal("made a subnet from a host that isn't an IP")
+	}
+}
@@ -4,42 +4,51 @@ import (
 	"crypto/sha256"
 	"encoding/hex"
 	"fmt"
-	"math/rand"
 	"sort"
 	"strconv"
 	"sync"
-	"time"
 )
 
 // this struct represents a single block in the bc
 type Block struct {
-	Index        int				// Position of the block in the chain
-	Timestamp    int64				// When block was created
-	PreviousHash string
-	Hash         string				// Calculated hash of this block
-	Transactions []*Transaction	
-	Nonce        int				// Nonce used for POW
-	Difficulty   int				// Mining difficulty level
+	Index             int   // Position of the block in the chain
+	Timestamp         int64 // When block was created
+	PreviousHash      string
+	Hash              string // Calculated hash of this block
+	MerkleRoot        string // Merkle root of the transactions, so headers verify without bodies
+	Transactions      []*Transaction
+	Nonce             int                  // Nonce used for POW
+	Difficulty        int                  // Mining difficulty level
+	UTXOCommitment    string               // MuHash of the UTXO set after this block's transactions are applied
+	Proposer          string               // Validator that produced a PoS block (see ValidatorAddress); empty for PoW
+	Round             int                  // PoS round the block was proposed in, 0 unless earlier proposers missed their turn
+	Signature         string               // Proposer's signature over the hash
+	Commit            *CommitCertificate   // Precommits finalizing the block, once it has them; not part of the hash
+	AuthorityProposal *AuthorityProposal   // PoA sealer's vote to add or remove an authority, if any
+	ConsensusSwitch   *ConsensusActivation // Announcement of a switch to another consensus engine at a later height, if any
+	Version           int                  // Header version, with a bit set for each fork the producer signals readiness for
 }
 
-// Constants for various bc settings
+// Constants for various bc settings, used by the built-in chain specs
 const (
 	BlockReward        = 50		   // Fixed block reward for miners
 	AdjustmentInterval = 10		   // How often the difficulty is adjusted
+	TargetBlockTime    = 10 * 60   // Seconds per block the difficulty adjustment aims for
 	MaxBlockSize       = 1_000_000 // Max block size in bytes for scalability
 	MinTransactionFee  = 1         // Min fee for transactions
 )
 
-// Creates new block
-func NewBlock(transactions []*Transaction, previousHash string, difficulty int) *Block {
+// Creates new block, timestamped by clock
+func NewBlock(transactions []*Transaction, previousHash string, difficulty int, clock Clock) *Block {
 	block := &Block{
-		Index:        0,					// Initially set index to 0, will be set later
-		Timestamp:    time.Now().Unix(),	// Record the current time as the block's timestamp
-		PreviousHash: previousHash,			// Link to previous block
-		Transactions: transactions,			// Add transaction
-		Difficulty:   difficulty,			// Set difficulty for this block
-	}
-	block.Hash = block.calculateHash()		// Calculate block's hash based on its content
+		Index:        0,                  // Initially set index to 0, will be set later
+		Timestamp:    clock.Now().Unix(), // Record the current time as the block's timestamp
+		PreviousHash: previousHash,       // Link to previous block
+		Transactions: transactions,       // Add transaction
+		Difficulty:   difficulty,         // Set difficulty for this block
+	}
+	block.MerkleRoot = block.calculateMerkleRoot() // Commit to the transactions in the header
+	block.Hash = block.calculateHash()             // Calculate block's hash based on its content
 	return block
 }
 
@@ -49,9 +58,23 @@ func (b *Block) calculateHash() string {
 	record := strconv.Itoa(b.Index) +
 		strconv.FormatInt(b.Timestamp, 10) +
 		b.PreviousHash +
-		b.calculateMerkleRoot() +
+		b.MerkleRoot +
+		b.UTXOCommitment +
 		strconv.Itoa(b.Nonce) +
 		strconv.Itoa(b.Difficulty)
+	if b.Proposer != "" {
+		// Only PoS blocks commit to a slot, so PoW hashes are unchanged
+		record += b.Proposer + strconv.Itoa(b.Round)
+	}
+	if b.AuthorityProposal != nil {
+		record += b.AuthorityProposal.key()
+	}
+	if b.ConsensusSwitch != nil {
+		record += b.ConsensusSwitch.Algorithm + strconv.Itoa(b.ConsensusSwitch.Height)
+	}
+	if b.Version != 0 {
+		record += "v" + strconv.Itoa(b.Version)
+	}
 
 	// Generate SHA-256 hash
 	hash := sha256.Sum256([]byte(record))
@@ -92,132 +115,262 @@ func calculateMerkleRoot(transactionHashes []string) string {
 
 // Blockchain struct represents the entire blockchain(bc)
 type Blockchain struct {
-	Blocks              []*Block			   // Array ofall blocks in the chain
-	Stake               map[string]int         // Stake mapping for PoS (address to stake amount)
-	blockReward         int                    // Internal value for block reward
-	ProtocolVersion     string                 // Track the current protocol version
-	ConsensusAlgorithm  string                 // Track the current consensus algorithm (e.g PoW, PoS)
-	MaxBlockSize        int                    // Max block size allowed in bytes
-	lock                sync.RWMutex           // Lock for thread-safe access
-	Mempool             *Mempool               // Holds unconfirmed transactions
-	Accounts            map[string]*Account    // Tracks accounts and their balances
-	UTXOSet             *UTXOSet               // Manages the Unspent Transaction Outputs (UTXOs)
-	ContractEngine      *ContractEngine		   // Manages smart contracts
-	DIDRegistry         *DIDRegistry		   // Manages Decentralised Identifiers (DIDs)
-	MinerAddress        string                 // Address of current miner
+	Blocks             []*Block                  // Array ofall blocks in the chain
+	Stake              map[string]int            // Voting power of the active PoS validator set (address to stake amount)
+	Staking            *StakingState             // Bonds, unbonding stake and the validator set, updated by staking transactions
+	Authorities        *AuthorityState           // PoA signers and the votes to change them
+	genesisAuthorities []string                  // Signers the chain started with, where replays of authority votes begin
+	authorityProposals map[string]bool           // This node's PoA votes: true to add the address, false to remove it
+	blockReward        int                       // Internal value for block reward
+	forks              *forkTracker              // Deployment state of the chain's forks, for the next block
+	readyForks         map[string]bool           // Signalled forks this node signals readiness for
+	schedule           *consensusSchedule        // Consensus engine each height runs, as announced on chain
+	pendingSwitch      string                    // Consensus switch this node announces in the next block it produces
+	MaxBlockSize       int                       // Max block size allowed in bytes
+	lock               sync.RWMutex              // Lock for thread-safe access
+	Mempool            *Mempool                  // Holds unconfirmed transactions
+	Accounts           map[string]*Account       // Tracks accounts and their balances
+	UTXOSet            *UTXOSet                  // Manages the Unspent Transaction Outputs (UTXOs)
+	ContractEngine     *ContractEngine           // Manages smart contracts
+	DIDRegistry        *DIDRegistry              // Manages Decentralised Identifiers (DIDs)
+	MinerAddress       string                    // Address of current miner
+	snapshotBase       *Snapshot                 // Snapshot the state was restored from, until its history is validated
+	PruneDepth         int                       // Number of recent block bodies to keep, 0 keeps the full history
+	prunedBelow        int                       // Blocks below this height only have their headers stored
+	undo               map[string]*UTXOUndo      // Undo data for connected blocks by hash, used to reorg
+	voters             map[string]map[string]int // Validator set voting on each connected block, by hash
+	finalizedHeight    int                       // Height of the last finalized block, which fork choice never reverts
+	Indexer            *TxIndexer                // Optional transaction and address index, nil when disabled
+	Spec               *ChainSpec                // Genesis and consensus parameters of the chain
+	Clock              Clock                     `json:"-"` // Time source for block timestamps and slot rounds
+	checkpoints        map[int]string            // Block hash each checkpointed height must have
+	assumeValid        string                    // Block up to which signatures are not checked while syncing, "" to check all
+	syncAssumedValid   int                       // Height of the assumed-valid block in the chain being synced, 0 when not syncing one
 }
 
-// Initialise a new bc, starting with the genesis block
+// Initialise a new bc on the main chain, starting with the genesis block
 func NewBlockchain() *Blockchain {
-	genesisBlock := NewBlock([]*Transaction{}, "0", 1) 	// Genesis block with no transactions and difficulty 1
-	return &Blockchain{
+	return NewBlockchainFromSpec(MainnetSpec)
+}
+
+// NewBlockchainFromSpec initialises a bc starting with the genesis block the spec derives
+func NewBlockchainFromSpec(spec *ChainSpec) *Blockchain {
+	genesisBlock, utxoSet := spec.Genesis()
+	authorities := NewAuthorityState(spec.Authorities)
+	bc := &Blockchain{
 		Blocks:             []*Block{genesisBlock},		// Bc starts with the genesis block
+		Spec:               spec,
 		Stake:              make(map[string]int),
-		blockReward:        BlockReward,				// Set initial block reward
-		ProtocolVersion:    "v1.0",						// Default protocol version
-		ConsensusAlgorithm: "PoW", 						// Default to Proof of Work
-		MaxBlockSize:       MaxBlockSize,				// Set maximum block size
-		Mempool:            NewMempool(), 				// Initialise the transaction pool
+		Staking:            NewStakingState(),
+		Authorities:        authorities,
+		genesisAuthorities: authorities.Clone().Signers,
+		authorityProposals: make(map[string]bool),
+		blockReward:        spec.BlockReward, // Set initial block reward
+		forks:              newForkTracker(spec.Forks),
+		readyForks:         make(map[string]bool),
+		schedule:           newConsensusSchedule(spec.Consensus),
+		MaxBlockSize:       spec.MaxBlockSize, // Set maximum block size
+		Mempool:            NewMempool(),      // Initialise the transaction pool
+		Clock:              SystemClock,
 		Accounts:           make(map[string]*Account),
-		UTXOSet:            NewUTXOSet(),
+		UTXOSet:            utxoSet, // Holds the premine
 		ContractEngine:     NewContractEngine(),
 		DIDRegistry:        NewDIDRegistry(),
+		undo:               make(map[string]*UTXOUndo),
+		voters:             make(map[string]map[string]int),
+		checkpoints:        make(map[int]string),
+		assumeValid:        spec.AssumeValid,
 	}
+	for height, hash := range spec.Checkpoints {
+		bc.checkpoints[height] = hash
+	}
+	return bc
 }
 
 // Adjust the mining difficulty based on the time it took to mine the last blocks
 func (bc *Blockchain) AdjustDifficulty() int {
 	bc.lock.RLock()
 	defer bc.lock.RUnlock()
-
-	if len(bc.Blocks)%AdjustmentInterval != 0 {
-		return bc.Blocks[len(bc.Blocks)-1].Difficulty		// No adjustment needed
-	}
-
-	// Calculate time tkaen to mine the last AdjustsmentInterval blocks
-	lastAdjustmentBlock := bc.Blocks[len(bc.Blocks)-AdjustmentInterval]
-	expectedTime := AdjustmentInterval * 10 * 60 // Assuming 10 minutes per block
-	actualTime := int(bc.Blocks[len(bc.Blocks)-1].Timestamp - lastAdjustmentBlock.Timestamp)
-
-	// Adjust difficulty based on block mining times
-	if actualTime < expectedTime/2 {
-		return lastAdjustmentBlock.Difficulty + 1
-	} else if actualTime > expectedTime*2 {
-		if lastAdjustmentBlock.Difficulty > 1 {
-			return lastAdjustmentBlock.Difficulty - 1
-		}
-	}
-
-	return lastAdjustmentBlock.Difficulty		// No significant change, return current difficulty
+	return bc.adjustDifficulty()
 }
 
-// Adds a new block to the bc after validating and processing the transactions
-func (bc *Blockchain) AddBlock(transactions []*Transaction) *Block {
-	bc.lock.Lock()
-	defer bc.lock.Unlock()
+// adjustDifficulty is AdjustDifficulty for callers that already hold the lock.
+func (bc *Blockchain) adjustDifficulty() int {
+	return nextDifficulty(bc.Blocks, bc.Spec)
+}
 
-	// Adjust difficulty based on the current state of the bc
-	difficulty := bc.AdjustDifficulty()
+// assembleBlock builds the next block paying rewardAddress, applies its transactions to the UTXO set
+// and staking ledger, and records the resulting commitment in the header. The consensus fields are
+// taken from the header the engine prepared. Callers must hold the lock and revert the returned
+// undo with revertBlockState if the block is not added to the chain.
+func (bc *Blockchain) assembleBlock(transactions []*Transaction, rewardAddress string, header *Block) (*Block, *UTXOUndo) {
 	lastBlock := bc.Blocks[len(bc.Blocks)-1]
 
-	// If no miner address is set, select one based on stake or account balance
-	if bc.MinerAddress == "" {
-		bc.MinerAddress = bc.SelectMinerAddress()
-	}
-
 	// Reward the miner
 	minerRewardTx := &Transaction{
-		Sender:    "system",			// System generates the reward
-		Recipient: bc.MinerAddress,		// Reward goes to the miner
-		Amount:    bc.GetBlockReward(),	// Reward amount based on current block reward
-		Fee:       0,					// No fee for reward transactions
+		Sender:    "system",              // System generates the reward
+		Recipient: rewardAddress,         // Reward goes to the miner
+		Amount:    bc.blockReward,        // Reward amount based on current block reward
+		Fee:       0,                     // No fee for reward transactions
+		Nonce:     int64(len(bc.Blocks)), // Block height keeps each reward's hash unique
 	}
-	transactions = append([]*Transaction{minerRewardTx}, transactions...)	// Reward transaction
 
-	// Sort transactions by fee (highest fee first)
+	// Sort transactions by fee (highest fee first), after the reward which always comes first
+	transactions = append([]*Transaction(nil), transactions...)
 	sort.SliceStable(transactions, func(i, j int) bool {
 		return transactions[i].Fee > transactions[j].Fee
 	})
 
-	// Collect valid transactions up to the max block size
+	// Collect valid transactions up to the max block size, applying each as it is accepted
+	undo := &UTXOUndo{Staking: bc.Staking.Clone(), Authorities: bc.Authorities.Clone()}
+	bc.engineAt(header.Index).Finalize(bc.Staking, bc.Authorities, header)
+	bc.UTXOSet.ApplyTransaction(minerRewardTx, rewardAddress, len(bc.Blocks), undo)
 	validTransactions := []*Transaction{minerRewardTx}
-	currentSize := minerRewardTx.Size() 
+	currentSize := minerRewardTx.Size()
 	for _, tx := range transactions {
 		if bc.IsValidTransaction(tx) {
 			txSize := tx.Size()
-			if currentSize+txSize <= MaxBlockSize {
+			if currentSize+txSize > bc.MaxBlockSize {
+				continue
+			}
+			if tx.IsStaking() && bc.Staking.checkTransaction(tx, len(bc.Blocks), true) != nil {
+				continue // Staking transactions must also fit the ledger, e.g. unbond no more than is bonded
+			}
+			if bc.UTXOSet.ApplyTransaction(tx, rewardAddress, len(bc.Blocks), undo) == nil {
+				if tx.IsStaking() {
+					bc.Staking.applyTransaction(tx, len(bc.Blocks))
+				}
 				validTransactions = append(validTransactions, tx)
 				currentSize += txSize
 			}
 		}
 	}
 
-	// Create a new block with the valid transactions
-	newBlock := NewBlock(validTransactions, lastBlock.Hash, difficulty)
-	pow := NewProofOfWork(newBlock)
-	nonce, hash, err := pow.Run()
+	// Release matured unbonds and rotate the validator set at an epoch boundary
+	for _, released := range bc.Staking.endBlock(len(bc.Blocks)) {
+		bc.UTXOSet.AddUTXO(released)
+		undo.Created = append(undo.Created, released)
+	}
+	bc.setStaking(bc.Staking)
+
+	newBlock := NewBlock(validTransactions, lastBlock.Hash, header.Difficulty, bc.Clock)
+	newBlock.Index = len(bc.Blocks)
+	newBlock.Proposer = header.Proposer
+	newBlock.Round = header.Round
+	newBlock.AuthorityProposal = header.AuthorityProposal
+	newBlock.ConsensusSwitch = header.ConsensusSwitch
+	newBlock.Version = header.Version
+	newBlock.UTXOCommitment = bc.UTXOSet.Commitment()
+	newBlock.Hash = newBlock.calculateHash()
+	return newBlock, undo
+}
 
-	// Handle potential errors in the mining process
+// connectBlock applies a received block to the UTXO set and staking ledger and checks the header's
+// commitment. On any failure both are restored and an error describing the divergence is returned.
+func (bc *Blockchain) connectBlock(block *Block) (*UTXOUndo, error) {
+	if block.calculateMerkleRoot() != block.MerkleRoot {
+		return nil, fmt.Errorf("block %d body does not match its merkle root", block.Index)
+	}
+
+	undo, err := applyBlockState(bc.UTXOSet, bc.Staking, bc.Authorities, block, bc.engineAt(block.Index), bc.blockReward, bc.Accounts, block.Index > bc.syncAssumedValid)
 	if err != nil {
-		fmt.Println("Error during Proof of Work:", err)
-		return nil
+		return nil, err
 	}
-	newBlock.Hash = hash
-	newBlock.Nonce = nonce
-	newBlock.Index = len(bc.Blocks)
+	bc.setStaking(bc.Staking)
+
+	if commitment := bc.UTXOSet.Commitment(); commitment != block.UTXOCommitment {
+		bc.revertBlockState(undo)
+		return nil, fmt.Errorf("UTXO commitment mismatch at block %d: header %s, local %s", block.Index, block.UTXOCommitment, commitment)
+	}
+	return undo, nil
+}
+
+// AcceptBlock validates a block received from the network against the current tip, connects it to
+// the UTXO set and appends it to the chain.
+func (bc *Blockchain) AcceptBlock(block *Block) error {
+	bc.lock.Lock()
+	defer bc.lock.Unlock()
+
+	if err := bc.connectTip(block); err != nil {
+		return err
+	}
+	bc.applyCommits([]*Block{block})
+	bc.pruneBlocks()
+	return nil
+}
+
+// Tip returns the last block in the chain.
+func (bc *Blockchain) Tip() *Block {
+	bc.lock.RLock()
+	defer bc.lock.RUnlock()
+	return bc.Blocks[len(bc.Blocks)-1]
+}
 
-	// Validate the newly mined block before adding it to the chain
-	if bc.IsValidNewBlock(newBlock, lastBlock) {
-		bc.Blocks = append(bc.Blocks, newBlock)
-		bc.clearMinedTransactions(validTransactions)
-		return newBlock
+// connectTip validates a block against the current tip and connects it. Callers must hold the lock.
+func (bc *Blockchain) connectTip(block *Block) error {
+	lastBlock := bc.Blocks[len(bc.Blocks)-1]
+	if err := bc.checkNewBlock(block, lastBlock); err != nil {
+		return err
+	}
+	undo, err := bc.connectBlock(block)
+	if err != nil {
+		return err
+	}
+	bc.Blocks = append(bc.Blocks, block)
+	bc.undo[block.Hash] = undo
+	bc.recordVoters(block)
+	bc.recordSwitch(block)
+	bc.recordForks(block, undo)
+	bc.clearMinedTransactions(block.Transactions)
+	if bc.Indexer != nil {
+		bc.Indexer.ConnectBlock(block)
 	}
 	return nil
 }
 
-// Validate whether a newly mined block is valid and follows the rules of the blockchain
+// appendBlock adds a block that has already been applied to the UTXO set, keeping its undo data
+// for reorgs and pruning old bodies. Callers must hold the lock.
+func (bc *Blockchain) appendBlock(block *Block, undo *UTXOUndo) {
+	bc.Blocks = append(bc.Blocks, block)
+	bc.undo[block.Hash] = undo
+	bc.recordVoters(block)
+	bc.recordSwitch(block)
+	bc.recordForks(block, undo)
+	bc.clearMinedTransactions(block.Transactions)
+	if bc.Indexer != nil {
+		bc.Indexer.ConnectBlock(block)
+	}
+	bc.pruneBlocks()
+}
+
+// Validate whether a newly mined block is valid and follows the rules of the blockchain, including
+// those of the consensus engine its height runs. Callers must hold the lock.
 func (bc *Blockchain) IsValidNewBlock(newBlock, previousBlock *Block) bool {
-	
+	return bc.checkNewBlock(newBlock, previousBlock) == nil
+}
+
+// checkNewBlock is IsValidNewBlock returning why a block is rejected. Callers must hold the lock.
+func (bc *Blockchain) checkNewBlock(newBlock, previousBlock *Block) error {
+	if !isValidLink(newBlock, previousBlock, newBlock.Index > bc.syncAssumedValid) {
+		return fmt.Errorf("block %d does not extend the current tip", newBlock.Index)
+	}
+	if err := bc.checkCheckpoint(newBlock); err != nil {
+		return err
+	}
+	if err := bc.schedule.checkBlock(newBlock); err != nil {
+		return err
+	}
+	if err := checkForkRules(bc.Blocks, newBlock, bc.forks, bc.Spec); err != nil {
+		return err
+	}
+	return bc.engineAt(newBlock.Index).VerifyHeader(bc, newBlock, previousBlock)
+}
+
+// isValidLink checks what can be checked about a block from its parent alone. The proposer schedule
+// depends on the validator set as of the parent, so a PoS block's signature is checked here but its
+// slot is only checked when the block is connected. The signature is skipped unless verifySignature
+// is set, for blocks up to the assumed-valid one.
+func isValidLink(newBlock, previousBlock *Block, verifySignature bool) bool {
 	// Check if the block index is consecutive
 	if previousBlock.Index+1 != newBlock.Index {
 		return false
@@ -228,110 +381,69 @@ func (bc *Blockchain) IsValidNewBlock(newBlock, previousBlock *Block) bool {
 		return false
 	}
 
-	// Validate the PoW
-	pow := NewProofOfWork(newBlock)
-	if !pow.Validate() {
+	// Check the body matches the header, unless only the header is present
+	if newBlock.Transactions != nil && newBlock.calculateMerkleRoot() != newBlock.MerkleRoot {
 		return false
 	}
 
-	// Recalculate the block's hash and compare
-	if newBlock.calculateHash() != newBlock.Hash {
+	// Only PoA blocks carry authority votes
+	if newBlock.AuthorityProposal != nil && newBlock.Proposer == "" {
 		return false
 	}
-	return true
+
+	return hasValidSeal(newBlock, verifySignature)
+}
+
+// Checks the block's hash is its own and that it is sealed by a proof of work or, for PoS and PoA
+// blocks, by its proposer's signature, which is only checked if verifySignature is set
+func hasValidSeal(block *Block, verifySignature bool) bool {
+	// PoS and PoA blocks are signed by their proposer instead of carrying a PoW
+	if block.Proposer != "" {
+		if verifySignature && verifyBlockSignature(block) != nil {
+			return false
+		}
+	} else {
+		pow := NewProofOfWork(block)
+		if !pow.Validate() {
+			return false
+		}
+	}
+
+	// Recalculate the block's hash and compare
+	return block.calculateHash() == block.Hash
 }
 
 // Validate the entire blockchain by checking each block's validity in order
 func (bc *Blockchain) IsValidChain(blocks []*Block) bool {
+	// The chain's own headers say which engine each block runs and which forks are active
+	schedule := newConsensusSchedule(bc.schedule.Genesis)
+	forks := newForkTracker(bc.forks.Forks)
+	if len(blocks) > 0 {
+		if bc.checkCheckpoint(blocks[0]) != nil {
+			return false
+		}
+		forks.record(blocks[0])
+	}
+	assumedValid := bc.assumedValidHeight(blocks)
 	for i := 1; i < len(blocks); i++ {
-		if !bc.IsValidNewBlock(blocks[i], blocks[i-1]) {
+		if !isValidLink(blocks[i], blocks[i-1], i > assumedValid) || bc.checkCheckpoint(blocks[i]) != nil {
 			return false
 		}
+		if schedule.checkBlock(blocks[i]) != nil || checkForkRules(blocks[:i], blocks[i], forks, bc.Spec) != nil {
+			return false
+		}
+		schedule.record(blocks[i])
+		forks.record(blocks[i])
 	}
 	return true
 }
 
-// Selects a proposer based on the amount of stake they hold
+// SelectProposer returns the validator entitled to propose the next block in the current round.
 func (bc *Blockchain) SelectProposer() string {
 	bc.lock.RLock()
 	defer bc.lock.RUnlock()
-
-	// Sum the total stake in the network
-	totalStake := 0
-	for _, stake := range bc.Stake {
-		totalStake += stake
-	}
-
-	// If no stake is available, return an empty string
-	if totalStake == 0 {
-		return ""
-	}
-
-	// Select a proposer randomly, weighted by their stake
-	weightedRandom := rand.New(rand.NewSource(time.Now().UnixNano()))
-	randomPoint := weightedRandom.Intn(totalStake)
-	runningTotal := 0
-
-	for address, stake := range bc.Stake {
-		runningTotal += stake
-		if runningTotal >= randomPoint {
-			return address
-		}
-	}
-
-	return ""
-}
-
-// Adds a new block using PoS consensus
-func (bc *Blockchain) AddBlockPoS(transactions []*Transaction) *Block {
-	bc.lock.Lock() // Lock the bc for writing
-	defer bc.lock.Unlock() // Ensure unlocked after the operation
-
-	// Select a proposer (the "miner" in PoS) based on their stake
-	proposer := bc.SelectProposer()
-	if proposer == "" { // If no proposer is found (maybe no one has any stake)
-		fmt.Println("No stakes in the network, falling back to PoW")
-		return bc.AddBlock(transactions)
-	}
-
-	// Get the last block in the chain
 	lastBlock := bc.Blocks[len(bc.Blocks)-1]
-
-	// Create a transaction to reward the propser (like a mining reward)
-	minerRewardTx := &Transaction{
-		Sender:    "system",			// System "creates" this reward
-		Recipient: proposer,			// The propser get the reward
-		Amount:    bc.GetBlockReward(), // Reward amount from the bc settings
-		Fee:       0,					// No fee for this transaction
-	}
-	transactions = append([]*Transaction{minerRewardTx}, transactions...)
-
-	// Create a new block with the given transactions
-	newBlock := NewBlock(transactions, lastBlock.Hash, lastBlock.Difficulty)
-	newBlock.Nonce = 0 // In PoS, nonce isn't really used, but it's part of the block struct
-
-	// Validate new block before ading it to the chain
-	if bc.IsValidNewBlock(newBlock, lastBlock) {
-		bc.Blocks = append(bc.Blocks, newBlock)	// Add the block to the chain
-		bc.clearMinedTransactions(transactions)	// Clear out these transactions from the mempool
-		return newBlock
-	}
-	return nil // If block wasn't valid
-}
-
-// Upgrade the bc protocol to a new version
-func (bc *Blockchain) UpgradeProtocol(version string) {
-	bc.lock.Lock()	// Lock the bc for writing
-	defer bc.lock.Unlock()	// Unlock after the operation is complete
-	bc.ProtocolVersion = version	// Set the new protocol version
-	fmt.Printf("Blockchain protocol upgraded to version %s\n", version)
-}
-
-func (bc *Blockchain) SetConsensusAlgorithm(algorithm string) {
-	bc.lock.Lock()
-	defer bc.lock.Unlock()
-	bc.ConsensusAlgorithm = algorithm
-	fmt.Printf("Consensus algorithm set to %s\n", algorithm)
+	return ProposerForSlot(lastBlock.Hash, slotRound(lastBlock, bc.Clock.Now()), bc.Stake)
 }
 
 func (bc *Blockchain) SetMaxBlockSize(size int) {
@@ -358,7 +470,11 @@ func (bc *Blockchain) GetBlockReward() int {
 func (bc *Blockchain) SelectMinerAddress() string {
 	bc.lock.RLock()
 	defer bc.lock.RUnlock()
+	return bc.selectMinerAddress()
+}
 
+// selectMinerAddress is SelectMinerAddress for callers that already hold the lock.
+func (bc *Blockchain) selectMinerAddress() string {
 	// Find the address with the highest stake
 	var highestStake int
 	var minerAddress string
@@ -383,6 +499,11 @@ func (bc *Blockchain) SelectMinerAddress() string {
 
 // Checks if a transaction is valid according to the bc's rules
 func (bc *Blockchain) IsValidTransaction(tx *Transaction) bool {
+	// Staking transactions are signed by the validator address they come from rather than an account
+	if tx.IsStaking() {
+		return tx.verifyStaking() == nil && tx.Fee >= bc.Spec.MinTransactionFee
+	}
+
 	// Verify the transaction's signature using the sender's public key
 	senderAccount := bc.Accounts[tx.Sender]
 	if senderAccount == nil {
@@ -405,7 +526,7 @@ func (bc *Blockchain) IsValidTransaction(tx *Transaction) bool {
 	}
 
 	// Ensure the transaction fee meets the min required
-	if tx.Fee < MinTransactionFee {
+	if tx.Fee < bc.Spec.MinTransactionFee {
 		return false
 	}
 
@@ -414,10 +535,7 @@ func (bc *Blockchain) IsValidTransaction(tx *Transaction) bool {
 
 // Removes transactions that have been successfully included in a block from the mempool 
 func (bc *Blockchain) clearMinedTransactions(transactions []*Transaction) {
-	// Lock the mempool to safely remove transactions
-	bc.Mempool.lock.Lock()
-	defer bc.Mempool.lock.Unlock()
 	for _, tx := range transactions {
-		bc.Mempool.RemoveTransaction(tx)  // Remove the transaction from the mempool
+		bc.Mempool.RemoveTransaction(tx) // Remove the transaction from the mempool (it takes its own lock)
 	}
 }
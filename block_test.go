@@ -0,0 +1,154 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"strings"
+	"testing"
+)
+
+// newKeyAddress returns a key and the address it signs for.
+func newKeyAddress(t *testing.T) (*ecdsa.PrivateKey, string) {
+	t.Helper()
+	key, pub, err := GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	address, err := ValidatorAddress(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key, address
+}
+
+// generate produces one regtest block on bc paying address.
+func generate(t *testing.T, bc *Blockchain, address string) *Block {
+	t.Helper()
+	blocks, err := bc.GenerateBlocks(1, address, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return blocks[0]
+}
+
+// reseal recomputes a tampered block's merkle root and hash, which is all a regtest block needs.
+func reseal(block *Block) {
+	block.MerkleRoot = block.calculateMerkleRoot()
+	block.Hash = block.calculateHash()
+}
+
+func TestAcceptBlockRejectsInflatedReward(t *testing.T) {
+	producer, receiver := NewBlockchainFromSpec(RegtestSpec), NewBlockchainFromSpec(RegtestSpec)
+	block := generate(t, producer, "miner")
+	block.Transactions[0].Amount = BlockReward + 1
+	reseal(block)
+
+	err := receiver.AcceptBlock(block)
+	if err == nil || !strings.Contains(err.Error(), "more than the block reward") {
+		t.Fatalf("accepted a block minting more than the reward: %v", err)
+	}
+}
+
+func TestAcceptBlockRejectsSecondReward(t *testing.T) {
+	producer, receiver := NewBlockchainFromSpec(RegtestSpec), NewBlockchainFromSpec(RegtestSpec)
+	block := generate(t, producer, "miner")
+	block.Transactions = append(block.Transactions, &Transaction{Sender: "system", Recipient: "miner", Amount: 1})
+	reseal(block)
+
+	err := receiver.AcceptBlock(block)
+	if err == nil || !strings.Contains(err.Error(), "second reward") {
+		t.Fatalf("accepted a block with two reward transactions: %v", err)
+	}
+}
+
+func TestAcceptBlockChecksTransferSignatures(t *testing.T) {
+	producer, receiver := NewBlockchainFromSpec(RegtestSpec), NewBlockchainFromSpec(RegtestSpec)
+	key, address := newKeyAddress(t)
+	funding := generate(t, producer, address)
+	if err := receiver.AcceptBlock(funding); err != nil {
+		t.Fatal(err)
+	}
+
+	// Only the producer knows the sender's account; the receiver takes the key from the address
+	producer.Accounts[address] = NewAccount(address, BlockReward, &key.PublicKey)
+	tx := &Transaction{Sender: address, Recipient: "alice", Amount: 10, Fee: MinTransactionFee, Nonce: 1}
+	if err := tx.Sign(key); err != nil {
+		t.Fatal(err)
+	}
+	if err := producer.Mempool.AddTransaction(tx, producer.Accounts, producer.UTXOSet); err != nil {
+		t.Fatal(err)
+	}
+	block := generate(t, producer, "miner")
+	if len(block.Transactions) != 2 || block.Transactions[0].Sender != "system" {
+		t.Fatalf("block does not hold the reward followed by the transfer: %+v", block.Transactions)
+	}
+
+	// A transfer signed by anyone else is rejected
+	forgerKey, _ := newKeyAddress(t)
+	forged := *block
+	forgedTx := *tx
+	if err := forgedTx.Sign(forgerKey); err != nil {
+		t.Fatal(err)
+	}
+	forged.Transactions = []*Transaction{block.Transactions[0], &forgedTx}
+	reseal(&forged)
+	if err := receiver.AcceptBlock(&forged); err == nil || !strings.Contains(err.Error(), "not signed") {
+		t.Fatalf("accepted a transfer signed by another key: %v", err)
+	}
+
+	if err := receiver.AcceptBlock(block); err != nil {
+		t.Fatalf("rejected a signed transfer: %v", err)
+	}
+}
+
+// fundedTransfer mines a block paying a fresh key on producer and receiver, and returns a transfer
+// from it that producer has put in its mempool.
+func fundedTransfer(t *testing.T, producer, receiver *Blockchain) *Transaction {
+	t.Helper()
+	key, address := newKeyAddress(t)
+	if err := receiver.AcceptBlock(generate(t, producer, address)); err != nil {
+		t.Fatal(err)
+	}
+	producer.Accounts[address] = NewAccount(address, BlockReward, &key.PublicKey)
+	tx := &Transaction{Sender: address, Recipient: "alice", Amount: 10, Fee: 1, Nonce: 1}
+	if err := tx.Sign(key); err != nil {
+		t.Fatal(err)
+	}
+	if err := producer.Mempool.AddTransaction(tx, producer.Accounts, producer.UTXOSet); err != nil {
+		t.Fatal(err)
+	}
+	return tx
+}
+
+func TestAcceptBlockRejectsReplayedTransfer(t *testing.T) {
+	producer, receiver := NewBlockchainFromSpec(RegtestSpec), NewBlockchainFromSpec(RegtestSpec)
+	tx := fundedTransfer(t, producer, receiver)
+	if err := receiver.AcceptBlock(generate(t, producer, "miner")); err != nil {
+		t.Fatal(err)
+	}
+	balance := receiver.UTXOSet.GetBalance(tx.Sender)
+
+	// The producer won't include it again, so the replay is put into its next block by hand
+	replay := generate(t, producer, "miner")
+	replay.Transactions = append(replay.Transactions, tx)
+	reseal(replay)
+	if err := receiver.AcceptBlock(replay); err == nil || !strings.Contains(err.Error(), "already confirmed") {
+		t.Fatalf("accepted a block replaying a confirmed transfer: %v", err)
+	}
+	if got := receiver.UTXOSet.GetBalance(tx.Sender); got != balance {
+		t.Fatalf("rejected replay changed the sender's balance from %d to %d", balance, got)
+	}
+	if got := receiver.UTXOSet.GetBalance("alice"); got != tx.Amount {
+		t.Fatalf("recipient holds %d, want %d", got, tx.Amount)
+	}
+}
+
+func TestAcceptBlockRejectsRepeatedTransfer(t *testing.T) {
+	producer, receiver := NewBlockchainFromSpec(RegtestSpec), NewBlockchainFromSpec(RegtestSpec)
+	tx := fundedTransfer(t, producer, receiver)
+	block := generate(t, producer, "miner")
+	block.Transactions = append(block.Transactions, tx)
+	reseal(block)
+	if err := receiver.AcceptBlock(block); err == nil || !strings.Contains(err.Error(), "already confirmed") {
+		t.Fatalf("accepted a block holding the same transfer twice: %v", err)
+	}
+}
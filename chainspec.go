@@ -0,0 +1,278 @@
+// chainspec.go
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"time"
+)
+
+// A chain spec holds everything nodes must agree on before the first block: the network name
+// peers exchange in the handshake, the genesis block's timestamp and premine, the consensus
+// parameters and the fork schedule. The genesis block is derived from the spec, so two nodes with
+// the same spec start from the same genesis hash. Peers also exchange a hash of the spec's consensus
+// parameters in the handshake, so nodes with different specs refuse each other even where the
+// difference doesn't show in the genesis block.
+
+// GenesisAllocation is an amount the genesis block pays to an address.
+type GenesisAllocation struct {
+	Address string
+	Amount  int
+}
+
+// ChainSpec defines a chain's genesis block and consensus parameters.
+type ChainSpec struct {
+	Name               string              // Network identifier peers must share.
+	GenesisTimestamp   int64               // Fixed genesis time so every node derives the same genesis hash.
+	GenesisDifficulty  int                 // Difficulty of the genesis block, which later blocks retarget from.
+	Premine            []GenesisAllocation // Coins created by the genesis block.
+	Consensus          string              // Engine the chain starts with.
+	Authorities        []string            // Authorities a PoA chain starts with.
+	BlockReward        int                 // Initial reward for producing a block.
+	AdjustmentInterval int                 // Blocks between difficulty adjustments.
+	TargetBlockTime    int                 // Seconds per block the difficulty adjustment aims for.
+	NoRetargeting      bool                // Keep the genesis difficulty instead of adjusting it.
+	MaxBlockSize       int                 // Initial max block size in bytes.
+	MinTransactionFee  int                 // Min fee for transactions.
+	Forks              []Fork              // Fork schedule.
+	Seeds              []string            // Seeds used when none are configured.
+	Checkpoints        map[int]string      // Block hash each checkpointed height must have.
+	AssumeValid        string              // Block up to which signatures are not checked while syncing, if any.
+	Regtest            bool                // Allow generating blocks and setting the clock on request, for testing.
+}
+
+// MainnetSpec is the main chain.
+var MainnetSpec = &ChainSpec{
+	Name:               "go-blockchain-main",
+	GenesisTimestamp:   1700000000,
+	GenesisDifficulty:  1,
+	Premine:            []GenesisAllocation{{Address: "bob", Amount: 100}},
+	Consensus:          "PoW",
+	BlockReward:        BlockReward,
+	AdjustmentInterval: AdjustmentInterval,
+	TargetBlockTime:    TargetBlockTime,
+	MaxBlockSize:       MaxBlockSize,
+	MinTransactionFee:  MinTransactionFee,
+	Forks:              DefaultForks,
+	Seeds:              []string{"127.0.0.1:" + DefaultSeedPort}, // Local only; there are no public seeds yet
+	Checkpoints: map[int]string{
+		0: "3170812de0d182238ec7edfadacb92efb7464558be24ccf457579bdfd8a86c95",
+	},
+}
+
+// TestnetSpec is a public test chain, with a faucet premine and forks scheduled earlier than on
+// the main chain so they are exercised first.
+var TestnetSpec = &ChainSpec{
+	Name:               "go-blockchain-test",
+	GenesisTimestamp:   1704067200,
+	GenesisDifficulty:  1,
+	Premine:            []GenesisAllocation{{Address: "faucet", Amount: 1_000_000}},
+	Consensus:          "PoW",
+	BlockReward:        BlockReward,
+	AdjustmentInterval: AdjustmentInterval,
+	TargetBlockTime:    TargetBlockTime,
+	MaxBlockSize:       MaxBlockSize,
+	MinTransactionFee:  MinTransactionFee,
+	Forks: []Fork{
+		{Name: ForkStrictDifficulty, Height: 10 * AdjustmentInterval},
+		{Name: ForkMedianTime, Height: SignalledFork, Bit: 0, StartHeight: SignalWindow, TimeoutHeight: 10 * SignalWindow},
+	},
+	Seeds: []string{"127.0.0.1:18090"},
+}
+
+// RegtestSpec is a private chain for local testing: blocks need no work to mine, the difficulty
+// never changes and every fork is active from genesis.
+var RegtestSpec = &ChainSpec{
+	Name:               "go-blockchain-regtest",
+	GenesisTimestamp:   1690000000,
+	GenesisDifficulty:  0,
+	Premine:            []GenesisAllocation{{Address: "bob", Amount: 100}},
+	Consensus:          "PoW",
+	BlockReward:        BlockReward,
+	AdjustmentInterval: AdjustmentInterval,
+	TargetBlockTime:    TargetBlockTime,
+	NoRetargeting:      true,
+	MaxBlockSize:       MaxBlockSize,
+	MinTransactionFee:  MinTransactionFee,
+	Forks: []Fork{
+		{Name: ForkStrictDifficulty, Height: 0},
+		{Name: ForkMedianTime, Height: 0},
+	},
+	Regtest: true,
+}
+
+// ChainSpecs are the built-in specs, by the name the -chain flag takes.
+var ChainSpecs = map[string]*ChainSpec{
+	"main":    MainnetSpec,
+	"test":    TestnetSpec,
+	"regtest": RegtestSpec,
+}
+
+// ChainSpecNames returns the names of the built-in specs, sorted.
+func ChainSpecNames() []string {
+	names := make([]string, 0, len(ChainSpecs))
+	for name := range ChainSpecs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// LoadChainSpec returns the built-in spec with the given name, or reads a spec from a JSON file.
+func LoadChainSpec(nameOrPath string) (*ChainSpec, error) {
+	if spec, ok := ChainSpecs[nameOrPath]; ok {
+		return spec, nil
+	}
+	data, err := os.ReadFile(nameOrPath)
+	if err != nil {
+		return nil, err
+	}
+	spec := &ChainSpec{}
+	if err := json.Unmarshal(data, spec); err != nil {
+		return nil, fmt.Errorf("invalid chain spec: %w", err)
+	}
+	if err := spec.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid chain spec %s: %w", nameOrPath, err)
+	}
+	return spec, nil
+}
+
+// Validate checks the spec describes a chain nodes can run.
+func (s *ChainSpec) Validate() error {
+	switch {
+	case s.Name == "":
+		return errors.New("missing network name")
+	case s.GenesisDifficulty < 0:
+		return errors.New("genesis difficulty must not be negative")
+	case s.BlockReward < 0:
+		return errors.New("block reward must not be negative")
+	case s.AdjustmentInterval <= 0:
+		return errors.New("adjustment interval must be positive")
+	case s.TargetBlockTime <= 0:
+		return errors.New("target block time must be positive")
+	case s.MaxBlockSize <= 0:
+		return errors.New("max block size must be positive")
+	case s.MinTransactionFee < 0:
+		return errors.New("min transaction fee must not be negative")
+	}
+	if _, ok := consensusEngines[s.Consensus]; !ok {
+		return fmt.Errorf("unknown consensus %q, expected one of %v", s.Consensus, ConsensusNames())
+	}
+	if s.Consensus == "PoA" && len(s.Authorities) == 0 {
+		return errors.New("a PoA chain needs authorities")
+	}
+	for _, authority := range s.Authorities {
+		if _, err := parseValidatorAddress(authority); err != nil {
+			return fmt.Errorf("authority %s: %w", shortValidator(authority), err)
+		}
+	}
+
+	allocated := make(map[string]bool)
+	for _, allocation := range s.Premine {
+		if allocation.Address == "" || allocation.Amount <= 0 {
+			return fmt.Errorf("premine to %q must name an address and a positive amount", allocation.Address)
+		}
+		if allocated[allocation.Address] {
+			return fmt.Errorf("premine to %s is listed twice", allocation.Address)
+		}
+		allocated[allocation.Address] = true
+	}
+
+	scheduled := make(map[string]bool)
+	for _, fork := range s.Forks {
+		if scheduled[fork.Name] {
+			return fmt.Errorf("fork %s is scheduled twice", fork.Name)
+		}
+		scheduled[fork.Name] = true
+		if fork.Height != SignalledFork {
+			if fork.Height < 0 {
+				return fmt.Errorf("fork %s has a negative height", fork.Name)
+			}
+			continue
+		}
+		if fork.Bit < 0 || fork.Bit >= 29 { // The top three bits mark a version-bits header
+			return fmt.Errorf("fork %s signals with bit %d, expected 0 to 28", fork.Name, fork.Bit)
+		}
+		if fork.StartHeight < 0 || fork.TimeoutHeight <= fork.StartHeight {
+			return fmt.Errorf("fork %s must time out after it starts", fork.Name)
+		}
+	}
+
+	for height, hash := range s.Checkpoints {
+		if height < 0 {
+			return fmt.Errorf("checkpoint at negative height %d", height)
+		}
+		if err := checkBlockHash(hash); err != nil {
+			return fmt.Errorf("checkpoint at height %d: %w", height, err)
+		}
+	}
+	if hash, ok := s.Checkpoints[0]; ok && hash != s.GenesisHash() {
+		return fmt.Errorf("genesis checkpoint %s does not match the genesis block %s", hash, s.GenesisHash())
+	}
+	if s.AssumeValid != "" {
+		if err := checkBlockHash(s.AssumeValid); err != nil {
+			return fmt.Errorf("assumed-valid block: %w", err)
+		}
+	}
+	return nil
+}
+
+// Genesis builds the spec's genesis block, returning it with the UTXO set holding the premine. The
+// premine is in the block so the UTXO set can be rebuilt from the chain alone.
+func (s *ChainSpec) Genesis() (*Block, *UTXOSet) {
+	utxoSet := NewUTXOSet()
+	transactions := make([]*Transaction, 0, len(s.Premine))
+	for _, allocation := range s.Premine {
+		tx := &Transaction{
+			Sender:    "system",
+			Recipient: allocation.Address,
+			Amount:    allocation.Amount,
+			Fee:       0,
+		}
+		transactions = append(transactions, tx)
+		utxoSet.ApplyTransaction(tx, "", 0, &UTXOUndo{})
+	}
+
+	block := NewBlock(transactions, "0", s.GenesisDifficulty, NewMockClock(time.Unix(s.GenesisTimestamp, 0)))
+	block.UTXOCommitment = utxoSet.Commitment()
+	block.Hash = block.calculateHash()
+	return block, utxoSet
+}
+
+// GenesisHash returns the hash of the spec's genesis block.
+func (s *ChainSpec) GenesisHash() string {
+	block, _ := s.Genesis()
+	return block.Hash
+}
+
+// Hash returns a hash of everything in the spec that nodes must agree on. Seeds, checkpoints and
+// the assumed-valid block are left out: they only decide where a node looks for the chain and how
+// much of it the node checks, so nodes may differ on them.
+func (s *ChainSpec) Hash() string {
+	consensus := *s
+	consensus.Seeds = nil
+	consensus.Checkpoints = nil
+	consensus.AssumeValid = ""
+	data, _ := json.Marshal(&consensus) // Every field is plain data, so encoding can't fail
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// ChainSpecSummary describes the chain a node runs for the API.
+type ChainSpecSummary struct {
+	*ChainSpec
+	GenesisHash string
+	SpecHash    string
+}
+
+// ChainSpecSummary returns the chain's spec, genesis hash and spec hash.
+func (bc *Blockchain) ChainSpecSummary() ChainSpecSummary {
+	bc.lock.RLock()
+	defer bc.lock.RUnlock()
+	return ChainSpecSummary{ChainSpec: bc.Spec, GenesisHash: bc.Blocks[0].Hash, SpecHash: bc.Spec.Hash()}
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestBuiltInChainSpecsAreValid(t *testing.T) {
+	for name, spec := range ChainSpecs {
+		if err := spec.Validate(); err != nil {
+			t.Errorf("chain spec %s: %v", name, err)
+		}
+	}
+}
+
+func TestHandshakeRejectsPeersWithADifferentSpec(t *testing.T) {
+	n, peer := newTestNode(t), newTestNode(t)
+	if err := n.checkVersion(peer.versionMessage()); err != nil {
+		t.Fatalf("rejected a peer on the same spec: %v", err)
+	}
+
+	// Same name and genesis block, different consensus rules
+	spec := *RegtestSpec
+	spec.BlockReward++
+	peer.Blockchain.Spec = &spec
+	if err := n.checkVersion(peer.versionMessage()); err == nil || !strings.Contains(err.Error(), "chain spec") {
+		t.Fatalf("accepted a peer whose spec differs: %v", err)
+	}
+
+	// Where a node looks for peers is its own business
+	spec = *RegtestSpec
+	spec.Seeds = []string{"192.0.2.1:8090"}
+	if err := n.checkVersion(peer.versionMessage()); err != nil {
+		t.Fatalf("rejected a peer whose spec only differs in its seeds: %v", err)
+	}
+}
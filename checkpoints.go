@@ -0,0 +1,136 @@
+// checkpoints.go
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// A checkpoint pins the block at a height to a known hash: a chain with a different block there is
+// invalid, and the chain never reorganizes to a fork below the last checkpoint it has passed. The
+// assumed-valid block is a hash the node trusts, along with everything before it: while syncing a
+// chain that contains it, the signatures of blocks up to it are not checked. Everything else still
+// is, including proof of work, the UTXO accounting and the header's UTXO commitment, so a chain can
+// only use the shortcut to reach the state the assumed-valid block commits to.
+
+// parseCheckpoints parses a comma-separated list of height:hash checkpoints.
+func parseCheckpoints(list string) (map[int]string, error) {
+	checkpoints := make(map[int]string)
+	for _, entry := range strings.Split(list, ",") {
+		height, hash, ok := strings.Cut(strings.TrimSpace(entry), ":")
+		if !ok {
+			return nil, fmt.Errorf("checkpoint %q is not height:hash", entry)
+		}
+		h, err := strconv.Atoi(height)
+		if err != nil {
+			return nil, fmt.Errorf("checkpoint %q has an invalid height", entry)
+		}
+		checkpoints[h] = hash
+	}
+	return checkpoints, nil
+}
+
+// checkBlockHash reports whether hash looks like a block hash.
+func checkBlockHash(hash string) error {
+	if decoded, err := hex.DecodeString(hash); err != nil || len(decoded) != 32 {
+		return fmt.Errorf("%q is not a block hash", hash)
+	}
+	return nil
+}
+
+// AddCheckpoints pins the blocks at the given heights to the given hashes, in addition to the chain
+// spec's checkpoints. It fails if the chain already has a different block at one of the heights.
+func (bc *Blockchain) AddCheckpoints(checkpoints map[int]string) error {
+	bc.lock.Lock()
+	defer bc.lock.Unlock()
+	for height, hash := range checkpoints {
+		if height < 0 {
+			return fmt.Errorf("checkpoint at negative height %d", height)
+		}
+		if err := checkBlockHash(hash); err != nil {
+			return fmt.Errorf("checkpoint at height %d: %w", height, err)
+		}
+		if height < len(bc.Blocks) && bc.Blocks[height].Hash != hash {
+			return fmt.Errorf("checkpoint at height %d conflicts with block %s", height, bc.Blocks[height].Hash)
+		}
+	}
+	for height, hash := range checkpoints {
+		bc.checkpoints[height] = hash
+	}
+	return nil
+}
+
+// SetAssumeValid sets the block below which signatures are not checked while syncing, or "" to
+// check every signature.
+func (bc *Blockchain) SetAssumeValid(hash string) error {
+	if hash != "" {
+		if err := checkBlockHash(hash); err != nil {
+			return err
+		}
+	}
+	bc.lock.Lock()
+	defer bc.lock.Unlock()
+	bc.assumeValid = hash
+	return nil
+}
+
+// checkCheckpoint reports whether a block conflicts with a checkpoint.
+func (bc *Blockchain) checkCheckpoint(block *Block) error {
+	if hash, ok := bc.checkpoints[block.Index]; ok && block.Hash != hash {
+		return fmt.Errorf("block %d does not match the checkpoint %s", block.Index, hash)
+	}
+	return nil
+}
+
+// lastCheckpoint returns the height of the highest checkpoint the chain has reached, or 0. Callers
+// must hold the lock.
+func (bc *Blockchain) lastCheckpoint() int {
+	last := 0
+	for height := range bc.checkpoints {
+		if height > last && height < len(bc.Blocks) {
+			last = height
+		}
+	}
+	return last
+}
+
+// assumedValidHeight returns the height of the assumed-valid block in blocks, or 0 if they don't
+// contain it, so the signatures of blocks up to that height need not be checked.
+func (bc *Blockchain) assumedValidHeight(blocks []*Block) int {
+	if bc.assumeValid == "" {
+		return 0
+	}
+	for _, block := range blocks {
+		if block.Hash == bc.assumeValid {
+			return block.Index
+		}
+	}
+	return 0
+}
+
+// CheckpointSummary describes the checkpoints for the API.
+type CheckpointSummary struct {
+	Checkpoints []Checkpoint
+	AssumeValid string // Block below which signatures are not checked while syncing, if any.
+}
+
+// Checkpoint is a height pinned to a block hash.
+type Checkpoint struct {
+	Height int
+	Hash   string
+}
+
+// CheckpointSummary returns the checkpoints, by height, and the assumed-valid block.
+func (bc *Blockchain) CheckpointSummary() CheckpointSummary {
+	bc.lock.RLock()
+	defer bc.lock.RUnlock()
+	summary := CheckpointSummary{Checkpoints: make([]Checkpoint, 0, len(bc.checkpoints)), AssumeValid: bc.assumeValid}
+	for height, hash := range bc.checkpoints {
+		summary.Checkpoints = append(summary.Checkpoints, Checkpoint{Height: height, Hash: hash})
+	}
+	sort.Slice(summary.Checkpoints, func(i, j int) bool { return summary.Checkpoints[i].Height < summary.Checkpoints[j].Height })
+	return summary
+}
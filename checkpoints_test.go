@@ -0,0 +1,155 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// checkpointForks returns a regtest chain of ten blocks and a longer chain forking from it at height
+// 3, with later timestamps so its blocks differ.
+func checkpointForks(t *testing.T) (chain, fork *Blockchain) {
+	t.Helper()
+	chain, fork = NewBlockchainFromSpec(RegtestSpec), NewBlockchainFromSpec(RegtestSpec)
+	if _, err := chain.GenerateBlocks(10, "alice", nil); err != nil {
+		t.Fatal(err)
+	}
+	fork.SetClock(NewMockClock(time.Now().Add(time.Hour)))
+	if _, err := fork.GenerateBlocks(3, "alice", nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fork.GenerateBlocks(12, "bob", nil); err != nil {
+		t.Fatal(err)
+	}
+	return chain, fork
+}
+
+func TestCheckpointRejectsOtherChains(t *testing.T) {
+	chain, fork := checkpointForks(t)
+	bc := NewBlockchainFromSpec(RegtestSpec)
+	if err := bc.AddCheckpoints(map[int]string{5: chain.Blocks[5].Hash}); err != nil {
+		t.Fatal(err)
+	}
+
+	if bc.IsValidChain(fork.Blocks) {
+		t.Fatal("a chain with a different block at a checkpoint is valid")
+	}
+	if !bc.IsValidChain(chain.Blocks) {
+		t.Fatal("the checkpointed chain is invalid")
+	}
+	if err := bc.Reorganize(chain.Blocks); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReorganizeRefusesForksBelowCheckpoint(t *testing.T) {
+	chain, fork := checkpointForks(t)
+	bc := NewBlockchainFromSpec(RegtestSpec)
+	if err := bc.Reorganize(chain.Blocks); err != nil {
+		t.Fatal(err)
+	}
+	if err := bc.AddCheckpoints(map[int]string{5: chain.Blocks[5].Hash, 1000: chain.Blocks[5].Hash}); err != nil {
+		t.Fatal(err)
+	}
+	if got := bc.lastCheckpoint(); got != 5 {
+		t.Fatalf("last checkpoint %d, want the highest reached, 5", got)
+	}
+
+	err := bc.Reorganize(fork.Blocks)
+	if err == nil || !strings.Contains(err.Error(), "below checkpoint") {
+		t.Fatalf("reorganized to a fork below a checkpoint: %v", err)
+	}
+	if bc.Tip().Hash != chain.Tip().Hash {
+		t.Fatal("the refused reorganization changed the tip")
+	}
+}
+
+func TestAddCheckpointsRejectsBadCheckpoints(t *testing.T) {
+	chain, fork := checkpointForks(t)
+	bc := NewBlockchainFromSpec(RegtestSpec)
+	if err := bc.Reorganize(chain.Blocks); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := bc.AddCheckpoints(map[int]string{4: fork.Blocks[4].Hash}); err == nil {
+		t.Fatal("added a checkpoint conflicting with the chain")
+	}
+	if err := bc.AddCheckpoints(map[int]string{-1: chain.Blocks[1].Hash}); err == nil {
+		t.Fatal("added a checkpoint at a negative height")
+	}
+	if err := bc.AddCheckpoints(map[int]string{1: "abc"}); err == nil {
+		t.Fatal("added a checkpoint that is not a block hash")
+	}
+	if got := len(bc.CheckpointSummary().Checkpoints); got != len(RegtestSpec.Checkpoints) {
+		t.Fatalf("%d checkpoints after only rejected additions", got)
+	}
+}
+
+func TestParseCheckpoints(t *testing.T) {
+	hash := strings.Repeat("ab", 32)
+	checkpoints, err := parseCheckpoints("1:" + hash + ", 20:" + hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(checkpoints) != 2 || checkpoints[1] != hash || checkpoints[20] != hash {
+		t.Fatalf("parsed %v", checkpoints)
+	}
+	for _, list := range []string{"1" + hash, "x:" + hash} {
+		if _, err := parseCheckpoints(list); err == nil {
+			t.Fatalf("parsed %q", list)
+		}
+	}
+}
+
+// assumeValidChain returns a PoA chain spec and six blocks sealed under it, with the signature of the
+// block at height bad replaced by another block's.
+func assumeValidChain(t *testing.T, bad int) (*ChainSpec, []*Block) {
+	t.Helper()
+	key, address := newKeyAddress(t)
+	spec := *RegtestSpec
+	spec.Consensus = "PoA"
+	spec.Authorities = []string{address}
+	producer := NewBlockchainFromSpec(&spec)
+	if _, err := producer.GenerateBlocks(6, "miner", key); err != nil {
+		t.Fatal(err)
+	}
+	blocks := append([]*Block{}, producer.Blocks...)
+	tampered := *blocks[bad]
+	tampered.Signature = blocks[bad%5+1].Signature
+	blocks[bad] = &tampered
+	return &spec, blocks
+}
+
+func TestAssumeValidSkipsSignaturesUpToTheBlock(t *testing.T) {
+	spec, blocks := assumeValidChain(t, 2)
+
+	strict := NewBlockchainFromSpec(spec)
+	if strict.IsValidChain(blocks) || strict.Reorganize(blocks) == nil {
+		t.Fatal("accepted a bad signature without an assumed-valid block")
+	}
+
+	trusting := NewBlockchainFromSpec(spec)
+	if err := trusting.SetAssumeValid(blocks[4].Hash); err != nil {
+		t.Fatal(err)
+	}
+	if got := trusting.assumedValidHeight(blocks); got != 4 {
+		t.Fatalf("assumed-valid height %d, want 4", got)
+	}
+	if err := trusting.Reorganize(blocks); err != nil {
+		t.Fatalf("checked a signature below the assumed-valid block: %v", err)
+	}
+}
+
+func TestAssumeValidChecksSignaturesAboveTheBlock(t *testing.T) {
+	spec, blocks := assumeValidChain(t, 5)
+	bc := NewBlockchainFromSpec(spec)
+	if err := bc.SetAssumeValid(blocks[4].Hash); err != nil {
+		t.Fatal(err)
+	}
+	if bc.IsValidChain(blocks) || bc.Reorganize(blocks) == nil {
+		t.Fatal("accepted a bad signature above the assumed-valid block")
+	}
+	if err := bc.SetAssumeValid("not a hash"); err == nil {
+		t.Fatal("assumed valid a block that is not a hash")
+	}
+}
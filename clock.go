@@ -0,0 +1,53 @@
+// clock.go
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// Clock tells a node the time, so simulations and tests can run it with a skewed or fixed clock.
+type Clock interface {
+	Now() time.Time
+}
+
+// systemClock reads the machine's clock.
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+// SystemClock is the clock nodes use unless told otherwise.
+var SystemClock Clock = systemClock{}
+
+// MockClock is a clock that only moves when told to, so regtest chains and tests control time.
+type MockClock struct {
+	now  time.Time
+	lock sync.Mutex
+}
+
+// NewMockClock returns a clock stopped at now.
+func NewMockClock(now time.Time) *MockClock {
+	return &MockClock{now: now}
+}
+
+func (c *MockClock) Now() time.Time {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.now
+}
+
+// Set moves the clock to now.
+func (c *MockClock) Set(now time.Time) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.now = now
+}
+
+// Advance moves the clock on by d.
+func (c *MockClock) Advance(d time.Duration) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.now = c.now.Add(d)
+}
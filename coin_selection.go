@@ -0,0 +1,124 @@
+// coin_selection.go
+package main
+
+import (
+	"sort"
+)
+
+// CoinSelectionStrategy decides which of an owner's UTXOs are spent to fund a payment.
+// Every strategy is deterministic: the same UTXO set always yields the same selection.
+type CoinSelectionStrategy int
+
+const (
+	CoinSelectionLargestFirst   CoinSelectionStrategy = iota // Spend the biggest outputs first, minimising the number of inputs.
+	CoinSelectionBranchAndBound                              // Search for inputs that avoid a change output, else largest-first.
+	CoinSelectionOldestFirst                                 // Spend the outputs created at the lowest heights first.
+)
+
+// bnbMaxTries bounds the branch-and-bound search so selection time stays predictable.
+const bnbMaxTries = 100_000
+
+// SelectUTXOs picks UTXOs belonging to owner worth at least amount using the given strategy.
+// If the owner cannot cover the amount, all of their UTXOs and their total are returned.
+func (u *UTXOSet) SelectUTXOs(owner string, amount int, strategy CoinSelectionStrategy) ([]UTXO, int) {
+	u.lock.RLock()
+	utxos := u.ownerUTXOs(owner)
+	u.lock.RUnlock()
+
+	switch strategy {
+	case CoinSelectionBranchAndBound:
+		if selected, total, ok := selectBranchAndBound(utxos, amount, MinTransactionFee); ok {
+			return selected, total
+		}
+		sortLargestFirst(utxos)
+	case CoinSelectionOldestFirst:
+		sort.SliceStable(utxos, func(i, j int) bool {
+			return utxos[i].Height < utxos[j].Height
+		})
+	default:
+		sortLargestFirst(utxos)
+	}
+	return accumulateUTXOs(utxos, amount)
+}
+
+// sortLargestFirst orders UTXOs by descending amount, keeping the existing order for ties.
+func sortLargestFirst(utxos []UTXO) {
+	sort.SliceStable(utxos, func(i, j int) bool {
+		return utxos[i].Amount > utxos[j].Amount
+	})
+}
+
+// accumulateUTXOs takes UTXOs in order until their total reaches amount.
+func accumulateUTXOs(utxos []UTXO, amount int) ([]UTXO, int) {
+	var accumulated []UTXO
+	accumulatedValue := 0
+	for _, utxo := range utxos {
+		accumulated = append(accumulated, utxo)
+		accumulatedValue += utxo.Amount
+		if accumulatedValue >= amount {
+			break
+		}
+	}
+	return accumulated, accumulatedValue
+}
+
+// selectBranchAndBound searches for a set of UTXOs whose total lands between amount and
+// amount+costOfChange, so the payment needs no change output. The selection with the least
+// excess found within bnbMaxTries wins. ok is false if no such set was found.
+func selectBranchAndBound(utxos []UTXO, amount, costOfChange int) ([]UTXO, int, bool) {
+	sorted := make([]UTXO, len(utxos))
+	copy(sorted, utxos)
+	sortLargestFirst(sorted)
+
+	available := 0
+	for _, utxo := range sorted {
+		available += utxo.Amount
+	}
+	if available < amount {
+		return nil, 0, false
+	}
+
+	var selection, best []int
+	bestExcess := -1
+	tries := 0
+
+	var search func(i, total, remaining int)
+	search = func(i, total, remaining int) {
+		if tries >= bnbMaxTries || bestExcess == 0 {
+			return
+		}
+		tries++
+
+		if total > amount+costOfChange {
+			return // Overshot the window; adding more only makes it worse.
+		}
+		if total >= amount {
+			if excess := total - amount; bestExcess < 0 || excess < bestExcess {
+				best = append(best[:0], selection...)
+				bestExcess = excess
+			}
+			return
+		}
+		if i == len(sorted) || total+remaining < amount {
+			return // Not enough value left to reach the target.
+		}
+
+		// Try including the next UTXO before trying without it.
+		selection = append(selection, i)
+		search(i+1, total+sorted[i].Amount, remaining-sorted[i].Amount)
+		selection = selection[:len(selection)-1]
+		search(i+1, total, remaining-sorted[i].Amount)
+	}
+	search(0, 0, available)
+
+	if bestExcess < 0 {
+		return nil, 0, false
+	}
+	selected := make([]UTXO, 0, len(best))
+	total := 0
+	for _, i := range best {
+		selected = append(selected, sorted[i])
+		total += sorted[i].Amount
+	}
+	return selected, total, true
+}
@@ -0,0 +1,64 @@
+package main
+
+import "testing"
+
+// ownerSet returns a UTXO set holding outputs of the given amounts for alice, created at
+// descending heights so the last one is the oldest.
+func ownerSet(t *testing.T, amounts ...int) *UTXOSet {
+	t.Helper()
+	u := NewUTXOSet()
+	for i, amount := range amounts {
+		utxo := UTXO{TxID: "tx", Index: i, Amount: amount, Owner: "alice", Height: len(amounts) - i}
+		if err := u.AddUTXO(utxo); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return u
+}
+
+// amounts lists the amounts of the selected outputs in order.
+func amounts(utxos []UTXO) []int {
+	result := make([]int, len(utxos))
+	for i, utxo := range utxos {
+		result[i] = utxo.Amount
+	}
+	return result
+}
+
+func TestSelectUTXOsStrategies(t *testing.T) {
+	u := ownerSet(t, 5, 3, 8, 4)
+	for _, test := range []struct {
+		name     string
+		strategy CoinSelectionStrategy
+		amount   int
+		want     []int
+	}{
+		{"largest first", CoinSelectionLargestFirst, 9, []int{8, 5}},
+		{"branch and bound finds a changeless set", CoinSelectionBranchAndBound, 7, []int{4, 3}},
+		{"oldest first", CoinSelectionOldestFirst, 6, []int{4, 8}},
+	} {
+		selected, total := u.SelectUTXOs("alice", test.amount, test.strategy)
+		got := amounts(selected)
+		if len(got) != len(test.want) || total < test.amount {
+			t.Fatalf("%s: selected %v worth %d, want %v", test.name, got, total, test.want)
+		}
+		for i := range got {
+			if got[i] != test.want[i] {
+				t.Fatalf("%s: selected %v, want %v", test.name, got, test.want)
+			}
+		}
+	}
+}
+
+func TestSelectUTXOsCannotCoverAmount(t *testing.T) {
+	u := ownerSet(t, 5, 3)
+	for _, strategy := range []CoinSelectionStrategy{CoinSelectionLargestFirst, CoinSelectionBranchAndBound, CoinSelectionOldestFirst} {
+		selected, total := u.SelectUTXOs("alice", 9, strategy)
+		if len(selected) != 2 || total != 8 {
+			t.Fatalf("strategy %d returned %v worth %d for an amount the owner can't cover", strategy, amounts(selected), total)
+		}
+	}
+	if selected, total := u.SelectUTXOs("bob", 1, CoinSelectionLargestFirst); len(selected) != 0 || total != 0 {
+		t.Fatal("selected outputs for an owner with none")
+	}
+}
@@ -0,0 +1,367 @@
+// consensus.go
+package main
+
+import (
+	"crypto/ecdsa"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+const (
+	ConsensusActivationDelay = 10 // Blocks between announcing a consensus switch and the earliest height it may activate at.
+)
+
+// errNoKey is returned when an engine that signs blocks is asked to produce one without a key.
+var errNoKey = errors.New("a validator key is required to produce blocks")
+
+// Every block is produced under one consensus engine, chosen by its height. The chain starts under
+// a genesis engine, and a switch is announced in a block header naming the new engine and the
+// height it takes over at, at least ConsensusActivationDelay blocks later. Because the schedule is
+// part of the headers, every node reading the same chain switches at the same block.
+
+// ConsensusEngine is the set of rules for producing, checking and choosing between blocks.
+type ConsensusEngine interface {
+	// Name returns the engine's name, as used in the schedule.
+	Name() string
+	// Prepare returns the header of the next block key would produce on the tip, with its index,
+	// previous hash, difficulty and any proposer, round or authority vote filled in. It fails if
+	// key may not produce the block now. Callers must hold the lock.
+	Prepare(bc *Blockchain, key *ecdsa.PrivateKey) (*Block, error)
+	// Seal completes an assembled block: PoW mines it and PoS and PoA sign it.
+	Seal(block *Block, key *ecdsa.PrivateKey) error
+	// VerifyHeader checks the engine's rules for a block extending previous, beyond the linkage,
+	// seal and hash isValidLink checks. Callers must hold the lock.
+	VerifyHeader(bc *Blockchain, block, previous *Block) error
+	// Finalize applies the engine's own state changes for a block to the staking ledger and
+	// authority set, before the block's transactions.
+	Finalize(staking *StakingState, authorities *AuthorityState, block *Block)
+	// SelectFork reports whether a candidate chain should replace ours. Callers must hold the lock.
+	SelectFork(bc *Blockchain, candidate []*Block) bool
+}
+
+// consensusEngines are the engines a chain can be scheduled to run, by name.
+var consensusEngines = map[string]ConsensusEngine{
+	"PoW": PoWEngine{},
+	"PoS": PoSEngine{},
+	"PoA": PoAEngine{},
+}
+
+// ConsensusNames returns the names of the known engines, sorted.
+func ConsensusNames() []string {
+	names := make([]string, 0, len(consensusEngines))
+	for name := range consensusEngines {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// ConsensusActivation announces that blocks from Height on are produced under Algorithm.
+type ConsensusActivation struct {
+	Algorithm string
+	Height    int
+}
+
+// consensusSchedule is the genesis engine and the switches announced by a chain's blocks, in order.
+type consensusSchedule struct {
+	Genesis     string
+	Activations []ConsensusActivation
+	announcedAt []int // Index of the block announcing each activation, so a disconnect can drop it.
+}
+
+// newConsensusSchedule returns a schedule running the genesis engine from the start.
+func newConsensusSchedule(genesis string) *consensusSchedule {
+	return &consensusSchedule{Genesis: genesis}
+}
+
+// replaySchedule rebuilds the schedule a chain's headers announce.
+func replaySchedule(genesis string, blocks []*Block) *consensusSchedule {
+	schedule := newConsensusSchedule(genesis)
+	for _, block := range blocks {
+		schedule.record(block)
+	}
+	return schedule
+}
+
+// at returns the name of the engine blocks at height are produced under.
+func (s *consensusSchedule) at(height int) string {
+	algorithm := s.Genesis
+	for _, activation := range s.Activations {
+		if activation.Height <= height {
+			algorithm = activation.Algorithm
+		}
+	}
+	return algorithm
+}
+
+// pending returns the announced switch not yet active at height, if there is one.
+func (s *consensusSchedule) pending(height int) *ConsensusActivation {
+	if n := len(s.Activations); n > 0 && s.Activations[n-1].Height > height {
+		return &s.Activations[n-1]
+	}
+	return nil
+}
+
+// checkBlock checks the rules the schedule alone decides for a block: that it is sealed the way
+// its engine seals blocks, and that any switch it announces is far enough ahead, names a known
+// engine other than the one already due, and does not overlap a switch still pending. PoS blocks
+// may be mined instead of signed while nobody has stake, which only the engine can check.
+func (s *consensusSchedule) checkBlock(block *Block) error {
+	switch s.at(block.Index) {
+	case "PoW":
+		if block.Proposer != "" {
+			return fmt.Errorf("block %d is signed but its height runs PoW", block.Index)
+		}
+	case "PoA":
+		if block.Proposer == "" {
+			return fmt.Errorf("block %d is mined but its height runs PoA", block.Index)
+		}
+	}
+
+	announced := block.ConsensusSwitch
+	if announced == nil {
+		return nil
+	}
+	if _, ok := consensusEngines[announced.Algorithm]; !ok {
+		return fmt.Errorf("block %d announces unknown consensus %q", block.Index, announced.Algorithm)
+	}
+	if announced.Height < block.Index+ConsensusActivationDelay {
+		return fmt.Errorf("block %d announces a switch at height %d, less than %d blocks ahead", block.Index, announced.Height, ConsensusActivationDelay)
+	}
+	if pending := s.pending(block.Index); pending != nil {
+		return fmt.Errorf("block %d announces a switch while the switch to %s at height %d is pending", block.Index, pending.Algorithm, pending.Height)
+	}
+	if s.at(announced.Height) == announced.Algorithm {
+		return fmt.Errorf("block %d announces a switch to %s, which is already running", block.Index, announced.Algorithm)
+	}
+	return nil
+}
+
+// record adds the switch a block announces, if any.
+func (s *consensusSchedule) record(block *Block) {
+	if block.ConsensusSwitch != nil {
+		s.Activations = append(s.Activations, *block.ConsensusSwitch)
+		s.announcedAt = append(s.announcedAt, block.Index)
+	}
+}
+
+// unrecord drops the switch announced by a block being disconnected.
+func (s *consensusSchedule) unrecord(block *Block) {
+	if n := len(s.announcedAt); n > 0 && s.announcedAt[n-1] == block.Index {
+		s.Activations = s.Activations[:n-1]
+		s.announcedAt = s.announcedAt[:n-1]
+	}
+}
+
+// recordSwitch adds the switch a connected block announces to the schedule. Callers must hold the lock.
+func (bc *Blockchain) recordSwitch(block *Block) {
+	bc.schedule.record(block)
+	if block.ConsensusSwitch != nil && block.ConsensusSwitch.Algorithm == bc.pendingSwitch {
+		bc.pendingSwitch = "" // Announced, whether by this node or another
+	}
+}
+
+// engineAt returns the engine for the block at height. Callers must hold the lock.
+func (bc *Blockchain) engineAt(height int) ConsensusEngine {
+	return consensusEngines[bc.schedule.at(height)]
+}
+
+// Engine returns the engine the next block is produced under.
+func (bc *Blockchain) Engine() ConsensusEngine {
+	bc.lock.RLock()
+	defer bc.lock.RUnlock()
+	return bc.engineAt(len(bc.Blocks))
+}
+
+// SetConsensusAlgorithm sets the engine a new chain starts under, or once the chain has blocks,
+// has this node announce a switch to it in the next block it produces. The switch then activates
+// ConsensusActivationDelay blocks after that block.
+func (bc *Blockchain) SetConsensusAlgorithm(algorithm string) error {
+	if _, ok := consensusEngines[algorithm]; !ok {
+		return fmt.Errorf("unknown consensus algorithm %q, expected one of %s", algorithm, strings.Join(ConsensusNames(), ", "))
+	}
+	bc.lock.Lock()
+	defer bc.lock.Unlock()
+	if len(bc.Blocks) <= 1 {
+		bc.schedule = newConsensusSchedule(algorithm)
+		fmt.Printf("Consensus algorithm set to %s\n", algorithm)
+		return nil
+	}
+	height := len(bc.Blocks)
+	if pending := bc.schedule.pending(height); pending != nil {
+		return fmt.Errorf("a switch to %s at height %d is already pending", pending.Algorithm, pending.Height)
+	}
+	if bc.schedule.at(height) == algorithm {
+		return fmt.Errorf("the chain already runs %s", algorithm)
+	}
+	bc.pendingSwitch = algorithm
+	fmt.Printf("Switch to %s will be announced in the next block this node produces\n", algorithm)
+	return nil
+}
+
+// announceSwitch adds this node's pending switch to a header it is producing, if the schedule
+// still allows it. Callers must hold the lock.
+func (bc *Blockchain) announceSwitch(header *Block) {
+	if bc.pendingSwitch == "" {
+		return
+	}
+	header.ConsensusSwitch = &ConsensusActivation{Algorithm: bc.pendingSwitch, Height: header.Index + ConsensusActivationDelay}
+	if err := bc.schedule.checkBlock(header); err != nil {
+		fmt.Println("Dropping consensus switch:", err)
+		header.ConsensusSwitch = nil
+		bc.pendingSwitch = ""
+	}
+}
+
+// ConsensusSummary describes the consensus schedule for the API.
+type ConsensusSummary struct {
+	Height      int                   // Height of the next block.
+	Current     string                // Engine the next block is produced under.
+	Genesis     string                // Engine the chain started under.
+	Activations []ConsensusActivation // Switches announced on chain, in order.
+	Announcing  string                // Switch this node will announce in the next block it produces, if any.
+}
+
+// ConsensusSummary returns the engine in force, the switches announced on chain and this node's own.
+func (bc *Blockchain) ConsensusSummary() ConsensusSummary {
+	bc.lock.RLock()
+	defer bc.lock.RUnlock()
+	height := len(bc.Blocks)
+	return ConsensusSummary{
+		Height:      height,
+		Current:     bc.schedule.at(height),
+		Genesis:     bc.schedule.Genesis,
+		Activations: append([]ConsensusActivation(nil), bc.schedule.Activations...),
+		Announcing:  bc.pendingSwitch,
+	}
+}
+
+// AddBlock produces the next block under the engine its height runs: a PoW block is mined, and
+// PoS and PoA blocks are signed with key, which must be entitled to the current slot. It returns
+// nil if the block cannot be produced.
+func (bc *Blockchain) AddBlock(transactions []*Transaction, key *ecdsa.PrivateKey) *Block {
+	bc.lock.Lock()
+	defer bc.lock.Unlock()
+	if bc.MinerAddress == "" {
+		bc.MinerAddress = bc.selectMinerAddress()
+	}
+	newBlock, err := bc.produceBlock(transactions, key, bc.MinerAddress)
+	if err != nil {
+		fmt.Println("Cannot produce block:", err)
+		return nil
+	}
+	return newBlock
+}
+
+// produceBlock is AddBlock for callers that already hold the lock, paying the reward of a mined
+// block to minerAddress.
+func (bc *Blockchain) produceBlock(transactions []*Transaction, key *ecdsa.PrivateKey, minerAddress string) (*Block, error) {
+	lastBlock := bc.Blocks[len(bc.Blocks)-1]
+	engine := bc.engineAt(len(bc.Blocks))
+	header, err := engine.Prepare(bc, key)
+	if err != nil {
+		return nil, err
+	}
+	bc.announceSwitch(header)
+	header.Version = bc.forks.blockVersion(header.Index, bc.readyForks)
+
+	// Miners are paid at their configured address and proposers at their validator address
+	rewardAddress := header.Proposer
+	if rewardAddress == "" {
+		rewardAddress = minerAddress
+	}
+
+	// Assemble the block and apply it to the UTXO set so the header can commit to the result
+	newBlock, undo := bc.assembleBlock(transactions, rewardAddress, header)
+	if err := engine.Seal(newBlock, key); err != nil {
+		bc.revertBlockState(undo)
+		return nil, fmt.Errorf("failed to seal block: %w", err)
+	}
+
+	// Prepare already checked the engine's rules against the state before the block
+	if !isValidLink(newBlock, lastBlock, true) {
+		bc.revertBlockState(undo)
+		return nil, fmt.Errorf("block %d does not extend the tip", newBlock.Index)
+	}
+	if err := checkForkRules(bc.Blocks, newBlock, bc.forks, bc.Spec); err != nil {
+		bc.revertBlockState(undo)
+		return nil, err
+	}
+	bc.appendBlock(newBlock, undo)
+	return newBlock, nil
+}
+
+// PrefersChain reports whether a candidate chain should replace ours: one finalizing a block
+// beyond ours always does, and otherwise the engine in force decides.
+func (bc *Blockchain) PrefersChain(blocks []*Block) bool {
+	bc.lock.RLock()
+	defer bc.lock.RUnlock()
+	return bc.prefersChain(blocks)
+}
+
+// prefersChain is PrefersChain for callers that already hold the lock.
+func (bc *Blockchain) prefersChain(blocks []*Block) bool {
+	return bc.finalizesBeyond(blocks) || bc.engineAt(len(bc.Blocks)).SelectFork(bc, blocks)
+}
+
+// PoWEngine mines blocks and follows the chain with the most work.
+type PoWEngine struct{}
+
+// Name implements ConsensusEngine.
+func (PoWEngine) Name() string { return "PoW" }
+
+// Prepare implements ConsensusEngine. Anyone may mine, at the adjusted difficulty.
+func (PoWEngine) Prepare(bc *Blockchain, key *ecdsa.PrivateKey) (*Block, error) {
+	lastBlock := bc.Blocks[len(bc.Blocks)-1]
+	return &Block{Index: len(bc.Blocks), PreviousHash: lastBlock.Hash, Difficulty: bc.adjustDifficulty()}, nil
+}
+
+// Seal implements ConsensusEngine by running the proof of work.
+func (PoWEngine) Seal(block *Block, key *ecdsa.PrivateKey) error {
+	nonce, hash, err := NewProofOfWork(block).Run()
+	if err != nil {
+		return err
+	}
+	block.Nonce = nonce
+	block.Hash = hash
+	return nil
+}
+
+// VerifyHeader implements ConsensusEngine. The proof of work itself is checked by isValidLink.
+func (PoWEngine) VerifyHeader(bc *Blockchain, block, previous *Block) error {
+	if block.Proposer != "" {
+		return fmt.Errorf("block %d is signed but its height runs PoW", block.Index)
+	}
+	return nil
+}
+
+// Finalize implements ConsensusEngine. PoW keeps no state of its own.
+func (PoWEngine) Finalize(staking *StakingState, authorities *AuthorityState, block *Block) {}
+
+// SelectFork implements ConsensusEngine, preferring the chain with more work.
+func (PoWEngine) SelectFork(bc *Blockchain, candidate []*Block) bool {
+	return chainWork(candidate) > chainWork(bc.Blocks)
+}
+
+// chainWork estimates the work behind a chain: each mined block counts the hashes its difficulty
+// takes on average, and each signed block counts one.
+func chainWork(blocks []*Block) int64 {
+	work := int64(0)
+	for _, block := range blocks {
+		if block.Proposer != "" {
+			work++
+			continue
+		}
+		difficulty := block.Difficulty // Leading hex zeros, so each is worth 16 times the work
+		if difficulty > 15 {
+			difficulty = 15
+		}
+		if difficulty < 0 {
+			difficulty = 0
+		}
+		work += int64(1) << (4 * difficulty)
+	}
+	return work
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestConsensusSwitchActivatesAtTheAnnouncedHeight(t *testing.T) {
+	key, authority := newKeyAddress(t)
+	clock := NewMockClock(time.Unix(RegtestSpec.GenesisTimestamp, 0))
+	bc, follower := NewBlockchainFromSpec(RegtestSpec), NewBlockchainFromSpec(RegtestSpec)
+	for _, chain := range []*Blockchain{bc, follower} {
+		chain.Clock = clock
+		if err := chain.SetAuthorities([]string{authority}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	next := func(key *ecdsa.PrivateKey) (*Block, error) {
+		clock.Advance(time.Second)
+		blocks, err := bc.GenerateBlocks(1, "miner", key)
+		if err != nil {
+			return nil, err
+		}
+		return blocks[0], nil
+	}
+
+	if _, err := next(nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := bc.SetConsensusAlgorithm("PoA"); err != nil {
+		t.Fatal(err)
+	}
+	announcing, err := next(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	activation := announcing.ConsensusSwitch
+	if activation == nil || activation.Algorithm != "PoA" || activation.Height != announcing.Index+ConsensusActivationDelay {
+		t.Fatalf("block announced %+v, want PoA %d blocks later", activation, ConsensusActivationDelay)
+	}
+	if err := bc.SetConsensusAlgorithm("PoS"); err == nil {
+		t.Fatal("accepted a second switch while one is pending")
+	}
+
+	// Blocks are still mined up to the activation height, and sealed from there on
+	for len(bc.Blocks) < activation.Height {
+		if _, err := next(nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if bc.Engine().Name() != "PoA" {
+		t.Fatalf("engine is %s at the activation height", bc.Engine().Name())
+	}
+	if _, err := next(nil); err == nil {
+		t.Fatal("mined a block at a PoA height")
+	}
+	if sealed, err := next(key); err != nil || sealed.Proposer != authority {
+		t.Fatalf("authority could not seal after the switch: %v", err)
+	}
+
+	for _, block := range bc.Blocks[1:] {
+		if err := follower.AcceptBlock(block); err != nil {
+			t.Fatalf("follower rejected block %d: %v", block.Index, err)
+		}
+	}
+	if summary := follower.ConsensusSummary(); summary.Current != "PoA" || summary.Genesis != "PoW" || len(summary.Activations) != 1 {
+		t.Fatalf("follower's schedule is %+v", summary)
+	}
+}
+
+func TestConsensusScheduleRejectsBadAnnouncements(t *testing.T) {
+	schedule := newConsensusSchedule("PoW")
+	schedule.record(&Block{Index: 1, ConsensusSwitch: &ConsensusActivation{Algorithm: "PoS", Height: 20}})
+	for reason, block := range map[string]*Block{
+		"unknown consensus": {Index: 2, ConsensusSwitch: &ConsensusActivation{Algorithm: "Bogus", Height: 30}},
+		"less than":         {Index: 2, ConsensusSwitch: &ConsensusActivation{Algorithm: "PoA", Height: 5}},
+		"is pending":        {Index: 2, ConsensusSwitch: &ConsensusActivation{Algorithm: "PoA", Height: 30}},
+		"signed but":        {Index: 2, Proposer: "validator"},
+	} {
+		if err := schedule.checkBlock(block); err == nil || !strings.Contains(err.Error(), reason) {
+			t.Errorf("block %+v gave %v, want %q", block, err, reason)
+		}
+	}
+	if err := newConsensusSchedule("PoA").checkBlock(&Block{Index: 2}); err == nil {
+		t.Error("accepted a mined block at a PoA height")
+	}
+
+	// Disconnecting the announcing block drops the switch
+	schedule.unrecord(&Block{Index: 1})
+	if schedule.at(25) != "PoW" || schedule.pending(2) != nil {
+		t.Fatal("switch survived the disconnect of the block announcing it")
+	}
+	if err := schedule.checkBlock(&Block{Index: 20, ConsensusSwitch: &ConsensusActivation{Algorithm: "PoW", Height: 40}}); err == nil {
+		t.Fatal("accepted a switch to the engine already running")
+	}
+}
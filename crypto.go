@@ -7,10 +7,13 @@ import (
 	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/sha256"
+	"crypto/x509"
+	"encoding/pem"
 	"errors"
 	"fmt"
 	"io"
 	"math/big"
+	"os"
 	"strconv"
 )
 
@@ -23,6 +26,35 @@ func GenerateKeyPair() (*ecdsa.PrivateKey, *ecdsa.PublicKey, error) {
 	return privateKey, &privateKey.PublicKey, nil
 }
 
+// LoadOrCreateKey reads a PEM-encoded ECDSA private key from path, generating and saving a new one
+// readable only by its owner if the file doesn't exist yet.
+func LoadOrCreateKey(path string) (*ecdsa.PrivateKey, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		privateKey, _, err := GenerateKeyPair()
+		if err != nil {
+			return nil, err
+		}
+		der, err := x509.MarshalECPrivateKey(privateKey)
+		if err != nil {
+			return nil, err
+		}
+		if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), 0600); err != nil {
+			return nil, err
+		}
+		return privateKey, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM key found in %s", path)
+	}
+	return x509.ParseECPrivateKey(block.Bytes)
+}
+
 // SignTransaction signs a transaction using the given private key.
 func SignTransaction(tx *Transaction, privKey *ecdsa.PrivateKey) (r, s *big.Int, err error) {
 	// Generate a hash of the transaction data to sign
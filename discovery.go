@@ -0,0 +1,176 @@
+// discovery.go
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"math/rand"
+	"time"
+)
+
+const (
+	TargetOutboundPeers   = 8                // Outbound sessions the node tries to keep open.
+	OutboundCheckInterval = 30 * time.Second // How often the outbound session count is topped up.
+	AddrSaveInterval      = 15 * time.Minute // How often known addresses are written to disk.
+)
+
+// maintainOutbound keeps the node at its target number of outbound sessions and periodically
+// saves the address manager, until the node stops.
+func (n *Node) maintainOutbound() {
+	defer n.wg.Done()
+
+	check := time.NewTicker(OutboundCheckInterval)
+	defer check.Stop()
+	save := time.NewTicker(AddrSaveInterval)
+	defer save.Stop()
+
+	n.fillOutbound()
+	for {
+		select {
+		case <-check.C:
+			n.fillOutbound()
+		case <-save.C:
+			if err := n.AddrManager.Save(); err != nil {
+				log.Printf("Failed to save peer addresses: %v", err)
+			}
+		case <-n.quit:
+			return
+		}
+	}
+}
+
+// fillOutbound dials addresses from the address manager until the node has TargetOutboundPeers
+// outbound sessions. At most one session is opened per network group so a single network can't
+// surround the node; local addresses are exempt so a test network can run on one machine. Seeds
+// are only asked for addresses, so sessions with them don't count.
+func (n *Node) fillOutbound() {
+	n.lock.RLock()
+	outbound := 0
+	connected := make(map[string]bool)
+	groups := make(map[string]bool)
+	for address, peer := range n.sessions {
+		connected[address] = true
+		if !peer.Inbound && !peer.Version.HasService(ServiceSeed) {
+			outbound++
+			groups[addressGroup(address)] = true
+		}
+	}
+	n.lock.RUnlock()
+
+	for ; outbound < TargetOutboundPeers; outbound++ {
+		ka := n.AddrManager.Select(func(ka *KnownAddress) bool {
+			group := addressGroup(ka.Address)
+			return ka.Address == n.Address || connected[ka.Address] || (groups[group] && group != "local") ||
+				ka.Services&ServiceSeed != 0 || n.BanManager.IsBanned(ka.Address)
+		})
+		if ka == nil {
+			if outbound == 0 {
+				n.querySeeds()
+			}
+			return
+		}
+		connected[ka.Address] = true
+		groups[addressGroup(ka.Address)] = true
+
+		n.AddrManager.Attempt(ka.Address)
+		go func(address string) {
+			if _, err := n.dialPeer(address); err != nil {
+				log.Printf("Failed to connect to peer %s: %v", address, err)
+			}
+		}(ka.Address)
+	}
+}
+
+// peerConnected is called once a session has started. Outbound peers have proven their address
+// works, so it is recorded as good and their addresses are asked for; inbound peers are only
+// known to be reachable at the address they claim, so it is added as a new address.
+func (n *Node) peerConnected(peer *Peer) {
+	if peer.Inbound {
+		n.AddrManager.AddAddresses([]NetAddress{{
+			Address:   peer.Address,
+			Services:  peer.Version.Services,
+			Timestamp: time.Now().Unix(),
+		}}, peer.conn.RemoteAddr().String())
+		return
+	}
+
+	n.AddrManager.Good(peer.Address, peer.Version.Services)
+	peer.Send(Message{Type: MessageTypeGetAddr})
+	if n.Seed {
+		return // A seed isn't a peer to sync with, so it doesn't advertise itself
+	}
+	n.sendAddresses(peer, []NetAddress{{Address: n.Address, Services: n.localServices(), Timestamp: time.Now().Unix()}})
+}
+
+// handleGetAddr answers a peer's request for addresses. Each inbound peer is answered once per
+// session, so it can't map out our whole table by asking repeatedly; outbound peers are never
+// answered, which stops a node we chose from learning about the rest of our peers.
+func (n *Node) handleGetAddr(from *Peer) {
+	if !from.Inbound || from.answeredGetAddr {
+		return
+	}
+	from.answeredGetAddr = true
+	n.sendAddresses(from, n.AddrManager.GetAddresses(MaxAddrPerMessage))
+	if n.Seed {
+		// The peer has what it came for; give the reply time to go out, then free the slot
+		time.AfterFunc(SeedLingerTime, from.Close)
+	}
+}
+
+// handleAddr adds the addresses a peer sent us. Small messages usually carry freshly announced
+// addresses, so their new entries are passed on to a couple of other peers.
+func (n *Node) handleAddr(payload []byte, from *Peer) {
+	var addresses []NetAddress
+	if err := json.Unmarshal(payload, &addresses); err != nil || len(addresses) > MaxAddrPerMessage {
+		n.Misbehaving(from, MisbehaviorMalformedMessage, "malformed addr")
+		return
+	}
+	for _, na := range addresses {
+		from.knownInventory.Add("addr:" + na.Address)
+	}
+
+	added := n.AddrManager.AddAddresses(addresses, from.Address)
+	if from.Version.HasService(ServiceSeed) && len(added) > 0 {
+		go n.fillOutbound() // Don't wait for the next check to use what a seed told us
+	}
+	if len(addresses) > AddrRelayLimit || len(added) == 0 {
+		return
+	}
+
+	n.lock.RLock()
+	var peers []*Peer
+	for _, peer := range n.sessions {
+		if peer != from {
+			peers = append(peers, peer)
+		}
+	}
+	n.lock.RUnlock()
+
+	rand.Shuffle(len(peers), func(i, j int) { peers[i], peers[j] = peers[j], peers[i] })
+	if len(peers) > AddrRelayFanout {
+		peers = peers[:AddrRelayFanout]
+	}
+	for _, peer := range peers {
+		n.sendAddresses(peer, added)
+	}
+}
+
+// sendAddresses sends the addresses the peer doesn't already know about.
+func (n *Node) sendAddresses(peer *Peer, addresses []NetAddress) {
+	var fresh []NetAddress
+	for _, na := range addresses {
+		if na.Address != peer.Address && peer.knownInventory.Add("addr:"+na.Address) {
+			fresh = append(fresh, na)
+		}
+	}
+	if len(fresh) == 0 {
+		return
+	}
+
+	data, err := json.Marshal(fresh)
+	if err != nil {
+		log.Printf("Failed to marshal addresses for %s: %v", peer.Address, err)
+		return
+	}
+	peer.Send(Message{Type: MessageTypeAddr, Payload: data})
+}
@@ -0,0 +1,577 @@
+// finality.go
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"sync"
+)
+
+// Vote types.
+const (
+	VotePrevote   = "prevote"   // The validator has seen the block and considers it valid.
+	VotePrecommit = "precommit" // The validator saw a quorum prevote the block and commits to it.
+)
+
+const (
+	MisbehaviorInvalidVote = 20           // A vote or commit certificate that fails verification.
+	MaxPendingVotes        = 1000         // Votes held for blocks that haven't arrived yet.
+	DefaultVoteFile        = "votes.json" // Where the heights this node voted at are kept between runs.
+	pendingVoteWindow      = 2            // How far past our tip a vote may be and still be held.
+
+	// Votes held per validator: a prevote and a precommit for each height in the window, and for
+	// the block after our tip.
+	maxPendingVotesPerValidator = 2 * (pendingVoteWindow + 1)
+)
+
+// Blocks are produced by PoW or PoS as before, but under PoS the validators then vote on them. Each
+// validator prevotes the new tip; once validators holding more than two thirds of the voting power
+// have prevoted a block, each precommits it; and more than two thirds of precommits form a commit
+// certificate that finalizes the block and everything before it. A validator never votes for two
+// blocks at one height, so two conflicting certificates would need more than a third of the power
+// to equivocate. Fork choice still follows the longest chain, but never reverts a finalized block.
+//
+// Votes for a block are weighed by the validator set in force once the block was connected, which
+// the chain records per block alongside its undo data.
+
+// Vote is a validator's signed prevote or precommit for a block.
+type Vote struct {
+	Type      string
+	Height    int
+	BlockHash string
+	Validator string
+	Signature string // Hex ASN.1 signature over the vote's digest.
+}
+
+// CommitCertificate is a quorum of precommits finalizing a block. It travels with the block but is
+// not part of the block hash, since it only exists after the block does.
+type CommitCertificate struct {
+	Height     int
+	BlockHash  string
+	Precommits []Vote
+}
+
+// digest is what a validator signs for the vote.
+func (v *Vote) digest() []byte {
+	sum := sha256.Sum256([]byte("vote:" + v.Type + ":" + strconv.Itoa(v.Height) + ":" + v.BlockHash))
+	return sum[:]
+}
+
+// ID identifies the vote for gossip. It covers the signature, so a copy with a forged signature
+// cannot stand in for the real vote.
+func (v *Vote) ID() string {
+	sum := sha256.Sum256([]byte(hex.EncodeToString(v.digest()) + ":" + v.Validator + ":" + v.Signature))
+	return hex.EncodeToString(sum[:])
+}
+
+// newVote creates a vote signed with the validator's key.
+func newVote(voteType string, height int, blockHash string, key *ecdsa.PrivateKey) (*Vote, error) {
+	validator, err := ValidatorAddress(&key.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	vote := &Vote{Type: voteType, Height: height, BlockHash: blockHash, Validator: validator}
+	signature, err := ecdsa.SignASN1(rand.Reader, key, vote.digest())
+	if err != nil {
+		return nil, err
+	}
+	vote.Signature = hex.EncodeToString(signature)
+	return vote, nil
+}
+
+// verify checks the vote is well formed and signed by its validator.
+func (v *Vote) verify() error {
+	if v.Type != VotePrevote && v.Type != VotePrecommit {
+		return fmt.Errorf("unknown vote type %q", v.Type)
+	}
+	publicKey, err := parseValidatorAddress(v.Validator)
+	if err != nil {
+		return err
+	}
+	signature, err := hex.DecodeString(v.Signature)
+	if err != nil || !ecdsa.VerifyASN1(publicKey, v.digest(), signature) {
+		return errors.New("invalid vote signature")
+	}
+	return nil
+}
+
+// hasQuorum reports whether power is more than two thirds of the total.
+func hasQuorum(power int, voters map[string]int) bool {
+	total := 0
+	for _, stake := range voters {
+		total += stake
+	}
+	return total > 0 && 3*power > 2*total
+}
+
+// recordVoters remembers the validator set that votes on a block just connected. Callers must hold the lock.
+func (bc *Blockchain) recordVoters(block *Block) {
+	if len(bc.Stake) == 0 {
+		return // Nobody votes on blocks without a validator set
+	}
+	voters := make(map[string]int, len(bc.Stake))
+	for validator, stake := range bc.Stake {
+		voters[validator] = stake
+	}
+	bc.voters[block.Hash] = voters
+}
+
+// Voters returns the validator set that votes on the block at height with the given hash, or nil if
+// the block is not on the chain or has no validators.
+func (bc *Blockchain) Voters(height int, hash string) map[string]int {
+	bc.lock.RLock()
+	defer bc.lock.RUnlock()
+	if height < 0 || height >= len(bc.Blocks) || bc.Blocks[height].Hash != hash {
+		return nil
+	}
+	return bc.voters[hash]
+}
+
+// FinalizedHeight returns the height of the last finalized block. Genesis is always final.
+func (bc *Blockchain) FinalizedHeight() int {
+	bc.lock.RLock()
+	defer bc.lock.RUnlock()
+	return bc.finalizedHeight
+}
+
+// verifyCommit checks a certificate's precommits are for a block on the chain, from distinct
+// validators of its voting set, and carry more than two thirds of its power. Callers must hold the lock.
+func (bc *Blockchain) verifyCommit(cert *CommitCertificate) error {
+	if cert.Height < 0 || cert.Height >= len(bc.Blocks) || bc.Blocks[cert.Height].Hash != cert.BlockHash {
+		return fmt.Errorf("certified block %d is not on the chain", cert.Height)
+	}
+	voters := bc.voters[cert.BlockHash]
+	if voters == nil {
+		return fmt.Errorf("no validator set recorded for block %d", cert.Height)
+	}
+	return checkCertificate(cert, voters)
+}
+
+// checkCertificate checks a certificate's precommits are for its block, from distinct validators of
+// voters, and carry more than two thirds of their power.
+func checkCertificate(cert *CommitCertificate, voters map[string]int) error {
+	power := 0
+	seen := make(map[string]bool)
+	for i := range cert.Precommits {
+		vote := &cert.Precommits[i]
+		if vote.Type != VotePrecommit || vote.Height != cert.Height || vote.BlockHash != cert.BlockHash {
+			return errors.New("certificate contains a vote for something else")
+		}
+		if seen[vote.Validator] || voters[vote.Validator] == 0 {
+			return fmt.Errorf("certificate counts %s twice or outside the validator set", shortValidator(vote.Validator))
+		}
+		if err := vote.verify(); err != nil {
+			return err
+		}
+		seen[vote.Validator] = true
+		power += voters[vote.Validator]
+	}
+	if !hasQuorum(power, voters) {
+		return fmt.Errorf("certificate for block %d lacks a two-thirds quorum", cert.Height)
+	}
+	return nil
+}
+
+// CurrentVoters returns the validator set in force at the tip, which votes on the next blocks
+// unless an epoch boundary changes it.
+func (bc *Blockchain) CurrentVoters() map[string]int {
+	bc.lock.RLock()
+	defer bc.lock.RUnlock()
+	voters := make(map[string]int, len(bc.Stake))
+	for validator, stake := range bc.Stake {
+		voters[validator] = stake
+	}
+	return voters
+}
+
+// finalize verifies a certificate and finalizes its block, attaching the certificate to it. It
+// returns false without error if the block is already final. Callers must hold the lock.
+func (bc *Blockchain) finalize(cert *CommitCertificate) (bool, error) {
+	if cert.Height <= bc.finalizedHeight {
+		return false, nil
+	}
+	if err := bc.verifyCommit(cert); err != nil {
+		return false, err
+	}
+	bc.Blocks[cert.Height].Commit = cert
+	bc.finalizedHeight = cert.Height
+	log.Printf("Block %d finalized with %d precommits", cert.Height, len(cert.Precommits))
+	return true, nil
+}
+
+// Finalize verifies a certificate and finalizes its block. It returns false without error if the
+// block is already final.
+func (bc *Blockchain) Finalize(cert *CommitCertificate) (bool, error) {
+	bc.lock.Lock()
+	defer bc.lock.Unlock()
+	return bc.finalize(cert)
+}
+
+// applyCommits finalizes blocks that arrived with a certificate. Certificates that don't verify are
+// dropped from the block, since they are not covered by its hash. Callers must hold the lock.
+func (bc *Blockchain) applyCommits(blocks []*Block) {
+	for _, block := range blocks {
+		if block.Commit == nil || block.Commit.BlockHash != block.Hash {
+			block.Commit = nil
+			continue
+		}
+		if _, err := bc.finalize(block.Commit); err != nil {
+			log.Printf("Ignoring commit certificate for block %d: %v", block.Index, err)
+			block.Commit = nil
+		}
+	}
+}
+
+// finalityState tracks the votes a node has seen and cast.
+type finalityState struct {
+	lock     sync.Mutex
+	votes    map[int]map[string]map[string]*Vote // Votes by height, then type and block hash, then validator.
+	cast     map[int]map[string]string           // Block hash this node voted for, by height and type.
+	pending  map[string][]*Vote                  // Verified votes for blocks not yet connected, by block hash.
+	npending int
+	held     map[string]int                // Votes in pending, by validator.
+	commits  map[string]*CommitCertificate // Certificates for blocks not yet connected, by block hash.
+
+	signed     map[string]int // Highest height this node voted at, by type.
+	signedPath string         // Where signed is saved, or empty to keep it in memory.
+	restored   map[string]int // signed as loaded at startup; the node never votes at or below it.
+}
+
+func newFinalityState() *finalityState {
+	return &finalityState{
+		votes:    make(map[int]map[string]map[string]*Vote),
+		cast:     make(map[int]map[string]string),
+		pending:  make(map[string][]*Vote),
+		held:     make(map[string]int),
+		commits:  make(map[string]*CommitCertificate),
+		signed:   make(map[string]int),
+		restored: make(map[string]int),
+	}
+}
+
+// LoadVoteFile makes the node remember the heights it voted at in path. Which blocks it voted for
+// is forgotten on restart, so it won't vote again at or below a height it voted at before. A
+// missing file means the node hasn't voted yet.
+func (n *Node) LoadVoteFile(path string) error {
+	f := n.finality
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.signedPath = path
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(data, &f.signed); err != nil {
+		return fmt.Errorf("failed to decode %s: %w", path, err)
+	}
+	for voteType, height := range f.signed {
+		f.restored[voteType] = height
+	}
+	return nil
+}
+
+// saveSigned writes the heights this node voted at to disk. Callers must hold the lock.
+func (f *finalityState) saveSigned() error {
+	if f.signedPath == "" {
+		return nil
+	}
+	data, err := json.Marshal(f.signed)
+	if err != nil {
+		return err
+	}
+	tmp := f.signedPath + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, f.signedPath)
+}
+
+// hold keeps a verified vote from a current validator for a block that hasn't arrived yet. Votes
+// travel faster than blocks, which are announced and then fetched, so most validators' votes
+// reach a node before the block does. Each validator only gets a few votes held, so one can't
+// crowd out the rest with votes for blocks that will never arrive.
+func (f *finalityState) hold(vote *Vote) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.npending >= MaxPendingVotes || f.held[vote.Validator] >= maxPendingVotesPerValidator {
+		return
+	}
+	f.pending[vote.BlockHash] = append(f.pending[vote.BlockHash], vote)
+	f.npending++
+	f.held[vote.Validator]++
+}
+
+// unhold forgets held votes. Callers must hold the lock.
+func (f *finalityState) unhold(votes []*Vote) {
+	f.npending -= len(votes)
+	for _, vote := range votes {
+		if f.held[vote.Validator]--; f.held[vote.Validator] <= 0 {
+			delete(f.held, vote.Validator)
+		}
+	}
+}
+
+// holdCommit keeps a certificate, already checked against the current validators, for a block
+// that hasn't arrived yet.
+func (f *finalityState) holdCommit(cert *CommitCertificate) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if len(f.commits) < MaxPendingVotes {
+		f.commits[cert.BlockHash] = cert
+	}
+}
+
+// release returns and forgets what was held for a block.
+func (f *finalityState) release(hash string) ([]*Vote, *CommitCertificate) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	votes, cert := f.pending[hash], f.commits[hash]
+	delete(f.pending, hash)
+	delete(f.commits, hash)
+	f.unhold(votes)
+	return votes, cert
+}
+
+// add records a vote and returns every vote of its type for its block so far.
+func (f *finalityState) add(vote *Vote) []*Vote {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	key := vote.Type + ":" + vote.BlockHash
+	if f.votes[vote.Height] == nil {
+		f.votes[vote.Height] = make(map[string]map[string]*Vote)
+	}
+	if f.votes[vote.Height][key] == nil {
+		f.votes[vote.Height][key] = make(map[string]*Vote)
+	}
+	f.votes[vote.Height][key][vote.Validator] = vote
+
+	tally := make([]*Vote, 0, len(f.votes[vote.Height][key]))
+	for _, v := range f.votes[vote.Height][key] {
+		tally = append(tally, v)
+	}
+	return tally
+}
+
+// claim records that this node votes voteType for hash at height, and reports false if it already
+// voted that type at that height, for this block or any other, or at or below the height it had
+// voted up to before it restarted. The height is saved before the vote is allowed.
+func (f *finalityState) claim(voteType string, height int, hash string) bool {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if height <= f.restored[voteType] {
+		return false
+	}
+	if _, voted := f.cast[height][voteType]; voted {
+		return false
+	}
+	if height > f.signed[voteType] {
+		previous := f.signed[voteType]
+		f.signed[voteType] = height
+		if err := f.saveSigned(); err != nil {
+			log.Printf("Not voting at height %d: %v", height, err)
+			f.signed[voteType] = previous
+			return false
+		}
+	}
+	if f.cast[height] == nil {
+		f.cast[height] = make(map[string]string)
+	}
+	f.cast[height][voteType] = hash
+	return true
+}
+
+// prune forgets votes at or below the finalized height.
+func (f *finalityState) prune(finalized int) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	for height := range f.votes {
+		if height <= finalized {
+			delete(f.votes, height)
+		}
+	}
+	for height := range f.cast {
+		if height <= finalized {
+			delete(f.cast, height)
+		}
+	}
+	for hash, votes := range f.pending {
+		if votes[0].Height <= finalized {
+			delete(f.pending, hash)
+			f.unhold(votes)
+		}
+	}
+	for hash, cert := range f.commits {
+		if cert.Height <= finalized {
+			delete(f.commits, hash)
+		}
+	}
+}
+
+// Prevote votes for a block the node has just connected as its tip, if the node's key belongs to
+// the block's validator set. Votes and certificates that arrived ahead of the block are counted first.
+func (n *Node) Prevote(block *Block) {
+	votes, cert := n.finality.release(block.Hash)
+	for _, vote := range votes {
+		n.processVote(vote)
+	}
+	if cert != nil {
+		n.acceptCommit(cert)
+	}
+	n.castVote(VotePrevote, block.Index, block.Hash)
+}
+
+// castVote signs and processes the node's own vote, unless it isn't a voter for the block or has
+// already voted this type at this height.
+func (n *Node) castVote(voteType string, height int, hash string) {
+	if n.PrivateKey == nil {
+		return
+	}
+	address, err := ValidatorAddress(&n.PrivateKey.PublicKey)
+	if err != nil || n.Blockchain.Voters(height, hash)[address] == 0 {
+		return
+	}
+	if !n.finality.claim(voteType, height, hash) {
+		return
+	}
+	vote, err := newVote(voteType, height, hash, n.PrivateKey)
+	if err != nil {
+		log.Printf("Failed to sign %s for block %d: %v", voteType, height, err)
+		return
+	}
+	n.recentlySeen.Add(vote.ID())
+	n.processVote(vote)
+}
+
+// handleVote checks a vote from a peer and counts it. The vote is only marked as seen once it
+// verifies, so an invalid copy can't keep the real one from being processed.
+func (n *Node) handleVote(payload []byte, from *Peer) {
+	var vote Vote
+	if err := json.Unmarshal(payload, &vote); err != nil {
+		n.Misbehaving(from, MisbehaviorMalformedMessage, "malformed vote")
+		return
+	}
+	if n.recentlySeen.Has(vote.ID()) {
+		from.knownInventory.Add(vote.ID())
+		return
+	}
+	if err := vote.verify(); err != nil {
+		n.Misbehaving(from, MisbehaviorInvalidVote, "invalid vote")
+		return
+	}
+	if !n.receiveInventory(vote.ID(), from) {
+		return
+	}
+	n.processVote(&vote)
+}
+
+// processVote counts a verified vote, passes it on, and acts on any quorum it completes: a prevote
+// quorum draws the node's precommit and a precommit quorum finalizes the block.
+func (n *Node) processVote(vote *Vote) {
+	if vote.Height <= n.Blockchain.FinalizedHeight() {
+		return
+	}
+	voters := n.Blockchain.Voters(vote.Height, vote.BlockHash)
+	if voters == nil {
+		// Most likely a block still on its way to us, voted on by the validators we know
+		if vote.Height <= n.Blockchain.Tip().Index+pendingVoteWindow && n.Blockchain.CurrentVoters()[vote.Validator] > 0 {
+			n.finality.hold(vote)
+		}
+		return
+	}
+	if voters[vote.Validator] == 0 {
+		return
+	}
+	if payload, err := json.Marshal(vote); err == nil {
+		n.gossip(MessageTypeVote, vote.ID(), payload)
+	}
+
+	tally := n.finality.add(vote)
+	power := 0
+	for _, v := range tally {
+		power += voters[v.Validator]
+	}
+	if !hasQuorum(power, voters) {
+		return
+	}
+
+	if vote.Type == VotePrevote {
+		n.castVote(VotePrecommit, vote.Height, vote.BlockHash)
+		return
+	}
+	cert := &CommitCertificate{Height: vote.Height, BlockHash: vote.BlockHash}
+	for _, v := range tally {
+		cert.Precommits = append(cert.Precommits, *v)
+	}
+	n.acceptCommit(cert)
+}
+
+// handleCommit finalizes a block with a certificate from a peer. The certificate is only marked as
+// seen once it has finalized its block, which acceptCommit does as it passes it on, so an invalid
+// certificate can't keep a valid one for the same block from being processed. A certificate for a
+// block that hasn't arrived is held if it carries a quorum of the current validators.
+func (n *Node) handleCommit(payload []byte, from *Peer) {
+	var cert CommitCertificate
+	if err := json.Unmarshal(payload, &cert); err != nil {
+		n.Misbehaving(from, MisbehaviorMalformedMessage, "malformed commit certificate")
+		return
+	}
+	id := "commit:" + cert.BlockHash
+	if n.recentlySeen.Has(id) {
+		from.knownInventory.Add(id)
+		return
+	}
+	if n.Blockchain.Voters(cert.Height, cert.BlockHash) == nil {
+		if cert.Height <= n.Blockchain.FinalizedHeight() || cert.Height > n.Blockchain.Tip().Index+pendingVoteWindow {
+			return
+		}
+		if checkCertificate(&cert, n.Blockchain.CurrentVoters()) == nil {
+			n.finality.holdCommit(&cert) // Otherwise forged, or the block starts an epoch with new validators
+		}
+		return
+	}
+	n.acceptCommit(&cert)
+}
+
+// acceptCommit finalizes the certified block and passes the certificate on.
+func (n *Node) acceptCommit(cert *CommitCertificate) {
+	finalized, err := n.Blockchain.Finalize(cert)
+	if err != nil {
+		log.Printf("Rejected commit certificate for block %d: %v", cert.Height, err)
+		return
+	}
+	if !finalized {
+		return
+	}
+	n.finality.prune(cert.Height)
+	if payload, err := json.Marshal(cert); err == nil {
+		n.gossip(MessageTypeCommit, "commit:"+cert.BlockHash, payload)
+	}
+}
+
+// gossip sends a message to every peer not yet known to have the object it carries.
+func (n *Node) gossip(msgType MessageType, id string, payload []byte) {
+	n.recentlySeen.Add(id)
+	n.lock.RLock()
+	peers := make([]*Peer, 0, len(n.sessions))
+	for _, peer := range n.sessions {
+		peers = append(peers, peer)
+	}
+	n.lock.RUnlock()
+
+	for _, peer := range peers {
+		if peer.knownInventory.Add(id) {
+			peer.Send(Message{Type: msgType, Payload: payload})
+		}
+	}
+}
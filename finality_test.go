@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+)
+
+func TestVoteIDCoversSignature(t *testing.T) {
+	key, _ := newKeyAddress(t)
+	vote, err := newVote(VotePrevote, 1, "block", key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	forged := *vote
+	forged.Signature = "00"
+	if forged.ID() == vote.ID() {
+		t.Fatal("a vote with a forged signature has the real vote's ID")
+	}
+}
+
+func TestHoldCapsVotesPerValidator(t *testing.T) {
+	f := newFinalityState()
+	for i := 0; i < 2*maxPendingVotesPerValidator; i++ {
+		f.hold(&Vote{Type: VotePrevote, Height: 1, BlockHash: fmt.Sprint("block", i), Validator: "flooder"})
+	}
+	f.hold(&Vote{Type: VotePrevote, Height: 1, BlockHash: "block0", Validator: "honest"})
+	if f.npending != maxPendingVotesPerValidator+1 {
+		t.Fatalf("held %d votes, want %d", f.npending, maxPendingVotesPerValidator+1)
+	}
+
+	// Released votes free the validator's allowance
+	if votes, _ := f.release("block0"); len(votes) != 2 {
+		t.Fatalf("released %d votes for block0, want 2", len(votes))
+	}
+	f.hold(&Vote{Type: VotePrevote, Height: 1, BlockHash: "next", Validator: "flooder"})
+	if len(f.pending["next"]) != 1 {
+		t.Fatal("a released vote still counts against its validator")
+	}
+	f.prune(1)
+	if f.npending != 0 || len(f.held) != 0 {
+		t.Fatalf("%d votes from %d validators still held after pruning", f.npending, len(f.held))
+	}
+}
+
+func TestClaimSurvivesRestart(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "votes.json")
+	n := newTestNode(t)
+	if err := n.LoadVoteFile(path); err != nil {
+		t.Fatal(err)
+	}
+	if !n.finality.claim(VotePrevote, 5, "a") {
+		t.Fatal("refused a first vote")
+	}
+	if n.finality.claim(VotePrevote, 5, "b") {
+		t.Fatal("voted twice at one height")
+	}
+
+	// After a restart the node no longer knows which block it voted for at height 5
+	restarted := newTestNode(t)
+	if err := restarted.LoadVoteFile(path); err != nil {
+		t.Fatal(err)
+	}
+	if restarted.finality.claim(VotePrevote, 5, "b") || restarted.finality.claim(VotePrevote, 4, "b") {
+		t.Fatal("voted again at or below the height voted at before the restart")
+	}
+	if !restarted.finality.claim(VotePrecommit, 5, "b") {
+		t.Fatal("refused a precommit at a height only prevoted at")
+	}
+	if !restarted.finality.claim(VotePrevote, 6, "c") {
+		t.Fatal("refused a vote above the restored height")
+	}
+}
+
+func TestBlockWithBodyReturnsACopy(t *testing.T) {
+	bc := NewBlockchainFromSpec(RegtestSpec)
+	block := generate(t, bc, "miner")
+	served := bc.blockWithBody(block.Hash)
+	if served == nil || served == block {
+		t.Fatal("getdata would serve the chain's own block, which finalizing writes to")
+	}
+	served.Commit = &CommitCertificate{Height: block.Index}
+	if bc.Tip().Commit != nil {
+		t.Fatal("changing a served block changed the chain")
+	}
+}
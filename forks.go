@@ -0,0 +1,298 @@
+// forks.go
+package main
+
+import (
+	"fmt"
+	"sort"
+)
+
+const (
+	SignalledFork        = -1                 // Fork.Height of a fork activated by version-bit signalling rather than at a fixed height.
+	SignalWindow         = 100                // Blocks per signalling period; fork states only change between periods.
+	SignalThreshold      = 75                 // Blocks in a period that must signal for a fork to lock in.
+	VersionBitsTop       = 0x20000000         // Top bits of a header version that signals with version bits.
+	VersionBitsTopMask   = 0xe0000000         // Mask selecting the top bits of a header version.
+	medianTimeBlocks     = 11                 // Blocks whose median timestamp a new block may not precede under ForkMedianTime.
+	ForkStrictDifficulty = "strictdifficulty" // Mined blocks must carry the difficulty the retarget rules give them.
+	ForkMedianTime       = "mediantime"       // Block timestamps may not precede the median of the last blocks.
+)
+
+// Consensus rule changes are named forks. A fork either activates at a fixed height, or is
+// deployed BIP9-style: from its start height block producers set its bit in the header version
+// once they run the new rules, and if SignalThreshold blocks of a SignalWindow period signal, the
+// fork locks in and activates one period later. A fork that has not locked in by its timeout
+// fails. Validation asks which forks are active at a block's height, so every node applies the new
+// rules from the same block.
+
+// Fork is a named consensus rule change and how it activates.
+type Fork struct {
+	Name          string
+	Height        int // Height the fork activates at, or SignalledFork to activate by signalling.
+	Bit           int // Header version bit signalling readiness, for signalled forks.
+	StartHeight   int // Height signalling starts counting from, for signalled forks.
+	TimeoutHeight int // Height by which a signalled fork must lock in or fail.
+}
+
+// DefaultForks is the fork schedule of the main chain.
+var DefaultForks = []Fork{
+	{Name: ForkStrictDifficulty, Height: 100 * AdjustmentInterval},
+	{Name: ForkMedianTime, Height: SignalledFork, Bit: 0, StartHeight: SignalWindow, TimeoutHeight: 100 * SignalWindow},
+}
+
+// ForkState is where a fork is in its deployment.
+type ForkState int
+
+const (
+	ForkDefined  ForkState = iota // Not yet signalled for.
+	ForkStarted                   // Signals are being counted.
+	ForkLockedIn                  // Enough blocks signalled; activates at the next period.
+	ForkActive                    // The fork's rules apply.
+	ForkFailed                    // Timed out without locking in.
+)
+
+// String returns the state's name.
+func (s ForkState) String() string {
+	return [...]string{"defined", "started", "locked_in", "active", "failed"}[s]
+}
+
+// signals reports whether a header version signals the given bit.
+func signals(version, bit int) bool {
+	return version&VersionBitsTopMask == VersionBitsTop && version&(1<<bit) != 0
+}
+
+// forkTracker follows the deployment of a chain's forks as its blocks are connected. After the
+// block at height h has been recorded, it describes the forks for the block at h+1.
+type forkTracker struct {
+	Forks   []Fork
+	States  map[string]ForkState // State of each signalled fork.
+	Since   map[string]int       // Height each signalled fork entered its state.
+	Signals map[string]int       // Blocks signalling each started fork so far this period.
+}
+
+// newForkTracker returns a tracker for a chain with no blocks recorded yet.
+func newForkTracker(forks []Fork) *forkTracker {
+	t := &forkTracker{
+		Forks:   forks,
+		States:  make(map[string]ForkState),
+		Since:   make(map[string]int),
+		Signals: make(map[string]int),
+	}
+	for _, fork := range forks {
+		if fork.Height == SignalledFork {
+			t.States[fork.Name] = ForkDefined
+		}
+	}
+	return t
+}
+
+// replayForks rebuilds the tracker for a chain's headers.
+func replayForks(forks []Fork, blocks []*Block) *forkTracker {
+	t := newForkTracker(forks)
+	for _, block := range blocks {
+		t.record(block)
+	}
+	return t
+}
+
+// Clone returns a copy, so the tracker before a block can be kept to undo it.
+func (t *forkTracker) Clone() *forkTracker {
+	clone := newForkTracker(t.Forks)
+	for name, state := range t.States {
+		clone.States[name] = state
+	}
+	for name, height := range t.Since {
+		clone.Since[name] = height
+	}
+	for name, count := range t.Signals {
+		clone.Signals[name] = count
+	}
+	return clone
+}
+
+// record counts a block's signals and, at the end of a period, moves signalled forks on.
+func (t *forkTracker) record(block *Block) {
+	for _, fork := range t.Forks {
+		if fork.Height == SignalledFork && t.States[fork.Name] == ForkStarted && signals(block.Version, fork.Bit) {
+			t.Signals[fork.Name]++
+		}
+	}
+	next := block.Index + 1
+	if next%SignalWindow != 0 {
+		return
+	}
+
+	for _, fork := range t.Forks {
+		if fork.Height != SignalledFork {
+			continue
+		}
+		state := t.States[fork.Name]
+		switch {
+		case state == ForkDefined && next >= fork.StartHeight:
+			state = ForkStarted
+		case state == ForkStarted && t.Signals[fork.Name] >= SignalThreshold:
+			state = ForkLockedIn
+		case state == ForkStarted && next >= fork.TimeoutHeight:
+			state = ForkFailed
+		case state == ForkLockedIn:
+			state = ForkActive
+		}
+		if state != t.States[fork.Name] {
+			t.States[fork.Name] = state
+			t.Since[fork.Name] = next
+		}
+		delete(t.Signals, fork.Name)
+	}
+}
+
+// fork returns the named fork, if the chain schedules it.
+func (t *forkTracker) fork(name string) (Fork, bool) {
+	for _, fork := range t.Forks {
+		if fork.Name == name {
+			return fork, true
+		}
+	}
+	return Fork{}, false
+}
+
+// state returns a fork's state for the block at height, which must be at most one past the last
+// block recorded.
+func (t *forkTracker) state(fork Fork, height int) ForkState {
+	if fork.Height != SignalledFork {
+		if height >= fork.Height {
+			return ForkActive
+		}
+		return ForkDefined
+	}
+	if t.States[fork.Name] == ForkActive && height < t.Since[fork.Name] {
+		return ForkLockedIn // Active is final, so earlier heights were still waiting to activate
+	}
+	return t.States[fork.Name]
+}
+
+// active reports whether the named fork's rules apply to the block at height.
+func (t *forkTracker) active(name string, height int) bool {
+	fork, ok := t.fork(name)
+	return ok && t.state(fork, height) == ForkActive
+}
+
+// blockVersion returns the header version for the block at height: the version-bits top bits with
+// the bit of every started or locked-in fork this node is ready for.
+func (t *forkTracker) blockVersion(height int, ready map[string]bool) int {
+	version := VersionBitsTop
+	for _, fork := range t.Forks {
+		state := t.state(fork, height)
+		if fork.Height == SignalledFork && ready[fork.Name] && (state == ForkStarted || state == ForkLockedIn) {
+			version |= 1 << fork.Bit
+		}
+	}
+	return version
+}
+
+// nextDifficulty returns the difficulty the chain's retarget rules give the block after the last of
+// blocks.
+func nextDifficulty(blocks []*Block, spec *ChainSpec) int {
+	if spec.NoRetargeting || len(blocks)%spec.AdjustmentInterval != 0 {
+		return blocks[len(blocks)-1].Difficulty // No adjustment needed
+	}
+
+	// Calculate time taken to mine the last AdjustmentInterval blocks
+	lastAdjustmentBlock := blocks[len(blocks)-spec.AdjustmentInterval]
+	expectedTime := spec.AdjustmentInterval * spec.TargetBlockTime
+	actualTime := int(blocks[len(blocks)-1].Timestamp - lastAdjustmentBlock.Timestamp)
+
+	// Adjust difficulty based on block mining times
+	if actualTime < expectedTime/2 {
+		return lastAdjustmentBlock.Difficulty + 1
+	} else if actualTime > expectedTime*2 && lastAdjustmentBlock.Difficulty > 1 {
+		return lastAdjustmentBlock.Difficulty - 1
+	}
+	return lastAdjustmentBlock.Difficulty // No significant change, return current difficulty
+}
+
+// medianTimePast returns the median timestamp of the last medianTimeBlocks of blocks.
+func medianTimePast(blocks []*Block) int64 {
+	start := len(blocks) - medianTimeBlocks
+	if start < 0 {
+		start = 0
+	}
+	timestamps := make([]int64, 0, medianTimeBlocks)
+	for _, block := range blocks[start:] {
+		timestamps = append(timestamps, block.Timestamp)
+	}
+	sort.Slice(timestamps, func(i, j int) bool { return timestamps[i] < timestamps[j] })
+	return timestamps[len(timestamps)/2]
+}
+
+// checkForkRules checks a block extending chain, whose last block is its parent, against the rules
+// of the forks active at its height.
+func checkForkRules(chain []*Block, block *Block, forks *forkTracker, spec *ChainSpec) error {
+	if forks.active(ForkStrictDifficulty, block.Index) && block.Proposer == "" {
+		if expected := nextDifficulty(chain, spec); block.Difficulty != expected {
+			return fmt.Errorf("block %d has difficulty %d, expected %d", block.Index, block.Difficulty, expected)
+		}
+	}
+	if forks.active(ForkMedianTime, block.Index) {
+		if median := medianTimePast(chain); block.Timestamp < median {
+			return fmt.Errorf("block %d timestamp %d precedes the median time %d of the last blocks", block.Index, block.Timestamp, median)
+		}
+	}
+	return nil
+}
+
+// recordForks counts a connected block's signals, keeping the tracker before it in the block's undo
+// data. Callers must hold the lock.
+func (bc *Blockchain) recordForks(block *Block, undo *UTXOUndo) {
+	undo.Forks = bc.forks.Clone()
+	bc.forks.record(block)
+}
+
+// UpgradeProtocol has this node signal readiness for a fork in the blocks it produces, as running
+// software that implements it would. The fork's rules apply once enough of the network signals.
+func (bc *Blockchain) UpgradeProtocol(name string) error {
+	bc.lock.Lock()
+	defer bc.lock.Unlock()
+	fork, ok := bc.forks.fork(name)
+	if !ok {
+		return fmt.Errorf("unknown fork %q", name)
+	}
+	if fork.Height != SignalledFork {
+		return fmt.Errorf("fork %s activates at height %d and needs no signalling", name, fork.Height)
+	}
+	switch bc.forks.state(fork, len(bc.Blocks)) {
+	case ForkActive:
+		return fmt.Errorf("fork %s is already active", name)
+	case ForkFailed:
+		return fmt.Errorf("fork %s failed to activate", name)
+	}
+	bc.readyForks[name] = true
+	fmt.Printf("Signalling readiness for fork %s\n", name)
+	return nil
+}
+
+// ForkStatus describes a fork's deployment for the API.
+type ForkStatus struct {
+	Fork
+	State      string
+	Since      int  // Height the fork entered its state, for signalled forks.
+	Signals    int  // Blocks signalling so far this period, while signalling is counted.
+	Signalling bool // Whether this node signals readiness for the fork.
+}
+
+// ForkStatuses returns the state of every scheduled fork at the next block's height.
+func (bc *Blockchain) ForkStatuses() []ForkStatus {
+	bc.lock.RLock()
+	defer bc.lock.RUnlock()
+	height := len(bc.Blocks)
+	statuses := make([]ForkStatus, 0, len(bc.forks.Forks))
+	for _, fork := range bc.forks.Forks {
+		status := ForkStatus{Fork: fork, State: bc.forks.state(fork, height).String(), Signalling: bc.readyForks[fork.Name]}
+		if fork.Height == SignalledFork {
+			status.Since = bc.forks.Since[fork.Name]
+			status.Signals = bc.forks.Signals[fork.Name]
+		} else if height >= fork.Height {
+			status.Since = fork.Height
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// signalledFork is a fork deployed by signalling bit 0 from the first period, timing out after the third.
+var signalledFork = Fork{Name: ForkMedianTime, Height: SignalledFork, Bit: 0, StartHeight: SignalWindow, TimeoutHeight: 3 * SignalWindow}
+
+// recordPeriod records one SignalWindow of blocks from height, signalling bit in the first count.
+func recordPeriod(tracker *forkTracker, height, count, bit int) {
+	for i := 0; i < SignalWindow; i++ {
+		version := VersionBitsTop
+		if i < count {
+			version |= 1 << bit
+		}
+		tracker.record(&Block{Index: height + i, Version: version})
+	}
+}
+
+// remine re-runs the proof of work of a block whose difficulty was changed.
+func remine(t *testing.T, block *Block) {
+	t.Helper()
+	if err := (PoWEngine{}).Seal(block, nil); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestForkActivatesAtItsHeight(t *testing.T) {
+	tracker := newForkTracker([]Fork{{Name: ForkStrictDifficulty, Height: 5}})
+	if tracker.active(ForkStrictDifficulty, 4) {
+		t.Fatal("fork active before its height")
+	}
+	if !tracker.active(ForkStrictDifficulty, 5) {
+		t.Fatal("fork not active at its height")
+	}
+	if tracker.active(ForkMedianTime, 5) {
+		t.Fatal("an unscheduled fork is active")
+	}
+}
+
+func TestSignalledForkLocksInAndActivates(t *testing.T) {
+	tracker := newForkTracker([]Fork{signalledFork})
+	want := []ForkState{ForkStarted, ForkLockedIn, ForkActive}
+	for period, state := range want {
+		recordPeriod(tracker, period*SignalWindow, SignalThreshold, signalledFork.Bit)
+		next := (period + 1) * SignalWindow
+		if got := tracker.state(signalledFork, next); got != state {
+			t.Fatalf("after period %d the fork is %s, want %s", period, got, state)
+		}
+	}
+	if tracker.active(ForkMedianTime, 3*SignalWindow-1) {
+		t.Fatal("fork active in the period it was locked in")
+	}
+	if !tracker.active(ForkMedianTime, 3*SignalWindow) {
+		t.Fatal("fork not active the period after locking in")
+	}
+}
+
+func TestSignalledForkFailsBelowThreshold(t *testing.T) {
+	tracker := newForkTracker([]Fork{signalledFork})
+	for period := 0; period < 3; period++ {
+		recordPeriod(tracker, period*SignalWindow, SignalThreshold-1, signalledFork.Bit)
+	}
+	if got := tracker.state(signalledFork, 3*SignalWindow); got != ForkFailed {
+		t.Fatalf("fork is %s after timing out below the threshold, want failed", got)
+	}
+	if version := tracker.blockVersion(3*SignalWindow, map[string]bool{ForkMedianTime: true}); signals(version, signalledFork.Bit) {
+		t.Fatal("still signalling a failed fork")
+	}
+}
+
+func TestBlockVersionSignalsOnlyReadyForks(t *testing.T) {
+	tracker := newForkTracker([]Fork{signalledFork})
+	recordPeriod(tracker, 0, 0, signalledFork.Bit)
+
+	if version := tracker.blockVersion(SignalWindow, nil); signals(version, signalledFork.Bit) {
+		t.Fatal("signalling a fork this node is not ready for")
+	}
+	if version := tracker.blockVersion(SignalWindow, map[string]bool{ForkMedianTime: true}); !signals(version, signalledFork.Bit) {
+		t.Fatalf("version %#x does not signal a started fork this node is ready for", version)
+	}
+	if signals(1<<signalledFork.Bit, signalledFork.Bit) {
+		t.Fatal("a version without the top bits counted as a signal")
+	}
+}
+
+func TestUpgradeProtocolRejectsHeightForks(t *testing.T) {
+	bc := NewBlockchainFromSpec(RegtestSpec)
+	if err := bc.UpgradeProtocol(ForkStrictDifficulty); err == nil {
+		t.Fatal("signalling accepted for a fork that activates at a height")
+	}
+	if err := bc.UpgradeProtocol("nosuchfork"); err == nil {
+		t.Fatal("signalling accepted for an unknown fork")
+	}
+}
+
+func TestAcceptBlockEnforcesStrictDifficulty(t *testing.T) {
+	spec := *RegtestSpec
+	spec.Forks = []Fork{{Name: ForkStrictDifficulty, Height: 2}}
+	producer, receiver := NewBlockchainFromSpec(&spec), NewBlockchainFromSpec(&spec)
+
+	early := generate(t, producer, "miner")
+	early.Difficulty++
+	remine(t, early)
+	if err := receiver.AcceptBlock(early); err != nil {
+		t.Fatalf("rejected a block before the fork activated: %v", err)
+	}
+
+	producer = NewBlockchainFromSpec(&spec)
+	if err := producer.AcceptBlock(early); err != nil {
+		t.Fatal(err)
+	}
+	late := generate(t, producer, "miner")
+	late.Difficulty++
+	remine(t, late)
+	err := receiver.AcceptBlock(late)
+	if err == nil || !strings.Contains(err.Error(), "expected") {
+		t.Fatalf("accepted a block with the wrong difficulty after the fork: %v", err)
+	}
+}
+
+func TestAcceptBlockEnforcesMedianTime(t *testing.T) {
+	producer, receiver := NewBlockchainFromSpec(RegtestSpec), NewBlockchainFromSpec(RegtestSpec)
+	for i := 0; i < 3; i++ {
+		if err := receiver.AcceptBlock(generate(t, producer, "miner")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	block := generate(t, producer, "miner")
+	block.Timestamp = RegtestSpec.GenesisTimestamp - 1
+	reseal(block)
+	err := receiver.AcceptBlock(block)
+	if err == nil || !strings.Contains(err.Error(), "median time") {
+		t.Fatalf("accepted a block older than the median time past: %v", err)
+	}
+}
@@ -37,6 +37,7 @@ type Gamification struct {
 	Levels      []int // Thresholds for leveling up
 	Cooldowns   map[string]time.Duration
 	db          *InMemoryDatabase
+	Clock       Clock // Time source for activity times and cooldowns
 }
 
 // Leaderboard maintains the ranking of users based on their points.
@@ -61,7 +62,8 @@ func NewGamification(db *InMemoryDatabase) *Gamification {
 			"voting":    5 * time.Minute,
 			"liquidity": 30 * time.Minute,
 		},
-		db: db,
+		db:    db,
+		Clock: SystemClock,
 	}
 }
 
@@ -81,8 +83,8 @@ func (g *Gamification) RewardUser(address string, points int, activity string) e
 	}
 
 	user.Points += points
-	user.LastActive = time.Now()
-	user.RewardLog[activity] = time.Now()
+	user.LastActive = g.Clock.Now()
+	user.RewardLog[activity] = g.Clock.Now()
 
 	g.db.Set(user.Address, user) // Save user to the database
 
@@ -111,7 +113,7 @@ func (g *Gamification) loadOrCreateUser(address string) (*User, error) {
 		Points:     0,
 		Level:      1,
 		Badges:     make(map[string]Badge),
-		LastActive: time.Now(),
+		LastActive: g.Clock.Now(),
 		RewardLog:  make(map[string]time.Time),
 	}
 	g.Users[address] = user
@@ -164,7 +166,7 @@ func (g *Gamification) RewardTransactionFees(address string, feesContributed int
 // DetectSuspiciousPatterns detects suspicious activity based on the frequency of user actions.
 // This is a simple anti-cheating mechanism to prevent users from abusing the reward system.
 func (g *Gamification) DetectSuspiciousPatterns(user *User) error {
-	activityFrequency := time.Since(user.LastActive)
+	activityFrequency := g.Clock.Now().Sub(user.LastActive)
 	if activityFrequency < 1*time.Minute {
 		return errors.New("suspicious activity detected: too frequent actions")
 	}
@@ -175,7 +177,7 @@ func (g *Gamification) DetectSuspiciousPatterns(user *User) error {
 // This prevents abuse of the reward system by enforcing a cooldown period between actions.
 func (g *Gamification) EnforceCooldown(user *User, activity string) error {
 	if cooldown, ok := g.Cooldowns[activity]; ok {
-		if time.Since(user.RewardLog[activity]) < cooldown {
+		if g.Clock.Now().Sub(user.RewardLog[activity]) < cooldown {
 			return fmt.Errorf("cooldown period for %s not met", activity)
 		}
 	}
@@ -0,0 +1,293 @@
+// gossip.go
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+const (
+	MaxInvPerMessage      = 1000             // Most inventory vectors in a single inv, getdata or notfound.
+	MaxPeerKnownInventory = 5000             // Inventory remembered per peer to avoid echoing it back.
+	RecentlySeenCacheSize = 20000            // Objects remembered node-wide so they are processed once.
+	GetDataTimeout        = 30 * time.Second // How long a requested object is waited for before asking another peer.
+	TrickleInterval       = 5 * time.Second  // Average delay before queued transaction announcements are sent.
+)
+
+// InvType identifies the kind of object an inventory vector refers to.
+type InvType int
+
+const (
+	InvTypeTransaction InvType = iota
+	InvTypeBlock
+)
+
+// InvVector names an object by type and hash without carrying its contents.
+type InvVector struct {
+	Type InvType
+	Hash string
+}
+
+// inventorySet is a bounded set of hashes. Once full, the oldest entry is forgotten to make room.
+type inventorySet struct {
+	entries map[string]struct{}
+	order   []string // Insertion order, used as a ring once the set is full.
+	next    int      // Position in order to overwrite next.
+	limit   int
+	lock    sync.Mutex
+}
+
+// newInventorySet creates a set holding at most limit hashes.
+func newInventorySet(limit int) *inventorySet {
+	return &inventorySet{entries: make(map[string]struct{}), limit: limit}
+}
+
+// Add inserts a hash and reports whether it was new.
+func (s *inventorySet) Add(hash string) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if _, exists := s.entries[hash]; exists {
+		return false
+	}
+	if len(s.order) < s.limit {
+		s.order = append(s.order, hash)
+	} else {
+		delete(s.entries, s.order[s.next])
+		s.order[s.next] = hash
+		s.next = (s.next + 1) % s.limit
+	}
+	s.entries[hash] = struct{}{}
+	return true
+}
+
+// Has reports whether the set contains a hash.
+func (s *inventorySet) Has(hash string) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	_, exists := s.entries[hash]
+	return exists
+}
+
+// trickleDelay picks the wait before the next batch of transaction announcements. Randomising it
+// makes it harder to tell which peer a transaction came from by timing when it is announced.
+func trickleDelay() time.Duration {
+	return time.Duration(rand.Int63n(int64(2 * TrickleInterval)))
+}
+
+// RelayBlock announces a block to every peer that doesn't already know about it. Blocks are
+// announced straight away.
+func (n *Node) RelayBlock(block *Block) {
+	n.recentlySeen.Add(block.Hash)
+	n.announce(InvVector{Type: InvTypeBlock, Hash: block.Hash})
+}
+
+// RelayTransaction announces a transaction to every peer that doesn't already know about it. The
+// announcement waits for each peer's next trickle.
+func (n *Node) RelayTransaction(tx *Transaction) {
+	hash := tx.Hash()
+	n.recentlySeen.Add(hash)
+	n.announce(InvVector{Type: InvTypeTransaction, Hash: hash})
+}
+
+// announce queues an inventory vector for every session whose peer doesn't already have it.
+func (n *Node) announce(inv InvVector) {
+	n.lock.RLock()
+	peers := make([]*Peer, 0, len(n.sessions))
+	for _, peer := range n.sessions {
+		peers = append(peers, peer)
+	}
+	n.lock.RUnlock()
+
+	for _, peer := range peers {
+		if !peer.knownInventory.Add(inv.Hash) {
+			continue
+		}
+		if inv.Type == InvTypeBlock {
+			peer.sendInventory(MessageTypeInv, []InvVector{inv})
+		} else {
+			peer.queueTrickle(inv)
+		}
+	}
+}
+
+// handleInv requests the announced objects we have neither seen nor already asked someone for.
+func (n *Node) handleInv(payload []byte, from *Peer) {
+	var inventory []InvVector
+	if err := json.Unmarshal(payload, &inventory); err != nil || len(inventory) > MaxInvPerMessage {
+		n.Misbehaving(from, MisbehaviorMalformedMessage, "malformed inv")
+		return
+	}
+
+	var wanted []InvVector
+	for _, inv := range inventory {
+		from.knownInventory.Add(inv.Hash)
+		if n.recentlySeen.Has(inv.Hash) || n.haveInventory(inv) || !n.markRequested(inv.Hash) {
+			continue
+		}
+		wanted = append(wanted, inv)
+	}
+	if len(wanted) > 0 {
+		from.limiter.Expect(wanted)
+		from.sendInventory(MessageTypeGetData, wanted)
+	}
+}
+
+// handleGetData sends the requested objects back to the peer, and a notfound for any we don't have.
+func (n *Node) handleGetData(payload []byte, from *Peer) {
+	var inventory []InvVector
+	if err := json.Unmarshal(payload, &inventory); err != nil || len(inventory) > MaxInvPerMessage {
+		n.Misbehaving(from, MisbehaviorMalformedMessage, "malformed getdata")
+		return
+	}
+
+	var missing []InvVector
+	for _, inv := range inventory {
+		var object interface{}
+		msgType := MessageTypeTransaction
+		switch inv.Type {
+		case InvTypeBlock:
+			if block := n.Blockchain.blockWithBody(inv.Hash); block != nil {
+				object = block
+			}
+			msgType = MessageTypeNewBlock
+		case InvTypeTransaction:
+			if tx := n.Blockchain.Mempool.GetTransaction(inv.Hash); tx != nil {
+				object = tx
+			}
+		}
+		if object == nil {
+			missing = append(missing, inv)
+			continue
+		}
+
+		data, err := json.Marshal(object)
+		if err != nil {
+			log.Printf("Failed to marshal %s for %s: %v", inv.Hash, from.Address, err)
+			continue
+		}
+		from.knownInventory.Add(inv.Hash)
+		from.Send(Message{Type: msgType, Payload: data})
+	}
+	if len(missing) > 0 {
+		from.sendInventory(MessageTypeNotFound, missing)
+	}
+}
+
+// handleNotFound forgets our outstanding requests for objects the peer turned out not to have,
+// so the next peer to announce them is asked instead.
+func (n *Node) handleNotFound(payload []byte, from *Peer) {
+	var inventory []InvVector
+	if err := json.Unmarshal(payload, &inventory); err != nil {
+		n.Misbehaving(from, MisbehaviorMalformedMessage, "malformed notfound")
+		return
+	}
+	from.limiter.Forget(inventory)
+	for _, inv := range inventory {
+		n.clearRequested(inv.Hash)
+	}
+}
+
+// haveInventory reports whether the object is already in our chain or mempool.
+func (n *Node) haveInventory(inv InvVector) bool {
+	if inv.Type == InvTypeBlock {
+		return n.Blockchain.hasBlock(inv.Hash)
+	}
+	return n.Blockchain.Mempool.GetTransaction(inv.Hash) != nil
+}
+
+// markRequested records an outstanding getdata. It returns false if the object has already been
+// requested from some peer and that request hasn't timed out.
+func (n *Node) markRequested(hash string) bool {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	if requestedAt, exists := n.inFlight[hash]; exists && time.Since(requestedAt) < GetDataTimeout {
+		return false
+	}
+	n.inFlight[hash] = time.Now()
+	return true
+}
+
+// clearRequested forgets an outstanding getdata.
+func (n *Node) clearRequested(hash string) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	delete(n.inFlight, hash)
+}
+
+// receiveInventory records that an object has arrived and reports whether it still needs
+// processing. Each object is processed once no matter how many peers send it.
+func (n *Node) receiveInventory(hash string, from *Peer) bool {
+	if from != nil {
+		from.knownInventory.Add(hash)
+	}
+	n.clearRequested(hash)
+	return n.recentlySeen.Add(hash)
+}
+
+// sendInventory sends inventory vectors to the peer, split across as many messages as needed.
+func (p *Peer) sendInventory(msgType MessageType, inventory []InvVector) {
+	for len(inventory) > 0 {
+		batch := inventory
+		if len(batch) > MaxInvPerMessage {
+			batch = batch[:MaxInvPerMessage]
+		}
+		inventory = inventory[len(batch):]
+
+		data, err := json.Marshal(batch)
+		if err != nil {
+			log.Printf("Failed to marshal inventory for %s: %v", p.Address, err)
+			return
+		}
+		p.Send(Message{Type: msgType, Payload: data})
+	}
+}
+
+// queueTrickle holds a transaction announcement until the peer's next trickle.
+func (p *Peer) queueTrickle(inv InvVector) {
+	p.trickleLock.Lock()
+	defer p.trickleLock.Unlock()
+	p.trickleQueue = append(p.trickleQueue, inv)
+}
+
+// flushTrickle sends the queued transaction announcements as one inv.
+func (p *Peer) flushTrickle() {
+	p.trickleLock.Lock()
+	inventory := p.trickleQueue
+	p.trickleQueue = nil
+	p.trickleLock.Unlock()
+
+	if len(inventory) > 0 {
+		p.sendInventory(MessageTypeInv, inventory)
+	}
+}
+
+// hasBlock reports whether a block with the given hash is in the chain.
+func (bc *Blockchain) hasBlock(hash string) bool {
+	bc.lock.RLock()
+	defer bc.lock.RUnlock()
+	for i := len(bc.Blocks) - 1; i >= 0; i-- {
+		if bc.Blocks[i].Hash == hash {
+			return true
+		}
+	}
+	return false
+}
+
+// blockWithBody returns a copy of the block with the given hash, or nil if it isn't in the chain
+// or its body has been pruned. It is a copy because finalizing a block sets its commit under the
+// lock, and the caller reads it without.
+func (bc *Blockchain) blockWithBody(hash string) *Block {
+	bc.lock.RLock()
+	defer bc.lock.RUnlock()
+	for i := len(bc.Blocks) - 1; i >= bc.prunedBelow && i >= 0; i-- {
+		if bc.Blocks[i].Hash == hash {
+			block := *bc.Blocks[i]
+			return &block
+		}
+	}
+	return nil
+}
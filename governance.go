@@ -59,8 +59,8 @@ func (g *Governance) CreateProposal(description, category string, options []stri
 	defer g.lock.Unlock()
 
 	// Generate a unique proposal ID using a hash of the description and current time.
-	proposalID := fmt.Sprintf("%x", sha256.Sum256([]byte(description+time.Now().String())))
-	deadline := time.Now().Add(duration) // Set the deadline for voting.
+	proposalID := fmt.Sprintf("%x", sha256.Sum256([]byte(description+g.Blockchain.Clock.Now().String())))
+	deadline := g.Blockchain.Clock.Now().Add(duration) // Set the deadline for voting.
 
 	// Initialize the proposal with the provided details.
 	proposal := &Proposal{
@@ -91,7 +91,7 @@ func (g *Governance) Vote(proposalID, voterAddress string, optionIndex int, priv
 		return errors.New("proposal not found")
 	}
 
-	if time.Now().After(proposal.Deadline) {
+	if g.Blockchain.Clock.Now().After(proposal.Deadline) {
 		return errors.New("voting period has ended")
 	}
 
@@ -125,7 +125,7 @@ func (g *Governance) TallyVotes(proposalID string) (string, error) {
 		return "", errors.New("proposal not found")
 	}
 
-	if time.Now().Before(proposal.Deadline) {
+	if g.Blockchain.Clock.Now().Before(proposal.Deadline) {
 		return "", errors.New("voting period has not ended")
 	}
 
@@ -207,12 +207,20 @@ func (g *Governance) executeNetworkUpgrade(proposal *Proposal) {
 	// Perform the network upgrade based on the winning option.
 	switch upgradeAction {
 	case "Upgrade to v2.0":
-		g.Blockchain.UpgradeProtocol("v2.0")
-		g.logEvent("Blockchain upgraded to protocol version 2.0")
+		// Upgrading only signals readiness; the new rules apply once enough of the network signals
+		if err := g.Blockchain.UpgradeProtocol(ForkMedianTime); err != nil {
+			g.logEvent(fmt.Sprintf("Network upgrade failed: %v", err))
+			return
+		}
+		g.logEvent("Signalling readiness for protocol version 2.0")
 
 	case "Enable new consensus algorithm":
-		g.Blockchain.SetConsensusAlgorithm("PoS")
-		g.logEvent("Consensus algorithm switched to Proof of Stake (PoS)")
+		// The switch is announced on chain and activates at a later height on every node together
+		if err := g.Blockchain.SetConsensusAlgorithm("PoS"); err != nil {
+			g.logEvent(fmt.Sprintf("Network upgrade failed: %v", err))
+			return
+		}
+		g.logEvent("Switch to Proof of Stake (PoS) scheduled")
 
 	case "Increase block size":
 		g.Blockchain.SetMaxBlockSize(2_000_000) // Example increase to 2 MB
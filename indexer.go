@@ -0,0 +1,188 @@
+// indexer.go
+package main
+
+import (
+	"sync"
+)
+
+// TxLocation records where a confirmed transaction sits in the chain.
+type TxLocation struct {
+	BlockHeight int
+	BlockHash   string
+	Position    int // Index of the transaction within the block.
+}
+
+// AddressTxEntry records one confirmed transaction touching an address.
+type AddressTxEntry struct {
+	TxHash      string
+	BlockHeight int
+	Position    int
+	Amount      int // Net change to the address's balance; negative when it paid out.
+}
+
+// TxIndexer maps transaction hashes to their location and addresses to their history. It is built
+// as blocks are connected and rewound as they are disconnected, so it always follows the active chain.
+type TxIndexer struct {
+	txs       map[string]TxLocation
+	addresses map[string][]AddressTxEntry // Entries in chain order, oldest first.
+	lock      sync.RWMutex
+}
+
+// NewTxIndexer creates an empty index.
+func NewTxIndexer() *TxIndexer {
+	return &TxIndexer{
+		txs:       make(map[string]TxLocation),
+		addresses: make(map[string][]AddressTxEntry),
+	}
+}
+
+// ConnectBlock indexes every transaction in a block that has just been connected.
+func (ix *TxIndexer) ConnectBlock(block *Block) {
+	ix.lock.Lock()
+	defer ix.lock.Unlock()
+
+	minerAddress := blockRewardAddress(block)
+	for position, tx := range block.Transactions {
+		txHash := tx.Hash()
+		ix.txs[txHash] = TxLocation{BlockHeight: block.Index, BlockHash: block.Hash, Position: position}
+		for _, change := range addressChanges(tx, minerAddress) {
+			ix.addresses[change.address] = append(ix.addresses[change.address], AddressTxEntry{
+				TxHash:      txHash,
+				BlockHeight: block.Index,
+				Position:    position,
+				Amount:      change.amount,
+			})
+		}
+	}
+}
+
+// DisconnectBlock removes a block's transactions from the index. Blocks must be disconnected from
+// the tip down, which keeps each address's entries in chain order.
+func (ix *TxIndexer) DisconnectBlock(block *Block) {
+	ix.lock.Lock()
+	defer ix.lock.Unlock()
+
+	minerAddress := blockRewardAddress(block)
+	for _, tx := range block.Transactions {
+		delete(ix.txs, tx.Hash())
+		for _, change := range addressChanges(tx, minerAddress) {
+			entries := ix.addresses[change.address]
+			for len(entries) > 0 && entries[len(entries)-1].BlockHeight >= block.Index {
+				entries = entries[:len(entries)-1]
+			}
+			if len(entries) == 0 {
+				delete(ix.addresses, change.address)
+			} else {
+				ix.addresses[change.address] = entries
+			}
+		}
+	}
+}
+
+// GetTransaction looks up where a confirmed transaction is.
+func (ix *TxIndexer) GetTransaction(txHash string) (TxLocation, bool) {
+	ix.lock.RLock()
+	defer ix.lock.RUnlock()
+	location, exists := ix.txs[txHash]
+	return location, exists
+}
+
+// AddressHistory returns one page of an address's transactions, newest first, along with the
+// total number of entries. Pages start at 1.
+func (ix *TxIndexer) AddressHistory(address string, page, limit int) ([]AddressTxEntry, int) {
+	ix.lock.RLock()
+	defer ix.lock.RUnlock()
+
+	entries := ix.addresses[address]
+	total := len(entries)
+	start := (page - 1) * limit
+	if page < 1 || limit < 1 || start >= total {
+		return []AddressTxEntry{}, total
+	}
+	end := start + limit
+	if end > total {
+		end = total
+	}
+
+	result := make([]AddressTxEntry, 0, end-start)
+	for i := start; i < end; i++ {
+		result = append(result, entries[total-1-i])
+	}
+	return result, total
+}
+
+// addressChange is the net effect of a transaction on one address.
+type addressChange struct {
+	address string
+	amount  int
+}
+
+// addressChanges works out how a transaction changes each address's balance, in a fixed order:
+// sender, recipient, then the miner collecting the fee. Change outputs net out against the sender.
+func addressChanges(tx *Transaction, minerAddress string) []addressChange {
+	var changes []addressChange
+	add := func(address string, amount int) {
+		for i := range changes {
+			if changes[i].address == address {
+				changes[i].amount += amount
+				return
+			}
+		}
+		changes = append(changes, addressChange{address: address, amount: amount})
+	}
+
+	if tx.Sender != "system" {
+		add(tx.Sender, -(tx.Amount + tx.Fee))
+	}
+	add(tx.Recipient, tx.Amount)
+	if tx.Sender != "system" && tx.Fee > 0 && minerAddress != "" {
+		add(minerAddress, tx.Fee)
+	}
+	return changes
+}
+
+// blockRewardAddress returns the recipient of a block's reward transaction, which also collects its fees.
+func blockRewardAddress(block *Block) string {
+	if len(block.Transactions) > 0 && block.Transactions[0].Sender == "system" {
+		return block.Transactions[0].Recipient
+	}
+	return ""
+}
+
+// EnableTxIndex turns on the transaction indexer and builds it from the stored blocks. Blocks
+// whose bodies are not stored (pruned or restored from a snapshot) are skipped.
+func (bc *Blockchain) EnableTxIndex() {
+	bc.lock.Lock()
+	defer bc.lock.Unlock()
+	bc.rebuildTxIndex()
+}
+
+// rebuildTxIndex replaces the index with one built from the stored blocks. Callers must hold the lock.
+func (bc *Blockchain) rebuildTxIndex() {
+	bc.Indexer = NewTxIndexer()
+	for _, block := range bc.Blocks {
+		bc.Indexer.ConnectBlock(block)
+	}
+}
+
+// FindTransaction looks up a confirmed transaction through the index. The transaction itself is
+// nil if its block body has been pruned; found is false if the index is disabled or has no entry.
+func (bc *Blockchain) FindTransaction(txHash string) (tx *Transaction, location TxLocation, found bool) {
+	bc.lock.RLock()
+	defer bc.lock.RUnlock()
+
+	if bc.Indexer == nil {
+		return nil, TxLocation{}, false
+	}
+	location, found = bc.Indexer.GetTransaction(txHash)
+	if !found {
+		return nil, TxLocation{}, false
+	}
+	if location.BlockHeight < len(bc.Blocks) {
+		block := bc.Blocks[location.BlockHeight]
+		if block.Hash == location.BlockHash && location.Position < len(block.Transactions) {
+			tx = block.Transactions[location.Position]
+		}
+	}
+	return tx, location, true
+}
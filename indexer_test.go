@@ -0,0 +1,66 @@
+package main
+
+import "testing"
+
+func TestIndexerFollowsTheActiveChain(t *testing.T) {
+	bc := NewBlockchainFromSpec(RegtestSpec)
+	bc.EnableTxIndex()
+	tx := fundedTransfer(t, bc, NewBlockchainFromSpec(RegtestSpec))
+	block := generate(t, bc, "miner")
+
+	found, location, ok := bc.FindTransaction(tx.Hash())
+	if !ok || found == nil || found.Hash() != tx.Hash() || location.BlockHash != block.Hash || location.Position != 1 {
+		t.Fatalf("transaction indexed at %+v, want position 1 of block %d", location, block.Index)
+	}
+	history, total := bc.Indexer.AddressHistory(tx.Sender, 1, 1)
+	if total != 2 || len(history) != 1 || history[0].TxHash != tx.Hash() || history[0].Amount != -(tx.Amount+tx.Fee) {
+		t.Fatalf("sender's newest entry is %+v of %d, want the transfer of 2", history, total)
+	}
+	if history, _ := bc.Indexer.AddressHistory(tx.Sender, 2, 1); len(history) != 1 || history[0].Amount != BlockReward {
+		t.Fatalf("sender's second page is %+v, want its funding reward", history)
+	}
+	if miner, _ := bc.Indexer.AddressHistory("miner", 1, 10); len(miner) != 2 || miner[0].Amount != tx.Fee {
+		t.Fatalf("miner's history is %+v, want the fee and then the reward", miner)
+	}
+
+	// A longer branch without the transfer rewinds the index
+	branch := NewBlockchainFromSpec(RegtestSpec)
+	if err := branch.AcceptBlock(bc.Blocks[1]); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := branch.GenerateBlocks(2, "bob", nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := bc.Reorganize(branch.Blocks); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, ok := bc.FindTransaction(tx.Hash()); ok {
+		t.Fatal("transaction of a disconnected block is still indexed")
+	}
+	if _, total := bc.Indexer.AddressHistory(tx.Sender, 1, 10); total != 1 {
+		t.Fatalf("sender has %d entries after the reorg, want only its funding reward", total)
+	}
+	if _, total := bc.Indexer.AddressHistory("miner", 1, 10); total != 0 {
+		t.Fatalf("miner has %d entries after its blocks were disconnected", total)
+	}
+}
+
+func TestIndexerDisabledOrUnknown(t *testing.T) {
+	bc := NewBlockchainFromSpec(RegtestSpec)
+	block := generate(t, bc, "miner")
+	if _, _, ok := bc.FindTransaction(block.Transactions[0].Hash()); ok {
+		t.Fatal("found a transaction with the index disabled")
+	}
+
+	// Enabling the index builds it from the stored blocks
+	bc.EnableTxIndex()
+	if _, location, ok := bc.FindTransaction(block.Transactions[0].Hash()); !ok || location.BlockHeight != 1 {
+		t.Fatalf("reward indexed at %+v, want block 1", location)
+	}
+	if _, _, ok := bc.FindTransaction("unknown"); ok {
+		t.Fatal("found a transaction that was never confirmed")
+	}
+	if history, total := bc.Indexer.AddressHistory("miner", 0, 10); len(history) != 0 || total != 1 {
+		t.Fatalf("page 0 returned %d entries of %d", len(history), total)
+	}
+}
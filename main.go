@@ -6,7 +6,10 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"os/signal"
 	"strings"
+	"syscall"
+	"time"
 )
 
 // Global variables for private and public keys used in the node.
@@ -27,22 +30,135 @@ func main() {
 	// Command-line flags to configure the node
 	nodeAddress := flag.String("node", "localhost:8080", "Node address")
 	knownPeers := flag.String("peers", "", "Comma-separated list of known peers")
+	seeds := flag.String("seeds", "", "Comma-separated seed nodes to ask for peers when there are none to connect to")
 	apiPort := flag.String("api", ":8081", "API server port")
-	mode := flag.String("mode", "full", "Node mode (full, light, api)")
+	mode := flag.String("mode", "full", "Node mode (full, light, api, seed)")
+	snapshotPath := flag.String("snapshot", "", "Start from a UTXO snapshot file instead of genesis")
+	pruneDepth := flag.Int("prune", 0, "Keep only the bodies of the last N blocks (0 keeps the full history)")
+	txIndex := flag.Bool("txindex", false, "Index confirmed transactions and address history")
+	addrFile := flag.String("peersfile", DefaultAddrFile, "File where known peer addresses are kept")
+	banFile := flag.String("banfile", DefaultBanFile, "File where banned subnets are kept")
+	voteFile := flag.String("votefile", DefaultVoteFile, "File where the heights this node voted at are kept")
+	certFile := flag.String("cert", DefaultCertFile, "Node TLS certificate, generated on first run if missing")
+	keyFile := flag.String("key", DefaultKeyFile, "Node TLS private key, generated on first run if missing")
+	caFile := flag.String("ca", "", "CA bundle peer certificates must chain to (optional)")
+	pinnedKeys := flag.String("pinned", "", "Comma-separated key fingerprints of the only peers to accept (optional)")
+	encryption := flag.String("encryption", EncryptionTLS, "How peer connections are secured (tls, noise)")
+	nodeKeyFile := flag.String("nodekey", "", "File holding the node identity key, generated if missing (default: a new key each run)")
+	pinnedNodes := flag.String("pinnednodes", "", "Comma-separated node IDs of the only peers to accept over Noise (optional)")
+	authorities := flag.String("authorities", "", "Comma-separated validator addresses of the PoA authorities (enables PoA)")
+	chain := flag.String("chain", "main", "Chain to run: main, test, regtest, or the path of a chain spec JSON file")
+	checkpoints := flag.String("checkpoints", "", "Comma-separated height:hash checkpoints, in addition to the chain spec's (optional)")
+	assumeValid := flag.String("assumevalid", "", "Block hash up to which signatures are not checked while syncing (default: the chain spec's), or 0 to check every signature")
 	flag.Parse()
 
-	// Initialise the bc, mempool, and gamification system
-	blockchain := NewBlockchain()
-	blockchain.UTXOSet = NewUTXOSet()
-	blockchain.Accounts = make(map[string]*Account)
-	blockchain.Mempool = NewMempool()
+	// Initialise the bc from its chain spec, and the gamification system
+	spec, err := LoadChainSpec(*chain)
+	if err != nil {
+		log.Fatalf("Failed to load chain spec: %v (built-in chains are %v)", err, ChainSpecNames())
+	}
+	blockchain := NewBlockchainFromSpec(spec)
+	fmt.Printf("Running chain %s, genesis %s\n", spec.Name, blockchain.Blocks[0].Hash)
 	database := NewInMemoryDatabase()
 	gamification := NewGamification(database)
+	if spec.Regtest {
+		// Regtest time only moves when a test sets it through the API
+		clock := NewMockClock(time.Now())
+		blockchain.SetClock(clock)
+		gamification.Clock = clock
+	}
+
+	if *nodeKeyFile != "" {
+		key, err := LoadOrCreateKey(*nodeKeyFile)
+		if err != nil {
+			log.Fatalf("Failed to load node key: %v", err)
+		}
+		privateKey, publicKey = key, &key.PublicKey
+	}
 
 	// Create and configure the node with the initialised bc and keys
 	node := NewNode(*nodeAddress, blockchain, privateKey)
+	node.Clock = blockchain.Clock
+	node.Light = *mode == "light"
+	node.Seed = *mode == "seed"
+	if *seeds != "" {
+		node.Seeds = parsePeers(*seeds)
+	}
+	addrManager, err := LoadAddrManager(*addrFile)
+	if err != nil {
+		log.Fatalf("Failed to load peer addresses: %v", err)
+	}
+	node.AddrManager = addrManager
+	banManager, err := LoadBanManager(*banFile)
+	if err != nil {
+		log.Fatalf("Failed to load ban list: %v", err)
+	}
+	node.BanManager = banManager
+	if err := node.LoadVoteFile(*voteFile); err != nil {
+		log.Fatalf("Failed to load vote record: %v", err)
+	}
+	node.TLSOptions = TLSOptions{CertFile: *certFile, KeyFile: *keyFile, CAFile: *caFile}
+	if *pinnedKeys != "" {
+		node.TLSOptions.PinnedKeys = parsePeers(*pinnedKeys)
+	}
+	if *encryption != EncryptionTLS && *encryption != EncryptionNoise {
+		log.Fatalf("Unknown encryption %q, expected %s or %s", *encryption, EncryptionTLS, EncryptionNoise)
+	}
+	node.Encryption = *encryption
+	if *pinnedNodes != "" {
+		node.PinnedNodeIDs = parsePeers(*pinnedNodes)
+	}
 
-	initializeBlockchainWithGenesis(blockchain)
+	if err := blockchain.SetPruneDepth(*pruneDepth); err != nil {
+		log.Fatalf("Failed to configure pruning: %v", err)
+	}
+
+	if *checkpoints != "" {
+		parsed, err := parseCheckpoints(*checkpoints)
+		if err != nil {
+			log.Fatalf("Failed to parse checkpoints: %v", err)
+		}
+		if err := blockchain.AddCheckpoints(parsed); err != nil {
+			log.Fatalf("Failed to add checkpoints: %v", err)
+		}
+	}
+	switch *assumeValid {
+	case "":
+	case "0":
+		blockchain.SetAssumeValid("")
+	default:
+		if err := blockchain.SetAssumeValid(*assumeValid); err != nil {
+			log.Fatalf("Failed to set the assumed-valid block: %v", err)
+		}
+	}
+
+	if *authorities != "" {
+		// Authorities must be set before any block so every node replays votes from the same set
+		if err := blockchain.SetAuthorities(parsePeers(*authorities)); err != nil {
+			log.Fatalf("Failed to configure authorities: %v", err)
+		}
+		if err := blockchain.SetConsensusAlgorithm("PoA"); err != nil {
+			log.Fatalf("Failed to enable PoA: %v", err)
+		}
+		if address, err := ValidatorAddress(publicKey); err == nil {
+			fmt.Printf("PoA enabled, this node's authority address is %s\n", address)
+		}
+	}
+
+	if *snapshotPath != "" {
+		// Start from the snapshot; its history is validated once a peer sends us the full chain
+		snapshot, err := LoadSnapshot(*snapshotPath)
+		if err != nil {
+			log.Fatalf("Failed to load snapshot: %v", err)
+		}
+		if err := blockchain.RestoreSnapshot(snapshot); err != nil {
+			log.Fatalf("Failed to restore snapshot: %v", err)
+		}
+		fmt.Printf("Started from snapshot at height %d (%s)\n", snapshot.Height, snapshot.BlockHash)
+	}
+	if *txIndex {
+		blockchain.EnableTxIndex()
+	}
 
 	// Start the API server if the mode is set to "api"
 	if *mode == "api" {
@@ -52,6 +168,15 @@ func main() {
 		}()
 	}
 
+	// A seed only serves addresses, so it runs without the interactive CLIs until interrupted
+	if node.Seed {
+		if *knownPeers != "" {
+			node.DiscoverPeers(parsePeers(*knownPeers))
+		}
+		runSeed(node)
+		return
+	}
+
 	// Run the wallet CLI to interact with the bc
 	cli := NewWalletCLI(NewNodeAPIClient(fmt.Sprintf("http://localhost%s", *apiPort)))
 	cli.Run()
@@ -59,13 +184,22 @@ func main() {
 	// Discover and connect to known peers if provided
 	if *knownPeers != "" {
 		node.DiscoverPeers(parsePeers(*knownPeers))
+
+		// Fetch the full history in the background to check the snapshot we started from
+		if blockchain.NeedsSnapshotValidation() {
+			for _, peer := range parsePeers(*knownPeers) {
+				go node.RequestBlockchain(peer)
+			}
+		}
 	}
 
 	// Start the node or API server based on the mode
 	switch *mode {
 	case "full":
 		go func() {
-			log.Fatal(node.Start())
+			if err := node.Start(); err != nil {
+				log.Fatal(err)
+			}
 		}()
 	case "api":
 		api := NewNodeAPI(node)
@@ -82,6 +216,22 @@ func main() {
 
 	// Enter the CLI loop for interactive commands
 	cliLoop(blockchain, gamification)
+
+	// Close peer sessions cleanly on exit
+	node.Stop()
+}
+
+// runSeed runs the node as a seed until it is interrupted.
+func runSeed(node *Node) {
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-interrupt
+		node.Stop()
+	}()
+	if err := node.Start(); err != nil {
+		log.Fatal(err)
+	}
 }
 
 // cliLoop provides a simple command-line interface for interacting with the blockchain.
@@ -95,7 +245,8 @@ func cliLoop(bc *Blockchain, gamification *Gamification) {
 		fmt.Println("6. Register DID")
 		fmt.Println("7. Authenticate DID")
 		fmt.Println("8. Switch Consensus Algorithm")
-		fmt.Println("9. Exit")
+		fmt.Println("9. Export Snapshot")
+		fmt.Println("10. Exit")
 		fmt.Print("Enter choice: ")
 
 		var choice int
@@ -119,6 +270,8 @@ func cliLoop(bc *Blockchain, gamification *Gamification) {
 		case 8:
 			handleSwitchConsensus(bc)
 		case 9:
+			handleExportSnapshot(bc)
+		case 10:
 			return
 		default:
 			fmt.Println("Invalid choice")
@@ -128,13 +281,41 @@ func cliLoop(bc *Blockchain, gamification *Gamification) {
 
 // Allows switching between different consensus algorithms.
 func handleSwitchConsensus(bc *Blockchain) {
-	fmt.Println("Available consensus algorithms: PoW, PoS")
+	summary := bc.ConsensusSummary()
+	fmt.Printf("Current consensus algorithm: %s\n", summary.Current)
+	fmt.Printf("Available consensus algorithms: %s\n", strings.Join(ConsensusNames(), ", "))
 	fmt.Print("Enter the new consensus algorithm: ")
 	var algo string
 	fmt.Scanln(&algo)
 
-	bc.SetConsensusAlgorithm(algo)
-	fmt.Printf("Switched to %s consensus algorithm.\n", algo)
+	// The switch is announced in a block and activates at a later height on every node together
+	if err := bc.SetConsensusAlgorithm(algo); err != nil {
+		fmt.Println("Cannot switch consensus:", err)
+		return
+	}
+	fmt.Printf("Switch to %s requested; it activates %d blocks after the block announcing it.\n", algo, ConsensusActivationDelay)
+}
+
+// Dumps the UTXO set and accounts at a chosen height to a snapshot file.
+func handleExportSnapshot(bc *Blockchain) {
+	var height int
+	var path string
+	fmt.Print("Enter snapshot height: ")
+	fmt.Scanln(&height)
+	fmt.Print("Enter output file: ")
+	fmt.Scanln(&path)
+
+	snapshot, err := bc.CreateSnapshot(height)
+	if err != nil {
+		fmt.Println("Failed to create snapshot:", err)
+		return
+	}
+	if err := snapshot.WriteFile(path); err != nil {
+		fmt.Println("Failed to write snapshot:", err)
+		return
+	}
+
+	fmt.Printf("Snapshot at height %d written to %s (commitment %s)\n", snapshot.Height, path, snapshot.UTXOCommitment)
 }
 
 // Creates and signs a new transaction.
@@ -188,16 +369,6 @@ func handleCreateTransaction(tp *Mempool, bc *Blockchain) {
 func handleMineBlock(bc *Blockchain, tp *Mempool, gamification *Gamification, utxoSet *UTXOSet) {
 	minerAddress := "miner-address" // Replace with the actual miner address
 
-	// Initialise miner's address in UTXO set if not already present
-	if !utxoSet.HasUTXO(minerAddress) {
-		utxoSet.AddUTXO(UTXO{
-			Owner:  minerAddress,
-			Amount: 0,
-			TxID:   "genesis",
-			Index:  0,
-		})
-	}
-
 	// Enforce cooldown period
 	user, _ := gamification.loadOrCreateUser(minerAddress) // Load or create the user object
 	err := gamification.EnforceCooldown(user, "mining")
@@ -214,7 +385,8 @@ func handleMineBlock(bc *Blockchain, tp *Mempool, gamification *Gamification, ut
 	}
 
 	transactions := tp.GetTransactions()
-	newBlock := bc.AddBlock(transactions)
+	// Under PoS and PoA the node's key signs, and only in a slot it is entitled to
+	newBlock := bc.AddBlock(transactions, privateKey)
 	if newBlock == nil {
 		fmt.Println("Failed to mine block.")
 		return
@@ -223,13 +395,9 @@ func handleMineBlock(bc *Blockchain, tp *Mempool, gamification *Gamification, ut
 	tp.Clear() // Clear the mempool after mining
 
 	// Reward the miner with points for successful block mining
+	// (fees are paid out to the block's reward address when the block is connected)
 	gamification.RewardUser(minerAddress, 100, "mining")
 
-	// Optionally distribute fees and rewards among participants
-	for _, tx := range transactions {
-		tx.DistributeFees(utxoSet, minerAddress)
-	}
-
 	fmt.Println("Block mined successfully!")
 }
 
@@ -327,25 +495,3 @@ func handlePrintBlockchain(bc *Blockchain) {
 func parsePeers(peers string) []string {
 	return strings.Split(peers, ",")
 }
-
-// Creates a genesis block and initialises the UTXO set with some initial transactions.
-func initializeBlockchainWithGenesis(blockchain *Blockchain) {
-	// Assign some initial UTXOs to users for testing
-	genesisTransaction := &Transaction{
-		Sender:    "system",
-		Recipient: "bob",
-		Amount:    100,
-		Fee:       0,
-	}
-
-	// Add this transaction to the UTXO set
-	blockchain.UTXOSet.AddUTXO(UTXO{
-		Owner:  "bob",
-		Amount: 100,
-		TxID:   genesisTransaction.Hash(),
-		Index:  0,
-	})
-
-	// Mine the genesis block
-	blockchain.AddBlock([]*Transaction{genesisTransaction})
-}
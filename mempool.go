@@ -2,6 +2,7 @@ package main
 
 import (
 	"errors"
+	"fmt"
 	"sort"
 	"sync"
 	"time"
@@ -11,12 +12,17 @@ import (
 type Mempool struct {
 	transactions map[string]*Transaction // Using a map for quick lookups and uniqueness
 	lock         sync.RWMutex            // Read-write lock for thread-safe access
+	Clock        Clock                   `json:"-"` // Time source for transaction ages
 }
 
+// ErrDuplicateTransaction is returned when adding a transaction the mempool already holds.
+var ErrDuplicateTransaction = errors.New("transaction already exists in the mempool")
+
 // Initialises a new Mempool
 func NewMempool() *Mempool {
 	return &Mempool{
 		transactions: make(map[string]*Transaction),
+		Clock:        SystemClock,
 	}
 }
 
@@ -27,20 +33,16 @@ func (m *Mempool) AddTransaction(tx *Transaction, accounts map[string]*Account,
 
 	// Validate the transaction before adding
 	if err := tx.Validate(accounts, utxoSet); err != nil {
-		return errors.New("invalid transaction: " + err.Error())
+		return fmt.Errorf("invalid transaction: %w", err)
 	}
 
 	txID := tx.Hash()
 	if _, exists := m.transactions[txID]; exists {
-		return errors.New("transaction already exists in the mempool")
+		return ErrDuplicateTransaction
 	}
 
 	m.transactions[txID] = tx
 
-	// Sort transactions by fee, descending order (highest fee first)
-	transactions := m.GetTransactions()
-	m.sortTransactionsByFee(transactions)
-
 	return nil
 }
 
@@ -102,7 +104,7 @@ func (m *Mempool) PurgeOldTransactions(maxAge time.Duration) {
 	m.lock.Lock()
 	defer m.lock.Unlock()
 
-	currentTime := time.Now().Unix()
+	currentTime := m.Clock.Now().Unix()
 	for txID, tx := range m.transactions {
 		if currentTime-tx.Timestamp > int64(maxAge.Seconds()) {
 			delete(m.transactions, txID)
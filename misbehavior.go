@@ -0,0 +1,78 @@
+// misbehavior.go
+package main
+
+import (
+	"errors"
+	"log"
+	"net"
+	"time"
+)
+
+const (
+	BanScoreThreshold = 100 // Misbehavior score at which a peer is banned.
+
+	MisbehaviorInvalidBlock       = 100 // A block that fails validation.
+	MisbehaviorInvalidTransaction = 10  // A transaction that fails validation.
+	MisbehaviorInvalidSignature   = 50  // A transaction whose signature doesn't verify.
+	MisbehaviorMalformedMessage   = 20  // A message whose payload can't be decoded.
+	MisbehaviorProtocolViolation  = 50  // A corrupt frame or a message sent out of turn.
+	MisbehaviorForeignHistory     = 20  // A chain that contradicts the snapshot the node started from.
+)
+
+// Misbehaving adds to a peer's misbehavior score. Scores are kept per host rather than per
+// session, so reconnecting doesn't wipe the slate clean. Once the score reaches
+// BanScoreThreshold the host's subnet is banned and the host disconnected.
+func (n *Node) Misbehaving(peer *Peer, score int, reason string) {
+	host := addressHost(peer.conn.RemoteAddr().String())
+
+	n.lock.Lock()
+	n.misbehavior[host] += score
+	total := n.misbehavior[host]
+	if total >= BanScoreThreshold {
+		delete(n.misbehavior, host)
+	}
+	n.lock.Unlock()
+
+	log.Printf("Peer %s misbehaving (%s): score %d", peer.Address, reason, total)
+	if total < BanScoreThreshold {
+		return
+	}
+
+	subnet, err := misbehaviorSubnet(host)
+	if err != nil {
+		// Not an IP, so there's nothing to ban; just drop the session
+		peer.Close()
+		return
+	}
+	if err := n.BanSubnet(subnet, DefaultBanDuration, reason); err != nil {
+		log.Printf("Failed to save ban list: %v", err)
+	}
+}
+
+// BanSubnet bans a subnet and disconnects any peers inside it.
+func (n *Node) BanSubnet(subnet *net.IPNet, duration time.Duration, reason string) error {
+	err := n.BanManager.Ban(subnet, duration, reason)
+
+	n.lock.RLock()
+	var banned []*Peer
+	for _, peer := range n.sessions {
+		if ip := net.ParseIP(addressHost(peer.conn.RemoteAddr().String())); ip != nil && subnet.Contains(ip) {
+			banned = append(banned, peer)
+		}
+	}
+	n.lock.RUnlock()
+
+	for _, peer := range banned {
+		log.Printf("Disconnecting banned peer %s", peer.Address)
+		peer.Close()
+	}
+	return err
+}
+
+// UnbanSubnet lifts a ban. It reports whether the subnet was banned.
+func (n *Node) UnbanSubnet(subnet *net.IPNet) (bool, error) {
+	return n.BanManager.Unban(subnet)
+}
+
+// errBannedPeer is returned when dialling an address that is banned.
+var errBannedPeer = errors.New("peer is banned")
@@ -3,101 +3,283 @@ package main
 import (
 	"crypto/ecdsa"
 	"crypto/tls"
-	"crypto/x509"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net"
-	"os"
 	"sync"
 	"time"
 )
 
 const (
-	RateLimitWindow      = 10 * time.Second  // Time window for rate limiting peer requests.
-	MaxRequestsPerWindow = 100               // Maximum requests allowed within the rate limit window.
-	MaxConnectionRetries = 3                 // Maximum retries for peer connections.
-	RetryDelay           = 2 * time.Second   // Delay between connection retries.
+	RateLimitWindow      = 10 * time.Second // Time window for rate limiting peer requests.
+	MaxRequestsPerWindow = 100              // Maximum requests allowed within the rate limit window.
+	MaxConnectionRetries = 3                // Maximum retries for peer connections.
+	RetryDelay           = 2 * time.Second  // Delay between connection retries.
+	MaxFutureBlockTime   = 2 * time.Hour    // How far ahead of our clock a block's timestamp may be.
 )
 
 type MessageType int
 
 const (
-	MessageTypeNewBlock MessageType = iota     // New block message type.
-	MessageTypeTransaction                     // Transaction message type.
-	MessageTypeRequestBlockchain               // Request for the entire blockchain.
-	MessageTypeResponseBlockchain              // Response containing the entire blockchain.
-	MessageTypeNewPeer                         // Message indicating a new peer connection.
+	MessageTypeNewBlock           MessageType = iota // New block message type.
+	MessageTypeTransaction                           // Transaction message type.
+	MessageTypeRequestBlockchain                     // Request for the entire blockchain.
+	MessageTypeResponseBlockchain                    // Response containing the entire blockchain.
+	MessageTypeNewPeer                               // Message indicating a new peer connection.
+	MessageTypeVersion                               // Handshake: the sender's protocol version, chain and services.
+	MessageTypeVerack                                // Handshake: acknowledges the peer's version.
+	MessageTypePing                                  // Keepalive carrying a nonce to echo back.
+	MessageTypePong                                  // Reply to a ping, echoing its nonce.
+	MessageTypeInv                                   // Announces blocks or transactions by hash.
+	MessageTypeGetData                               // Requests announced objects in full.
+	MessageTypeNotFound                              // Reply to getdata for objects the peer doesn't have.
+	MessageTypeGetAddr                               // Asks a peer for addresses it knows.
+	MessageTypeAddr                                  // A list of peer addresses.
+	MessageTypeVote                                  // A validator's prevote or precommit for a block.
+	MessageTypeCommit                                // A commit certificate finalizing a block.
 )
 
 type Message struct {
-	Type    MessageType   // Type of the message.
-	Payload []byte        // Content of the message.
+	Type    MessageType // Type of the message.
+	Payload []byte      // Content of the message.
+	from    *Peer       // Session the message arrived on; nil for messages raised locally.
 }
 
 type Node struct {
-	Address          string            // The node's address.
-	Blockchain       *Blockchain       // The blockchain instance associated with the node.
-	Peers            map[string]bool   // A map of known peer addresses.
-	lock             sync.RWMutex      // A read-write lock for thread-safe operations.
-	requestCounts    map[string]int    // Counts the number of requests per peer.
+	Address          string               // The node's address.
+	Blockchain       *Blockchain          // The blockchain instance associated with the node.
+	AddrManager      *AddrManager         // Addresses of peers the node knows about.
+	BanManager       *BanManager          // Subnets the node refuses to talk to.
+	misbehavior      map[string]int       // Misbehavior score per peer host.
+	lock             sync.RWMutex         // A read-write lock for thread-safe operations.
+	requestCounts    map[string]int       // Counts the number of requests per peer.
 	lastRequestTimes map[string]time.Time // Tracks the last request time per peer.
-	messageQueue     chan Message      // A queue for processing incoming messages.
-	PrivateKey       *ecdsa.PrivateKey // The node's private key for signing transactions.
+	messageQueue     chan Message         // A queue for processing incoming messages.
+	PrivateKey       *ecdsa.PrivateKey    // The node's private key for signing transactions.
+	ChainID          string               // Network identifier exchanged in the handshake.
+	Light            bool                 // Whether the node runs in light mode and serves no blocks.
+	Seed             bool                 // Whether the node runs as a seed and only deals in addresses.
+	Seeds            []string             // Seed nodes to ask for addresses when there are none to dial; nil uses the chain's fallbacks.
+	lastSeedQuery    time.Time
+	nonce            uint64                     // Random value identifying this node in handshakes.
+	peerVersions     map[string]*VersionMessage // What each peer advertised in its handshake, by listen address.
+	sessions         map[string]*Peer           // Open peer sessions, by listen address.
+	TLSOptions       TLSOptions                 // Where the node's certificate lives and how peers are authenticated.
+	tlsIdentity      *TLSIdentity               // Loaded once and shared by the listener and every dial.
+	Encryption       string                     // How connections are secured: EncryptionTLS or EncryptionNoise.
+	Transport        Transport                  // Overrides the TCP transport Encryption selects, e.g. for simulations.
+	Clock            Clock                      // Source of the current time.
+	PinnedNodeIDs    []string                   // Node IDs of the only peers to accept over Noise. Optional.
+	listener         net.Listener
+	quit             chan struct{} // Closed by Stop to shut the node down.
+	stopOnce         sync.Once
+	wg               sync.WaitGroup       // Tracks the node's goroutines so Stop can wait for them.
+	recentlySeen     *inventorySet        // Blocks and transactions already processed or relayed.
+	inFlight         map[string]time.Time // Objects requested with getdata, by hash, and when.
+	ready            chan *Peer           // Peers with a message waiting in their inbound queue, in arrival order.
+	finality         *finalityState       // Votes seen and cast for the finality gadget.
 }
 
 func NewNode(address string, blockchain *Blockchain, privateKey *ecdsa.PrivateKey) *Node {
 	return &Node{
 		Address:          address,
 		Blockchain:       blockchain,
-		Peers:            make(map[string]bool),
+		AddrManager:      NewAddrManager(""),
+		BanManager:       NewBanManager(""),
+		misbehavior:      make(map[string]int),
 		requestCounts:    make(map[string]int),
 		lastRequestTimes: make(map[string]time.Time),
 		messageQueue:     make(chan Message, 100),
 		PrivateKey:       privateKey,
+		ChainID:          blockchain.Spec.Name,
+		TLSOptions:       DefaultTLSOptions(),
+		Encryption:       EncryptionTLS,
+		Clock:            SystemClock,
+		nonce:            newNodeNonce(),
+		peerVersions:     make(map[string]*VersionMessage),
+		sessions:         make(map[string]*Peer),
+		quit:             make(chan struct{}),
+		recentlySeen:     newInventorySet(RecentlySeenCacheSize),
+		inFlight:         make(map[string]time.Time),
+		ready:            make(chan *Peer, (MaxInboundPeers+MaxOutboundPeers)*PeerInboundQueueSize),
+		finality:         newFinalityState(),
 	}
 }
 
-// Load the TLS configuration for secure connections, including server and CA certificates.
-func loadTLSConfig() (*tls.Config, error) {
-	cert, err := tls.LoadX509KeyPair("server.crt", "server.key")
+// transportConfig returns the node's TLS configuration, loading or generating its identity the
+// first time it is needed.
+func (n *Node) transportConfig() (*tls.Config, error) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	if n.tlsIdentity == nil {
+		identity, err := NewTLSIdentity(n.TLSOptions)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load TLS identity: %w", err)
+		}
+		n.tlsIdentity = identity
+	}
+	return n.tlsIdentity.Config(), nil
+}
+
+// dialPeer opens a secure connection to a peer, performs the version handshake and starts a
+// session. If a session with the peer is already open it is returned instead.
+func (n *Node) dialPeer(address string) (*Peer, error) {
+	if peer := n.session(address); peer != nil {
+		return peer, nil
+	}
+	if n.BanManager.IsBanned(address) {
+		return nil, errBannedPeer
+	}
+	if !n.hasSessionSlot(false) {
+		return nil, errors.New("outbound connection limit reached")
+	}
+
+	conn, err := n.transport().Dial(address)
 	if err != nil {
 		return nil, err
 	}
-	caCert, err := os.ReadFile("ca.crt")
+	if n.BanManager.IsBanned(conn.RemoteAddr().String()) {
+		conn.Close()
+		return nil, errBannedPeer
+	}
+
+	conn.SetDeadline(time.Now().Add(HandshakeTimeout))
+	version, err := n.initiateHandshake(conn)
 	if err != nil {
-		return nil, err
+		conn.Close()
+		return nil, fmt.Errorf("handshake failed: %w", err)
+	}
+	conn.SetDeadline(time.Time{})
+
+	return n.addPeer(newPeer(n, conn, version, address, false))
+}
+
+// addPeer registers a session and starts servicing it. If a session with the same peer is already
+// open, the one dialled by the node with the lower nonce is kept so both ends agree on the survivor.
+func (n *Node) addPeer(peer *Peer) (*Peer, error) {
+	n.lock.Lock()
+	select {
+	case <-n.quit:
+		n.lock.Unlock()
+		peer.conn.Close()
+		return nil, errors.New("node is shutting down")
+	default:
+	}
+	existing := n.sessions[peer.Address]
+	if existing != nil && existing.dialerNonce() <= peer.dialerNonce() {
+		n.lock.Unlock()
+		peer.conn.Close()
+		return existing, nil
+	}
+	if existing == nil && n.countSessions(peer.Inbound) >= maxSessions(peer.Inbound) {
+		n.lock.Unlock()
+		peer.conn.Close()
+		return nil, errors.New("connection limit reached")
+	}
+	n.sessions[peer.Address] = peer
+	n.peerVersions[peer.Address] = peer.Version
+	n.lock.Unlock()
+
+	if existing != nil {
+		existing.Close()
+	}
+	peer.run()
+	n.peerConnected(peer)
+	return peer, nil
+}
+
+// countSessions counts the open inbound or outbound sessions. Callers must hold the lock.
+func (n *Node) countSessions(inbound bool) int {
+	count := 0
+	for _, peer := range n.sessions {
+		if peer.Inbound == inbound {
+			count++
+		}
+	}
+	return count
+}
+
+// hasSessionSlot reports whether another inbound or outbound session would fit under the cap.
+func (n *Node) hasSessionSlot(inbound bool) bool {
+	n.lock.RLock()
+	defer n.lock.RUnlock()
+	return n.countSessions(inbound) < maxSessions(inbound)
+}
+
+// maxSessions returns the cap on inbound or outbound sessions.
+func maxSessions(inbound bool) int {
+	if inbound {
+		return MaxInboundPeers
+	}
+	return MaxOutboundPeers
+}
+
+// removePeer forgets a session once it has closed.
+func (n *Node) removePeer(peer *Peer) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	if n.sessions[peer.Address] == peer {
+		delete(n.sessions, peer.Address)
 	}
-	caCertPool := x509.NewCertPool()
-	caCertPool.AppendCertsFromPEM(caCert)
-	return &tls.Config{
-		Certificates: []tls.Certificate{cert},
-		RootCAs:      caCertPool,
-		ClientCAs:    caCertPool,
-		ClientAuth:   tls.RequireAndVerifyClientCert,
-	}, nil
+}
+
+// session returns the open session with a peer, or nil if there is none.
+func (n *Node) session(address string) *Peer {
+	n.lock.RLock()
+	defer n.lock.RUnlock()
+	return n.sessions[address]
+}
+
+// rememberPeerVersion records what a peer advertised in its handshake.
+func (n *Node) rememberPeerVersion(address string, version *VersionMessage) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	n.peerVersions[address] = version
 }
 
 // Start the node's main operations, including listening for connections and processing messages.
+// It returns nil once Stop has been called.
 func (n *Node) Start() error {
-	tlsConfig, err := loadTLSConfig()
+	ln, err := n.transport().Listen(n.Address)
 	if err != nil {
 		return err
 	}
-
-	ln, err := tls.Listen("tcp", n.Address, tlsConfig)
-	if err != nil {
-		return err
+	n.lock.Lock()
+	select {
+	case <-n.quit:
+		n.lock.Unlock()
+		ln.Close()
+		return nil
+	default:
 	}
-	defer ln.Close()
-
-	fmt.Printf("Secure Node started at %s\n", n.Address)
+	n.listener = ln
+	n.lock.Unlock()
 
+	n.wg.Add(2)
 	go n.processMessageQueue()
+	go n.maintainOutbound()
+	switch {
+	case n.tlsIdentity != nil:
+		fmt.Printf("Secure Node started at %s (key fingerprint %s)\n", n.Address, n.tlsIdentity.Fingerprint())
+		n.wg.Add(1)
+		go n.watchTLSIdentity()
+	case n.Transport == nil:
+		nodeID, _ := NodeID(&n.PrivateKey.PublicKey)
+		fmt.Printf("Secure Node started at %s (Noise, node ID %s)\n", n.Address, nodeID)
+	default:
+		fmt.Printf("Node started at %s\n", n.Address)
+	}
 
 	for {
 		conn, err := ln.Accept()
 		if err != nil {
+			select {
+			case <-n.quit:
+				return nil
+			default:
+			}
 			log.Printf("Failed to accept connection: %v", err)
 			continue
 		}
@@ -105,219 +287,402 @@ func (n *Node) Start() error {
 	}
 }
 
-// Handle incoming connections from peers, including rate limiting and message decoding.
-func (n *Node) handleConnection(conn net.Conn) {
-	defer conn.Close()
+// Stop closes the listener and every peer session, then waits for the node's goroutines to finish.
+func (n *Node) Stop() {
+	n.stopOnce.Do(func() {
+		n.lock.Lock()
+		close(n.quit)
+		if n.listener != nil {
+			n.listener.Close()
+		}
+		peers := make([]*Peer, 0, len(n.sessions))
+		for _, peer := range n.sessions {
+			peers = append(peers, peer)
+		}
+		n.lock.Unlock()
 
+		for _, peer := range peers {
+			peer.Close()
+		}
+		n.wg.Wait()
+
+		if err := n.AddrManager.Save(); err != nil {
+			log.Printf("Failed to save peer addresses: %v", err)
+		}
+	})
+}
+
+// Handle incoming connections from peers: rate limit them, run the handshake and hand the
+// connection over to a peer session.
+func (n *Node) handleConnection(conn net.Conn) {
 	peerAddr := conn.RemoteAddr().String()
+	if n.BanManager.IsBanned(peerAddr) {
+		conn.Close()
+		return
+	}
 	if !n.rateLimit(peerAddr) {
 		log.Printf("Rate limit exceeded for peer: %s", peerAddr)
+		conn.Close()
+		return
+	}
+	if !n.hasSessionSlot(true) {
+		log.Printf("Inbound connection limit reached, dropping %s", peerAddr)
+		conn.Close()
 		return
 	}
 
-	var msg Message
-	decoder := json.NewDecoder(conn)
-	err := decoder.Decode(&msg)
+	// No other message is processed until the peer has completed the handshake
+	conn.SetDeadline(time.Now().Add(HandshakeTimeout))
+	secured, err := n.transport().Secure(conn)
+	if err != nil {
+		log.Printf("Securing connection from %s failed: %v", peerAddr, err)
+		conn.Close()
+		return
+	}
+	conn = secured
+	version, err := n.acceptHandshake(conn)
 	if err != nil {
-		log.Printf("Failed to decode message: %v", err)
+		log.Printf("Handshake with %s failed: %v", peerAddr, err)
+		conn.Close()
 		return
 	}
+	conn.SetDeadline(time.Time{})
 
-	switch msg.Type {
-	case MessageTypeRequestBlockchain:
-		n.handleRequestBlockchain(conn)
-	default:
-		n.messageQueue <- msg
+	// Learn the peer's listening address from its version rather than a separate message
+	address := peerListenAddress(version.ListenAddress, conn.RemoteAddr())
+	if _, err := n.addPeer(newPeer(n, conn, version, address, true)); err != nil {
+		log.Printf("Dropping connection from %s: %v", peerAddr, err)
 	}
 }
 
-// Implement rate limiting to prevent peers from overwhelming the node with requests.
+// Implement rate limiting to prevent peers from overwhelming the node with requests. Requests are
+// counted per host, since a peer can pick a new source port for every connection.
 func (n *Node) rateLimit(peerAddr string) bool {
+	host := addressHost(peerAddr)
 	now := time.Now()
 	n.lock.Lock()
 	defer n.lock.Unlock()
 
-	if lastRequestTime, exists := n.lastRequestTimes[peerAddr]; exists {
+	if lastRequestTime, exists := n.lastRequestTimes[host]; exists {
 		if now.Sub(lastRequestTime) > RateLimitWindow {
-			n.requestCounts[peerAddr] = 0
+			n.requestCounts[host] = 0
 		}
 	}
 
-	n.lastRequestTimes[peerAddr] = now
-	n.requestCounts[peerAddr]++
+	n.lastRequestTimes[host] = now
+	n.requestCounts[host]++
 
-	return n.requestCounts[peerAddr] <= MaxRequestsPerWindow
+	return n.requestCounts[host] <= MaxRequestsPerWindow
 }
 
 // Continuously process messages from the message queue, dispatching them to the appropriate handlers.
 func (n *Node) processMessageQueue() {
-	for msg := range n.messageQueue {
-		switch msg.Type {
-		case MessageTypeNewBlock:
-			n.handleNewBlock(msg.Payload)
-		case MessageTypeTransaction:
-			n.handleTransaction(msg.Payload)
-		case MessageTypeResponseBlockchain:
-			n.handleResponseBlockchain(msg.Payload)
-		case MessageTypeNewPeer:
-			n.handleNewPeer(msg.Payload)
+	defer n.wg.Done()
+	for {
+		var msg Message
+		select {
+		case msg = <-n.messageQueue:
+		case peer := <-n.ready:
+			msg = <-peer.inbound
+		case <-n.quit:
+			return
 		}
+		n.handleMessage(msg)
 	}
 }
 
-// Handle the reception of a new block, validate it, and propagate it to peers.
-func (n *Node) handleNewBlock(payload []byte) {
+// Dispatch a message to its handler.
+func (n *Node) handleMessage(msg Message) {
+	if n.Seed && !seedMessageTypes[msg.Type] {
+		return
+	}
+	switch msg.Type {
+	case MessageTypeNewBlock:
+		n.handleNewBlock(msg.Payload, msg.from)
+	case MessageTypeTransaction:
+		n.handleTransaction(msg.Payload, msg.from)
+	case MessageTypeInv:
+		if msg.from != nil {
+			n.handleInv(msg.Payload, msg.from)
+		}
+	case MessageTypeGetData:
+		if msg.from != nil {
+			n.handleGetData(msg.Payload, msg.from)
+		}
+	case MessageTypeNotFound:
+		if msg.from != nil {
+			n.handleNotFound(msg.Payload, msg.from)
+		}
+	case MessageTypeRequestBlockchain:
+		if msg.from != nil {
+			n.handleRequestBlockchain(msg.from)
+		}
+	case MessageTypeResponseBlockchain:
+		n.handleResponseBlockchain(msg.Payload, msg.from)
+	case MessageTypeNewPeer:
+		n.handleNewPeer(msg.Payload, msg.from)
+	case MessageTypeGetAddr:
+		if msg.from != nil {
+			n.handleGetAddr(msg.from)
+		}
+	case MessageTypeAddr:
+		if msg.from != nil {
+			n.handleAddr(msg.Payload, msg.from)
+		}
+	case MessageTypeVote:
+		if msg.from != nil {
+			n.handleVote(msg.Payload, msg.from)
+		}
+	case MessageTypeCommit:
+		if msg.from != nil {
+			n.handleCommit(msg.Payload, msg.from)
+		}
+	}
+}
+
+// Handle the reception of a new block, validate it, and announce it to peers that don't have it.
+func (n *Node) handleNewBlock(payload []byte, from *Peer) {
 	var block Block
 	err := json.Unmarshal(payload, &block)
 	if err != nil {
 		log.Printf("Failed to unmarshal block: %v", err)
+		if from != nil {
+			n.Misbehaving(from, MisbehaviorMalformedMessage, "malformed block")
+		}
+		return
+	}
+	// A copy whose hash or seal doesn't check out is not the block it claims to be, so it must not
+	// stop the real block from being fetched
+	if !hasValidSeal(&block, true) {
+		if from != nil {
+			n.Misbehaving(from, MisbehaviorInvalidBlock, "block hash or seal does not verify")
+		}
+		return
+	}
+	if n.recentlySeen.Has(block.Hash) {
+		if from != nil {
+			from.knownInventory.Add(block.Hash)
+		}
+		return
+	}
+	if time.Unix(block.Timestamp, 0).After(n.Clock.Now().Add(MaxFutureBlockTime)) {
+		// Either the miner's clock or ours is off, so the peer isn't penalized
+		log.Printf("Rejected block %d: timestamp too far in the future", block.Index)
 		return
 	}
-	if n.Blockchain.IsValidNewBlock(&block, n.Blockchain.Blocks[len(n.Blockchain.Blocks)-1]) {
-		n.Blockchain.lock.Lock()
-		n.Blockchain.Blocks = append(n.Blockchain.Blocks, &block)
-		n.Blockchain.lock.Unlock()
-		n.broadcastToPeers(MessageTypeNewBlock, payload)
+	if existing := n.Blockchain.ConflictingBlock(&block); existing != nil {
+		n.reportDoubleSign(existing, &block)
+	}
+	tip := n.Blockchain.Tip()
+	if err := n.Blockchain.AcceptBlock(&block); err != nil {
+		// The block stays unseen, so it is fetched again once it may connect
+		log.Printf("Rejected block %d: %v", block.Index, err)
+		n.clearRequested(block.Hash)
+		if from == nil {
+			return
+		}
+		if errors.Is(err, ErrBlockNotYetValid) {
+			return // Our clock may be behind, so the block is fetched again when announced after its time
+		}
+		if block.PreviousHash != tip.Hash {
+			// Not invalid, just not on our tip: the peer may be ahead of us or on a competing branch
+			if block.Index > tip.Index {
+				go n.RequestBlockchain(from.Address)
+			}
+			return
+		}
+		n.Misbehaving(from, MisbehaviorInvalidBlock, "invalid block")
+		return
 	}
+	n.receiveInventory(block.Hash, from)
+	n.RelayBlock(&block)
+	n.Prevote(&block)
 }
 
-// Handle the reception of a transaction, validate it, and propagate it to peers.
-func (n *Node) handleTransaction(payload []byte) {
+// Handle the reception of a transaction, validate it, and announce it to peers that don't have it.
+func (n *Node) handleTransaction(payload []byte, from *Peer) {
 	var tx Transaction
 	err := json.Unmarshal(payload, &tx)
 	if err != nil {
 		log.Printf("Failed to unmarshal transaction: %v", err)
+		if from != nil {
+			n.Misbehaving(from, MisbehaviorMalformedMessage, "malformed transaction")
+		}
 		return
 	}
+	hash := tx.Hash()
+	if n.recentlySeen.Has(hash) {
+		if from != nil {
+			from.knownInventory.Add(hash)
+		}
+		return
+	}
+	// The hash doesn't cover the signature, so a rejected copy must not stop the real one from
+	// being fetched: the transaction is only marked seen once the mempool takes it
 	if err := n.Blockchain.Mempool.AddTransaction(&tx, n.Blockchain.Accounts, n.Blockchain.UTXOSet); err != nil {
 		log.Printf("Failed to add transaction to mempool: %v", err)
+		if errors.Is(err, ErrDuplicateTransaction) {
+			n.receiveInventory(hash, from)
+			return
+		}
+		n.clearRequested(hash)
+		if from == nil {
+			return
+		}
+		if errors.Is(err, ErrInvalidSignature) {
+			n.Misbehaving(from, MisbehaviorInvalidSignature, "transaction signature does not verify")
+		} else {
+			n.Misbehaving(from, MisbehaviorInvalidTransaction, "invalid transaction")
+		}
 		return
 	}
-	n.broadcastToPeers(MessageTypeTransaction, payload)
+	n.receiveInventory(hash, from)
+	n.RelayTransaction(&tx)
 }
 
 // Respond to requests for the entire blockchain by sending the blockchain data to the requesting peer.
-func (n *Node) handleRequestBlockchain(conn net.Conn) {
-	n.Blockchain.lock.RLock()
-	defer n.Blockchain.lock.RUnlock()
+func (n *Node) handleRequestBlockchain(peer *Peer) {
+	// A pruned node no longer has the full history, so it can't serve it
+	if n.Blockchain.IsPruned() {
+		log.Printf("Refusing blockchain request from %s: blocks below height %d are pruned", peer.Address, n.Blockchain.PrunedHeight())
+		return
+	}
 
+	n.Blockchain.lock.RLock()
 	data, err := json.Marshal(n.Blockchain)
+	n.Blockchain.lock.RUnlock()
 	if err != nil {
 		log.Printf("Failed to marshal blockchain: %v", err)
 		return
 	}
 
-	encoder := json.NewEncoder(conn)
-	if err := encoder.Encode(data); err != nil {
-		log.Printf("Failed to send blockchain data: %v", err)
-	}
+	peer.Send(Message{Type: MessageTypeResponseBlockchain, Payload: data})
 }
 
 // Handle the reception of a blockchain from a peer, and update the node's blockchain if the received one is valid and longer.
-func (n *Node) handleResponseBlockchain(payload []byte) {
+func (n *Node) handleResponseBlockchain(payload []byte, from *Peer) {
 	var receivedBlockchain Blockchain
 	err := json.Unmarshal(payload, &receivedBlockchain)
 	if err != nil {
 		log.Printf("Failed to unmarshal blockchain response: %v", err)
 		return
 	}
-	if len(receivedBlockchain.Blocks) > len(n.Blockchain.Blocks) && n.Blockchain.IsValidChain(receivedBlockchain.Blocks) {
-		n.Blockchain.lock.Lock()
-		n.Blockchain.Blocks = receivedBlockchain.Blocks
-		n.Blockchain.lock.Unlock()
+	if n.Blockchain.NeedsSnapshotValidation() {
+		go func(blocks []*Block) {
+			err := n.Blockchain.ValidateSnapshotHistory(blocks)
+			switch {
+			case err == nil:
+				log.Printf("Snapshot history validated against peer chain")
+			case errors.Is(err, ErrInvalidHistory) && from != nil:
+				log.Printf("Snapshot history from %s is invalid: %v", from.Address, err)
+				n.Misbehaving(from, MisbehaviorInvalidBlock, "invalid chain")
+			case errors.Is(err, ErrForeignHistory) && from != nil:
+				log.Printf("Snapshot history from %s is for another chain: %v", from.Address, err)
+				n.Misbehaving(from, MisbehaviorForeignHistory, "chain contradicts our snapshot")
+			default:
+				log.Printf("Snapshot history validation failed: %v", err)
+				if !n.Blockchain.NeedsSnapshotValidation() {
+					n.switchToChain(blocks) // The snapshot was discarded, so sync from genesis instead
+				}
+			}
+		}(receivedBlockchain.Blocks)
+		return
 	}
+	n.switchToChain(receivedBlockchain.Blocks)
 }
 
-// Handle the addition of a new peer to the node's list of known peers and attempt to establish a connection.
-func (n *Node) handleNewPeer(payload []byte) {
+// switchToChain reorganizes to a chain received from a peer if it is valid and we prefer it.
+func (n *Node) switchToChain(blocks []*Block) {
+	// The consensus engine's preferred chain wins, and so does one finalizing a block beyond ours;
+	// Reorganize refuses either if it would revert a finalized block
+	candidate := n.Blockchain.PrefersChain(blocks)
+	if len(blocks) > 0 && candidate && n.Blockchain.IsValidChain(blocks) {
+		if err := n.Blockchain.Reorganize(blocks); err != nil {
+			log.Printf("Failed to switch to received blockchain: %v", err)
+			return
+		}
+		// Peers still on the old branch learn about the new tip from us
+		n.RelayBlock(n.Blockchain.Tip())
+		n.Prevote(n.Blockchain.Tip())
+	}
+}
+
+// Handle a single peer address announced by an older peer. It is added to the address manager
+// like any other gossiped address and connected to when outbound slots need filling.
+func (n *Node) handleNewPeer(payload []byte, from *Peer) {
 	var peerAddress string
 	err := json.Unmarshal(payload, &peerAddress)
 	if err != nil {
 		log.Printf("Failed to unmarshal new peer address: %v", err)
 		return
 	}
-	n.lock.Lock()
-	defer n.lock.Unlock()
-	if !n.Peers[peerAddress] {
-		n.Peers[peerAddress] = true
-		go n.connectToPeer(peerAddress)
+	source := "local"
+	if from != nil {
+		source = from.Address
 	}
+	n.AddrManager.AddAddresses([]NetAddress{{Address: peerAddress, Timestamp: time.Now().Unix()}}, source)
 }
 
-// Attempt to establish a secure connection to a peer and notify them of the new connection.
+// Attempt to open a session with a peer. The handshake tells the peer our listening address,
+// so no further message is needed.
 func (n *Node) connectToPeer(address string) {
 	for i := 0; i < MaxConnectionRetries; i++ {
-		tlsConfig, err := loadTLSConfig()
-		if err != nil {
-			log.Printf("Failed to load TLS config: %v", err)
-			return
-		}
-
-		conn, err := tls.Dial("tcp", address, tlsConfig)
-		if err != nil {
+		n.AddrManager.Attempt(address)
+		if _, err := n.dialPeer(address); err != nil {
 			log.Printf("Failed to connect to peer %s: %v", address, err)
-			time.Sleep(RetryDelay)
-			continue
+			select {
+			case <-time.After(RetryDelay):
+				continue
+			case <-n.quit:
+				return
+			}
 		}
-		defer conn.Close()
+		return
+	}
+}
 
-		msg := Message{Type: MessageTypeNewPeer, Payload: []byte(n.Address)}
-		encoder := json.NewEncoder(conn)
-		err = encoder.Encode(msg)
-		if err != nil {
-			log.Printf("Failed to send new peer message to %s: %v", address, err)
-			time.Sleep(RetryDelay)
-			continue
-		}
+// Request a peer's blockchain. The response arrives on the session and is queued like any other
+// message. Peers that advertised a pruned history can't serve it, so they are skipped.
+func (n *Node) RequestBlockchain(address string) {
+	peer, err := n.dialPeer(address)
+	if err != nil {
+		log.Printf("Failed to connect to peer %s: %v", address, err)
+		return
+	}
 
-		n.lock.Lock()
-		n.Peers[address] = true
-		n.lock.Unlock()
-		break
+	if !peer.Version.HasService(ServiceFull) {
+		log.Printf("Peer %s does not serve the full blockchain", address)
+		return
 	}
+	peer.Send(Message{Type: MessageTypeRequestBlockchain})
 }
 
-// Broadcast a message to all known peers in the network.
+// Broadcast a message to every peer we have a session with.
 func (n *Node) broadcastToPeers(msgType MessageType, payload []byte) {
 	n.lock.RLock()
-	defer n.lock.RUnlock()
-
-	for peer := range n.Peers {
-		go func(peer string) {
-			for i := 0; i < MaxConnectionRetries; i++ {
-				tlsConfig, err := loadTLSConfig()
-				if err != nil {
-					log.Printf("Failed to load TLS config for peer %s: %v", peer, err)
-					return
-				}
+	peers := make([]*Peer, 0, len(n.sessions))
+	for _, peer := range n.sessions {
+		peers = append(peers, peer)
+	}
+	n.lock.RUnlock()
 
-				conn, err := tls.Dial("tcp", peer, tlsConfig)
-				if err != nil {
-					log.Printf("Failed to connect to peer %s: %v", peer, err)
-					time.Sleep(RetryDelay)
-					continue
-				}
-				defer conn.Close()
-
-				msg := Message{Type: msgType, Payload: payload}
-				encoder := json.NewEncoder(conn)
-				err = encoder.Encode(msg)
-				if err != nil {
-					log.Printf("Failed to send message to peer %s: %v", peer, err)
-					time.Sleep(RetryDelay)
-					continue
-				}
-				break
-			}
-		}(peer)
+	for _, peer := range peers {
+		peer.Send(Message{Type: msgType, Payload: payload})
 	}
 }
 
 // Attempt to connect to a list of known peers, establishing connections with those that are
+// reachable. They are also added to the address manager so they are remembered across restarts.
 func (n *Node) DiscoverPeers(knownPeers []string) {
+	var addresses []NetAddress
 	for _, peer := range knownPeers {
 		if peer != n.Address {
-			go n.connectToPeer(peer)
+			addresses = append(addresses, NetAddress{Address: peer, Timestamp: time.Now().Unix()})
 		}
 	}
+	n.AddrManager.AddAddresses(addresses, "local")
+
+	for _, na := range addresses {
+		go n.connectToPeer(na.Address)
+	}
 }
\ No newline at end of file
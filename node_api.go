@@ -5,9 +5,32 @@ import (
 	"fmt"
 	"log"
 	"net/http"
+	"strconv"
 	"strings"
+	"time"
 )
 
+const (
+	DefaultHistoryPageSize = 50  // Entries per page when the client doesn't ask for a limit.
+	MaxHistoryPageSize     = 500 // Largest page of address history served in one request.
+)
+
+// ConfirmedTransaction is a transaction found in the chain along with where it was confirmed.
+// Transaction is nil if the block body has been pruned.
+type ConfirmedTransaction struct {
+	*Transaction
+	Location TxLocation
+}
+
+// AddressHistoryPage is one page of an address's confirmed transactions, newest first.
+type AddressHistoryPage struct {
+	Address string
+	Page    int
+	Limit   int
+	Total   int
+	Entries []AddressTxEntry
+}
+
 // Provides an HTTP API for interacting with the blockchain node.
 type NodeAPI struct {
 	Node *Node
@@ -34,6 +57,26 @@ func (api *NodeAPI) Start(port string) error {
 	http.HandleFunc("/send", api.handleSendTransaction)
 	http.HandleFunc("/blockchain", api.handleGetBlockchain)
 	http.HandleFunc("/transaction", api.handleGetTransaction)
+	http.HandleFunc("/history", api.handleGetAddressHistory)
+	http.HandleFunc("/bans", api.handleListBans)
+	http.HandleFunc("/bans/add", api.handleAddBan)
+	http.HandleFunc("/bans/remove", api.handleRemoveBan)
+	http.HandleFunc("/staking/bond", api.handleStakingTransaction(TxTypeBond))
+	http.HandleFunc("/staking/delegate", api.handleStakingTransaction(TxTypeDelegate))
+	http.HandleFunc("/staking/unbond", api.handleStakingTransaction(TxTypeUnbond))
+	http.HandleFunc("/staking/unjail", api.handleStakingTransaction(TxTypeUnjail))
+	http.HandleFunc("/staking/validators", api.handleGetValidators)
+	http.HandleFunc("/staking/delegations", api.handleGetDelegations)
+	http.HandleFunc("/authorities", api.handleGetAuthorities)
+	http.HandleFunc("/consensus", api.handleGetConsensus)
+	http.HandleFunc("/forks", api.handleGetForks)
+	http.HandleFunc("/chainspec", api.handleGetChainSpec)
+	http.HandleFunc("/checkpoints", api.handleGetCheckpoints)
+	http.HandleFunc("/regtest/generate", api.handleGenerateBlocks)
+	http.HandleFunc("/regtest/settime", api.handleSetMockTime)
+	http.HandleFunc("/forks/signal", api.handleSignalFork)
+	http.HandleFunc("/authorities/propose", api.handleProposeAuthority)
+	http.HandleFunc("/authorities/discard", api.handleDiscardAuthority)
 	log.Printf("API server running on port %s", port)
 	return http.ListenAndServe(port, nil)
 }
@@ -82,6 +125,7 @@ func (api *NodeAPI) handleSendTransaction(w http.ResponseWriter, r *http.Request
 		http.Error(w, "Failed to add transaction to the mempool", http.StatusInternalServerError)
 		return
 	}
+	api.Node.RelayTransaction(tx)
 
 	json.NewEncoder(w).Encode(map[string]string{"status": "Transaction added to mempool"})
 }
@@ -100,12 +144,339 @@ func (api *NodeAPI) handleGetTransaction(w http.ResponseWriter, r *http.Request)
 	}
 
 	tx := api.Node.Blockchain.Mempool.GetTransaction(txID)
-	if tx == nil {
+	if tx != nil {
+		json.NewEncoder(w).Encode(tx)
+		return
+	}
+
+	// Fall back to the index for transactions that have already been confirmed
+	confirmedTx, location, found := api.Node.Blockchain.FindTransaction(txID)
+	if !found {
 		http.Error(w, "Transaction not found", http.StatusNotFound)
 		return
 	}
 
-	json.NewEncoder(w).Encode(tx)
+	json.NewEncoder(w).Encode(ConfirmedTransaction{Transaction: confirmedTx, Location: location})
+}
+
+// Handles requests for the confirmed transaction history of an address, one page at a time.
+func (api *NodeAPI) handleGetAddressHistory(w http.ResponseWriter, r *http.Request) {
+	address := r.URL.Query().Get("address")
+	if address == "" {
+		http.Error(w, "Address is required", http.StatusBadRequest)
+		return
+	}
+
+	indexer := api.Node.Blockchain.Indexer
+	if indexer == nil {
+		http.Error(w, "Transaction index is disabled", http.StatusNotImplemented)
+		return
+	}
+
+	page, limit := 1, DefaultHistoryPageSize
+	if value := r.URL.Query().Get("page"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed < 1 {
+			http.Error(w, "Invalid page", http.StatusBadRequest)
+			return
+		}
+		page = parsed
+	}
+	if value := r.URL.Query().Get("limit"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed < 1 || parsed > MaxHistoryPageSize {
+			http.Error(w, "Invalid limit", http.StatusBadRequest)
+			return
+		}
+		limit = parsed
+	}
+
+	entries, total := indexer.AddressHistory(address, page, limit)
+	json.NewEncoder(w).Encode(AddressHistoryPage{
+		Address: address,
+		Page:    page,
+		Limit:   limit,
+		Total:   total,
+		Entries: entries,
+	})
+}
+
+// Handles requests to list the banned subnets.
+func (api *NodeAPI) handleListBans(w http.ResponseWriter, r *http.Request) {
+	json.NewEncoder(w).Encode(api.Node.BanManager.List())
+}
+
+// Handles requests to ban a subnet or single IP. Duration is in seconds and defaults to DefaultBanDuration.
+func (api *NodeAPI) handleAddBan(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "POST required", http.StatusMethodNotAllowed)
+		return
+	}
+	var req struct {
+		Subnet   string `json:"subnet"`
+		Duration int64  `json:"duration"`
+		Reason   string `json:"reason"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	subnet, err := ParseSubnet(req.Subnet)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	duration := DefaultBanDuration
+	if req.Duration < 0 {
+		http.Error(w, "Invalid duration", http.StatusBadRequest)
+		return
+	} else if req.Duration > 0 {
+		duration = time.Duration(req.Duration) * time.Second
+	}
+	if req.Reason == "" {
+		req.Reason = "manually added"
+	}
+
+	if err := api.Node.BanSubnet(subnet, duration, req.Reason); err != nil {
+		http.Error(w, "Failed to save ban list", http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]string{"status": "Banned " + subnet.String()})
+}
+
+// Handles requests to lift the ban on a subnet or single IP.
+func (api *NodeAPI) handleRemoveBan(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "POST required", http.StatusMethodNotAllowed)
+		return
+	}
+	var req struct {
+		Subnet string `json:"subnet"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	subnet, err := ParseSubnet(req.Subnet)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	removed, err := api.Node.UnbanSubnet(subnet)
+	if err != nil {
+		http.Error(w, "Failed to save ban list", http.StatusInternalServerError)
+		return
+	}
+	if !removed {
+		http.Error(w, "Subnet is not banned", http.StatusNotFound)
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]string{"status": "Unbanned " + subnet.String()})
+}
+
+// Returns a handler that signs a staking transaction of the given type with the node's key, from the
+// node's validator address, and relays it. Bonds and unjailing are for the node itself; delegations
+// and unbonds name a validator, and an unbond without one releases the node's own bond.
+func (api *NodeAPI) handleStakingTransaction(txType string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "POST required", http.StatusMethodNotAllowed)
+			return
+		}
+		var req struct {
+			Validator string `json:"validator"`
+			Amount    int    `json:"amount"`
+			Fee       int    `json:"fee"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+
+		sender, err := ValidatorAddress(&api.Node.PrivateKey.PublicKey)
+		if err != nil {
+			http.Error(w, "Invalid node key", http.StatusInternalServerError)
+			return
+		}
+		tx := &Transaction{
+			Sender:    sender,
+			Amount:    req.Amount,
+			Fee:       req.Fee,
+			Nonce:     time.Now().UnixNano(), // Keeps repeated operations with the same amount distinct
+			Timestamp: time.Now().Unix(),
+			Type:      txType,
+			Validator: req.Validator,
+		}
+		if txType == TxTypeBond || txType == TxTypeUnjail {
+			tx.Validator = ""
+		}
+		if err := tx.Sign(api.Node.PrivateKey); err != nil {
+			http.Error(w, "Failed to sign transaction", http.StatusInternalServerError)
+			return
+		}
+		if err := api.Node.Blockchain.CheckStakingTransaction(tx); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if err := api.Node.Blockchain.Mempool.AddTransaction(tx, api.Node.Blockchain.Accounts, api.Node.Blockchain.UTXOSet); err != nil {
+			http.Error(w, "Failed to add transaction to the mempool: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		api.Node.RelayTransaction(tx)
+
+		json.NewEncoder(w).Encode(map[string]string{"status": "Staking transaction added to mempool", "id": tx.Hash()})
+	}
+}
+
+// Handles requests for the active validator set and the one taking over at the next epoch.
+func (api *NodeAPI) handleGetValidators(w http.ResponseWriter, r *http.Request) {
+	json.NewEncoder(w).Encode(api.Node.Blockchain.StakingSummary())
+}
+
+// Handles requests for what an address has bonded and is unbonding.
+func (api *NodeAPI) handleGetDelegations(w http.ResponseWriter, r *http.Request) {
+	address := r.URL.Query().Get("address")
+	if address == "" {
+		http.Error(w, "Address is required", http.StatusBadRequest)
+		return
+	}
+	delegations, unbonding := api.Node.Blockchain.Delegations(address)
+	json.NewEncoder(w).Encode(struct {
+		Address     string
+		Delegations []Delegation
+		Unbonding   []UnbondingEntry
+	}{address, delegations, unbonding})
+}
+
+// Handles requests for the consensus engine in force and the switches announced on chain.
+func (api *NodeAPI) handleGetConsensus(w http.ResponseWriter, r *http.Request) {
+	json.NewEncoder(w).Encode(api.Node.Blockchain.ConsensusSummary())
+}
+
+// Handles requests for the deployment state of every scheduled fork.
+func (api *NodeAPI) handleGetForks(w http.ResponseWriter, r *http.Request) {
+	json.NewEncoder(w).Encode(api.Node.Blockchain.ForkStatuses())
+}
+
+// Handles requests for the chain spec the node runs and its genesis hash.
+func (api *NodeAPI) handleGetChainSpec(w http.ResponseWriter, r *http.Request) {
+	json.NewEncoder(w).Encode(api.Node.Blockchain.ChainSpecSummary())
+}
+
+// Handles requests for the checkpoints and the assumed-valid block.
+func (api *NodeAPI) handleGetCheckpoints(w http.ResponseWriter, r *http.Request) {
+	json.NewEncoder(w).Encode(api.Node.Blockchain.CheckpointSummary())
+}
+
+// Handles requests to produce blocks on a regtest chain, returning their hashes.
+func (api *NodeAPI) handleGenerateBlocks(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "POST required", http.StatusMethodNotAllowed)
+		return
+	}
+	var req struct {
+		Count   int    `json:"count"`
+		Address string `json:"address"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	blocks, err := api.Node.Generate(req.Count, req.Address)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	hashes := make([]string, 0, len(blocks))
+	for _, block := range blocks {
+		hashes = append(hashes, block.Hash)
+	}
+	json.NewEncoder(w).Encode(hashes)
+}
+
+// Handles requests to set the clock of a regtest chain, given as Unix seconds.
+func (api *NodeAPI) handleSetMockTime(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "POST required", http.StatusMethodNotAllowed)
+		return
+	}
+	var req struct {
+		Time int64 `json:"time"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if err := api.Node.Blockchain.SetMockTime(time.Unix(req.Time, 0)); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]string{"status": "Clock set to " + time.Unix(req.Time, 0).UTC().Format(time.RFC3339)})
+}
+
+// Handles requests to signal readiness for a fork in the blocks this node produces.
+func (api *NodeAPI) handleSignalFork(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "POST required", http.StatusMethodNotAllowed)
+		return
+	}
+	var req struct {
+		Name string `json:"name"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if err := api.Node.Blockchain.UpgradeProtocol(req.Name); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]string{"status": "Signalling readiness for " + req.Name})
+}
+
+// Handles requests for the PoA authority set, the votes to change it and this node's proposals.
+func (api *NodeAPI) handleGetAuthorities(w http.ResponseWriter, r *http.Request) {
+	json.NewEncoder(w).Encode(api.Node.Blockchain.AuthoritySummary())
+}
+
+// Handles requests to vote, in the blocks this node seals, to add or remove an authority.
+func (api *NodeAPI) handleProposeAuthority(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "POST required", http.StatusMethodNotAllowed)
+		return
+	}
+	var req struct {
+		Address string `json:"address"`
+		Add     bool   `json:"add"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if err := api.Node.Blockchain.ProposeAuthority(req.Address, req.Add); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]string{"status": "Proposal recorded"})
+}
+
+// Handles requests to stop voting on an authority.
+func (api *NodeAPI) handleDiscardAuthority(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "POST required", http.StatusMethodNotAllowed)
+		return
+	}
+	var req struct {
+		Address string `json:"address"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	api.Node.Blockchain.DiscardAuthorityProposal(req.Address)
+	json.NewEncoder(w).Encode(map[string]string{"status": "Proposal discarded"})
 }
 
 // Sends a request to the NodeAPI to get the balance of a specific address.
@@ -182,3 +553,23 @@ func (api *NodeAPIClient) GetTransaction(txID string) (*Transaction, error) {
 
 	return &tx, nil
 }
+
+// Retrieves one page of an address's confirmed transaction history from the NodeAPI.
+func (api *NodeAPIClient) GetAddressHistory(address string, page, limit int) (*AddressHistoryPage, error) {
+	resp, err := http.Get(fmt.Sprintf("%s/history?address=%s&page=%d&limit=%d", api.BaseURL, address, page, limit))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to get address history: %s", resp.Status)
+	}
+
+	var history AddressHistoryPage
+	if err := json.NewDecoder(resp.Body).Decode(&history); err != nil {
+		return nil, err
+	}
+
+	return &history, nil
+}
@@ -0,0 +1,202 @@
+// node_handshake.go
+package main
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+const (
+	P2PProtocolVersion     = 1 // Version of the peer-to-peer protocol spoken by this node.
+	MinPeerProtocolVersion = 1 // Oldest peer protocol version we still talk to.
+	UserAgent              = "/go-blockchain:0.1.0/"
+	HandshakeTimeout       = 10 * time.Second // How long a peer has to complete the handshake.
+)
+
+// ServiceFlag describes what a node can do for its peers.
+type ServiceFlag uint64
+
+const (
+	ServiceFull   ServiceFlag = 1 << iota // Stores and serves the full block history.
+	ServicePruned                         // Validates everything but only serves recent blocks.
+	ServiceLight                          // Doesn't validate or serve blocks.
+	ServiceSeed                           // Only collects and serves peer addresses.
+)
+
+// VersionMessage is the first message each side sends on a connection. Peers must agree on the
+// chain before anything else is exchanged.
+type VersionMessage struct {
+	ProtocolVersion int
+	ChainID         string
+	GenesisHash     string
+	SpecHash        string // Hash of the chain spec's consensus parameters.
+	BestHeight      int
+	Services        ServiceFlag
+	PrunedHeight    int // Lowest height whose body the node can serve.
+	UserAgent       string
+	ListenAddress   string // Address the node accepts connections on.
+	Nonce           uint64 // Random per-node value used to detect connections to ourselves.
+	Timestamp       int64
+}
+
+// HasService reports whether the peer advertised the given service.
+func (v *VersionMessage) HasService(service ServiceFlag) bool {
+	return v.Services&service != 0
+}
+
+// newNodeNonce returns a random value identifying this node instance in handshakes.
+func newNodeNonce() uint64 {
+	var buf [8]byte
+	rand.Read(buf[:])
+	return binary.BigEndian.Uint64(buf[:])
+}
+
+// localServices works out which services this node offers.
+func (n *Node) localServices() ServiceFlag {
+	if n.Seed {
+		return ServiceSeed
+	}
+	if n.Light {
+		return ServiceLight
+	}
+	if n.Blockchain.PruneDepth > 0 {
+		return ServicePruned
+	}
+	return ServiceFull
+}
+
+// versionMessage describes this node for a handshake.
+func (n *Node) versionMessage() *VersionMessage {
+	n.Blockchain.lock.RLock()
+	genesisHash := n.Blockchain.Blocks[0].Hash
+	bestHeight := len(n.Blockchain.Blocks) - 1
+	prunedHeight := n.Blockchain.prunedBelow
+	n.Blockchain.lock.RUnlock()
+
+	return &VersionMessage{
+		ProtocolVersion: P2PProtocolVersion,
+		ChainID:         n.ChainID,
+		GenesisHash:     genesisHash,
+		SpecHash:        n.Blockchain.Spec.Hash(),
+		BestHeight:      bestHeight,
+		Services:        n.localServices(),
+		PrunedHeight:    prunedHeight,
+		UserAgent:       UserAgent,
+		ListenAddress:   n.Address,
+		Nonce:           n.nonce,
+		Timestamp:       n.Clock.Now().Unix(),
+	}
+}
+
+// checkVersion rejects peers we can't talk to.
+func (n *Node) checkVersion(version *VersionMessage) error {
+	if version.Nonce == n.nonce {
+		return errors.New("connected to self")
+	}
+	if version.ProtocolVersion < MinPeerProtocolVersion {
+		return fmt.Errorf("peer protocol version %d is older than the minimum %d", version.ProtocolVersion, MinPeerProtocolVersion)
+	}
+	if version.ChainID != n.ChainID {
+		return fmt.Errorf("peer is on chain %q, we are on %q", version.ChainID, n.ChainID)
+	}
+
+	n.Blockchain.lock.RLock()
+	genesisHash := n.Blockchain.Blocks[0].Hash
+	n.Blockchain.lock.RUnlock()
+	if version.GenesisHash != genesisHash {
+		return fmt.Errorf("peer genesis %s does not match ours %s", version.GenesisHash, genesisHash)
+	}
+	if specHash := n.Blockchain.Spec.Hash(); version.SpecHash != specHash {
+		return fmt.Errorf("peer chain spec %s does not match ours %s", version.SpecHash, specHash)
+	}
+	return nil
+}
+
+// initiateHandshake runs the dialing side of the handshake: send our version, check theirs and
+// exchange veracks.
+func (n *Node) initiateHandshake(conn io.ReadWriter) (*VersionMessage, error) {
+	if err := n.sendVersion(conn); err != nil {
+		return nil, err
+	}
+	version, err := n.receiveVersion(conn)
+	if err != nil {
+		return nil, err
+	}
+	if err := writeFrame(conn, Message{Type: MessageTypeVerack}); err != nil {
+		return nil, fmt.Errorf("failed to send verack: %w", err)
+	}
+	if err := receiveVerack(conn); err != nil {
+		return nil, err
+	}
+	return version, nil
+}
+
+// acceptHandshake runs the listening side of the handshake. The first message on an inbound
+// connection must be a version; anything else is a protocol violation.
+func (n *Node) acceptHandshake(conn io.ReadWriter) (*VersionMessage, error) {
+	version, err := n.receiveVersion(conn)
+	if err != nil {
+		return nil, err
+	}
+	if err := n.sendVersion(conn); err != nil {
+		return nil, err
+	}
+	// Answer the dialer's verack rather than sending ours alongside it, so the exchange runs in
+	// lockstep even over unbuffered connections
+	if err := receiveVerack(conn); err != nil {
+		return nil, err
+	}
+	if err := writeFrame(conn, Message{Type: MessageTypeVerack}); err != nil {
+		return nil, fmt.Errorf("failed to send verack: %w", err)
+	}
+	return version, nil
+}
+
+// sendVersion writes our version message.
+func (n *Node) sendVersion(w io.Writer) error {
+	payload, err := json.Marshal(n.versionMessage())
+	if err != nil {
+		return fmt.Errorf("failed to encode version: %w", err)
+	}
+	if err := writeFrame(w, Message{Type: MessageTypeVersion, Payload: payload}); err != nil {
+		return fmt.Errorf("failed to send version: %w", err)
+	}
+	return nil
+}
+
+// receiveVersion reads and checks the peer's version message.
+func (n *Node) receiveVersion(r io.Reader) (*VersionMessage, error) {
+	msg, err := readFrame(r)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read version: %w", err)
+	}
+	if msg.Type != MessageTypeVersion {
+		return nil, fmt.Errorf("protocol violation: expected version, got message type %d", msg.Type)
+	}
+
+	var version VersionMessage
+	if err := json.Unmarshal(msg.Payload, &version); err != nil {
+		return nil, fmt.Errorf("malformed version message: %w", err)
+	}
+	if err := n.checkVersion(&version); err != nil {
+		return nil, fmt.Errorf("incompatible peer: %w", err)
+	}
+	return &version, nil
+}
+
+// receiveVerack reads the peer's acknowledgement of our version.
+func receiveVerack(r io.Reader) error {
+	msg, err := readFrame(r)
+	if err != nil {
+		return fmt.Errorf("failed to read verack: %w", err)
+	}
+	if msg.Type != MessageTypeVerack {
+		return fmt.Errorf("protocol violation: expected verack, got message type %d", msg.Type)
+	}
+	return nil
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestHandshakeExchangesVersions(t *testing.T) {
+	dialer, listener := newTestNode(t), newTestNode(t)
+	generate(t, listener.Blockchain, "miner")
+	if err := listener.Blockchain.SetPruneDepth(10); err != nil {
+		t.Fatal(err)
+	}
+
+	local, remote := net.Pipe()
+	defer local.Close()
+	defer remote.Close()
+	accepted := make(chan *VersionMessage, 1)
+	go func() {
+		version, err := listener.acceptHandshake(remote)
+		if err != nil {
+			t.Error(err)
+		}
+		accepted <- version
+	}()
+
+	version, err := dialer.initiateHandshake(local)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version.BestHeight != 1 || !version.HasService(ServicePruned) || version.HasService(ServiceFull) {
+		t.Fatalf("listener advertised %+v, want a pruned node at height 1", version)
+	}
+	if theirs := <-accepted; theirs == nil || theirs.Nonce != dialer.nonce || !theirs.HasService(ServiceFull) {
+		t.Fatalf("dialer advertised %+v, want a full node", theirs)
+	}
+}
+
+func TestHandshakeRejectsIncompatiblePeers(t *testing.T) {
+	n := newTestNode(t)
+	for _, test := range []struct {
+		reason string
+		change func(*VersionMessage)
+	}{
+		{"connected to self", func(v *VersionMessage) { v.Nonce = n.nonce }},
+		{"older than the minimum", func(v *VersionMessage) { v.ProtocolVersion = MinPeerProtocolVersion - 1 }},
+		{"peer is on chain", func(v *VersionMessage) { v.ChainID = "other" }},
+		{"genesis", func(v *VersionMessage) { v.GenesisHash = "other" }},
+	} {
+		version := newTestNode(t).versionMessage()
+		test.change(version)
+		if err := n.checkVersion(version); err == nil || !strings.Contains(err.Error(), test.reason) {
+			t.Errorf("version %+v gave %v, want %q", version, err, test.reason)
+		}
+	}
+}
+
+func TestHandshakeRequiresVersionFirst(t *testing.T) {
+	n := newTestNode(t)
+	local, remote := net.Pipe()
+	defer local.Close()
+	defer remote.Close()
+	go writeFrame(local, Message{Type: MessageTypePing})
+
+	if _, err := n.acceptHandshake(remote); err == nil || !strings.Contains(err.Error(), "expected version") {
+		t.Fatalf("accepted a connection that opened with a ping: %v", err)
+	}
+}
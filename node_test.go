@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"testing"
+)
+
+// newTestNode returns a regtest node that isn't listening.
+func newTestNode(t *testing.T) *Node {
+	t.Helper()
+	key, _, err := GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewNode("127.0.0.1:0", NewBlockchainFromSpec(RegtestSpec), key)
+}
+
+// deliver hands a block to the node as if a peer had sent it.
+func deliver(t *testing.T, n *Node, block *Block) {
+	t.Helper()
+	payload, err := json.Marshal(block)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n.handleNewBlock(payload, nil)
+}
+
+// testPeer returns a peer of n on one end of an in-memory connection.
+func testPeer(t *testing.T, n *Node) *Peer {
+	t.Helper()
+	local, remote := net.Pipe()
+	t.Cleanup(func() {
+		local.Close()
+		remote.Close()
+	})
+	return newPeer(n, local, nil, "peer", true)
+}
+
+func TestHandleNewBlockIgnoresCopiesWithABadHash(t *testing.T) {
+	n := newTestNode(t)
+	block := generate(t, NewBlockchainFromSpec(RegtestSpec), "miner")
+
+	corrupted := *block
+	corrupted.Transactions = nil
+	corrupted.MerkleRoot = "corrupted"
+	deliver(t, n, &corrupted)
+	if n.recentlySeen.Has(block.Hash) {
+		t.Fatal("a copy that doesn't hash to the block's hash marked the block as seen")
+	}
+
+	deliver(t, n, block)
+	if tip := n.Blockchain.Tip(); tip.Hash != block.Hash {
+		t.Fatalf("real block was not connected after a corrupted copy, tip is %d", tip.Index)
+	}
+}
+
+func TestHandleNewBlockRetriesBlocksThatFailedToConnect(t *testing.T) {
+	n := newTestNode(t)
+	blocks, err := NewBlockchainFromSpec(RegtestSpec).GenerateBlocks(2, "miner", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The second block arrives first and can't connect yet
+	deliver(t, n, blocks[1])
+	deliver(t, n, blocks[0])
+	deliver(t, n, blocks[1])
+	if tip := n.Blockchain.Tip(); tip.Hash != blocks[1].Hash {
+		t.Fatalf("block that arrived early was not connected on its second delivery, tip is %d", tip.Index)
+	}
+}
+
+func TestHandleTransactionVerifiesSignatures(t *testing.T) {
+	n := newTestNode(t)
+	peer := testPeer(t, n)
+	key, address := newKeyAddress(t)
+	deliver(t, n, generate(t, NewBlockchainFromSpec(RegtestSpec), address))
+	n.Blockchain.Accounts[address] = NewAccount(address, BlockReward, nil)
+
+	tx := &Transaction{Sender: address, Recipient: "alice", Amount: 10, Fee: MinTransactionFee, Nonce: 1}
+	if err := tx.Sign(key); err != nil {
+		t.Fatal(err)
+	}
+	forged := *tx
+	forgerKey, _ := newKeyAddress(t)
+	if err := forged.Sign(forgerKey); err != nil {
+		t.Fatal(err)
+	}
+	send := func(tx *Transaction) {
+		payload, err := json.Marshal(tx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		n.handleTransaction(payload, peer)
+	}
+
+	send(&forged)
+	if n.Blockchain.Mempool.GetTransaction(tx.Hash()) != nil {
+		t.Fatal("mempool took a transaction signed by another key")
+	}
+	if n.recentlySeen.Has(tx.Hash()) {
+		t.Fatal("a forged copy marked the transaction as seen")
+	}
+	if score := n.misbehavior[addressHost(peer.conn.RemoteAddr().String())]; score != MisbehaviorInvalidSignature {
+		t.Fatalf("peer that sent a forged signature has score %d, want %d", score, MisbehaviorInvalidSignature)
+	}
+
+	send(tx)
+	if n.Blockchain.Mempool.GetTransaction(tx.Hash()) == nil {
+		t.Fatal("signed transaction was not accepted after a forged copy")
+	}
+	if !n.recentlySeen.Has(tx.Hash()) {
+		t.Fatal("accepted transaction was not marked as seen")
+	}
+}
@@ -0,0 +1,464 @@
+// noise.go
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	noiseProtocolName   = "Noise_XX_P256_AESGCM_SHA256"
+	noisePrologue       = "go-blockchain"
+	NoiseMaxMessageSize = 65535 // Largest handshake message or encrypted record, as in the Noise spec.
+	noiseTagSize        = 16
+)
+
+// The Noise transport authenticates peers by the node's own ECDSA key instead of a certificate.
+// It runs the Noise XX pattern over P-256:
+//
+//	-> e
+//	<- e, ee, s, es
+//	-> s, se
+//
+// Each side learns the other's static key during the handshake, so a peer's node ID is known and
+// can be checked against a pinned list before any protocol message is exchanged. Afterwards every
+// write is sealed with AES-GCM under per-direction keys.
+
+// NodeID identifies a node by the hex SHA-256 of its uncompressed public key.
+func NodeID(publicKey *ecdsa.PublicKey) (string, error) {
+	key, err := publicKey.ECDH()
+	if err != nil {
+		return "", err
+	}
+	return nodeIDFromECDH(key), nil
+}
+
+// nodeIDFromECDH derives a node ID from the ECDH form of its key.
+func nodeIDFromECDH(key *ecdh.PublicKey) string {
+	hash := sha256.Sum256(key.Bytes())
+	return hex.EncodeToString(hash[:])
+}
+
+// hkdf2 is the Noise HKDF with two outputs, built on HMAC-SHA256.
+func hkdf2(chainingKey, inputKeyMaterial []byte) ([]byte, []byte) {
+	extract := hmac.New(sha256.New, chainingKey)
+	extract.Write(inputKeyMaterial)
+	tempKey := extract.Sum(nil)
+
+	expand := hmac.New(sha256.New, tempKey)
+	expand.Write([]byte{0x01})
+	output1 := expand.Sum(nil)
+
+	expand = hmac.New(sha256.New, tempKey)
+	expand.Write(output1)
+	expand.Write([]byte{0x02})
+	output2 := expand.Sum(nil)
+	return output1, output2
+}
+
+// cipherState seals messages under one key with a counter nonce.
+type cipherState struct {
+	aead  cipher.AEAD
+	nonce uint64
+}
+
+// newCipherState creates an AES-256-GCM cipher state.
+func newCipherState(key []byte) (*cipherState, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &cipherState{aead: aead}, nil
+}
+
+// nextNonce returns the GCM nonce for the next message: four zero bytes then the big-endian counter.
+func (c *cipherState) nextNonce() ([]byte, error) {
+	if c.nonce == ^uint64(0) {
+		return nil, errors.New("noise: nonce exhausted")
+	}
+	nonce := make([]byte, 12)
+	binary.BigEndian.PutUint64(nonce[4:], c.nonce)
+	c.nonce++
+	return nonce, nil
+}
+
+func (c *cipherState) encrypt(ad, plaintext []byte) ([]byte, error) {
+	nonce, err := c.nextNonce()
+	if err != nil {
+		return nil, err
+	}
+	return c.aead.Seal(nil, nonce, plaintext, ad), nil
+}
+
+func (c *cipherState) decrypt(ad, ciphertext []byte) ([]byte, error) {
+	nonce, err := c.nextNonce()
+	if err != nil {
+		return nil, err
+	}
+	return c.aead.Open(nil, nonce, ciphertext, ad)
+}
+
+// symmetricState tracks the handshake transcript hash and chaining key.
+type symmetricState struct {
+	chainingKey []byte
+	hash        []byte
+	cipher      *cipherState // Nil until the first key is mixed in.
+}
+
+func newSymmetricState() *symmetricState {
+	hash := make([]byte, sha256.Size)
+	copy(hash, noiseProtocolName) // The name is shorter than a hash, so it is zero-padded
+	s := &symmetricState{chainingKey: append([]byte(nil), hash...), hash: hash}
+	s.mixHash([]byte(noisePrologue))
+	return s
+}
+
+func (s *symmetricState) mixHash(data []byte) {
+	h := sha256.New()
+	h.Write(s.hash)
+	h.Write(data)
+	s.hash = h.Sum(nil)
+}
+
+func (s *symmetricState) mixKey(inputKeyMaterial []byte) error {
+	var key []byte
+	s.chainingKey, key = hkdf2(s.chainingKey, inputKeyMaterial)
+	cs, err := newCipherState(key)
+	if err != nil {
+		return err
+	}
+	s.cipher = cs
+	return nil
+}
+
+func (s *symmetricState) encryptAndHash(plaintext []byte) ([]byte, error) {
+	ciphertext := plaintext
+	if s.cipher != nil {
+		var err error
+		if ciphertext, err = s.cipher.encrypt(s.hash, plaintext); err != nil {
+			return nil, err
+		}
+	}
+	s.mixHash(ciphertext)
+	return ciphertext, nil
+}
+
+func (s *symmetricState) decryptAndHash(ciphertext []byte) ([]byte, error) {
+	plaintext := ciphertext
+	if s.cipher != nil {
+		var err error
+		if plaintext, err = s.cipher.decrypt(s.hash, ciphertext); err != nil {
+			return nil, err
+		}
+	}
+	s.mixHash(ciphertext)
+	return plaintext, nil
+}
+
+// split derives the two transport keys: the first encrypts initiator to responder, the second
+// responder to initiator.
+func (s *symmetricState) split() (*cipherState, *cipherState, error) {
+	key1, key2 := hkdf2(s.chainingKey, nil)
+	c1, err := newCipherState(key1)
+	if err != nil {
+		return nil, nil, err
+	}
+	c2, err := newCipherState(key2)
+	if err != nil {
+		return nil, nil, err
+	}
+	return c1, c2, nil
+}
+
+// NoiseConn is a connection encrypted by the Noise transport.
+type NoiseConn struct {
+	net.Conn
+	send         *cipherState
+	recv         *cipherState
+	remoteStatic *ecdh.PublicKey
+	readBuf      []byte // Decrypted data not yet returned by Read.
+	readLock     sync.Mutex
+	writeLock    sync.Mutex
+}
+
+// RemoteNodeID returns the node ID the peer proved it holds the key for.
+func (c *NoiseConn) RemoteNodeID() string {
+	return nodeIDFromECDH(c.remoteStatic)
+}
+
+// Read decrypts the next record from the peer.
+func (c *NoiseConn) Read(p []byte) (int, error) {
+	c.readLock.Lock()
+	defer c.readLock.Unlock()
+
+	if len(c.readBuf) == 0 {
+		ciphertext, err := readNoiseMessage(c.Conn)
+		if err != nil {
+			return 0, err
+		}
+		plaintext, err := c.recv.decrypt(nil, ciphertext)
+		if err != nil {
+			return 0, fmt.Errorf("noise: %w", err)
+		}
+		c.readBuf = plaintext
+	}
+	n := copy(p, c.readBuf)
+	c.readBuf = c.readBuf[n:]
+	return n, nil
+}
+
+// Write encrypts p as one or more records. All of them go out in a single write to the underlying
+// connection, so a frame written in one call stays together on the wire.
+func (c *NoiseConn) Write(p []byte) (int, error) {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+
+	const maxPlaintext = NoiseMaxMessageSize - noiseTagSize
+	var out []byte
+	for remaining := p; len(remaining) > 0 || out == nil; {
+		chunk := remaining
+		if len(chunk) > maxPlaintext {
+			chunk = chunk[:maxPlaintext]
+		}
+		remaining = remaining[len(chunk):]
+
+		ciphertext, err := c.send.encrypt(nil, chunk)
+		if err != nil {
+			return 0, err
+		}
+		out = binary.BigEndian.AppendUint16(out, uint16(len(ciphertext)))
+		out = append(out, ciphertext...)
+	}
+	if _, err := c.Conn.Write(out); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// NoiseHandshake runs the Noise XX handshake over conn using the node's static ECDSA key and
+// returns the encrypted connection. initiator is true on the dialling side.
+func NoiseHandshake(conn net.Conn, static *ecdsa.PrivateKey, initiator bool) (*NoiseConn, error) {
+	staticKey, err := static.ECDH()
+	if err != nil {
+		return nil, fmt.Errorf("noise: node key can't be used for ECDH: %w", err)
+	}
+	ephemeral, err := ecdh.P256().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	state := newSymmetricState()
+	var remoteEphemeral, remoteStatic *ecdh.PublicKey
+	dh := func(private *ecdh.PrivateKey, public *ecdh.PublicKey) error {
+		shared, err := private.ECDH(public)
+		if err != nil {
+			return err
+		}
+		return state.mixKey(shared)
+	}
+
+	if initiator {
+		// -> e
+		if err := writeNoiseMessage(conn, ephemeral.PublicKey().Bytes()); err != nil {
+			return nil, err
+		}
+		state.mixHash(ephemeral.PublicKey().Bytes())
+		state.mixHash(nil) // Empty payload
+
+		// <- e, ee, s, es
+		message, err := readNoiseMessage(conn)
+		if err != nil {
+			return nil, err
+		}
+		if remoteEphemeral, message, err = readNoiseKey(message); err != nil {
+			return nil, err
+		}
+		state.mixHash(remoteEphemeral.Bytes())
+		if err := dh(ephemeral, remoteEphemeral); err != nil {
+			return nil, err
+		}
+		if remoteStatic, message, err = decryptNoiseKey(state, message); err != nil {
+			return nil, err
+		}
+		if err := dh(ephemeral, remoteStatic); err != nil {
+			return nil, err
+		}
+		if _, err := state.decryptAndHash(message); err != nil {
+			return nil, fmt.Errorf("noise: %w", err)
+		}
+
+		// -> s, se
+		encryptedStatic, err := state.encryptAndHash(staticKey.PublicKey().Bytes())
+		if err != nil {
+			return nil, err
+		}
+		if err := dh(staticKey, remoteEphemeral); err != nil {
+			return nil, err
+		}
+		payload, err := state.encryptAndHash(nil)
+		if err != nil {
+			return nil, err
+		}
+		if err := writeNoiseMessage(conn, append(encryptedStatic, payload...)); err != nil {
+			return nil, err
+		}
+	} else {
+		// -> e
+		message, err := readNoiseMessage(conn)
+		if err != nil {
+			return nil, err
+		}
+		if remoteEphemeral, message, err = readNoiseKey(message); err != nil {
+			return nil, err
+		}
+		state.mixHash(remoteEphemeral.Bytes())
+		if _, err := state.decryptAndHash(message); err != nil {
+			return nil, err
+		}
+
+		// <- e, ee, s, es
+		reply := append([]byte(nil), ephemeral.PublicKey().Bytes()...)
+		state.mixHash(ephemeral.PublicKey().Bytes())
+		if err := dh(ephemeral, remoteEphemeral); err != nil {
+			return nil, err
+		}
+		encryptedStatic, err := state.encryptAndHash(staticKey.PublicKey().Bytes())
+		if err != nil {
+			return nil, err
+		}
+		reply = append(reply, encryptedStatic...)
+		if err := dh(staticKey, remoteEphemeral); err != nil {
+			return nil, err
+		}
+		payload, err := state.encryptAndHash(nil)
+		if err != nil {
+			return nil, err
+		}
+		if err := writeNoiseMessage(conn, append(reply, payload...)); err != nil {
+			return nil, err
+		}
+
+		// -> s, se
+		if message, err = readNoiseMessage(conn); err != nil {
+			return nil, err
+		}
+		if remoteStatic, message, err = decryptNoiseKey(state, message); err != nil {
+			return nil, err
+		}
+		if err := dh(ephemeral, remoteStatic); err != nil {
+			return nil, err
+		}
+		if _, err := state.decryptAndHash(message); err != nil {
+			return nil, fmt.Errorf("noise: %w", err)
+		}
+	}
+
+	c1, c2, err := state.split()
+	if err != nil {
+		return nil, err
+	}
+	noiseConn := &NoiseConn{Conn: conn, send: c1, recv: c2, remoteStatic: remoteStatic}
+	if !initiator {
+		noiseConn.send, noiseConn.recv = c2, c1
+	}
+	return noiseConn, nil
+}
+
+// noiseKeySize is the length of an uncompressed P-256 point.
+const noiseKeySize = 65
+
+// readNoiseKey takes a cleartext public key off the front of a handshake message.
+func readNoiseKey(message []byte) (*ecdh.PublicKey, []byte, error) {
+	if len(message) < noiseKeySize {
+		return nil, nil, errors.New("noise: handshake message too short")
+	}
+	key, err := ecdh.P256().NewPublicKey(message[:noiseKeySize])
+	if err != nil {
+		return nil, nil, fmt.Errorf("noise: invalid public key: %w", err)
+	}
+	return key, message[noiseKeySize:], nil
+}
+
+// decryptNoiseKey takes an encrypted static key off the front of a handshake message.
+func decryptNoiseKey(state *symmetricState, message []byte) (*ecdh.PublicKey, []byte, error) {
+	if len(message) < noiseKeySize+noiseTagSize {
+		return nil, nil, errors.New("noise: handshake message too short")
+	}
+	plaintext, err := state.decryptAndHash(message[:noiseKeySize+noiseTagSize])
+	if err != nil {
+		return nil, nil, fmt.Errorf("noise: %w", err)
+	}
+	key, err := ecdh.P256().NewPublicKey(plaintext)
+	if err != nil {
+		return nil, nil, fmt.Errorf("noise: invalid static key: %w", err)
+	}
+	return key, message[noiseKeySize+noiseTagSize:], nil
+}
+
+// writeNoiseMessage sends a message prefixed with its two-byte length, in a single write.
+func writeNoiseMessage(w io.Writer, message []byte) error {
+	if len(message) > NoiseMaxMessageSize {
+		return errors.New("noise: message too large")
+	}
+	_, err := w.Write(append(binary.BigEndian.AppendUint16(nil, uint16(len(message))), message...))
+	return err
+}
+
+// readNoiseMessage reads one length-prefixed message.
+func readNoiseMessage(r io.Reader) ([]byte, error) {
+	var length [2]byte
+	if _, err := io.ReadFull(r, length[:]); err != nil {
+		return nil, err
+	}
+	message := make([]byte, binary.BigEndian.Uint16(length[:]))
+	if _, err := io.ReadFull(r, message); err != nil {
+		return nil, err
+	}
+	return message, nil
+}
+
+const (
+	EncryptionTLS   = "tls"   // Connections use TLS with the node's certificate.
+	EncryptionNoise = "noise" // Connections use the Noise handshake with the node's identity key.
+)
+
+// noiseHandshake secures conn with the node's identity key and checks the peer's node ID against
+// the pinned list, if there is one. conn is closed if anything fails.
+func (n *Node) noiseHandshake(conn net.Conn, initiator bool) (*NoiseConn, error) {
+	conn.SetDeadline(time.Now().Add(HandshakeTimeout))
+	noiseConn, err := NoiseHandshake(conn, n.PrivateKey, initiator)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	if len(n.PinnedNodeIDs) == 0 {
+		return noiseConn, nil
+	}
+	remoteID := noiseConn.RemoteNodeID()
+	for _, pinned := range n.PinnedNodeIDs {
+		if strings.EqualFold(strings.TrimSpace(pinned), remoteID) {
+			return noiseConn, nil
+		}
+	}
+	conn.Close()
+	return nil, fmt.Errorf("peer node ID %s is not pinned", remoteID)
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"strings"
+	"testing"
+)
+
+// noisePair runs the Noise handshake between two nodes over an in-memory connection and returns
+// both ends, the initiator's first. The raw connections are closed when the test ends.
+func noisePair(t *testing.T, initiator, responder *Node) (*NoiseConn, *NoiseConn, error, error) {
+	t.Helper()
+	local, remote := net.Pipe()
+	t.Cleanup(func() {
+		local.Close()
+		remote.Close()
+	})
+	type result struct {
+		conn *NoiseConn
+		err  error
+	}
+	accepted := make(chan result, 1)
+	go func() {
+		conn, err := responder.noiseHandshake(remote, false)
+		accepted <- result{conn, err}
+	}()
+	dialled, dialErr := initiator.noiseHandshake(local, true)
+	if dialErr != nil {
+		local.Close() // Unblocks the responder if it is still waiting
+	}
+	r := <-accepted
+	return dialled, r.conn, dialErr, r.err
+}
+
+func TestNoiseHandshakeAuthenticatesBothSides(t *testing.T) {
+	alice, bob := newTestNode(t), newTestNode(t)
+	a, b, err, acceptErr := noisePair(t, alice, bob)
+	if err != nil || acceptErr != nil {
+		t.Fatalf("handshake failed: %v, %v", err, acceptErr)
+	}
+	aliceID, _ := NodeID(&alice.PrivateKey.PublicKey)
+	bobID, _ := NodeID(&bob.PrivateKey.PublicKey)
+	if a.RemoteNodeID() != bobID || b.RemoteNodeID() != aliceID {
+		t.Fatal("a side did not learn the other's node ID")
+	}
+
+	// Frames survive the trip both ways, including ones larger than a single record
+	large := bytes.Repeat([]byte("x"), 3*NoiseMaxMessageSize)
+	go func() {
+		writeFrame(a, Message{Type: MessageTypeResponseBlockchain, Payload: large})
+		writeFrame(a, Message{Type: MessageTypeVerack})
+	}()
+	if msg, err := readFrame(b); err != nil || !bytes.Equal(msg.Payload, large) {
+		t.Fatalf("large frame arrived as %d bytes, %v", len(msg.Payload), err)
+	}
+	if msg, err := readFrame(b); err != nil || msg.Type != MessageTypeVerack {
+		t.Fatalf("second frame arrived as %+v, %v", msg, err)
+	}
+	go writeFrame(b, Message{Type: MessageTypeGetAddr})
+	if msg, err := readFrame(a); err != nil || msg.Type != MessageTypeGetAddr {
+		t.Fatalf("reply arrived as %+v, %v", msg, err)
+	}
+}
+
+func TestNoiseRejectsUnpinnedPeersAndForgedRecords(t *testing.T) {
+	alice, bob := newTestNode(t), newTestNode(t)
+	alice.PinnedNodeIDs = []string{strings.Repeat("0", 64)}
+	if _, _, err, _ := noisePair(t, alice, bob); err == nil || !strings.Contains(err.Error(), "not pinned") {
+		t.Fatalf("connected to a peer that isn't pinned: %v", err)
+	}
+
+	alice.PinnedNodeIDs = nil
+	local, remote := net.Pipe()
+	defer local.Close()
+	defer remote.Close()
+	accepted := make(chan *NoiseConn, 1)
+	go func() {
+		conn, _ := bob.noiseHandshake(remote, false)
+		accepted <- conn
+	}()
+	if _, err := alice.noiseHandshake(local, true); err != nil {
+		t.Fatal(err)
+	}
+	b := <-accepted
+
+	// A record that wasn't encrypted with the session key is refused
+	go local.Write([]byte{0, 20, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 17, 18, 19, 20})
+	if _, err := b.Read(make([]byte, 16)); err == nil {
+		t.Fatal("read a record that was not encrypted with the session key")
+	}
+}
@@ -0,0 +1,191 @@
+// peer.go
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	PeerSendQueueSize = 64               // Messages that can wait to be written to a peer.
+	PingInterval      = 30 * time.Second // How often an idle session is pinged.
+	PeerIdleTimeout   = 90 * time.Second // A peer that sends nothing for this long is disconnected.
+	PeerWriteTimeout  = 30 * time.Second // Longest a single frame may take to write.
+)
+
+// Peer is a long-lived session with another node. Messages are written by a single writer
+// goroutine from the send queue and read by a single reader goroutine, so the connection can be
+// used in both directions at once.
+type Peer struct {
+	Address   string          // Listen address the peer advertised, or its remote address if it has none.
+	Version   *VersionMessage // What the peer advertised in its handshake.
+	Inbound   bool            // Whether the peer dialled us.
+	conn      net.Conn
+	node      *Node
+	sendQueue chan Message
+	quit      chan struct{}
+	closeOnce sync.Once
+
+	knownInventory *inventorySet // Objects the peer is known to have, so they aren't announced to it.
+	trickleQueue   []InvVector   // Transaction announcements waiting for the next trickle.
+	trickleLock    sync.Mutex
+
+	answeredGetAddr bool // Whether the peer's getaddr has been answered; only touched by the message loop.
+
+	inbound chan Message // Messages read from the peer waiting to be handled.
+	limiter *peerLimiter
+}
+
+// newPeer wraps a connection that has completed the handshake.
+func newPeer(node *Node, conn net.Conn, version *VersionMessage, address string, inbound bool) *Peer {
+	return &Peer{
+		Address:   address,
+		Version:   version,
+		Inbound:   inbound,
+		conn:      conn,
+		node:      node,
+		sendQueue: make(chan Message, PeerSendQueueSize),
+		quit:      make(chan struct{}),
+
+		knownInventory: newInventorySet(MaxPeerKnownInventory),
+
+		inbound: make(chan Message, PeerInboundQueueSize),
+		limiter: newPeerLimiter(),
+	}
+}
+
+// dialerNonce is the nonce of the node that opened the connection. When two nodes connect to each
+// other at the same time both sides keep the session dialled by the lower nonce.
+func (p *Peer) dialerNonce() uint64 {
+	if p.Inbound {
+		return p.Version.Nonce
+	}
+	return p.node.nonce
+}
+
+// Send queues a message for the peer. A peer that can't keep up with its queue is disconnected
+// rather than being allowed to hold up the sender. Returns false if the message was not queued.
+func (p *Peer) Send(msg Message) bool {
+	select {
+	case <-p.quit:
+		return false
+	default:
+	}
+
+	select {
+	case p.sendQueue <- msg:
+		return true
+	case <-p.quit:
+		return false
+	default:
+		log.Printf("Send queue to %s is full, disconnecting", p.Address)
+		p.Close()
+		return false
+	}
+}
+
+// Close ends the session. It is safe to call more than once and from any goroutine.
+func (p *Peer) Close() {
+	p.closeOnce.Do(func() {
+		close(p.quit)
+		p.conn.Close()
+		p.node.removePeer(p)
+	})
+}
+
+// run services the session until it is closed.
+func (p *Peer) run() {
+	p.node.wg.Add(2)
+	go p.writeLoop()
+	go p.readLoop()
+}
+
+// writeLoop writes queued messages to the connection, pings the peer on a timer and trickles
+// out transaction announcements.
+func (p *Peer) writeLoop() {
+	defer p.node.wg.Done()
+	defer p.Close()
+
+	ticker := time.NewTicker(PingInterval)
+	defer ticker.Stop()
+	trickle := time.NewTimer(trickleDelay())
+	defer trickle.Stop()
+
+	for {
+		var msg Message
+		select {
+		case msg = <-p.sendQueue:
+		case <-trickle.C:
+			p.flushTrickle()
+			trickle.Reset(trickleDelay())
+			continue
+		case <-ticker.C:
+			msg = Message{Type: MessageTypePing, Payload: binary.BigEndian.AppendUint64(nil, newNodeNonce())}
+		case <-p.quit:
+			return
+		}
+
+		p.conn.SetWriteDeadline(time.Now().Add(PeerWriteTimeout))
+		if err := writeFrame(p.conn, msg); err != nil {
+			log.Printf("Failed to send message to peer %s: %v", p.Address, err)
+			return
+		}
+	}
+}
+
+// readLoop reads frames from the connection, answers keepalives itself and queues everything
+// else for the node's message loop. When the peer's queue is full the loop stops reading, which
+// slows that peer down without holding up anyone else.
+func (p *Peer) readLoop() {
+	defer p.node.wg.Done()
+	defer p.Close()
+
+	for {
+		p.conn.SetReadDeadline(time.Now().Add(PeerIdleTimeout))
+		msg, err := readFrame(p.conn)
+		if err != nil {
+			if errors.Is(err, ErrMalformedFrame) {
+				p.node.Misbehaving(p, MisbehaviorProtocolViolation, err.Error())
+			}
+			select {
+			case <-p.quit:
+			default:
+				log.Printf("Connection to peer %s lost: %v", p.Address, err)
+			}
+			return
+		}
+
+		if !p.limiter.Allow(msg.Type, msg.Payload) {
+			p.node.Misbehaving(p, MisbehaviorRateLimited, fmt.Sprintf("message type %d over its rate limit", msg.Type))
+			continue
+		}
+
+		switch msg.Type {
+		case MessageTypePing:
+			p.Send(Message{Type: MessageTypePong, Payload: msg.Payload})
+		case MessageTypePong:
+			// Receiving anything resets the idle timeout, which is all a pong is for
+		case MessageTypeVersion, MessageTypeVerack:
+			p.node.Misbehaving(p, MisbehaviorProtocolViolation, "repeated handshake message")
+			return
+		default:
+			msg.from = p
+			select {
+			case p.inbound <- msg:
+			case <-p.quit:
+				return
+			}
+			// One ready token per queued message, so the message loop takes turns between peers
+			select {
+			case p.node.ready <- p:
+			case <-p.quit:
+				return
+			}
+		}
+	}
+}
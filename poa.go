@@ -0,0 +1,300 @@
+// poa.go
+package main
+
+import (
+	"crypto/ecdsa"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// Under Proof of Authority a configured set of authorities take turns sealing blocks: the block at
+// height h in round r belongs to signer (h + r) mod n of the sorted set, so if an authority is
+// offline the next one takes over once its slot's round has passed. Blocks use the same proposer,
+// round and signature fields as PoS. An authority changes the set by proposing to add or remove an
+// address in a block it seals; once more than half of the authorities have proposed the same
+// change it takes effect.
+
+// AuthorityProposal is a sealer's vote, carried in its block, to add or remove an authority.
+type AuthorityProposal struct {
+	Target string // Validator address to add or remove.
+	Add    bool   // Whether to add Target rather than remove it.
+}
+
+// key identifies the change, so votes for it can be tallied.
+func (p *AuthorityProposal) key() string {
+	if p.Add {
+		return "+" + p.Target
+	}
+	return "-" + p.Target
+}
+
+// AuthorityState is the authority set as of a block and the votes to change it.
+type AuthorityState struct {
+	Signers []string                   // Authority addresses, sorted.
+	Votes   map[string]map[string]bool // Authorities voting for each pending change, by change key.
+}
+
+// NewAuthorityState returns a state with the given signers and no votes.
+func NewAuthorityState(signers []string) *AuthorityState {
+	state := &AuthorityState{Votes: make(map[string]map[string]bool)}
+	seen := make(map[string]bool)
+	for _, signer := range signers {
+		if !seen[signer] {
+			seen[signer] = true
+			state.Signers = append(state.Signers, signer)
+		}
+	}
+	sort.Strings(state.Signers)
+	return state
+}
+
+// Clone returns a deep copy, so the state before a block can be kept to undo it.
+func (a *AuthorityState) Clone() *AuthorityState {
+	clone := NewAuthorityState(a.Signers)
+	for change, voters := range a.Votes {
+		clone.Votes[change] = make(map[string]bool, len(voters))
+		for voter := range voters {
+			clone.Votes[change][voter] = true
+		}
+	}
+	return clone
+}
+
+// equal reports whether two states hold the same signers and votes. A nil state is the same as an
+// empty one.
+func (a *AuthorityState) equal(other *AuthorityState) bool {
+	if other == nil {
+		other = NewAuthorityState(nil)
+	}
+	x, errX := json.Marshal(a.Clone())
+	y, errY := json.Marshal(other.Clone())
+	return errX == nil && errY == nil && string(x) == string(y)
+}
+
+// IsSigner reports whether address is an authority.
+func (a *AuthorityState) IsSigner(address string) bool {
+	i := sort.SearchStrings(a.Signers, address)
+	return i < len(a.Signers) && a.Signers[i] == address
+}
+
+// SignerFor returns the authority entitled to seal the block at height in the given round, or ""
+// if there are no authorities.
+func (a *AuthorityState) SignerFor(height, round int) string {
+	if len(a.Signers) == 0 {
+		return ""
+	}
+	return a.Signers[(height+round)%len(a.Signers)]
+}
+
+// checkProposal reports whether a proposal would change the set.
+func (a *AuthorityState) checkProposal(p *AuthorityProposal) error {
+	if _, err := parseValidatorAddress(p.Target); err != nil {
+		return err
+	}
+	switch {
+	case p.Add && a.IsSigner(p.Target):
+		return fmt.Errorf("%s is already an authority", shortValidator(p.Target))
+	case !p.Add && !a.IsSigner(p.Target):
+		return fmt.Errorf("%s is not an authority", shortValidator(p.Target))
+	case !p.Add && len(a.Signers) == 1:
+		return errors.New("cannot remove the last authority")
+	}
+	return nil
+}
+
+// apply counts the vote carried by a PoA block, enacting the change once a majority of the
+// authorities have voted for it.
+func (a *AuthorityState) apply(block *Block) {
+	p := block.AuthorityProposal
+	if p == nil || !a.IsSigner(block.Proposer) || a.checkProposal(p) != nil {
+		return
+	}
+	change := p.key()
+	if a.Votes[change] == nil {
+		a.Votes[change] = make(map[string]bool)
+	}
+	a.Votes[change][block.Proposer] = true
+	if len(a.Votes[change]) <= len(a.Signers)/2 {
+		return
+	}
+
+	delete(a.Votes, change)
+	signers := make([]string, 0, len(a.Signers)+1) // A fresh slice, since the old one may be shared
+	for _, signer := range a.Signers {
+		if signer != p.Target {
+			signers = append(signers, signer)
+		}
+	}
+	if p.Add {
+		a.Signers = NewAuthorityState(append(signers, p.Target)).Signers
+		return
+	}
+	a.Signers = signers
+	for change, voters := range a.Votes { // A removed authority's votes no longer count
+		delete(voters, p.Target)
+		if len(voters) == 0 {
+			delete(a.Votes, change)
+		}
+	}
+}
+
+// verifyAuthority checks that a PoA block was sealed by the authority whose turn it was, that its
+// timestamp fits the round it claims, and that any vote it carries would change the
+// set. The signature is checked with the rest of the header. Callers must hold the lock.
+func (bc *Blockchain) verifyAuthority(block, previous *Block) error {
+	if err := checkRoundTime(block, previous, bc.Clock.Now()); err != nil {
+		return err
+	}
+	if signer := bc.Authorities.SignerFor(block.Index, block.Round); signer != block.Proposer {
+		return fmt.Errorf("block %d was sealed by %s out of turn", block.Index, shortValidator(block.Proposer))
+	}
+	if block.AuthorityProposal != nil {
+		if err := bc.Authorities.checkProposal(block.AuthorityProposal); err != nil {
+			return fmt.Errorf("block %d carries an invalid authority vote: %w", block.Index, err)
+		}
+	}
+	return nil
+}
+
+// SetAuthorities configures the authorities a PoA chain starts with. It must be called before the
+// chain has blocks beyond genesis, since every node has to replay votes from the same set.
+func (bc *Blockchain) SetAuthorities(signers []string) error {
+	for _, signer := range signers {
+		if _, err := parseValidatorAddress(signer); err != nil {
+			return fmt.Errorf("authority %s: %w", shortValidator(signer), err)
+		}
+	}
+	bc.lock.Lock()
+	defer bc.lock.Unlock()
+	if len(bc.Blocks) > 1 {
+		return errors.New("authorities can only be configured before the first block")
+	}
+	bc.Authorities = NewAuthorityState(signers)
+	bc.genesisAuthorities = bc.Authorities.Clone().Signers
+	return nil
+}
+
+// ProposeAuthority makes this node vote, in each block it seals, to add or remove target until the
+// change takes effect or the proposal is discarded.
+func (bc *Blockchain) ProposeAuthority(target string, add bool) error {
+	if _, err := parseValidatorAddress(target); err != nil {
+		return err
+	}
+	bc.lock.Lock()
+	defer bc.lock.Unlock()
+	bc.authorityProposals[target] = add
+	return nil
+}
+
+// DiscardAuthorityProposal stops this node voting on target.
+func (bc *Blockchain) DiscardAuthorityProposal(target string) {
+	bc.lock.Lock()
+	defer bc.lock.Unlock()
+	delete(bc.authorityProposals, target)
+}
+
+// nextProposal picks a proposal of this node's that would still change the set and that signer has
+// not voted for yet. Callers must hold the lock.
+func (bc *Blockchain) nextProposal(signer string) *AuthorityProposal {
+	targets := make([]string, 0, len(bc.authorityProposals))
+	for target := range bc.authorityProposals {
+		targets = append(targets, target)
+	}
+	sort.Strings(targets)
+	for _, target := range targets {
+		proposal := &AuthorityProposal{Target: target, Add: bc.authorityProposals[target]}
+		if bc.Authorities.checkProposal(proposal) == nil && !bc.Authorities.Votes[proposal.key()][signer] {
+			return proposal
+		}
+	}
+	return nil
+}
+
+// AuthoritySummary describes the authority set for the API.
+type AuthoritySummary struct {
+	Signers   []string
+	Votes     map[string][]string // Authorities voting for each pending change, by change key ("+" or "-" and the address).
+	Proposals map[string]bool     // This node's own proposals, by address: true to add, false to remove.
+}
+
+// AuthoritySummary returns the authority set, the pending votes and this node's proposals.
+func (bc *Blockchain) AuthoritySummary() AuthoritySummary {
+	bc.lock.RLock()
+	defer bc.lock.RUnlock()
+	state := bc.Authorities.Clone()
+	summary := AuthoritySummary{
+		Signers:   state.Signers,
+		Votes:     make(map[string][]string),
+		Proposals: make(map[string]bool),
+	}
+	for change, voters := range state.Votes {
+		for voter := range voters {
+			summary.Votes[change] = append(summary.Votes[change], voter)
+		}
+		sort.Strings(summary.Votes[change])
+	}
+	for target, add := range bc.authorityProposals {
+		summary.Proposals[target] = add
+	}
+	return summary
+}
+
+// PoAEngine has the authorities seal blocks in turn, and follows the longest chain.
+type PoAEngine struct{}
+
+// Name implements ConsensusEngine.
+func (PoAEngine) Name() string { return "PoA" }
+
+// Prepare implements ConsensusEngine. Only the authority whose turn it is may seal the block, and
+// it carries one of the node's pending authority proposals.
+func (PoAEngine) Prepare(bc *Blockchain, key *ecdsa.PrivateKey) (*Block, error) {
+	lastBlock := bc.Blocks[len(bc.Blocks)-1]
+	round := slotRound(lastBlock, bc.Clock.Now())
+	signer := bc.Authorities.SignerFor(len(bc.Blocks), round)
+	if signer == "" {
+		return nil, errors.New("no authorities are configured")
+	}
+	if key == nil {
+		return nil, errNoKey
+	}
+	address, err := ValidatorAddress(&key.PublicKey)
+	if err != nil {
+		return nil, fmt.Errorf("invalid authority key: %w", err)
+	}
+	if signer != address {
+		return nil, fmt.Errorf("round %d belongs to authority %s, not this one", round, shortValidator(signer))
+	}
+	return &Block{
+		Index:             len(bc.Blocks),
+		PreviousHash:      lastBlock.Hash,
+		Difficulty:        lastBlock.Difficulty,
+		Proposer:          signer,
+		Round:             round,
+		AuthorityProposal: bc.nextProposal(signer),
+	}, nil
+}
+
+// Seal implements ConsensusEngine by signing the block.
+func (PoAEngine) Seal(block *Block, key *ecdsa.PrivateKey) error {
+	return signBlock(block, key)
+}
+
+// VerifyHeader implements ConsensusEngine.
+func (PoAEngine) VerifyHeader(bc *Blockchain, block, previous *Block) error {
+	if block.Proposer == "" {
+		return fmt.Errorf("block %d is mined but its height runs PoA", block.Index)
+	}
+	return bc.verifyAuthority(block, previous)
+}
+
+// Finalize implements ConsensusEngine by counting the block's authority vote.
+func (PoAEngine) Finalize(staking *StakingState, authorities *AuthorityState, block *Block) {
+	authorities.apply(block)
+}
+
+// SelectFork implements ConsensusEngine with preferSlotChain.
+func (PoAEngine) SelectFork(bc *Blockchain, candidate []*Block) bool {
+	return preferSlotChain(bc, candidate)
+}
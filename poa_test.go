@@ -0,0 +1,140 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"strings"
+	"testing"
+	"time"
+)
+
+// authorityChains returns a sealing PoA regtest chain and a follower, both run by clock and
+// started with n authorities, along with the authorities' keys by address.
+func authorityChains(t *testing.T, n int) (*Blockchain, *Blockchain, *MockClock, map[string]*ecdsa.PrivateKey) {
+	t.Helper()
+	keys := make(map[string]*ecdsa.PrivateKey)
+	var signers []string
+	for i := 0; i < n; i++ {
+		key, address := newKeyAddress(t)
+		keys[address] = key
+		signers = append(signers, address)
+	}
+	clock := NewMockClock(time.Unix(RegtestSpec.GenesisTimestamp, 0))
+	var chains []*Blockchain
+	for i := 0; i < 2; i++ {
+		bc := NewBlockchainFromSpec(RegtestSpec)
+		bc.Clock = clock
+		if err := bc.SetAuthorities(signers); err != nil {
+			t.Fatal(err)
+		}
+		if err := bc.SetConsensusAlgorithm("PoA"); err != nil {
+			t.Fatal(err)
+		}
+		chains = append(chains, bc)
+	}
+	return chains[0], chains[1], clock, keys
+}
+
+// seal has the authority whose turn it is seal the next block a second after the last.
+func seal(t *testing.T, bc *Blockchain, clock *MockClock, keys map[string]*ecdsa.PrivateKey) *Block {
+	t.Helper()
+	clock.Advance(time.Second)
+	block, err := bc.GenerateBlocks(1, "unused", keys[bc.Authorities.SignerFor(len(bc.Blocks), 0)])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return block[0]
+}
+
+func TestPoAAuthoritiesSealInTurn(t *testing.T) {
+	bc, follower, clock, keys := authorityChains(t, 3)
+	for height := 1; height <= 6; height++ {
+		for address, key := range keys {
+			if address != bc.Authorities.SignerFor(height, 0) {
+				if _, err := bc.GenerateBlocks(1, "unused", key); err == nil {
+					t.Fatalf("authority %s sealed block %d out of turn", shortValidator(address), height)
+				}
+			}
+		}
+		block := seal(t, bc, clock, keys)
+		if block.Proposer != bc.Authorities.Signers[height%3] {
+			t.Fatalf("block %d sealed by %s, want the next authority in the rotation", height, shortValidator(block.Proposer))
+		}
+		if err := follower.AcceptBlock(block); err != nil {
+			t.Fatalf("follower rejected block %d: %v", height, err)
+		}
+	}
+
+	// Once a slot has passed the next authority takes over
+	clock.Advance(SlotDuration)
+	backup := bc.Authorities.SignerFor(len(bc.Blocks), 1)
+	blocks, err := bc.GenerateBlocks(1, "unused", keys[backup])
+	if err != nil {
+		t.Fatalf("backup authority could not seal after a missed slot: %v", err)
+	}
+	if err := follower.AcceptBlock(blocks[0]); err != nil {
+		t.Fatalf("follower rejected the backup's block: %v", err)
+	}
+}
+
+func TestPoARejectsBlocksSealedOutOfTurn(t *testing.T) {
+	bc, follower, clock, keys := authorityChains(t, 3)
+	block := seal(t, bc, clock, keys)
+
+	forged := *block
+	forged.Proposer = bc.Authorities.SignerFor(block.Index, 1) // Its round hasn't started
+	forged.Hash = forged.calculateHash()
+	if err := signBlock(&forged, keys[forged.Proposer]); err != nil {
+		t.Fatal(err)
+	}
+	if err := follower.AcceptBlock(&forged); err == nil || !strings.Contains(err.Error(), "out of turn") {
+		t.Fatalf("accepted a block sealed out of turn: %v", err)
+	}
+
+	outsiderKey, outsider := newKeyAddress(t)
+	forged.Proposer = outsider
+	forged.Hash = forged.calculateHash()
+	if err := signBlock(&forged, outsiderKey); err != nil {
+		t.Fatal(err)
+	}
+	if err := follower.AcceptBlock(&forged); err == nil {
+		t.Fatal("accepted a block sealed by a key that isn't an authority")
+	}
+	if err := follower.AcceptBlock(block); err != nil {
+		t.Fatalf("rejected the block sealed in turn: %v", err)
+	}
+}
+
+func TestPoAVotesChangeTheAuthoritySet(t *testing.T) {
+	bc, follower, clock, keys := authorityChains(t, 3)
+	newKey, newcomer := newKeyAddress(t)
+	if err := bc.ProposeAuthority(newcomer, true); err != nil {
+		t.Fatal(err)
+	}
+
+	// Two of the three authorities must vote before the newcomer joins
+	first := seal(t, bc, clock, keys)
+	if first.AuthorityProposal == nil || bc.Authorities.IsSigner(newcomer) {
+		t.Fatal("one vote was enough to add an authority")
+	}
+	second := seal(t, bc, clock, keys)
+	if !bc.Authorities.IsSigner(newcomer) || len(bc.Authorities.Signers) != 4 {
+		t.Fatal("a majority of votes did not add the authority")
+	}
+	for _, block := range []*Block{first, second} {
+		if err := follower.AcceptBlock(block); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !follower.Authorities.equal(bc.Authorities) {
+		t.Fatal("follower's authority set differs after replaying the votes")
+	}
+
+	// The newcomer now takes its turn
+	keys[newcomer] = newKey
+	for i := 0; i < 4; i++ {
+		if block := seal(t, bc, clock, keys); block.Proposer == newcomer {
+			return
+		}
+	}
+	t.Fatal("the new authority never got a turn")
+}
@@ -0,0 +1,241 @@
+// pos.go
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math/big"
+	"sort"
+	"strconv"
+	"time"
+)
+
+const (
+	SlotDuration = 10 * time.Second // How long each round's proposer has before the next one may propose.
+)
+
+// Under PoS every block has a slot: the previous block and a round number. Round 0 starts when the
+// previous block was made and each round lasts SlotDuration, so if a proposer is offline the next
+// round's proposer takes over. The proposer of a slot is drawn by stake from a hash of the
+// previous block and the round, so every node can work out who was entitled to it, and the
+// proposer signs the block so nobody else can claim the slot.
+
+// ValidatorAddress is the address a validator stakes and signs under: the hex of its PKIX public key.
+func ValidatorAddress(publicKey *ecdsa.PublicKey) (string, error) {
+	der, err := x509.MarshalPKIXPublicKey(publicKey)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(der), nil
+}
+
+// shortValidator abbreviates a validator address for messages. Every P-256 PKIX key starts with
+// the same header, so the end of the address is kept rather than the start.
+func shortValidator(address string) string {
+	if len(address) <= 16 {
+		return address
+	}
+	return "..." + address[len(address)-16:]
+}
+
+// parseValidatorAddress recovers a validator's public key from its address.
+func parseValidatorAddress(address string) (*ecdsa.PublicKey, error) {
+	der, err := hex.DecodeString(address)
+	if err != nil {
+		return nil, fmt.Errorf("invalid validator address: %w", err)
+	}
+	key, err := x509.ParsePKIXPublicKey(der)
+	if err != nil {
+		return nil, fmt.Errorf("invalid validator address: %w", err)
+	}
+	publicKey, ok := key.(*ecdsa.PublicKey)
+	if !ok {
+		return nil, errors.New("validator address is not an ECDSA key")
+	}
+	return publicKey, nil
+}
+
+// ProposerForSlot returns the validator entitled to propose the block after previousHash in the
+// given round, drawn with probability proportional to stake. It returns "" if nobody has stake.
+func ProposerForSlot(previousHash string, round int, stakes map[string]int) string {
+	addresses := make([]string, 0, len(stakes))
+	total := int64(0)
+	for address, stake := range stakes {
+		if stake > 0 {
+			addresses = append(addresses, address)
+			total += int64(stake)
+		}
+	}
+	if total == 0 {
+		return ""
+	}
+	sort.Strings(addresses) // Map order is random; every node must walk the stakes in the same order
+
+	seed := sha256.Sum256([]byte(previousHash + ":" + strconv.Itoa(round)))
+	point := new(big.Int).Mod(new(big.Int).SetBytes(seed[:]), big.NewInt(total)).Int64()
+	for _, address := range addresses {
+		point -= int64(stakes[address])
+		if point < 0 {
+			return address
+		}
+	}
+	return ""
+}
+
+// slotRound returns the round in progress at now for a block following previous.
+func slotRound(previous *Block, now time.Time) int {
+	elapsed := now.Unix() - previous.Timestamp
+	if elapsed < 0 {
+		return 0
+	}
+	return int(elapsed / int64(SlotDuration/time.Second))
+}
+
+// signBlock signs the block's hash with the proposer's key.
+func signBlock(block *Block, key *ecdsa.PrivateKey) error {
+	hash, err := hex.DecodeString(block.Hash)
+	if err != nil {
+		return err
+	}
+	signature, err := ecdsa.SignASN1(rand.Reader, key, hash)
+	if err != nil {
+		return err
+	}
+	block.Signature = hex.EncodeToString(signature)
+	return nil
+}
+
+// verifyBlockSignature checks the block was signed by its proposer.
+func verifyBlockSignature(block *Block) error {
+	publicKey, err := parseValidatorAddress(block.Proposer)
+	if err != nil {
+		return err
+	}
+	hash, err := hex.DecodeString(block.Hash)
+	if err != nil {
+		return fmt.Errorf("invalid block hash: %w", err)
+	}
+	signature, err := hex.DecodeString(block.Signature)
+	if err != nil || !ecdsa.VerifyASN1(publicKey, hash, signature) {
+		return errors.New("invalid proposer signature")
+	}
+	return nil
+}
+
+// PoSEngine has the validator drawn for each slot sign the block, and follows the longest chain.
+// While nobody has stake it falls back to mining blocks, so a chain can get validators bonded.
+type PoSEngine struct{}
+
+// Name implements ConsensusEngine.
+func (PoSEngine) Name() string { return "PoS" }
+
+// Prepare implements ConsensusEngine. Only the proposer of the current slot may produce the block.
+func (PoSEngine) Prepare(bc *Blockchain, key *ecdsa.PrivateKey) (*Block, error) {
+	lastBlock := bc.Blocks[len(bc.Blocks)-1]
+	round := slotRound(lastBlock, bc.Clock.Now())
+	proposer := ProposerForSlot(lastBlock.Hash, round, bc.Stake)
+	if proposer == "" { // If no proposer is found (maybe no one has any stake)
+		fmt.Println("No stakes in the network, falling back to PoW")
+		return PoWEngine{}.Prepare(bc, key)
+	}
+	if key == nil {
+		return nil, errNoKey
+	}
+	address, err := ValidatorAddress(&key.PublicKey)
+	if err != nil {
+		return nil, fmt.Errorf("invalid validator key: %w", err)
+	}
+	if proposer != address {
+		return nil, fmt.Errorf("round %d belongs to validator %s, not this one", round, shortValidator(proposer))
+	}
+	return &Block{Index: len(bc.Blocks), PreviousHash: lastBlock.Hash, Difficulty: lastBlock.Difficulty, Proposer: proposer, Round: round}, nil
+}
+
+// Seal implements ConsensusEngine by signing the block, or mining it when nobody has stake.
+func (PoSEngine) Seal(block *Block, key *ecdsa.PrivateKey) error {
+	if block.Proposer == "" {
+		return PoWEngine{}.Seal(block, key)
+	}
+	return signBlock(block, key)
+}
+
+// VerifyHeader implements ConsensusEngine.
+func (PoSEngine) VerifyHeader(bc *Blockchain, block, previous *Block) error {
+	if block.AuthorityProposal != nil {
+		return fmt.Errorf("block %d carries an authority vote outside PoA", block.Index)
+	}
+	if block.Proposer == "" {
+		if len(bc.Stake) > 0 {
+			return fmt.Errorf("block %d is mined while validators have stake", block.Index)
+		}
+		return nil
+	}
+	return bc.verifyProposer(block, previous)
+}
+
+// Finalize implements ConsensusEngine by charging the proposers of skipped rounds.
+func (PoSEngine) Finalize(staking *StakingState, authorities *AuthorityState, block *Block) {
+	staking.beginBlock(block.PreviousHash, block.Round, block.Proposer != "", block.Index)
+}
+
+// SelectFork implements ConsensusEngine with preferSlotChain.
+func (PoSEngine) SelectFork(bc *Blockchain, candidate []*Block) bool {
+	return preferSlotChain(bc, candidate)
+}
+
+// preferSlotChain is the fork choice of the slot-based engines: the longer chain, or between
+// chains of the same length the one produced in earlier rounds, whose blocks came from the
+// proposers first in line rather than from ones waiting out the others.
+func preferSlotChain(bc *Blockchain, candidate []*Block) bool {
+	if len(candidate) != len(bc.Blocks) {
+		return len(candidate) > len(bc.Blocks)
+	}
+	return totalRounds(candidate) < totalRounds(bc.Blocks)
+}
+
+// totalRounds returns the sum of the blocks' rounds.
+func totalRounds(blocks []*Block) int {
+	total := 0
+	for _, block := range blocks {
+		total += block.Round
+	}
+	return total
+}
+
+// ErrBlockNotYetValid is returned for a block dated ahead of our clock. It may become valid once
+// its time comes, so the peer that sent it isn't at fault.
+var ErrBlockNotYetValid = errors.New("block is not yet valid")
+
+// checkRoundTime checks a slot-based block's timestamp is late enough for the round it claims
+// and no more than a slot ahead of now. Without the upper bound a proposer further down the line
+// could claim its round early by dating its block in the future.
+func checkRoundTime(block, previous *Block, now time.Time) error {
+	if block.Round < 0 {
+		return fmt.Errorf("block %d has a negative round", block.Index)
+	}
+	if block.Timestamp < previous.Timestamp+int64(block.Round)*int64(SlotDuration/time.Second) {
+		return fmt.Errorf("block %d claims round %d before it started", block.Index, block.Round)
+	}
+	if time.Unix(block.Timestamp, 0).After(now.Add(SlotDuration)) {
+		return fmt.Errorf("%w: block %d is dated more than a slot ahead of our clock", ErrBlockNotYetValid, block.Index)
+	}
+	return nil
+}
+
+// verifyProposer checks that a PoS block was proposed by the validator entitled to its slot, and
+// that its timestamp fits the round it claims. The signature is checked with the rest of the
+// header. Callers must hold the lock.
+func (bc *Blockchain) verifyProposer(block, previous *Block) error {
+	if err := checkRoundTime(block, previous, bc.Clock.Now()); err != nil {
+		return err
+	}
+	if proposer := ProposerForSlot(previous.Hash, block.Round, bc.Stake); proposer != block.Proposer {
+		return fmt.Errorf("block %d was proposed by %s, not the slot's proposer", block.Index, shortValidator(block.Proposer))
+	}
+	return nil
+}
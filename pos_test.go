@@ -0,0 +1,45 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestCheckRoundTimeRejectsFutureRounds(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	previous := &Block{Index: 1, Timestamp: now.Unix()}
+	slot := int64(SlotDuration / time.Second)
+
+	onTime := &Block{Index: 2, Round: 1, Timestamp: now.Unix() + slot}
+	if err := checkRoundTime(onTime, previous, now.Add(SlotDuration)); err != nil {
+		t.Fatalf("rejected a block in its round: %v", err)
+	}
+
+	// Round 3 has not started yet, however the block is dated
+	early := &Block{Index: 2, Round: 3, Timestamp: now.Unix() + 3*slot}
+	if err := checkRoundTime(early, previous, now.Add(SlotDuration)); !errors.Is(err, ErrBlockNotYetValid) {
+		t.Fatalf("block two slots ahead of our clock gave %v, want ErrBlockNotYetValid", err)
+	}
+
+	// A block dated before its round is invalid whatever the time
+	backdated := &Block{Index: 2, Round: 3, Timestamp: now.Unix() + slot}
+	if err := checkRoundTime(backdated, previous, now.Add(SlotDuration)); err == nil || errors.Is(err, ErrBlockNotYetValid) {
+		t.Fatalf("block dated before its round gave %v, want a lasting rejection", err)
+	}
+}
+
+func TestPreferSlotChainPrefersEarlierRounds(t *testing.T) {
+	genesis := &Block{Hash: "genesis"}
+	bc := &Blockchain{Blocks: []*Block{genesis, {Index: 1, Round: 2}}}
+
+	if !preferSlotChain(bc, []*Block{genesis, {Index: 1, Round: 0}}) {
+		t.Fatal("did not prefer a branch of the same length produced in an earlier round")
+	}
+	if preferSlotChain(bc, []*Block{genesis, {Index: 1, Round: 3}}) {
+		t.Fatal("preferred a branch of the same length produced in a later round")
+	}
+	if !preferSlotChain(bc, []*Block{genesis, {Index: 1, Round: 5}, {Index: 2, Round: 5}}) {
+		t.Fatal("did not prefer a longer branch")
+	}
+}
@@ -1,12 +1,9 @@
 package main
 
 import (
-	"crypto/sha256"
-	"encoding/hex"
 	"errors"
 	"math/rand"
 	"runtime"
-	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -29,13 +26,14 @@ func NewProofOfWork(b *Block) *ProofOfWork {
 // It tries to find a nonce that results in a hash with the required number of leading zeros.
 func (pow *ProofOfWork) Run() (int, string, error) {
     var wg sync.WaitGroup
-    var mu sync.Mutex
+    var once sync.Once
     found := false
     var nonce int
     var hash string
 
     numWorkers := runtime.NumCPU() // Determine the number of goroutines based on available CPU cores.
     workChan := make(chan int, numWorkers)
+    done := make(chan struct{}) // Closed by the first worker to find a solution.
 
     timeout := time.After(5 * time.Minute) // Set a timeout for the mining process.
 
@@ -49,28 +47,27 @@ func (pow *ProofOfWork) Run() (int, string, error) {
             for n := range workChan {
                 h := pow.calculateHash(n)
                 if strings.HasPrefix(h, strings.Repeat("0", pow.Difficulty)) {
-                    mu.Lock()
-                    if !found {
+                    once.Do(func() {
                         found = true
                         nonce = n
                         hash = h
-                        close(workChan) // Stop other goroutines once the solution is found.
-                    }
-                    mu.Unlock()
-                    break
+                        close(done) // Stop the producer once the solution is found.
+                    })
+                    return
                 }
             }
         }()
     }
 
     go func() {
-        for i := startNonce; !found; i++ {
+        defer close(workChan) // Only the producer closes the work channel.
+        for i := startNonce; ; i++ {
             select {
-            case <-timeout:
-                close(workChan) // Stop all work if the timeout is reached.
+            case <-done:
                 return
-            default:
-                workChan <- i
+            case <-timeout:
+                return // Stop all work if the timeout is reached.
+            case workChan <- i:
             }
         }
     }()
@@ -83,16 +80,12 @@ func (pow *ProofOfWork) Run() (int, string, error) {
     return nonce, hash, nil
 }
 
-// calculateHash generates a SHA-256 hash of the block's data combined with the given nonce.
+// calculateHash generates the block's hash with the given nonce, so the proof covers every header
+// field the block hash does, such as an announced consensus switch.
 func (pow *ProofOfWork) calculateHash(nonce int) string {
-	record := strconv.Itoa(pow.Block.Index) +
-		strconv.FormatInt(pow.Block.Timestamp, 10) +
-		pow.Block.PreviousHash +
-		pow.Block.calculateMerkleRoot() +
-		strconv.Itoa(nonce) +
-		strconv.Itoa(pow.Difficulty)
-	hash := sha256.Sum256([]byte(record))
-	return hex.EncodeToString(hash[:])
+	block := *pow.Block
+	block.Nonce = nonce
+	return block.calculateHash()
 }
 
 // Validate checks if the provided nonce results in a valid hash that meets the difficulty criteria.
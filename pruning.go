@@ -0,0 +1,52 @@
+// pruning.go
+package main
+
+import (
+	"fmt"
+)
+
+// SetPruneDepth switches the node into pruned mode, keeping only the bodies and undo data of the
+// most recent depth blocks. Headers and the UTXO set are always kept. A depth of 0 disables pruning.
+func (bc *Blockchain) SetPruneDepth(depth int) error {
+	if depth < 0 {
+		return fmt.Errorf("invalid prune depth %d", depth)
+	}
+
+	bc.lock.Lock()
+	defer bc.lock.Unlock()
+	bc.PruneDepth = depth
+	bc.pruneBlocks()
+	return nil
+}
+
+// PrunedHeight returns the lowest height whose block body is still stored. Anything below it is
+// header-only and cannot be served to peers. It is 0 on a node that keeps the full history.
+func (bc *Blockchain) PrunedHeight() int {
+	bc.lock.RLock()
+	defer bc.lock.RUnlock()
+	return bc.prunedBelow
+}
+
+// IsPruned reports whether the node has discarded any block bodies.
+func (bc *Blockchain) IsPruned() bool {
+	return bc.PrunedHeight() > 0
+}
+
+// pruneBlocks strips the bodies and undo data of blocks that have fallen out of the retention
+// window. Callers must hold the lock.
+func (bc *Blockchain) pruneBlocks() {
+	if bc.PruneDepth == 0 {
+		return
+	}
+
+	keepFrom := len(bc.Blocks) - bc.PruneDepth
+	for height := bc.prunedBelow; height < keepFrom; height++ {
+		block := bc.Blocks[height]
+		delete(bc.undo, block.Hash)
+		delete(bc.voters, block.Hash)
+		bc.Blocks[height] = block.Header()
+	}
+	if keepFrom > bc.prunedBelow {
+		bc.prunedBelow = keepFrom
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// forkedChains returns a chain of length blocks paying alice, and a longer branch of it that
+// leaves it at height fork and pays bob.
+func forkedChains(t *testing.T, length, fork, branchLength int) (*Blockchain, *Blockchain) {
+	t.Helper()
+	chain := NewBlockchainFromSpec(RegtestSpec)
+	if _, err := chain.GenerateBlocks(length, "alice", nil); err != nil {
+		t.Fatal(err)
+	}
+	branch := NewBlockchainFromSpec(RegtestSpec)
+	for _, block := range chain.Blocks[1 : fork+1] {
+		if err := branch.AcceptBlock(block); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := branch.GenerateBlocks(branchLength, "bob", nil); err != nil {
+		t.Fatal(err)
+	}
+	return chain, branch
+}
+
+func TestPruningKeepsRecentBodiesAndTheUTXOSet(t *testing.T) {
+	bc := NewBlockchainFromSpec(RegtestSpec)
+	if _, err := bc.GenerateBlocks(5, "alice", nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := bc.SetPruneDepth(-1); err == nil {
+		t.Fatal("accepted a negative prune depth")
+	}
+	if err := bc.SetPruneDepth(2); err != nil {
+		t.Fatal(err)
+	}
+
+	if bc.PrunedHeight() != 4 || !bc.IsPruned() {
+		t.Fatalf("pruned below %d, want 4", bc.PrunedHeight())
+	}
+	if old := bc.Blocks[3]; old.Transactions != nil || bc.blockWithBody(old.Hash) != nil {
+		t.Fatal("a block outside the retention window kept its body")
+	}
+	if bc.blockWithBody(bc.Tip().Hash) == nil {
+		t.Fatal("the tip's body was pruned")
+	}
+	if got := bc.UTXOSet.GetBalance("alice"); got != 5*BlockReward {
+		t.Fatalf("alice holds %d after pruning, want %d", got, 5*BlockReward)
+	}
+}
+
+func TestPrunedNodeReorganizesWithinItsUndoData(t *testing.T) {
+	bc, branch := forkedChains(t, 4, 2, 3)
+	if err := bc.SetPruneDepth(3); err != nil {
+		t.Fatal(err)
+	}
+	if err := bc.Reorganize(branch.Blocks); err != nil {
+		t.Fatalf("pruned node could not reorg above its pruned height: %v", err)
+	}
+	if bc.Tip().Hash != branch.Tip().Hash || bc.UTXOSet.Commitment() != branch.UTXOSet.Commitment() {
+		t.Fatal("reorg did not leave the node on the branch's state")
+	}
+	if bc.UTXOSet.GetBalance("alice") != 2*BlockReward {
+		t.Fatalf("alice holds %d after the reorg, want the rewards of the shared blocks", bc.UTXOSet.GetBalance("alice"))
+	}
+}
+
+func TestPrunedNodeRefusesForksBeyondItsUndoData(t *testing.T) {
+	bc, branch := forkedChains(t, 4, 2, 3)
+	if err := bc.SetPruneDepth(1); err != nil {
+		t.Fatal(err)
+	}
+	commitment := bc.UTXOSet.Commitment()
+	err := bc.Reorganize(branch.Blocks)
+	if err == nil || !strings.Contains(err.Error(), "deeper than the retained undo data") {
+		t.Fatalf("reorg past the pruned undo data gave %v", err)
+	}
+	if bc.Tip().Index != 4 || bc.UTXOSet.Commitment() != commitment {
+		t.Fatal("refused reorg changed the chain")
+	}
+}
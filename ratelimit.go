@@ -0,0 +1,175 @@
+// ratelimit.go
+package main
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+)
+
+const (
+	MaxInboundPeers        = 117             // Most inbound sessions open at once.
+	MaxOutboundPeers       = 16              // Most outbound sessions open at once, including ones asked for explicitly.
+	PeerInboundQueueSize   = 32              // Messages read from a peer that can wait to be handled.
+	PeerByteRate           = 1 * 1024 * 1024 // Sustained bytes per second accepted from a peer.
+	PeerByteBurst          = MaxFrameSize    // Bytes a peer may send at once, enough for the largest message.
+	MisbehaviorRateLimited = 10              // Sending faster than a rate limit allows.
+)
+
+// messageLimit bounds one message type: how big it may be and how often a peer may send it.
+type messageLimit struct {
+	MaxSize int     // Largest payload, checked from the frame header before the payload is read.
+	Rate    float64 // Messages per second sustained.
+	Burst   float64 // Messages that may arrive back to back.
+}
+
+// messageLimits lists every message type a peer may send. Types not listed are rejected.
+var messageLimits = map[MessageType]messageLimit{
+	MessageTypeNewBlock:           {MaxSize: 4 * MaxBlockSize, Rate: 20, Burst: 100},
+	MessageTypeTransaction:        {MaxSize: 100 * 1024, Rate: 50, Burst: 200},
+	MessageTypeRequestBlockchain:  {MaxSize: 0, Rate: 1.0 / 60, Burst: 2},
+	MessageTypeResponseBlockchain: {MaxSize: MaxFrameSize, Rate: 1.0 / 10, Burst: 2},
+	MessageTypeNewPeer:            {MaxSize: 1024, Rate: 1, Burst: 10},
+	MessageTypeVersion:            {MaxSize: 4 * 1024, Rate: 0, Burst: 1},
+	MessageTypeVerack:             {MaxSize: 0, Rate: 0, Burst: 1},
+	MessageTypePing:               {MaxSize: 64, Rate: 1, Burst: 10},
+	MessageTypePong:               {MaxSize: 64, Rate: 1, Burst: 10},
+	MessageTypeInv:                {MaxSize: 128 * 1024, Rate: 20, Burst: 100},
+	MessageTypeGetData:            {MaxSize: 128 * 1024, Rate: 20, Burst: 100},
+	MessageTypeNotFound:           {MaxSize: 128 * 1024, Rate: 20, Burst: 100},
+	MessageTypeGetAddr:            {MaxSize: 0, Rate: 1.0 / 60, Burst: 2},
+	MessageTypeAddr:               {MaxSize: 128 * 1024, Rate: 1, Burst: 10},
+	MessageTypeVote:               {MaxSize: 4 * 1024, Rate: 50, Burst: 200},
+	MessageTypeCommit:             {MaxSize: 512 * 1024, Rate: 5, Burst: 20},
+}
+
+// maxMessageSize returns the largest payload allowed for a message type, and false if peers may
+// not send the type at all.
+func maxMessageSize(msgType MessageType) (int, bool) {
+	limit, exists := messageLimits[msgType]
+	return limit.MaxSize, exists
+}
+
+// tokenBucket allows a sustained rate with bursts up to its capacity.
+type tokenBucket struct {
+	rate     float64 // Tokens added per second.
+	capacity float64
+	tokens   float64
+	last     time.Time
+}
+
+// newTokenBucket creates a full bucket.
+func newTokenBucket(rate, capacity float64) *tokenBucket {
+	return &tokenBucket{rate: rate, capacity: capacity, tokens: capacity, last: time.Now()}
+}
+
+// Take removes n tokens if the bucket has them, refilling it for the time that has passed first.
+func (b *tokenBucket) Take(n float64) bool {
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.capacity {
+		b.tokens = b.capacity
+	}
+	b.last = now
+
+	if b.tokens < n {
+		return false
+	}
+	b.tokens -= n
+	return true
+}
+
+// peerLimiter holds a peer's token buckets: one per message type and one for bytes overall.
+type peerLimiter struct {
+	messages map[MessageType]*tokenBucket
+	bytes    *tokenBucket
+	expected map[string]time.Time // Objects we asked for with getdata, and when; their replies cost no message tokens.
+	lock     sync.Mutex
+}
+
+// newPeerLimiter creates full buckets for every message type.
+func newPeerLimiter() *peerLimiter {
+	limiter := &peerLimiter{
+		messages: make(map[MessageType]*tokenBucket),
+		bytes:    newTokenBucket(PeerByteRate, PeerByteBurst),
+		expected: make(map[string]time.Time),
+	}
+	for msgType, limit := range messageLimits {
+		limiter.messages[msgType] = newTokenBucket(limit.Rate, limit.Burst)
+	}
+	return limiter
+}
+
+// Allow charges a message against the peer's buckets and reports whether it is within its limits.
+func (l *peerLimiter) Allow(msgType MessageType, payload []byte) bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	bucket, exists := l.messages[msgType]
+	if !exists {
+		return false
+	}
+	if !l.takeExpected(msgType, payload) && !bucket.Take(1) {
+		return false
+	}
+	return l.bytes.Take(float64(FrameHeaderSize + len(payload)))
+}
+
+// takeExpected reports whether the message is the reply to an object we asked for, and stops
+// expecting it. Each request excuses one reply. Callers must hold the lock.
+func (l *peerLimiter) takeExpected(msgType MessageType, payload []byte) bool {
+	if len(l.expected) == 0 {
+		return false
+	}
+	hash := replyHash(msgType, payload)
+	requestedAt, exists := l.expected[hash]
+	if !exists {
+		return false
+	}
+	delete(l.expected, hash)
+	return time.Since(requestedAt) < GetDataTimeout
+}
+
+// replyHash returns the hash of the block or transaction a message carries, or an empty string
+// for any other message.
+func replyHash(msgType MessageType, payload []byte) string {
+	switch msgType {
+	case MessageTypeNewBlock:
+		var header struct{ Hash string }
+		if json.Unmarshal(payload, &header) == nil {
+			return header.Hash
+		}
+	case MessageTypeTransaction:
+		var tx Transaction
+		if json.Unmarshal(payload, &tx) == nil {
+			return tx.Hash()
+		}
+	}
+	return ""
+}
+
+// Expect records that we asked the peer for inventory, so its replies are not charged against
+// their message types' rates. A node catching up asks for far more blocks than a peer would
+// announce unprompted. Requests that have timed out are dropped.
+func (l *peerLimiter) Expect(inventory []InvVector) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	now := time.Now()
+	for hash, requestedAt := range l.expected {
+		if now.Sub(requestedAt) >= GetDataTimeout {
+			delete(l.expected, hash)
+		}
+	}
+	for _, inv := range inventory {
+		l.expected[inv.Hash] = now
+	}
+}
+
+// Forget drops expected replies for inventory the peer reported it doesn't have.
+func (l *peerLimiter) Forget(inventory []InvVector) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	for _, inv := range inventory {
+		delete(l.expected, inv.Hash)
+	}
+}
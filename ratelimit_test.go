@@ -0,0 +1,61 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+)
+
+// blockPayload returns a newblock payload for a block with the given hash.
+func blockPayload(t *testing.T, hash string) []byte {
+	t.Helper()
+	payload, err := json.Marshal(&Block{Hash: hash})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return payload
+}
+
+func TestLimiterDoesNotChargeRequestedBlocks(t *testing.T) {
+	limiter := newPeerLimiter()
+	inventory := make([]InvVector, 3*MaxGenerateBlocks/10)
+	for i := range inventory {
+		inventory[i] = InvVector{Type: InvTypeBlock, Hash: fmt.Sprint("requested", i)}
+	}
+
+	// Blocks we asked for arrive as fast as the peer can send them
+	limiter.Expect(inventory)
+	for i, inv := range inventory {
+		if !limiter.Allow(MessageTypeNewBlock, blockPayload(t, inv.Hash)) {
+			t.Fatalf("requested block %d was rate limited", i)
+		}
+	}
+
+	// Unrequested blocks still have a budget, even while other blocks are expected
+	limiter.Expect([]InvVector{{Type: InvTypeBlock, Hash: "pending"}})
+	burst := int(messageLimits[MessageTypeNewBlock].Burst)
+	for i := 0; i < burst; i++ {
+		if !limiter.Allow(MessageTypeNewBlock, blockPayload(t, fmt.Sprint("unrequested", i))) {
+			t.Fatalf("unrequested block %d of a burst of %d was rate limited", i, burst)
+		}
+	}
+	if limiter.Allow(MessageTypeNewBlock, blockPayload(t, "unrequested")) {
+		t.Fatal("unrequested blocks beyond the burst were allowed")
+	}
+	if limiter.Allow(MessageTypeNewBlock, blockPayload(t, inventory[0].Hash)) {
+		t.Fatal("a requested block was excused twice")
+	}
+	if !limiter.Allow(MessageTypeNewBlock, blockPayload(t, "pending")) {
+		t.Fatal("a requested block was charged once the burst was spent")
+	}
+}
+
+func TestLimiterForgetsBlocksNotFound(t *testing.T) {
+	limiter := newPeerLimiter()
+	inventory := []InvVector{{Type: InvTypeBlock, Hash: "a"}, {Type: InvTypeBlock, Hash: "b"}}
+	limiter.Expect(inventory)
+	limiter.Forget(inventory)
+	if len(limiter.expected) != 0 {
+		t.Fatalf("%d replies still expected after notfound", len(limiter.expected))
+	}
+}
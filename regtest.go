@@ -0,0 +1,76 @@
+// regtest.go
+package main
+
+import (
+	"crypto/ecdsa"
+	"errors"
+	"fmt"
+	"time"
+)
+
+const (
+	MaxGenerateBlocks = 1000 // Most blocks one generate request may produce.
+)
+
+// A regtest chain is for integration tests: its blocks need no work, they are only produced when a
+// test asks for them, and its nodes run on a MockClock that only moves when the test sets it. That
+// makes slot rounds, median times, mempool ages, governance deadlines and gamification cooldowns
+// reproducible.
+
+// ErrNotRegtest is returned by regtest controls on any other chain.
+var ErrNotRegtest = errors.New("only available on a regtest chain")
+
+// SetClock makes the chain and its mempool tell the time by clock.
+func (bc *Blockchain) SetClock(clock Clock) {
+	bc.lock.Lock()
+	defer bc.lock.Unlock()
+	bc.Clock = clock
+	bc.Mempool.Clock = clock
+}
+
+// SetMockTime moves the regtest chain's clock to now.
+func (bc *Blockchain) SetMockTime(now time.Time) error {
+	clock, ok := bc.Clock.(*MockClock)
+	if !bc.Spec.Regtest || !ok {
+		return ErrNotRegtest
+	}
+	clock.Set(now)
+	return nil
+}
+
+// GenerateBlocks produces count blocks on a regtest chain, each holding the mempool's transactions,
+// with the reward of mined blocks paid to address. PoS and PoA blocks are signed with key and pay
+// their proposer. It returns the blocks produced, which are fewer than count on error.
+func (bc *Blockchain) GenerateBlocks(count int, address string, key *ecdsa.PrivateKey) ([]*Block, error) {
+	if !bc.Spec.Regtest {
+		return nil, ErrNotRegtest
+	}
+	if count <= 0 || count > MaxGenerateBlocks {
+		return nil, fmt.Errorf("can generate 1 to %d blocks, not %d", MaxGenerateBlocks, count)
+	}
+	if address == "" {
+		return nil, errors.New("missing reward address")
+	}
+
+	bc.lock.Lock()
+	defer bc.lock.Unlock()
+	blocks := make([]*Block, 0, count)
+	for len(blocks) < count {
+		block, err := bc.produceBlock(bc.Mempool.GetTransactions(), key, address)
+		if err != nil {
+			return blocks, fmt.Errorf("generated %d of %d blocks: %w", len(blocks), count, err)
+		}
+		blocks = append(blocks, block)
+	}
+	return blocks, nil
+}
+
+// Generate has the node produce count blocks paying address and announce each to its peers.
+func (n *Node) Generate(count int, address string) ([]*Block, error) {
+	blocks, err := n.Blockchain.GenerateBlocks(count, address, n.PrivateKey)
+	for _, block := range blocks {
+		n.RelayBlock(block)
+		n.Prevote(block)
+	}
+	return blocks, err
+}
@@ -0,0 +1,140 @@
+// reorg.go
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+)
+
+// Reorganize switches the chain to a candidate that shares our genesis block and is either preferred
+// by the consensus engine in force or finalizes a block above our finalized height. Blocks after the fork point are disconnected using
+// their undo data and the candidate's blocks are connected in their place. If the fork is deeper
+// than the undo data we still hold (for example on a pruned node) or below a finalized block the
+// candidate is refused, and if any candidate block fails to connect, or the certificates of a
+// candidate the engine does not prefer don't verify, the original chain is restored.
+func (bc *Blockchain) Reorganize(blocks []*Block) error {
+	bc.lock.Lock()
+	defer bc.lock.Unlock()
+
+	better := bc.engineAt(len(bc.Blocks)).SelectFork(bc, blocks)
+	if !better && !bc.finalizesBeyond(blocks) {
+		return errors.New("candidate chain is not preferred over the current chain")
+	}
+	if blocks[0].Hash != bc.Blocks[0].Hash {
+		return errors.New("candidate chain has a different genesis block")
+	}
+
+	// Find the last block both chains have in common
+	fork := 0
+	for fork+1 < len(bc.Blocks) && fork+1 < len(blocks) && blocks[fork+1].Hash == bc.Blocks[fork+1].Hash {
+		fork++
+	}
+
+	// A finalized block is never reverted, however long the competing chain, and neither is a checkpoint
+	if fork < bc.finalizedHeight {
+		return fmt.Errorf("candidate chain forks at height %d, below finalized block %d", fork, bc.finalizedHeight)
+	}
+	if checkpoint := bc.lastCheckpoint(); fork < checkpoint {
+		return fmt.Errorf("candidate chain forks at height %d, below checkpoint %d", fork, checkpoint)
+	}
+
+	// Make sure every block we would disconnect can be undone
+	for height := len(bc.Blocks) - 1; height > fork; height-- {
+		if bc.undo[bc.Blocks[height].Hash] == nil {
+			return fmt.Errorf("fork at height %d is deeper than the retained undo data", fork)
+		}
+	}
+
+	var disconnected []*Block
+	for len(bc.Blocks)-1 > fork {
+		block := bc.Blocks[len(bc.Blocks)-1]
+		if err := bc.disconnectTip(); err != nil {
+			return err
+		}
+		disconnected = append(disconnected, block)
+	}
+
+	// Put the original chain back if the candidate turns out to be unacceptable
+	restore := func() {
+		for len(bc.Blocks)-1 > fork {
+			bc.disconnectTip()
+		}
+		for i := len(disconnected) - 1; i >= 0; i-- {
+			if restoreErr := bc.connectTip(disconnected[i]); restoreErr != nil {
+				log.Printf("Failed to restore block %d after a rejected reorg: %v", disconnected[i].Index, restoreErr)
+			}
+		}
+	}
+
+	// Signatures up to the assumed-valid block are trusted while the candidate is connected
+	bc.syncAssumedValid = bc.assumedValidHeight(blocks[fork+1:])
+	for _, block := range blocks[fork+1:] {
+		if err := bc.connectTip(block); err != nil {
+			bc.syncAssumedValid = 0
+			restore()
+			return fmt.Errorf("candidate block %d rejected: %w", block.Index, err)
+		}
+	}
+	bc.syncAssumedValid = 0
+
+	finalized := bc.finalizedHeight
+	bc.applyCommits(blocks)
+	if !better && bc.finalizedHeight == finalized {
+		restore()
+		return errors.New("candidate chain is not preferred and its commit certificates do not verify")
+	}
+
+	// Transactions that only the old branch confirmed go back to the mempool
+	confirmed := make(map[string]bool)
+	for _, block := range blocks[fork+1:] {
+		for _, tx := range block.Transactions {
+			confirmed[tx.Hash()] = true
+		}
+	}
+	for _, block := range disconnected {
+		for _, tx := range block.Transactions {
+			if tx.Sender != "system" && !confirmed[tx.Hash()] {
+				bc.Mempool.AddTransaction(tx, bc.Accounts, bc.UTXOSet)
+			}
+		}
+	}
+
+	bc.pruneBlocks()
+	return nil
+}
+
+// finalizesBeyond reports whether a candidate chain carries a commit certificate above our
+// finalized height. The certificate is only checked once its block is connected. Callers must hold
+// the lock.
+func (bc *Blockchain) finalizesBeyond(blocks []*Block) bool {
+	for _, block := range blocks {
+		if block.Commit != nil && block.Commit.Height > bc.finalizedHeight {
+			return true
+		}
+	}
+	return false
+}
+
+// disconnectTip removes the tip block and reverts its changes to the UTXO set and staking ledger.
+// Callers must hold the lock.
+func (bc *Blockchain) disconnectTip() error {
+	tip := bc.Blocks[len(bc.Blocks)-1]
+	undo := bc.undo[tip.Hash]
+	if undo == nil {
+		return fmt.Errorf("no undo data for block %d", tip.Index)
+	}
+	if tip.Index <= bc.finalizedHeight {
+		return fmt.Errorf("block %d is finalized", tip.Index)
+	}
+
+	bc.revertBlockState(undo)
+	bc.schedule.unrecord(tip)
+	if bc.Indexer != nil {
+		bc.Indexer.DisconnectBlock(tip)
+	}
+	delete(bc.undo, tip.Hash)
+	delete(bc.voters, tip.Hash)
+	bc.Blocks = bc.Blocks[:len(bc.Blocks)-1]
+	return nil
+}
@@ -0,0 +1,58 @@
+// seeds.go
+package main
+
+import (
+	"log"
+	"time"
+)
+
+const (
+	SeedQueryInterval = 20 * time.Second // Least time between rounds of asking seeds, so at most once per outbound check.
+	SeedLingerTime    = 5 * time.Second  // How long a seed keeps a session open after answering getaddr.
+	DefaultSeedPort   = "8090"           // Port seeds listen on by convention.
+)
+
+// seedMessageTypes are the messages a seed handles; everything else is ignored.
+var seedMessageTypes = map[MessageType]bool{
+	MessageTypeGetAddr: true,
+	MessageTypeAddr:    true,
+	MessageTypeNewPeer: true,
+}
+
+// seedAddresses returns the seeds to ask for addresses: the configured ones, or the fallbacks in the
+// chain spec if none are configured. An empty, non-nil list configures no seeds at all. The
+// fallbacks are IP addresses rather than host names so bootstrapping never depends on DNS. Seeds
+// themselves only use configured ones, so a fallback seed doesn't dial itself.
+func (n *Node) seedAddresses() []string {
+	seeds := n.Seeds
+	if seeds == nil && !n.Seed {
+		seeds = n.Blockchain.Spec.Seeds
+	}
+	var addresses []string
+	for _, seed := range seeds {
+		if seed != n.Address {
+			addresses = append(addresses, seed)
+		}
+	}
+	return addresses
+}
+
+// querySeeds asks every seed for addresses, unless that was done recently. Connecting is enough:
+// outbound sessions send getaddr on their own, and the seed closes the session once it has replied.
+func (n *Node) querySeeds() {
+	n.lock.Lock()
+	if time.Since(n.lastSeedQuery) < SeedQueryInterval {
+		n.lock.Unlock()
+		return
+	}
+	n.lastSeedQuery = time.Now()
+	n.lock.Unlock()
+
+	for _, seed := range n.seedAddresses() {
+		go func(seed string) {
+			if _, err := n.dialPeer(seed); err != nil {
+				log.Printf("Failed to query seed %s: %v", seed, err)
+			}
+		}(seed)
+	}
+}
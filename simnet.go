@@ -0,0 +1,579 @@
+// simnet.go
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	SimNodePort       = 8333                  // Port every simulated node listens on.
+	SimAcceptBacklog  = 64                    // Connections that can wait to be accepted.
+	SimPollInterval   = 10 * time.Millisecond // How often the harness re-checks a condition it waits for.
+	simEphemeralStart = 40000                 // First port handed to the dialling side of a connection.
+)
+
+// SimNetwork is an in-memory network for running many nodes in one process. Each write on a
+// connection is delivered whole after the network's latency, or dropped whole with its loss rate,
+// so a frame is never cut in half. Partitions black-hole traffic between groups the way a real
+// network split does: connections stay open but nothing gets through until the network heals.
+//
+// Latency jitter and loss come from a seeded source, so a run with the same seed makes the same
+// choices in the same order. Goroutines are still scheduled by the runtime, so tests should wait
+// for outcomes rather than for fixed times.
+type SimNetwork struct {
+	lock      sync.Mutex
+	rand      *rand.Rand
+	latency   time.Duration
+	jitter    time.Duration
+	loss      float64
+	listeners map[string]*simListener  // By listen address.
+	groups    map[string]int           // Partition group per node address; unlisted nodes are in group 0.
+	skew      map[string]time.Duration // Clock offset per node address.
+	nextPort  int
+}
+
+// NewSimNetwork creates a network with no latency, loss or partitions.
+func NewSimNetwork(seed int64) *SimNetwork {
+	return &SimNetwork{
+		rand:      rand.New(rand.NewSource(seed)),
+		listeners: make(map[string]*simListener),
+		groups:    make(map[string]int),
+		skew:      make(map[string]time.Duration),
+		nextPort:  simEphemeralStart,
+	}
+}
+
+// SetLatency delays every write by latency plus up to jitter more.
+func (s *SimNetwork) SetLatency(latency, jitter time.Duration) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.latency = latency
+	s.jitter = jitter
+}
+
+// SetLoss sets the fraction of writes that are dropped, from 0 to 1.
+func (s *SimNetwork) SetLoss(rate float64) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.loss = rate
+}
+
+// Partition splits the network so nodes can only reach others in their own group. Nodes left out
+// of every group form one more group together.
+func (s *SimNetwork) Partition(groups ...[]string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.groups = make(map[string]int)
+	for i, group := range groups {
+		for _, address := range group {
+			s.groups[address] = i + 1
+		}
+	}
+}
+
+// Heal removes all partitions.
+func (s *SimNetwork) Heal() {
+	s.Partition()
+}
+
+// SetClockSkew makes the clock of the node at address run ahead, or behind if skew is negative.
+func (s *SimNetwork) SetClockSkew(address string, skew time.Duration) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.skew[address] = skew
+}
+
+// Clock returns the clock of the node at address, which follows later calls to SetClockSkew.
+func (s *SimNetwork) Clock(address string) Clock {
+	return simClock{network: s, address: address}
+}
+
+// Transport returns the transport for the node at address.
+func (s *SimNetwork) Transport(address string) Transport {
+	return simTransport{network: s, address: address}
+}
+
+// route decides what happens to a write from one node to another: whether it is delivered and
+// how long it takes. Callers must hold the lock.
+func (s *SimNetwork) route(from, to string) (time.Duration, bool) {
+	if s.groups[from] != s.groups[to] {
+		return 0, false
+	}
+	if s.loss > 0 && s.rand.Float64() < s.loss {
+		return 0, false
+	}
+	delay := s.latency
+	if s.jitter > 0 {
+		delay += time.Duration(s.rand.Int63n(int64(s.jitter)))
+	}
+	return delay, true
+}
+
+// dial connects the node at from to the listener at to.
+func (s *SimNetwork) dial(from, to string) (net.Conn, error) {
+	s.lock.Lock()
+	listener := s.listeners[to]
+	if listener == nil {
+		s.lock.Unlock()
+		return nil, fmt.Errorf("dial %s: connection refused", to)
+	}
+	if s.groups[from] != s.groups[to] {
+		s.lock.Unlock()
+		return nil, fmt.Errorf("dial %s: network unreachable", to)
+	}
+	host, _, err := net.SplitHostPort(from)
+	if err != nil {
+		host = from
+	}
+	localAddr := simAddr(net.JoinHostPort(host, fmt.Sprint(s.nextPort)))
+	s.nextPort++
+	s.lock.Unlock()
+
+	toListener, toDialer := newSimPipe(), newSimPipe()
+	dialer := &simConn{network: s, localNode: from, remoteNode: to, localAddr: localAddr, remoteAddr: simAddr(to), in: toDialer, out: toListener, closed: make(chan struct{})}
+	accepted := &simConn{network: s, localNode: to, remoteNode: from, localAddr: simAddr(to), remoteAddr: localAddr, in: toListener, out: toDialer, closed: make(chan struct{})}
+
+	select {
+	case listener.accept <- accepted:
+		return dialer, nil
+	case <-listener.closed:
+		return nil, fmt.Errorf("dial %s: connection refused", to)
+	case <-time.After(HandshakeTimeout):
+		return nil, fmt.Errorf("dial %s: timed out", to)
+	}
+}
+
+// listen registers a listener at address.
+func (s *SimNetwork) listen(address string) (net.Listener, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.listeners[address] != nil {
+		return nil, fmt.Errorf("listen %s: address already in use", address)
+	}
+	listener := &simListener{
+		network: s,
+		address: address,
+		accept:  make(chan net.Conn, SimAcceptBacklog),
+		closed:  make(chan struct{}),
+	}
+	s.listeners[address] = listener
+	return listener, nil
+}
+
+// listening reports whether a node is listening at address.
+func (s *SimNetwork) listening(address string) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.listeners[address] != nil
+}
+
+// simTransport connects one node to the simulated network.
+type simTransport struct {
+	network *SimNetwork
+	address string
+}
+
+func (t simTransport) Dial(address string) (net.Conn, error) {
+	return t.network.dial(t.address, address)
+}
+
+func (t simTransport) Listen(address string) (net.Listener, error) {
+	return t.network.listen(address)
+}
+
+// Secure does nothing: traffic never leaves the process, so there is nobody to hide it from.
+func (t simTransport) Secure(conn net.Conn) (net.Conn, error) {
+	return conn, nil
+}
+
+// simClock is a node's clock on the simulated network.
+type simClock struct {
+	network *SimNetwork
+	address string
+}
+
+func (c simClock) Now() time.Time {
+	c.network.lock.Lock()
+	skew := c.network.skew[c.address]
+	c.network.lock.Unlock()
+	return time.Now().Add(skew)
+}
+
+// simAddr is an address on the simulated network.
+type simAddr string
+
+func (a simAddr) Network() string { return "sim" }
+func (a simAddr) String() string  { return string(a) }
+
+// simListener hands out connections dialled to its address.
+type simListener struct {
+	network   *SimNetwork
+	address   string
+	accept    chan net.Conn
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func (l *simListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.accept:
+		return conn, nil
+	case <-l.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *simListener) Close() error {
+	l.closeOnce.Do(func() {
+		close(l.closed)
+		l.network.lock.Lock()
+		if l.network.listeners[l.address] == l {
+			delete(l.network.listeners, l.address)
+		}
+		l.network.lock.Unlock()
+	})
+	return nil
+}
+
+func (l *simListener) Addr() net.Addr {
+	return simAddr(l.address)
+}
+
+// simPacket is one write in flight.
+type simPacket struct {
+	data      []byte
+	deliverAt time.Time
+}
+
+// simPipe carries one direction of a connection.
+type simPipe struct {
+	lock         sync.Mutex
+	packets      []simPacket
+	buf          []byte    // Delivered data not yet read.
+	lastDelivery time.Time // Packets are delivered in order, so none arrives before this.
+	deadline     time.Time
+	closed       bool
+	notify       chan struct{} // Signalled when anything above changes.
+}
+
+func newSimPipe() *simPipe {
+	return &simPipe{notify: make(chan struct{}, 1)}
+}
+
+// wake signals a reader waiting on the pipe.
+func (p *simPipe) wake() {
+	select {
+	case p.notify <- struct{}{}:
+	default:
+	}
+}
+
+// push queues data for delivery after delay.
+func (p *simPipe) push(data []byte, delay time.Duration) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.closed {
+		return io.ErrClosedPipe
+	}
+	deliverAt := time.Now().Add(delay)
+	if deliverAt.Before(p.lastDelivery) {
+		deliverAt = p.lastDelivery
+	}
+	p.lastDelivery = deliverAt
+	p.packets = append(p.packets, simPacket{data: append([]byte(nil), data...), deliverAt: deliverAt})
+	p.wake()
+	return nil
+}
+
+func (p *simPipe) close() {
+	p.lock.Lock()
+	p.closed = true
+	p.lock.Unlock()
+	p.wake()
+}
+
+func (p *simPipe) setDeadline(deadline time.Time) {
+	p.lock.Lock()
+	p.deadline = deadline
+	p.lock.Unlock()
+	p.wake()
+}
+
+// read blocks until data has been delivered, the pipe closes or the deadline passes.
+func (p *simPipe) read(b []byte) (int, error) {
+	for {
+		p.lock.Lock()
+		now := time.Now()
+		if len(p.buf) == 0 && len(p.packets) > 0 && !p.packets[0].deliverAt.After(now) {
+			p.buf = p.packets[0].data
+			p.packets = p.packets[1:]
+		}
+		if len(p.buf) > 0 {
+			n := copy(b, p.buf)
+			p.buf = p.buf[n:]
+			p.lock.Unlock()
+			return n, nil
+		}
+		if p.closed {
+			p.lock.Unlock()
+			return 0, io.EOF
+		}
+		if !p.deadline.IsZero() && !now.Before(p.deadline) {
+			p.lock.Unlock()
+			return 0, os.ErrDeadlineExceeded
+		}
+
+		wait := time.Duration(-1)
+		if len(p.packets) > 0 {
+			wait = p.packets[0].deliverAt.Sub(now)
+		}
+		if !p.deadline.IsZero() && (wait < 0 || p.deadline.Sub(now) < wait) {
+			wait = p.deadline.Sub(now)
+		}
+		p.lock.Unlock()
+
+		if wait < 0 {
+			<-p.notify
+			continue
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-p.notify:
+		case <-timer.C:
+		}
+		timer.Stop()
+	}
+}
+
+// simConn is one end of a connection on the simulated network.
+type simConn struct {
+	network    *SimNetwork
+	localNode  string // Listen address of the node at this end, which partitions apply to.
+	remoteNode string
+	localAddr  simAddr
+	remoteAddr simAddr
+	in         *simPipe
+	out        *simPipe
+	closed     chan struct{} // Closed by Close.
+	closeOnce  sync.Once
+}
+
+func (c *simConn) isClosed() bool {
+	select {
+	case <-c.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+func (c *simConn) Read(b []byte) (int, error) {
+	if c.isClosed() {
+		return 0, net.ErrClosed
+	}
+	n, err := c.in.read(b)
+	if err == io.EOF && c.isClosed() {
+		return n, net.ErrClosed
+	}
+	return n, err
+}
+
+// Write sends b as one packet, which the network may delay or drop as a whole.
+func (c *simConn) Write(b []byte) (int, error) {
+	if c.isClosed() {
+		return 0, net.ErrClosed
+	}
+	c.network.lock.Lock()
+	delay, delivered := c.network.route(c.localNode, c.remoteNode)
+	c.network.lock.Unlock()
+	if !delivered {
+		return len(b), nil
+	}
+	if err := c.out.push(b, delay); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// Close shuts both directions. The other end reads whatever is still in flight, then EOF.
+func (c *simConn) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.closed)
+		c.in.close()
+		c.out.close()
+	})
+	return nil
+}
+
+func (c *simConn) LocalAddr() net.Addr  { return c.localAddr }
+func (c *simConn) RemoteAddr() net.Addr { return c.remoteAddr }
+
+func (c *simConn) SetDeadline(t time.Time) error {
+	return c.SetReadDeadline(t)
+}
+
+func (c *simConn) SetReadDeadline(t time.Time) error {
+	c.in.setDeadline(t)
+	return nil
+}
+
+// SetWriteDeadline has nothing to do: writes never block.
+func (c *simConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
+
+// SimHarness runs a set of nodes on one SimNetwork, each with its own chain starting from the
+// same genesis block, so propagation, forks, reorgs and partition healing can be exercised in a
+// single process.
+type SimHarness struct {
+	Network *SimNetwork
+	Nodes   []*Node
+}
+
+// NewSimHarness creates count nodes on a new network. Node i listens at 10.i.0.1, so every node
+// is in its own network group.
+func NewSimHarness(count int, seed int64) (*SimHarness, error) {
+	h := &SimHarness{Network: NewSimNetwork(seed)}
+	for i := 0; i < count; i++ {
+		address := net.JoinHostPort(fmt.Sprintf("10.%d.0.1", i+1), fmt.Sprint(SimNodePort))
+		privateKey, _, err := GenerateKeyPair()
+		if err != nil {
+			return nil, err
+		}
+
+		blockchain := NewBlockchain()
+		blockchain.MinerAddress = address
+
+		node := NewNode(address, blockchain, privateKey)
+		node.Transport = h.Network.Transport(address)
+		node.Clock = h.Network.Clock(address)
+		node.Seeds = []string{} // Only nodes on the simulated network, never the chain's real fallback seeds
+		h.Nodes = append(h.Nodes, node)
+	}
+	return h, nil
+}
+
+// Start starts every node and waits until they are all listening.
+func (h *SimHarness) Start() error {
+	errs := make(chan error, len(h.Nodes))
+	for _, node := range h.Nodes {
+		go func(node *Node) {
+			if err := node.Start(); err != nil {
+				errs <- fmt.Errorf("node %s: %w", node.Address, err)
+			}
+		}(node)
+	}
+
+	deadline := time.Now().Add(HandshakeTimeout)
+	for {
+		select {
+		case err := <-errs:
+			return err
+		default:
+		}
+		listening := true
+		for _, node := range h.Nodes {
+			listening = listening && h.Network.listening(node.Address)
+		}
+		if listening {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return errors.New("timed out waiting for simulated nodes to start")
+		}
+		time.Sleep(SimPollInterval)
+	}
+}
+
+// Stop stops every node.
+func (h *SimHarness) Stop() {
+	for _, node := range h.Nodes {
+		node.Stop()
+	}
+}
+
+// Connect opens a session from node i to node j.
+func (h *SimHarness) Connect(i, j int) error {
+	_, err := h.Nodes[i].dialPeer(h.Nodes[j].Address)
+	return err
+}
+
+// ConnectLine connects each node to the next, so messages have to be relayed to cross the network.
+func (h *SimHarness) ConnectLine() error {
+	for i := 0; i+1 < len(h.Nodes); i++ {
+		if err := h.Connect(i, i+1); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Partition splits the network into groups of node indexes.
+func (h *SimHarness) Partition(groups ...[]int) {
+	addresses := make([][]string, len(groups))
+	for i, group := range groups {
+		for _, index := range group {
+			addresses[i] = append(addresses[i], h.Nodes[index].Address)
+		}
+	}
+	h.Network.Partition(addresses...)
+}
+
+// Mine has node i mine a block on its tip and announce it.
+func (h *SimHarness) Mine(i int) (*Block, error) {
+	node := h.Nodes[i]
+	block := node.Blockchain.AddBlock(nil, node.PrivateKey)
+	if block == nil {
+		return nil, fmt.Errorf("node %s failed to mine a block", node.Address)
+	}
+	node.RelayBlock(block)
+	node.Prevote(block)
+	return block, nil
+}
+
+// Converged reports whether every node has the same tip.
+func (h *SimHarness) Converged() bool {
+	tip := h.Nodes[0].Blockchain.Tip().Hash
+	for _, node := range h.Nodes[1:] {
+		if node.Blockchain.Tip().Hash != tip {
+			return false
+		}
+	}
+	return true
+}
+
+// WaitForConvergence waits until every node has the same tip.
+func (h *SimHarness) WaitForConvergence(timeout time.Duration) error {
+	return h.WaitFor(h.Converged, timeout)
+}
+
+// WaitForHeight waits until every node's chain has reached height.
+func (h *SimHarness) WaitForHeight(height int, timeout time.Duration) error {
+	return h.WaitFor(func() bool {
+		for _, node := range h.Nodes {
+			if node.Blockchain.Tip().Index < height {
+				return false
+			}
+		}
+		return true
+	}, timeout)
+}
+
+// WaitFor polls condition until it holds or timeout passes.
+func (h *SimHarness) WaitFor(condition func() bool, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for !condition() {
+		if time.Now().After(deadline) {
+			return errors.New("timed out waiting for the simulated network")
+		}
+		time.Sleep(SimPollInterval)
+	}
+	return nil
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// startHarness starts count fully connected nodes on a simulated network.
+func startHarness(t *testing.T, count int) *SimHarness {
+	t.Helper()
+	h, err := NewSimHarness(count, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := h.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(h.Stop)
+	for i := 0; i < count; i++ {
+		for j := i + 1; j < count; j++ {
+			if err := h.Connect(i, j); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	return h
+}
+
+// mine has node i mine blocks blocks.
+func mine(t *testing.T, h *SimHarness, i, blocks int) {
+	t.Helper()
+	for n := 0; n < blocks; n++ {
+		if _, err := h.Mine(i); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestSimPartitionReorg(t *testing.T) {
+	h := startHarness(t, 3)
+	mine(t, h, 0, 1)
+	if err := h.WaitForHeight(1, 10*time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	// Each side of the partition extends the chain; the minority side mines more
+	h.Partition([]int{0, 1}, []int{2})
+	mine(t, h, 0, 1)
+	mine(t, h, 2, 3)
+	if err := h.WaitFor(func() bool { return h.Nodes[1].Blockchain.Tip().Index == 2 }, 10*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	replaced := h.Nodes[0].Blockchain.Tip().Hash
+
+	// Once healed, the next block on the longer branch pulls the others over to it
+	h.Network.Heal()
+	mine(t, h, 2, 1)
+	if err := h.WaitForConvergence(10 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+	for _, node := range h.Nodes {
+		if tip := node.Blockchain.Tip(); tip.Index != 5 {
+			t.Fatalf("node %s is at height %d, want 5", node.Address, tip.Index)
+		}
+		if node.Blockchain.Blocks[2].Hash == replaced {
+			t.Fatalf("node %s kept the block the reorg replaced", node.Address)
+		}
+	}
+}
+
+func TestSimPropagatesAcrossLine(t *testing.T) {
+	h, err := NewSimHarness(4, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := h.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer h.Stop()
+	if err := h.ConnectLine(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Blocks mined at one end have to be relayed hop by hop to reach the other
+	mine(t, h, 0, 2)
+	if err := h.WaitForConvergence(10 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if height := h.Nodes[3].Blockchain.Tip().Index; height != 2 {
+		t.Fatalf("far end of the line is at height %d, want 2", height)
+	}
+}
+
+func TestSimResolvesCompetingBlocks(t *testing.T) {
+	h := startHarness(t, 2)
+
+	// Both nodes mine at the same height while unable to hear each other
+	h.Partition([]int{0}, []int{1})
+	mine(t, h, 0, 1)
+	mine(t, h, 1, 1)
+	if h.Converged() {
+		t.Fatal("partitioned nodes mined the same block")
+	}
+
+	// The first branch to grow wins on both
+	h.Network.Heal()
+	mine(t, h, 1, 1)
+	if err := h.WaitForConvergence(10 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if height := h.Nodes[0].Blockchain.Tip().Index; height != 2 {
+		t.Fatalf("converged at height %d, want 2", height)
+	}
+}
+
+func TestSimHarnessUsesNoRealSeeds(t *testing.T) {
+	h, err := NewSimHarness(2, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, node := range h.Nodes {
+		if seeds := node.seedAddresses(); len(seeds) != 0 {
+			t.Fatalf("node %s would ask seeds %v", node.Address, seeds)
+		}
+	}
+}
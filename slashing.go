@@ -0,0 +1,225 @@
+// slashing.go
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+)
+
+const (
+	DoubleSignSlashPercent = 5           // Share of a validator's bonded stake burned for signing two blocks in one slot.
+	DowntimeSlashPercent   = 1           // Share burned when a validator misses too many slots.
+	MaxMissedSlots         = 10          // Slots a validator may miss in an epoch before it is jailed.
+	DowntimeJailPeriod     = EpochLength // Blocks a validator jailed for downtime must wait before unjailing.
+	maxCountedRounds       = EpochLength // Missed rounds counted for one block, bounding the work a long gap costs.
+)
+
+// A PoS slot is the previous block and a round, and its proposer may sign one block for it. Signing
+// two is equivocation: anyone holding both headers can submit them as evidence, and the offender
+// loses part of everything bonded to it, including stake still unbonding, and is tombstoned out of
+// the validator set for good. A validator that misses too many of its slots in an epoch is slashed
+// more lightly and jailed until it sends an unjail transaction.
+
+// DoubleSignEvidence is a pair of headers one proposer signed for the same slot.
+type DoubleSignEvidence struct {
+	First  *Block
+	Second *Block
+}
+
+// Verify checks the headers conflict and were both signed by their proposer, and returns the offender.
+func (e *DoubleSignEvidence) Verify() (string, error) {
+	if e == nil || e.First == nil || e.Second == nil {
+		return "", errors.New("evidence needs two headers")
+	}
+	a, b := e.First, e.Second
+	if a.Proposer == "" || a.Proposer != b.Proposer {
+		return "", errors.New("evidence headers are not from the same proposer")
+	}
+	if a.Index != b.Index || a.PreviousHash != b.PreviousHash || a.Round != b.Round {
+		return "", errors.New("evidence headers are for different slots")
+	}
+	if a.Hash == b.Hash {
+		return "", errors.New("evidence headers are the same block")
+	}
+	for _, header := range []*Block{a, b} {
+		if header.calculateHash() != header.Hash {
+			return "", fmt.Errorf("evidence header %s does not match its hash", header.Hash)
+		}
+		if err := verifyBlockSignature(header); err != nil {
+			return "", err
+		}
+	}
+	return a.Proposer, nil
+}
+
+// slotKey identifies a proposer's slot, so the same equivocation is only punished once.
+func (e *DoubleSignEvidence) slotKey() string {
+	return e.First.Proposer + ":" + e.First.PreviousHash + ":" + strconv.Itoa(e.First.Round)
+}
+
+// checkEvidence reports whether verified evidence can still be acted on at height.
+func (s *StakingState) checkEvidence(evidence *DoubleSignEvidence, height int) error {
+	if evidence.First.Index+UnbondingPeriod <= height {
+		return errors.New("evidence is older than the unbonding period")
+	}
+	if s.Punished[evidence.slotKey()] {
+		return errors.New("double-signing in this slot has already been punished")
+	}
+	if s.Tombstoned[evidence.First.Proposer] {
+		return fmt.Errorf("%s is already tombstoned", shortValidator(evidence.First.Proposer))
+	}
+	return nil
+}
+
+// punishDoubleSign slashes and tombstones the offender named by accepted evidence.
+func (s *StakingState) punishDoubleSign(evidence *DoubleSignEvidence) {
+	offender := evidence.First.Proposer
+	s.Punished[evidence.slotKey()] = true
+	s.slash(offender, DoubleSignSlashPercent)
+	s.jail(offender, evidence.First.Index)
+	s.Tombstoned[offender] = true
+}
+
+// checkUnjail reports whether a jailed validator may rejoin at height.
+func (s *StakingState) checkUnjail(validator string, height int) error {
+	releaseHeight, jailed := s.Jailed[validator]
+	switch {
+	case !jailed:
+		return fmt.Errorf("%s is not jailed", shortValidator(validator))
+	case s.Tombstoned[validator]:
+		return fmt.Errorf("%s is tombstoned for double-signing", shortValidator(validator))
+	case height < releaseHeight:
+		return fmt.Errorf("%s is jailed until height %d", shortValidator(validator), releaseHeight)
+	case s.Bonds[validator][validator] <= 0:
+		return fmt.Errorf("%s has no bond of its own", shortValidator(validator))
+	}
+	return nil
+}
+
+// slash burns percent of everything bonded or unbonding to the validator, rounding up, and returns
+// the total burned.
+func (s *StakingState) slash(validator string, percent int) int {
+	cut := func(amount int) int {
+		return (amount*percent + 99) / 100
+	}
+
+	burned := 0
+	for delegator, amount := range s.Bonds[validator] {
+		penalty := cut(amount)
+		burned += penalty
+		if amount == penalty {
+			delete(s.Bonds[validator], delegator)
+		} else {
+			s.Bonds[validator][delegator] = amount - penalty
+		}
+	}
+	if len(s.Bonds[validator]) == 0 {
+		delete(s.Bonds, validator)
+	}
+
+	unbonding := s.Unbonding[:0]
+	for _, entry := range s.Unbonding {
+		if entry.Validator == validator {
+			penalty := cut(entry.Amount)
+			burned += penalty
+			entry.Amount -= penalty
+		}
+		if entry.Amount > 0 {
+			unbonding = append(unbonding, entry)
+		}
+	}
+	s.Unbonding = unbonding
+	return burned
+}
+
+// jail removes the validator from the active set straight away and keeps it out of later ones
+// until releaseHeight and an unjail transaction.
+func (s *StakingState) jail(validator string, releaseHeight int) {
+	s.Jailed[validator] = releaseHeight
+	delete(s.Validators, validator)
+	delete(s.Missed, validator)
+}
+
+// beginBlock charges the proposers of the rounds skipped before a PoS block with a missed slot,
+// jailing any that reach MaxMissedSlots this epoch. PoW blocks have no slots.
+func (s *StakingState) beginBlock(previousHash string, round int, pos bool, height int) {
+	if !pos {
+		return
+	}
+	stakes := make(map[string]int, len(s.Validators)) // Jailing shrinks the set; the block's rounds were drawn from the set before it
+	for validator, power := range s.Validators {
+		stakes[validator] = power
+	}
+	for r := 0; r < round && r < maxCountedRounds; r++ {
+		missed := ProposerForSlot(previousHash, r, stakes)
+		if missed == "" {
+			return
+		}
+		if _, jailed := s.Jailed[missed]; jailed {
+			continue
+		}
+		s.Missed[missed]++
+		if s.Missed[missed] >= MaxMissedSlots {
+			s.slash(missed, DowntimeSlashPercent)
+			s.jail(missed, height+DowntimeJailPeriod)
+		}
+	}
+}
+
+// ConflictingBlock returns the chain's block for the same slot as block if the same proposer
+// signed both, or nil.
+func (bc *Blockchain) ConflictingBlock(block *Block) *Block {
+	bc.lock.RLock()
+	defer bc.lock.RUnlock()
+	if block.Proposer == "" || block.Index < 1 || block.Index >= len(bc.Blocks) {
+		return nil
+	}
+	existing := bc.Blocks[block.Index]
+	if existing.Hash == block.Hash || existing.Proposer != block.Proposer ||
+		existing.PreviousHash != block.PreviousHash || existing.Round != block.Round {
+		return nil
+	}
+	return existing
+}
+
+// reportDoubleSign submits evidence that the proposer of existing also signed conflicting, paying
+// the fee from the node's validator address.
+func (n *Node) reportDoubleSign(existing, conflicting *Block) {
+	evidence := &DoubleSignEvidence{First: existing.Header(), Second: conflicting.Header()}
+	offender, err := evidence.Verify()
+	if err != nil {
+		return // Not a real equivocation, e.g. a forged signature
+	}
+
+	sender, err := ValidatorAddress(&n.PrivateKey.PublicKey)
+	if err != nil {
+		log.Printf("Cannot report double-signing: %v", err)
+		return
+	}
+	tx := &Transaction{
+		Sender:    sender,
+		Fee:       n.Blockchain.Spec.MinTransactionFee,
+		Nonce:     time.Now().UnixNano(),
+		Timestamp: time.Now().Unix(),
+		Type:      TxTypeEvidence,
+		Validator: offender,
+		Evidence:  evidence,
+	}
+	if err := tx.Sign(n.PrivateKey); err != nil {
+		log.Printf("Cannot report double-signing: %v", err)
+		return
+	}
+	if err := n.Blockchain.CheckStakingTransaction(tx); err != nil {
+		log.Printf("Not reporting double-signing by %s: %v", shortValidator(offender), err)
+		return
+	}
+	if err := n.Blockchain.Mempool.AddTransaction(tx, n.Blockchain.Accounts, n.Blockchain.UTXOSet); err != nil {
+		log.Printf("Cannot report double-signing by %s: %v", shortValidator(offender), err)
+		return
+	}
+	log.Printf("Validator %s double-signed block %d, evidence submitted", shortValidator(offender), existing.Index)
+	n.RelayTransaction(tx)
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"strings"
+	"testing"
+)
+
+// signedHeader returns a header for slot (previous, round) at height 5 signed by key.
+func signedHeader(t *testing.T, key *ecdsa.PrivateKey, proposer string, round int, timestamp int64) *Block {
+	t.Helper()
+	header := &Block{Index: 5, PreviousHash: "previous", Round: round, Proposer: proposer, Timestamp: timestamp}
+	header.Hash = header.calculateHash()
+	if err := signBlock(header, key); err != nil {
+		t.Fatal(err)
+	}
+	return header
+}
+
+// bondedState returns a ledger where validator is active with its own bond and a delegation.
+func bondedState(validator string) *StakingState {
+	staking := NewStakingState()
+	staking.Bonds[validator] = map[string]int{validator: 1000, "delegator": 200}
+	staking.Validators[validator] = 1200
+	return staking
+}
+
+func TestDoubleSignEvidenceSlashesAndTombstones(t *testing.T) {
+	key, validator := newKeyAddress(t)
+	evidence := &DoubleSignEvidence{First: signedHeader(t, key, validator, 0, 1), Second: signedHeader(t, key, validator, 0, 2)}
+	offender, err := evidence.Verify()
+	if err != nil || offender != validator {
+		t.Fatalf("evidence named %q, %v", offender, err)
+	}
+
+	staking := bondedState(validator)
+	if err := staking.checkEvidence(evidence, 6); err != nil {
+		t.Fatal(err)
+	}
+	staking.punishDoubleSign(evidence)
+	if staking.Bonds[validator][validator] != 950 || staking.Bonds[validator]["delegator"] != 190 {
+		t.Fatalf("bonds after slashing are %v, want 5%% burned from each", staking.Bonds[validator])
+	}
+	if _, active := staking.Validators[validator]; active || !staking.Tombstoned[validator] {
+		t.Fatal("offender is still in the validator set")
+	}
+	if err := staking.checkEvidence(evidence, 6); err == nil {
+		t.Fatal("the same double-sign was punished twice")
+	}
+	if err := staking.checkUnjail(validator, 1_000_000); err == nil || !strings.Contains(err.Error(), "tombstoned") {
+		t.Fatalf("tombstoned validator may unjail: %v", err)
+	}
+}
+
+func TestDoubleSignEvidenceRejectsNonConflicts(t *testing.T) {
+	key, validator := newKeyAddress(t)
+	forgerKey, _ := newKeyAddress(t)
+	first := signedHeader(t, key, validator, 0, 1)
+	for name, evidence := range map[string]*DoubleSignEvidence{
+		"same block":       {First: first, Second: first},
+		"different slots":  {First: first, Second: signedHeader(t, key, validator, 1, 2)},
+		"forged signature": {First: first, Second: signedHeader(t, forgerKey, validator, 0, 2)},
+		"missing header":   {First: first},
+	} {
+		if _, err := evidence.Verify(); err == nil {
+			t.Errorf("%s: accepted as evidence", name)
+		}
+	}
+
+	evidence := &DoubleSignEvidence{First: first, Second: signedHeader(t, key, validator, 0, 2)}
+	if err := bondedState(validator).checkEvidence(evidence, first.Index+UnbondingPeriod); err == nil {
+		t.Fatal("acted on evidence older than the unbonding period")
+	}
+}
+
+func TestMissedSlotsJailUntilUnjailed(t *testing.T) {
+	_, validator := newKeyAddress(t)
+	staking := bondedState(validator)
+
+	// A single validator is the proposer of every round, so each skipped round is its miss
+	staking.beginBlock("previous", MaxMissedSlots-1, true, 10)
+	if _, jailed := staking.Jailed[validator]; jailed {
+		t.Fatal("jailed before reaching the missed slot limit")
+	}
+	staking.beginBlock("previous", 1, false, 11)
+	if staking.Missed[validator] != MaxMissedSlots-1 {
+		t.Fatal("a PoW block counted missed slots")
+	}
+	staking.beginBlock("other", 1, true, 12)
+	if release, jailed := staking.Jailed[validator]; !jailed || release != 12+DowntimeJailPeriod {
+		t.Fatalf("jailed until %d (%v), want %d", release, jailed, 12+DowntimeJailPeriod)
+	}
+	if staking.Bonds[validator][validator] != 990 {
+		t.Fatalf("own bond is %d after downtime, want 1%% burned", staking.Bonds[validator][validator])
+	}
+
+	if err := staking.checkUnjail(validator, 12+DowntimeJailPeriod-1); err == nil {
+		t.Fatal("unjailed before the jail period ended")
+	}
+	if err := staking.checkUnjail(validator, 12+DowntimeJailPeriod); err != nil {
+		t.Fatalf("could not unjail after the jail period: %v", err)
+	}
+}
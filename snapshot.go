@@ -0,0 +1,429 @@
+// snapshot.go
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"sort"
+)
+
+// Snapshot captures the chain state at a given height so a new node can start from it instead of
+// replaying every block. The headers let the node keep extending the chain and later check the
+// snapshot against the full history.
+type Snapshot struct {
+	Height         int               // Height of the block the snapshot was taken at.
+	BlockHash      string            // Hash of that block.
+	UTXOCommitment string            // Commitment of the UTXO set, matching the block header.
+	Headers        []*Block          // Every block up to Height with its transactions stripped.
+	UTXOs          []UTXO            // All unspent outputs, sorted by TxID and Index.
+	Confirmed      []string          // Hashes of every transaction applied, sorted; checked against the history.
+	Accounts       []AccountSnapshot // All known accounts at Height, sorted by address.
+	AccountsHash   string            // Commitment to Accounts, checked against the history like Staking.
+	Staking        *StakingState     // Staking ledger at Height; not covered by the commitment, so checked against the history.
+	Authorities    *AuthorityState   // PoA authority set at Height; checked against the history like Staking.
+}
+
+// AccountSnapshot is the serialisable form of an Account.
+type AccountSnapshot struct {
+	Address   string
+	Balance   int
+	Nonce     int64
+	PublicKey string // Hex-encoded PKIX public key, empty if the account has none.
+}
+
+// Header returns a copy of the block without its transactions.
+func (b *Block) Header() *Block {
+	header := *b
+	header.Transactions = nil
+	return &header
+}
+
+// CreateSnapshot builds a snapshot at the given height. The tip is taken from the live UTXO set;
+// earlier heights are rebuilt by replaying the chain's blocks from genesis.
+func (bc *Blockchain) CreateSnapshot(height int) (*Snapshot, error) {
+	bc.lock.RLock()
+	defer bc.lock.RUnlock()
+
+	if height < 0 || height >= len(bc.Blocks) {
+		return nil, fmt.Errorf("height %d is outside the chain (tip is %d)", height, len(bc.Blocks)-1)
+	}
+
+	utxoSet := bc.UTXOSet
+	staking := bc.Staking.Clone()
+	authorities := bc.Authorities.Clone()
+	if height != len(bc.Blocks)-1 {
+		utxoSet = NewUTXOSet()
+		staking = NewStakingState()
+		authorities = NewAuthorityState(bc.genesisAuthorities)
+		schedule := newConsensusSchedule(bc.schedule.Genesis)
+		for _, block := range bc.Blocks[:height+1] {
+			if block.Transactions == nil && block.MerkleRoot != "" {
+				return nil, fmt.Errorf("body of block %d is not available to replay", block.Index)
+			}
+			if _, err := applyBlockState(utxoSet, staking, authorities, block, consensusEngines[schedule.at(block.Index)], bc.blockReward, bc.Accounts, true); err != nil {
+				return nil, err
+			}
+			schedule.record(block)
+		}
+	}
+
+	snapshot := &Snapshot{
+		Height:         height,
+		BlockHash:      bc.Blocks[height].Hash,
+		UTXOCommitment: utxoSet.Commitment(),
+		Staking:        staking,
+		Authorities:    authorities,
+	}
+	if snapshot.UTXOCommitment != bc.Blocks[height].UTXOCommitment {
+		return nil, fmt.Errorf("UTXO set does not match the commitment in block %d", height)
+	}
+
+	for _, block := range bc.Blocks[:height+1] {
+		snapshot.Headers = append(snapshot.Headers, block.Header())
+	}
+
+	utxoSet.lock.RLock()
+	for _, outputs := range utxoSet.UTXOs {
+		for _, utxo := range outputs {
+			snapshot.UTXOs = append(snapshot.UTXOs, utxo)
+		}
+	}
+	utxoSet.lock.RUnlock()
+	snapshot.Confirmed = utxoSet.confirmedHashes()
+	sort.Slice(snapshot.UTXOs, func(i, j int) bool {
+		if snapshot.UTXOs[i].TxID != snapshot.UTXOs[j].TxID {
+			return snapshot.UTXOs[i].TxID < snapshot.UTXOs[j].TxID
+		}
+		return snapshot.UTXOs[i].Index < snapshot.UTXOs[j].Index
+	})
+
+	// Accounts are rebuilt at the snapshot height. Nonces in pruned blocks are no longer in the
+	// history, so the ones the accounts recorded when the node restored or synced them are kept.
+	nonces := transferNonces(bc.Blocks[:height+1])
+	if bc.prunedBelow > 0 {
+		for address, account := range bc.Accounts {
+			if account.Nonce > nonces[address] {
+				nonces[address] = account.Nonce
+			}
+		}
+	}
+	accounts, err := rebuildAccounts(bc.Accounts, utxoSet, nonces)
+	if err != nil {
+		return nil, err
+	}
+	snapshot.Accounts = accounts
+	snapshot.AccountsHash = accountsHash(accounts)
+	return snapshot, nil
+}
+
+// transferNonces returns the highest nonce each sender has used for a transfer in blocks.
+func transferNonces(blocks []*Block) map[string]int64 {
+	nonces := make(map[string]int64)
+	for _, block := range blocks {
+		for _, tx := range block.Transactions {
+			if tx.Sender != "system" && !tx.IsStaking() && tx.Nonce > nonces[tx.Sender] {
+				nonces[tx.Sender] = tx.Nonce
+			}
+		}
+	}
+	return nonces
+}
+
+// rebuildAccounts returns the known accounts as the chain state has them: each balance is what the
+// UTXO set holds for the address and each nonce the highest it has used. Public keys are kept.
+func rebuildAccounts(known map[string]*Account, utxoSet *UTXOSet, nonces map[string]int64) ([]AccountSnapshot, error) {
+	accounts := make([]AccountSnapshot, 0, len(known))
+	for address, account := range known {
+		accountSnapshot := AccountSnapshot{Address: address, Balance: utxoSet.GetBalance(address), Nonce: nonces[address]}
+		if account.PublicKey != nil {
+			pubKeyBytes, err := x509.MarshalPKIXPublicKey(account.PublicKey)
+			if err != nil {
+				return nil, fmt.Errorf("failed to encode public key for %s: %w", address, err)
+			}
+			accountSnapshot.PublicKey = hex.EncodeToString(pubKeyBytes)
+		}
+		accounts = append(accounts, accountSnapshot)
+	}
+	sort.Slice(accounts, func(i, j int) bool {
+		return accounts[i].Address < accounts[j].Address
+	})
+	return accounts, nil
+}
+
+// accountsHash returns the commitment to a snapshot's accounts.
+func accountsHash(accounts []AccountSnapshot) string {
+	data, _ := json.Marshal(accounts) // Every field is plain data, so encoding can't fail
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// WriteFile saves the snapshot as JSON.
+func (s *Snapshot) WriteFile(path string) error {
+	data, err := json.Marshal(s)
+	if err != nil {
+		return fmt.Errorf("failed to encode snapshot: %w", err)
+	}
+	return os.WriteFile(path, data, 0600)
+}
+
+// LoadSnapshot reads a snapshot from disk and checks that its UTXOs hash to the recorded commitment.
+func LoadSnapshot(path string) (*Snapshot, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var snapshot Snapshot
+	if err := json.Unmarshal(data, &snapshot); err != nil {
+		return nil, fmt.Errorf("failed to decode snapshot: %w", err)
+	}
+
+	if len(snapshot.Headers) != snapshot.Height+1 {
+		return nil, errors.New("snapshot headers do not reach the snapshot height")
+	}
+	tip := snapshot.Headers[snapshot.Height]
+	if tip.Hash != snapshot.BlockHash || tip.UTXOCommitment != snapshot.UTXOCommitment {
+		return nil, errors.New("snapshot does not match its tip header")
+	}
+	if commitment := snapshot.utxoSet().Commitment(); commitment != snapshot.UTXOCommitment {
+		return nil, fmt.Errorf("snapshot UTXOs hash to %s, expected %s", commitment, snapshot.UTXOCommitment)
+	}
+	if hash := accountsHash(snapshot.Accounts); hash != snapshot.AccountsHash {
+		return nil, fmt.Errorf("snapshot accounts hash to %s, expected %s", hash, snapshot.AccountsHash)
+	}
+	return &snapshot, nil
+}
+
+// utxoSet rebuilds a UTXOSet from the snapshot's outputs.
+func (s *Snapshot) utxoSet() *UTXOSet {
+	utxoSet := NewUTXOSet()
+	for _, utxo := range s.UTXOs {
+		utxoSet.AddUTXO(utxo)
+	}
+	for _, hash := range s.Confirmed {
+		utxoSet.confirmed[hash] = true
+	}
+	return utxoSet
+}
+
+// accounts decodes the snapshot's accounts. An account whose address encodes a public key can only
+// have that key.
+func (s *Snapshot) accounts() (map[string]*Account, error) {
+	accounts := make(map[string]*Account)
+	for _, accountSnapshot := range s.Accounts {
+		var publicKey *ecdsa.PublicKey
+		if accountSnapshot.PublicKey != "" {
+			pubKeyBytes, err := hex.DecodeString(accountSnapshot.PublicKey)
+			if err != nil {
+				return nil, fmt.Errorf("invalid public key for %s: %w", accountSnapshot.Address, err)
+			}
+			parsed, err := x509.ParsePKIXPublicKey(pubKeyBytes)
+			if err != nil {
+				return nil, fmt.Errorf("invalid public key for %s: %w", accountSnapshot.Address, err)
+			}
+			ecdsaKey, ok := parsed.(*ecdsa.PublicKey)
+			if !ok {
+				return nil, fmt.Errorf("public key for %s is not an ECDSA key", accountSnapshot.Address)
+			}
+			publicKey = ecdsaKey
+		}
+		if addressKey, err := parseValidatorAddress(accountSnapshot.Address); err == nil && publicKey != nil && !publicKey.Equal(addressKey) {
+			return nil, fmt.Errorf("account %s has a public key other than the one its address encodes", shortValidator(accountSnapshot.Address))
+		}
+		account := NewAccount(accountSnapshot.Address, accountSnapshot.Balance, publicKey)
+		account.Nonce = accountSnapshot.Nonce
+		accounts[accountSnapshot.Address] = account
+	}
+	return accounts, nil
+}
+
+// RestoreSnapshot replaces the chain state with the snapshot. The headers are validated as a chain,
+// but the history behind them is only trusted until ValidateSnapshotHistory has checked it.
+func (bc *Blockchain) RestoreSnapshot(snapshot *Snapshot) error {
+	if len(snapshot.Headers) == 0 || snapshot.Headers[0].Hash != bc.Blocks[0].Hash {
+		return errors.New("snapshot is for a chain with a different genesis block")
+	}
+	if !bc.IsValidChain(snapshot.Headers) {
+		return errors.New("snapshot headers do not form a valid chain")
+	}
+
+	accounts, err := snapshot.accounts()
+	if err != nil {
+		return err
+	}
+
+	bc.lock.Lock()
+	defer bc.lock.Unlock()
+	bc.Blocks = snapshot.Headers
+	bc.schedule = replaySchedule(bc.schedule.Genesis, snapshot.Headers) // Switches and fork signals are in headers, so the snapshot carries them
+	bc.forks = replayForks(bc.forks.Forks, snapshot.Headers)
+	bc.UTXOSet = snapshot.utxoSet()
+	staking := snapshot.Staking
+	if staking == nil {
+		staking = NewStakingState()
+	}
+	bc.setStaking(staking.Clone())
+	if snapshot.Authorities != nil {
+		bc.Authorities = snapshot.Authorities.Clone()
+	}
+	bc.Accounts = accounts
+	bc.snapshotBase = snapshot
+	bc.prunedBelow = snapshot.Height + 1 // Only headers are known up to the snapshot
+	bc.undo = make(map[string]*UTXOUndo)
+	bc.voters = make(map[string]map[string]int)
+	bc.finalizedHeight = snapshot.Height // The snapshot is trusted as a starting point, so nothing below it is reverted
+	return nil
+}
+
+// NeedsSnapshotValidation reports whether the chain was started from a snapshot whose history
+// has not been checked yet.
+func (bc *Blockchain) NeedsSnapshotValidation() bool {
+	bc.lock.RLock()
+	defer bc.lock.RUnlock()
+	return bc.snapshotBase != nil
+}
+
+// Errors for a history that can't be used to check the snapshot. They say nothing about the
+// snapshot, only about whoever sent the history.
+var (
+	ErrForeignHistory = errors.New("history is not the chain the snapshot was taken from")
+	ErrInvalidHistory = errors.New("history is not a valid chain")
+)
+
+// ValidateSnapshotHistory replays full blocks from genesis and checks they reproduce the snapshot
+// the chain was started from. On success the missing block bodies are filled in from blocks. A
+// history that doesn't match the snapshot's headers, or isn't valid, fails with ErrForeignHistory
+// or ErrInvalidHistory and leaves the snapshot in place. But if the blocks the snapshot's headers
+// commit to don't reproduce it, the snapshot can't be trusted: the chain goes back to its genesis
+// block so it can sync normally.
+func (bc *Blockchain) ValidateSnapshotHistory(blocks []*Block) error {
+	bc.lock.RLock()
+	base := bc.snapshotBase
+	reward := bc.blockReward
+	bc.lock.RUnlock()
+	if base == nil {
+		return nil
+	}
+
+	if len(blocks) <= base.Height {
+		return fmt.Errorf("history only reaches height %d, snapshot is at %d", len(blocks)-1, base.Height)
+	}
+	history := blocks[:base.Height+1]
+	if err := bc.checkSnapshotHistory(base, history); err != nil {
+		return err
+	}
+	if err := bc.replaySnapshotHistory(base, history, reward); err != nil {
+		bc.discardSnapshot(base)
+		return err
+	}
+
+	bc.lock.Lock()
+	defer bc.lock.Unlock()
+	if bc.PruneDepth == 0 {
+		// A full node keeps the history it just validated; a pruned one only needed to check it
+		for i, block := range history {
+			if i < len(bc.Blocks) && bc.Blocks[i].Hash == block.Hash {
+				bc.Blocks[i] = block
+			}
+		}
+		bc.prunedBelow = 0
+		if bc.Indexer != nil {
+			bc.rebuildTxIndex()
+		}
+	}
+	bc.snapshotBase = nil
+	return nil
+}
+
+// checkSnapshotHistory checks history, which ends at the snapshot height, is the chain of the
+// snapshot's headers with the bodies they commit to.
+func (bc *Blockchain) checkSnapshotHistory(base *Snapshot, history []*Block) error {
+	for i, block := range history {
+		if block.Hash != base.Headers[i].Hash {
+			return fmt.Errorf("%w: it diverges from the snapshot headers at height %d", ErrForeignHistory, i)
+		}
+		if block.calculateMerkleRoot() != block.MerkleRoot {
+			return fmt.Errorf("%w: body of block %d does not match its merkle root", ErrInvalidHistory, i)
+		}
+	}
+	if !bc.IsValidChain(history) {
+		return ErrInvalidHistory
+	}
+	return nil
+}
+
+// replaySnapshotHistory checks that replaying history, which checkSnapshotHistory accepted,
+// reproduces the snapshot's UTXO set, staking ledger, authority set and accounts.
+func (bc *Blockchain) replaySnapshotHistory(base *Snapshot, history []*Block, reward int) error {
+	known, err := base.accounts()
+	if err != nil {
+		return err
+	}
+
+	utxoSet := NewUTXOSet()
+	staking := NewStakingState()
+	authorities := NewAuthorityState(bc.genesisAuthorities)
+	schedule := newConsensusSchedule(bc.schedule.Genesis)
+	assumedValid := bc.assumedValidHeight(history)
+	for i, block := range history {
+		if _, err := applyBlockState(utxoSet, staking, authorities, block, consensusEngines[schedule.at(block.Index)], reward, known, i > assumedValid); err != nil {
+			return fmt.Errorf("block %d: %w", i, err)
+		}
+		schedule.record(block)
+		if utxoSet.Commitment() != block.UTXOCommitment {
+			return fmt.Errorf("UTXO commitment mismatch replaying block %d", i)
+		}
+	}
+	if utxoSet.Commitment() != base.UTXOCommitment {
+		return errors.New("replayed UTXO set does not match the snapshot")
+	}
+	if !slices.Equal(utxoSet.confirmedHashes(), base.Confirmed) {
+		return errors.New("replayed confirmed transactions do not match the snapshot")
+	}
+	if !staking.equal(base.Staking) {
+		return errors.New("replayed staking ledger does not match the snapshot")
+	}
+	if base.Authorities != nil && !authorities.equal(base.Authorities) {
+		return errors.New("replayed authority set does not match the snapshot")
+	}
+	rebuilt, err := rebuildAccounts(known, utxoSet, transferNonces(history))
+	if err != nil {
+		return err
+	}
+	if accountsHash(rebuilt) != base.AccountsHash {
+		return errors.New("replayed account balances and nonces do not match the snapshot")
+	}
+	return nil
+}
+
+// discardSnapshot puts the chain back at its genesis block, unless it has moved on from base.
+func (bc *Blockchain) discardSnapshot(base *Snapshot) {
+	genesis, utxoSet := bc.Spec.Genesis()
+	bc.lock.Lock()
+	defer bc.lock.Unlock()
+	if bc.snapshotBase != base {
+		return
+	}
+	bc.Blocks = []*Block{genesis}
+	bc.schedule = newConsensusSchedule(bc.schedule.Genesis)
+	bc.forks = newForkTracker(bc.forks.Forks)
+	bc.UTXOSet = utxoSet
+	bc.setStaking(NewStakingState())
+	bc.Authorities = NewAuthorityState(bc.genesisAuthorities)
+	bc.Accounts = make(map[string]*Account)
+	bc.snapshotBase = nil
+	bc.prunedBelow = 0
+	bc.undo = make(map[string]*UTXOUndo)
+	bc.voters = make(map[string]map[string]int)
+	bc.finalizedHeight = 0
+	if bc.Indexer != nil {
+		bc.rebuildTxIndex()
+	}
+}
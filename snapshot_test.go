@@ -0,0 +1,122 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+// snapshotChain returns a regtest chain whose blocks pay alice, an account it knows.
+func snapshotChain(t *testing.T, blocks int) *Blockchain {
+	t.Helper()
+	bc := NewBlockchainFromSpec(RegtestSpec)
+	bc.Accounts["alice"] = NewAccount("alice", 1_000_000, nil)
+	if _, err := bc.GenerateBlocks(blocks, "alice", nil); err != nil {
+		t.Fatal(err)
+	}
+	return bc
+}
+
+func TestSnapshotAccountsAreRebuiltAtItsHeight(t *testing.T) {
+	bc := snapshotChain(t, 3)
+	snapshot, err := bc.CreateSnapshot(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(snapshot.Accounts) != 1 || snapshot.Accounts[0].Balance != BlockReward {
+		t.Fatalf("snapshot accounts are %+v, want alice with one block reward", snapshot.Accounts)
+	}
+
+	restored := NewBlockchainFromSpec(RegtestSpec)
+	if err := restored.RestoreSnapshot(snapshot); err != nil {
+		t.Fatal(err)
+	}
+	if err := restored.ValidateSnapshotHistory(bc.Blocks); err != nil {
+		t.Fatalf("history of an honest snapshot did not validate: %v", err)
+	}
+}
+
+func TestSnapshotWithForgedAccountsFallsBackToGenesis(t *testing.T) {
+	bc := snapshotChain(t, 2)
+	snapshot, err := bc.CreateSnapshot(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	snapshot.Accounts[0].Balance = 1_000_000
+	snapshot.AccountsHash = accountsHash(snapshot.Accounts)
+
+	restored := NewBlockchainFromSpec(RegtestSpec)
+	if err := restored.RestoreSnapshot(snapshot); err != nil {
+		t.Fatal(err)
+	}
+	if err := restored.ValidateSnapshotHistory(bc.Blocks); err == nil {
+		t.Fatal("history validated a snapshot with a forged balance")
+	}
+	if restored.NeedsSnapshotValidation() || len(restored.Blocks) != 1 {
+		t.Fatalf("chain kept the rejected snapshot, tip is %d", restored.Tip().Index)
+	}
+
+	// The chain syncs normally from there
+	if err := restored.Reorganize(bc.Blocks); err != nil {
+		t.Fatal(err)
+	}
+	if restored.Tip().Hash != bc.Tip().Hash {
+		t.Fatal("chain did not sync after discarding the snapshot")
+	}
+}
+
+func TestSnapshotShortHistoryKeepsSnapshot(t *testing.T) {
+	bc := snapshotChain(t, 2)
+	snapshot, err := bc.CreateSnapshot(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	restored := NewBlockchainFromSpec(RegtestSpec)
+	if err := restored.RestoreSnapshot(snapshot); err != nil {
+		t.Fatal(err)
+	}
+	if err := restored.ValidateSnapshotHistory(bc.Blocks[:2]); err == nil {
+		t.Fatal("history short of the snapshot validated it")
+	}
+	if !restored.NeedsSnapshotValidation() {
+		t.Fatal("a peer that is behind made the chain discard its snapshot")
+	}
+}
+
+func TestSnapshotForeignHistoryKeepsSnapshot(t *testing.T) {
+	bc := snapshotChain(t, 2)
+	snapshot, err := bc.CreateSnapshot(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	restored := NewBlockchainFromSpec(RegtestSpec)
+	if err := restored.RestoreSnapshot(snapshot); err != nil {
+		t.Fatal(err)
+	}
+	height := restored.Tip().Index
+
+	foreign := NewBlockchainFromSpec(RegtestSpec)
+	if _, err := foreign.GenerateBlocks(2, "mallory", nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := restored.ValidateSnapshotHistory(foreign.Blocks); !errors.Is(err, ErrForeignHistory) {
+		t.Fatalf("foreign history gave %v, want ErrForeignHistory", err)
+	}
+
+	// A tampered body under the snapshot's own headers is the sender's fault too
+	tampered := make([]*Block, len(bc.Blocks))
+	for i, block := range bc.Blocks {
+		copied := *block
+		tampered[i] = &copied
+	}
+	tampered[1].Transactions = []*Transaction{{Sender: "system", Recipient: "mallory", Amount: BlockReward}}
+	if err := restored.ValidateSnapshotHistory(tampered); !errors.Is(err, ErrInvalidHistory) {
+		t.Fatalf("tampered history gave %v, want ErrInvalidHistory", err)
+	}
+
+	if !restored.NeedsSnapshotValidation() || restored.Tip().Index != height {
+		t.Fatal("a peer on another chain made the chain discard its snapshot")
+	}
+	if err := restored.ValidateSnapshotHistory(bc.Blocks); err != nil {
+		t.Fatalf("snapshot did not validate after rejecting foreign histories: %v", err)
+	}
+}
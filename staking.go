@@ -0,0 +1,460 @@
+// staking.go
+package main
+
+import (
+	"crypto/ecdsa"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// Staking transaction types. Ordinary transfers leave Transaction.Type empty.
+const (
+	TxTypeBond     = "bond"     // Locks the sender's funds as its own stake, making it a validator.
+	TxTypeDelegate = "delegate" // Locks the sender's funds as stake behind Validator.
+	TxTypeUnbond   = "unbond"   // Starts releasing stake the sender bonded to Validator, or to itself.
+	TxTypeEvidence = "evidence" // Reports Validator for signing two blocks in one slot.
+	TxTypeUnjail   = "unjail"   // Returns the sender to the validator set after a downtime jailing.
+)
+
+const (
+	EpochLength        = 100             // Blocks per epoch. The validator set only changes at epoch boundaries.
+	UnbondingPeriod    = 2 * EpochLength // Blocks unbonded funds stay locked, so stake can still be slashed for recent misbehavior.
+	unbondReleaseIndex = 3               // Output index of the UTXO an unbond releases when it matures.
+)
+
+// Staking funds leave the UTXO set when they are bonded and come back as a new output once an
+// unbond has matured. In between they are tracked here. Validators' voting power follows their
+// bonds, but only takes effect at the next epoch boundary, so every node proposing or checking a
+// block in an epoch agrees on the set.
+
+// UnbondingEntry is stake on its way back to its owner.
+type UnbondingEntry struct {
+	TxID         string // Unbond transaction that started it; names the output it releases.
+	Delegator    string
+	Validator    string
+	Amount       int
+	MatureHeight int // Height of the block that releases the funds.
+}
+
+// StakingState is the staking ledger as of a block.
+type StakingState struct {
+	Bonds      map[string]map[string]int // Bonded amount by validator, then by delegator. A validator's own bond is under its own address.
+	Unbonding  []UnbondingEntry          // Oldest first.
+	Validators map[string]int            // Voting power of the active validator set.
+	Jailed     map[string]int            // Jailed validators and the height from which they may unjail.
+	Tombstoned map[string]bool           // Validators caught double-signing, jailed for good.
+	Missed     map[string]int            // Slots each validator has missed this epoch.
+	Punished   map[string]bool           // Slots whose double-signing has already been slashed.
+	Applied    map[string]bool           // Hashes of the staking transactions applied, so none is applied twice.
+}
+
+// NewStakingState returns an empty ledger.
+func NewStakingState() *StakingState {
+	return &StakingState{
+		Bonds:      make(map[string]map[string]int),
+		Validators: make(map[string]int),
+		Jailed:     make(map[string]int),
+		Tombstoned: make(map[string]bool),
+		Missed:     make(map[string]int),
+		Punished:   make(map[string]bool),
+		Applied:    make(map[string]bool),
+	}
+}
+
+// Clone returns a deep copy, so the state before a block can be kept to undo it.
+func (s *StakingState) Clone() *StakingState {
+	clone := NewStakingState()
+	for validator, delegators := range s.Bonds {
+		clone.Bonds[validator] = make(map[string]int, len(delegators))
+		for delegator, amount := range delegators {
+			clone.Bonds[validator][delegator] = amount
+		}
+	}
+	clone.Unbonding = append([]UnbondingEntry(nil), s.Unbonding...)
+	for validator, power := range s.Validators {
+		clone.Validators[validator] = power
+	}
+	for validator, height := range s.Jailed {
+		clone.Jailed[validator] = height
+	}
+	for validator := range s.Tombstoned {
+		clone.Tombstoned[validator] = true
+	}
+	for validator, missed := range s.Missed {
+		clone.Missed[validator] = missed
+	}
+	for slot := range s.Punished {
+		clone.Punished[slot] = true
+	}
+	for hash := range s.Applied {
+		clone.Applied[hash] = true
+	}
+	return clone
+}
+
+// equal reports whether two ledgers hold the same bonds, unbonding entries, validator set and
+// applied transactions. A nil ledger is the same as an empty one.
+func (s *StakingState) equal(other *StakingState) bool {
+	if other == nil {
+		other = NewStakingState()
+	}
+	a, errA := json.Marshal(s.Clone())
+	b, errB := json.Marshal(other.Clone())
+	return errA == nil && errB == nil && string(a) == string(b) // Maps marshal with sorted keys
+}
+
+// IsStaking reports whether the transaction is a staking operation rather than a transfer.
+func (tx *Transaction) IsStaking() bool {
+	return tx.Type != ""
+}
+
+// stakingValidator returns the validator a staking transaction concerns.
+func (tx *Transaction) stakingValidator() string {
+	if tx.Type == TxTypeBond || tx.Type == TxTypeUnjail || tx.Validator == "" {
+		return tx.Sender
+	}
+	return tx.Validator
+}
+
+// lockedAmount is how much a transaction takes out of the sender's UTXOs besides its fee.
+func (tx *Transaction) lockedAmount() int {
+	switch tx.Type {
+	case "", TxTypeBond, TxTypeDelegate:
+		return tx.Amount
+	default:
+		return 0 // Unbonding spends only the fee, the stake comes back when it matures; evidence and unjailing move nothing
+	}
+}
+
+// verifyStaking checks what can be checked about a staking transaction without the ledger: its
+// type and amount, and that it was signed by the key behind the sender's validator address.
+func (tx *Transaction) verifyStaking() error {
+	if err := tx.checkStaking(); err != nil {
+		return err
+	}
+	publicKey, err := parseValidatorAddress(tx.Sender)
+	if err != nil {
+		return err
+	}
+	if !tx.Verify(publicKey) {
+		return errors.New("invalid staking transaction signature")
+	}
+	return nil
+}
+
+// checkStaking is verifyStaking without the transaction's signature.
+func (tx *Transaction) checkStaking() error {
+	switch tx.Type {
+	case TxTypeBond, TxTypeDelegate, TxTypeUnbond:
+		if tx.Amount <= 0 {
+			return errors.New("staking amount must be positive")
+		}
+		if tx.Type == TxTypeDelegate && tx.Validator == "" {
+			return errors.New("delegation has no validator")
+		}
+	case TxTypeEvidence:
+		if tx.Amount != 0 {
+			return errors.New("evidence cannot carry an amount")
+		}
+		offender, err := tx.Evidence.Verify()
+		if err != nil {
+			return err
+		}
+		if offender != tx.Validator {
+			return errors.New("evidence does not concern the named validator")
+		}
+	case TxTypeUnjail:
+		if tx.Amount != 0 {
+			return errors.New("unjailing cannot carry an amount")
+		}
+	default:
+		return fmt.Errorf("unknown transaction type %q", tx.Type)
+	}
+	return nil
+}
+
+// checkTransaction reports whether a staking transaction can be applied to the ledger in the block
+// at height. Its signature is only checked if verifySignature is set.
+func (s *StakingState) checkTransaction(tx *Transaction, height int, verifySignature bool) error {
+	check := tx.verifyStaking
+	if !verifySignature {
+		check = tx.checkStaking
+	}
+	if err := check(); err != nil {
+		return err
+	}
+	if s.Applied[tx.Hash()] {
+		return errors.New("staking transaction was already applied") // A replay would otherwise unbond twice
+	}
+	validator := tx.stakingValidator()
+	switch tx.Type {
+	case TxTypeDelegate:
+		if s.Bonds[validator][validator] <= 0 {
+			return fmt.Errorf("%s is not a validator", shortValidator(validator))
+		}
+	case TxTypeUnbond:
+		if bonded := s.Bonds[validator][tx.Sender]; bonded < tx.Amount {
+			return fmt.Errorf("only %d bonded to %s", bonded, shortValidator(validator))
+		}
+	case TxTypeEvidence:
+		return s.checkEvidence(tx.Evidence, height)
+	case TxTypeUnjail:
+		return s.checkUnjail(validator, height)
+	}
+	return nil
+}
+
+// applyTransaction updates the ledger for a staking transaction that checkTransaction accepted.
+func (s *StakingState) applyTransaction(tx *Transaction, height int) {
+	s.Applied[tx.Hash()] = true
+	validator := tx.stakingValidator()
+	switch tx.Type {
+	case TxTypeEvidence:
+		s.punishDoubleSign(tx.Evidence)
+		return
+	case TxTypeUnjail:
+		delete(s.Jailed, validator)
+		return
+	}
+	if s.Bonds[validator] == nil {
+		s.Bonds[validator] = make(map[string]int)
+	}
+
+	if tx.Type != TxTypeUnbond {
+		s.Bonds[validator][tx.Sender] += tx.Amount
+		return
+	}
+	s.Bonds[validator][tx.Sender] -= tx.Amount
+	if s.Bonds[validator][tx.Sender] == 0 {
+		delete(s.Bonds[validator], tx.Sender)
+	}
+	if len(s.Bonds[validator]) == 0 {
+		delete(s.Bonds, validator)
+	}
+	s.Unbonding = append(s.Unbonding, UnbondingEntry{
+		TxID:         tx.Hash(),
+		Delegator:    tx.Sender,
+		Validator:    validator,
+		Amount:       tx.Amount,
+		MatureHeight: height + UnbondingPeriod,
+	})
+}
+
+// endBlock finishes a block: matured unbonds are released as outputs for the caller to add to the
+// UTXO set, and at an epoch boundary the validator set is replaced by the current bonds.
+func (s *StakingState) endBlock(height int) []UTXO {
+	var released []UTXO
+	pending := s.Unbonding[:0]
+	for _, entry := range s.Unbonding {
+		if entry.MatureHeight > height {
+			pending = append(pending, entry)
+			continue
+		}
+		released = append(released, UTXO{
+			TxID:   entry.TxID,
+			Index:  unbondReleaseIndex,
+			Amount: entry.Amount,
+			Owner:  entry.Delegator,
+			Height: height,
+		})
+	}
+	s.Unbonding = pending
+
+	if height%EpochLength == 0 {
+		s.Validators = s.PendingPower()
+		s.Missed = make(map[string]int) // Liveness is judged afresh each epoch
+	}
+	return released
+}
+
+// PendingPower is the voting power each validator will have from the next epoch: everything
+// bonded to it, provided it still has a bond of its own and is not jailed.
+func (s *StakingState) PendingPower() map[string]int {
+	power := make(map[string]int)
+	for validator, delegators := range s.Bonds {
+		if _, jailed := s.Jailed[validator]; jailed || delegators[validator] <= 0 {
+			continue
+		}
+		for _, amount := range delegators {
+			power[validator] += amount
+		}
+	}
+	return power
+}
+
+// Delegation is stake an address has bonded to one validator.
+type Delegation struct {
+	Validator string
+	Amount    int
+}
+
+// Delegations lists what address has bonded, by validator, and what it is unbonding.
+func (s *StakingState) Delegations(address string) ([]Delegation, []UnbondingEntry) {
+	var delegations []Delegation
+	for validator, delegators := range s.Bonds {
+		if amount := delegators[address]; amount > 0 {
+			delegations = append(delegations, Delegation{Validator: validator, Amount: amount})
+		}
+	}
+	sort.Slice(delegations, func(i, j int) bool {
+		return delegations[i].Validator < delegations[j].Validator
+	})
+
+	var unbonding []UnbondingEntry
+	for _, entry := range s.Unbonding {
+		if entry.Delegator == address {
+			unbonding = append(unbonding, entry)
+		}
+	}
+	return delegations, unbonding
+}
+
+// checkBlockTransactions checks a block after genesis starts with its only reward transaction,
+// which mints no more than reward (fees are paid to its recipient separately), and, if
+// verifySignatures is set, that every other transaction is signed by its sender.
+func checkBlockTransactions(block *Block, reward int, accounts map[string]*Account, verifySignatures bool) error {
+	if len(block.Transactions) == 0 || block.Transactions[0].Sender != "system" {
+		return fmt.Errorf("block %d does not start with a reward transaction", block.Index)
+	}
+	if coinbase := block.Transactions[0]; coinbase.Amount < 0 || coinbase.Amount > reward {
+		return fmt.Errorf("block %d rewards %d, more than the block reward of %d", block.Index, coinbase.Amount, reward)
+	}
+	for _, tx := range block.Transactions[1:] {
+		if tx.Sender == "system" {
+			return fmt.Errorf("block %d has a second reward transaction %s", block.Index, tx.Hash())
+		}
+		if !verifySignatures || tx.IsStaking() {
+			continue // Staking transactions are checked against the ledger below
+		}
+		key, err := senderKey(tx.Sender, accounts)
+		if err != nil {
+			return fmt.Errorf("transaction %s: %w", tx.Hash(), err)
+		}
+		if !tx.Verify(key) {
+			return fmt.Errorf("transaction %s is not signed by %s", tx.Hash(), tx.Sender)
+		}
+	}
+	return nil
+}
+
+// senderKey returns the public key a transfer from sender must be signed with: the key of its
+// account, or for a sender with no account key, the key its address encodes.
+func senderKey(sender string, accounts map[string]*Account) (*ecdsa.PublicKey, error) {
+	if account := accounts[sender]; account != nil && account.PublicKey != nil {
+		return account.PublicKey, nil
+	}
+	key, err := parseValidatorAddress(sender)
+	if err != nil {
+		return nil, fmt.Errorf("no public key for sender %s", sender)
+	}
+	return key, nil
+}
+
+// applyBlockState applies a block produced under the given engine to the UTXO set, the staking
+// ledger and the authority set. The returned undo data restores all three. On failure they are
+// left as they were. Blocks after genesis must pass checkBlockTransactions; signatures are only
+// checked if verifySignatures is set.
+func applyBlockState(utxoSet *UTXOSet, staking *StakingState, authorities *AuthorityState, block *Block, engine ConsensusEngine, reward int, accounts map[string]*Account, verifySignatures bool) (*UTXOUndo, error) {
+	if block.Index > 0 {
+		if err := checkBlockTransactions(block, reward, accounts, verifySignatures); err != nil {
+			return nil, err
+		}
+	}
+	before := staking.Clone()
+	undo, err := utxoSet.ApplyBlock(block)
+	if err != nil {
+		return nil, err
+	}
+	undo.Staking = before
+	undo.Authorities = authorities.Clone()
+
+	engine.Finalize(staking, authorities, block)
+	for _, tx := range block.Transactions {
+		if !tx.IsStaking() {
+			continue
+		}
+		if err := staking.checkTransaction(tx, block.Index, verifySignatures); err != nil {
+			utxoSet.Revert(undo)
+			*staking = *before
+			*authorities = *undo.Authorities
+			return nil, fmt.Errorf("staking transaction %s cannot be applied: %w", tx.Hash(), err)
+		}
+		staking.applyTransaction(tx, block.Index)
+	}
+	for _, utxo := range staking.endBlock(block.Index) {
+		utxoSet.AddUTXO(utxo)
+		undo.Created = append(undo.Created, utxo)
+	}
+	return undo, nil
+}
+
+// revertBlockState undoes a block's effect on the UTXO set, staking ledger, authority set and fork
+// states.
+// Callers must hold the lock.
+func (bc *Blockchain) revertBlockState(undo *UTXOUndo) {
+	bc.UTXOSet.Revert(undo)
+	if undo.Staking != nil {
+		bc.setStaking(undo.Staking)
+	}
+	if undo.Authorities != nil {
+		bc.Authorities = undo.Authorities
+	}
+	if undo.Forks != nil {
+		bc.forks = undo.Forks
+	}
+}
+
+// setStaking replaces the staking ledger, keeping Stake pointed at its validator set. Callers
+// must hold the lock.
+func (bc *Blockchain) setStaking(staking *StakingState) {
+	bc.Staking = staking
+	bc.Stake = staking.Validators
+}
+
+// StakingSummary describes the validator sets for the API.
+type StakingSummary struct {
+	Height       int
+	Epoch        int
+	NextEpochAt  int
+	Validators   map[string]int // Active voting power.
+	PendingPower map[string]int // Voting power from the next epoch.
+	Jailed       map[string]int // Jailed validators and the height from which they may unjail.
+	Tombstoned   []string       // Validators jailed for good for double-signing.
+}
+
+// StakingSummary returns the active and upcoming validator sets.
+func (bc *Blockchain) StakingSummary() StakingSummary {
+	bc.lock.RLock()
+	defer bc.lock.RUnlock()
+	height := len(bc.Blocks) - 1
+	staking := bc.Staking.Clone()
+	summary := StakingSummary{
+		Height:       height,
+		Epoch:        height / EpochLength,
+		NextEpochAt:  (height/EpochLength + 1) * EpochLength,
+		Validators:   staking.Validators,
+		PendingPower: staking.PendingPower(),
+		Jailed:       staking.Jailed,
+	}
+	for validator := range staking.Tombstoned {
+		summary.Tombstoned = append(summary.Tombstoned, validator)
+	}
+	sort.Strings(summary.Tombstoned)
+	return summary
+}
+
+// CheckStakingTransaction reports whether a staking transaction could be applied to the current ledger.
+func (bc *Blockchain) CheckStakingTransaction(tx *Transaction) error {
+	bc.lock.RLock()
+	defer bc.lock.RUnlock()
+	return bc.Staking.checkTransaction(tx, len(bc.Blocks), true)
+}
+
+// Delegations lists what address has bonded and is unbonding.
+func (bc *Blockchain) Delegations(address string) ([]Delegation, []UnbondingEntry) {
+	bc.lock.RLock()
+	defer bc.lock.RUnlock()
+	return bc.Staking.Delegations(address)
+}
@@ -0,0 +1,31 @@
+package main
+
+import "testing"
+
+func TestStakingRejectsReplayedUnbond(t *testing.T) {
+	key, validator := newKeyAddress(t)
+	staking := NewStakingState()
+	staking.Bonds[validator] = map[string]int{validator: 100}
+
+	unbond := &Transaction{Sender: validator, Amount: 10, Fee: MinTransactionFee, Nonce: 1, Type: TxTypeUnbond}
+	if err := unbond.Sign(key); err != nil {
+		t.Fatal(err)
+	}
+	if err := staking.checkTransaction(unbond, 1, true); err != nil {
+		t.Fatal(err)
+	}
+	staking.applyTransaction(unbond, 1)
+
+	// Enough is still bonded, but the same signed unbond must not release stake a second time
+	if err := staking.checkTransaction(unbond, 2, true); err == nil {
+		t.Fatal("accepted a replayed unbond")
+	}
+	if err := staking.Clone().checkTransaction(unbond, 2, true); err == nil {
+		t.Fatal("a cloned ledger accepted a replayed unbond")
+	}
+	forgotten := staking.Clone()
+	delete(forgotten.Applied, unbond.Hash())
+	if staking.equal(forgotten) {
+		t.Fatal("ledgers that applied different transactions are equal")
+	}
+}
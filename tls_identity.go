@@ -0,0 +1,282 @@
+// tls_identity.go
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultCertFile    = "node.crt" // Where the node's certificate is kept unless configured otherwise.
+	DefaultKeyFile     = "node.key" // Where the node's TLS private key is kept unless configured otherwise.
+	CertValidity       = 10 * 365 * 24 * time.Hour
+	CertReloadInterval = time.Minute // How often the certificate and CA files are checked for changes.
+)
+
+// TLSOptions says where a node's TLS identity lives and how it authenticates peers.
+//
+// Peers are authenticated by PinnedKeys if any are given, otherwise by CAFile if it is set.
+// With neither, any peer is accepted: the connection is encrypted but anyone can join, as on most
+// public peer-to-peer networks.
+type TLSOptions struct {
+	CertFile   string
+	KeyFile    string
+	CAFile     string   // PEM bundle of CAs peer certificates must chain to. Optional.
+	PinnedKeys []string // Fingerprints of the only peer keys to accept. Optional.
+}
+
+// DefaultTLSOptions keeps the identity in the working directory and accepts any peer.
+func DefaultTLSOptions() TLSOptions {
+	return TLSOptions{CertFile: DefaultCertFile, KeyFile: DefaultKeyFile}
+}
+
+// TLSIdentity holds the node's certificate and the rules for trusting peers. The certificate and
+// CA bundle are re-read when their files change, so they can be rotated without a restart; new
+// connections pick up the change and existing ones are left alone.
+type TLSIdentity struct {
+	options     TLSOptions
+	certificate *tls.Certificate
+	caPool      *x509.CertPool      // Nil unless a CA file is configured.
+	pinned      map[string]struct{} // Accepted key fingerprints, empty unless keys are pinned.
+	modTimes    map[string]time.Time
+	lock        sync.RWMutex
+}
+
+// NewTLSIdentity loads the node's certificate, generating a key and self-signed certificate if
+// none exists yet.
+func NewTLSIdentity(options TLSOptions) (*TLSIdentity, error) {
+	id := &TLSIdentity{
+		options:  options,
+		pinned:   make(map[string]struct{}),
+		modTimes: make(map[string]time.Time),
+	}
+	for _, fingerprint := range options.PinnedKeys {
+		id.pinned[strings.ToLower(strings.TrimSpace(fingerprint))] = struct{}{}
+	}
+
+	if _, err := os.Stat(options.CertFile); errors.Is(err, os.ErrNotExist) {
+		if err := generateIdentity(options.CertFile, options.KeyFile); err != nil {
+			return nil, fmt.Errorf("failed to generate TLS identity: %w", err)
+		}
+		log.Printf("Generated new TLS identity in %s", options.CertFile)
+	}
+
+	if _, err := id.Reload(); err != nil {
+		return nil, err
+	}
+	return id, nil
+}
+
+// Reload re-reads the certificate, key and CA bundle if any of the files have changed since they
+// were last loaded. It reports whether anything was reloaded.
+func (id *TLSIdentity) Reload() (bool, error) {
+	files := []string{id.options.CertFile, id.options.KeyFile}
+	if id.options.CAFile != "" {
+		files = append(files, id.options.CAFile)
+	}
+
+	changed := false
+	modTimes := make(map[string]time.Time)
+	for _, file := range files {
+		info, err := os.Stat(file)
+		if err != nil {
+			return false, err
+		}
+		modTimes[file] = info.ModTime()
+		id.lock.RLock()
+		if !info.ModTime().Equal(id.modTimes[file]) {
+			changed = true
+		}
+		id.lock.RUnlock()
+	}
+	if !changed {
+		return false, nil
+	}
+
+	certificate, err := tls.LoadX509KeyPair(id.options.CertFile, id.options.KeyFile)
+	if err != nil {
+		return false, err
+	}
+	var caPool *x509.CertPool
+	if id.options.CAFile != "" {
+		caCert, err := os.ReadFile(id.options.CAFile)
+		if err != nil {
+			return false, err
+		}
+		caPool = x509.NewCertPool()
+		if !caPool.AppendCertsFromPEM(caCert) {
+			return false, fmt.Errorf("no certificates found in %s", id.options.CAFile)
+		}
+	}
+
+	id.lock.Lock()
+	id.certificate = &certificate
+	id.caPool = caPool
+	id.modTimes = modTimes
+	id.lock.Unlock()
+	return true, nil
+}
+
+// Fingerprint returns the fingerprint of the node's own key, which is what peers pin.
+func (id *TLSIdentity) Fingerprint() string {
+	id.lock.RLock()
+	defer id.lock.RUnlock()
+	leaf, err := x509.ParseCertificate(id.certificate.Certificate[0])
+	if err != nil {
+		return ""
+	}
+	return KeyFingerprint(leaf)
+}
+
+// Config returns a TLS configuration for both listening and dialling. Both sides present a
+// certificate and check the other's with verifyPeer, so trust doesn't depend on host names.
+func (id *TLSIdentity) Config() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return id.currentCertificate(), nil
+		},
+		GetClientCertificate: func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			return id.currentCertificate(), nil
+		},
+		ClientAuth:            tls.RequireAnyClientCert,
+		InsecureSkipVerify:    true, // Replaced by verifyPeer, which doesn't check host names
+		VerifyPeerCertificate: id.verifyPeer,
+	}
+}
+
+// currentCertificate returns the certificate presented on new connections.
+func (id *TLSIdentity) currentCertificate() *tls.Certificate {
+	id.lock.RLock()
+	defer id.lock.RUnlock()
+	return id.certificate
+}
+
+// verifyPeer checks the certificate a peer presented against the pinned keys or the CA bundle.
+func (id *TLSIdentity) verifyPeer(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+	if len(rawCerts) == 0 {
+		return errors.New("peer presented no certificate")
+	}
+	certs := make([]*x509.Certificate, 0, len(rawCerts))
+	for _, raw := range rawCerts {
+		cert, err := x509.ParseCertificate(raw)
+		if err != nil {
+			return fmt.Errorf("invalid peer certificate: %w", err)
+		}
+		certs = append(certs, cert)
+	}
+	leaf := certs[0]
+
+	id.lock.RLock()
+	caPool := id.caPool
+	id.lock.RUnlock()
+
+	switch {
+	case len(id.pinned) > 0:
+		if _, ok := id.pinned[KeyFingerprint(leaf)]; !ok {
+			return fmt.Errorf("peer key %s is not pinned", KeyFingerprint(leaf))
+		}
+	case caPool != nil:
+		intermediates := x509.NewCertPool()
+		for _, cert := range certs[1:] {
+			intermediates.AddCert(cert)
+		}
+		_, err := leaf.Verify(x509.VerifyOptions{
+			Roots:         caPool,
+			Intermediates: intermediates,
+			KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+		})
+		if err != nil {
+			return fmt.Errorf("peer certificate not trusted: %w", err)
+		}
+	}
+	return nil
+}
+
+// KeyFingerprint identifies a certificate by the hex SHA-256 of its public key, so it stays the
+// same when the certificate is renewed with the same key.
+func KeyFingerprint(cert *x509.Certificate) string {
+	hash := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return hex.EncodeToString(hash[:])
+}
+
+// generateIdentity creates a P-256 key and a self-signed certificate for it. The key is written
+// readable only by its owner.
+func generateIdentity(certFile, keyFile string) error {
+	privateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: "go-blockchain node"},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(CertValidity),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+	}
+	certDER, err := x509.CreateCertificate(rand.Reader, template, template, &privateKey.PublicKey, privateKey)
+	if err != nil {
+		return err
+	}
+	keyDER, err := x509.MarshalECPrivateKey(privateKey)
+	if err != nil {
+		return err
+	}
+
+	for _, file := range []string{certFile, keyFile} {
+		if dir := filepath.Dir(file); dir != "." {
+			if err := os.MkdirAll(dir, 0700); err != nil {
+				return err
+			}
+		}
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		return err
+	}
+	return os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certDER}), 0644)
+}
+
+// watchTLSIdentity picks up certificate rotations until the node stops.
+func (n *Node) watchTLSIdentity() {
+	defer n.wg.Done()
+	ticker := time.NewTicker(CertReloadInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			reloaded, err := n.tlsIdentity.Reload()
+			if err != nil {
+				log.Printf("Failed to reload TLS identity: %v", err)
+			} else if reloaded {
+				log.Printf("Reloaded TLS identity, fingerprint %s", n.tlsIdentity.Fingerprint())
+			}
+		case <-n.quit:
+			return
+		}
+	}
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"crypto/ecdsa"
+	"crypto/rand"
 	"crypto/sha256"
 	"encoding/hex"
 	"errors"
@@ -12,19 +13,28 @@ import (
 
 // Transaction represents a transaction within the blockchain.
 type Transaction struct {
-	ID        string      // Unique identifier for the transaction.
-	Sender    string      // Address of the sender.
-	Recipient string      // Address of the recipient.
-	Amount    int         // Amount of value being transferred.
-	Fee       int         // Transaction fee.
-	Nonce     int64       // Nonce to ensure transaction uniqueness.
-	Signature *Signature  // Digital signature for the transaction.
-	Timestamp int64       // Timestamp when the transaction was created.
+	ID        string              // Unique identifier for the transaction.
+	Sender    string              // Address of the sender.
+	Recipient string              // Address of the recipient.
+	Amount    int                 // Amount of value being transferred.
+	Fee       int                 // Transaction fee.
+	Nonce     int64               // Nonce to ensure transaction uniqueness.
+	Signature *Signature          // Digital signature for the transaction.
+	Timestamp int64               // Timestamp when the transaction was created.
+	Type      string              // Staking operation (bond, unbond, delegate, evidence, unjail), or empty for a transfer.
+	Validator string              // Validator a delegation, unbond or evidence concerns.
+	Evidence  *DoubleSignEvidence // Conflicting headers carried by an evidence transaction.
 }
 
 // Hash generates a unique hash for the transaction based on its fields.
 func (tx *Transaction) Hash() string {
 	record := tx.Sender + tx.Recipient + fmt.Sprintf("%d", tx.Amount) + fmt.Sprintf("%d", tx.Fee) + fmt.Sprintf("%d", tx.Nonce)
+	if tx.Type != "" {
+		record += tx.Type + tx.Validator // Only staking transactions carry these, so transfer hashes are unchanged
+	}
+	if tx.Evidence != nil && tx.Evidence.First != nil && tx.Evidence.Second != nil {
+		record += tx.Evidence.First.Hash + tx.Evidence.Second.Hash
+	}
 	h := sha256.New()
 	h.Write([]byte(record))
 	return hex.EncodeToString(h.Sum(nil))
@@ -33,7 +43,7 @@ func (tx *Transaction) Hash() string {
 // Sign signs the transaction using the sender's private key.
 func (tx *Transaction) Sign(privKey *ecdsa.PrivateKey) error {
 	hash := sha256.Sum256([]byte(tx.Hash()))
-	r, s, err := ecdsa.Sign(nil, privKey, hash[:])
+	r, s, err := ecdsa.Sign(rand.Reader, privKey, hash[:])
 	if err != nil {
 		return err
 	}
@@ -50,18 +60,41 @@ func (tx *Transaction) Verify(pubKey *ecdsa.PublicKey) bool {
 	return ecdsa.Verify(pubKey, hash[:], tx.Signature.R, tx.Signature.S)
 }
 
+// ErrInvalidSignature is returned for a transfer that isn't signed by its sender.
+var ErrInvalidSignature = errors.New("transaction is not signed by its sender")
+
 // Validate ensures the transaction is valid by checking the sender's account and UTXOs.
+// The UTXO set is left untouched; outputs only move when the transaction is connected in a block.
+// Staking transactions are checked against their signature instead of the accounts.
 func (tx *Transaction) Validate(accounts map[string]*Account, utxoSet *UTXOSet) error {
-	if err := tx.validateAccounts(accounts); err != nil {
+	if tx.IsStaking() {
+		if err := tx.verifyStaking(); err != nil {
+			return err
+		}
+	} else if err := tx.validateAccounts(accounts); err != nil {
 		return err
-	}
-	if err := tx.ValidateUTXO(utxoSet); err != nil {
+	} else if err := tx.verifySender(accounts); err != nil {
 		return err
 	}
+	if _, total := utxoSet.FindUTXOs(tx.Sender, tx.lockedAmount()+tx.Fee); total < tx.lockedAmount()+tx.Fee {
+		return errors.New("insufficient UTXOs")
+	}
 	return nil
 }
 
 // validateAccounts checks if the sender's account exists and has sufficient balance.
+// verifySender checks a transfer is signed with the key senderKey finds for its sender.
+func (tx *Transaction) verifySender(accounts map[string]*Account) error {
+	key, err := senderKey(tx.Sender, accounts)
+	if err != nil {
+		return err
+	}
+	if !tx.Verify(key) {
+		return ErrInvalidSignature
+	}
+	return nil
+}
+
 func (tx *Transaction) validateAccounts(accounts map[string]*Account) error {
 	senderAccount, exists := accounts[tx.Sender]
 	if !exists {
@@ -77,34 +110,50 @@ func (tx *Transaction) validateAccounts(accounts map[string]*Account) error {
 
 // ValidateUTXO verifies the transaction's UTXOs and updates the UTXO set.
 func (tx *Transaction) ValidateUTXO(utxoSet *UTXOSet) error {
-	utxos, total := utxoSet.FindUTXOs(tx.Sender, tx.Amount+tx.Fee)
-	if total < tx.Amount+tx.Fee {
-		return errors.New("insufficient UTXOs")
+	_, _, err := tx.applyUTXO(utxoSet, 0)
+	return err
+}
+
+// applyUTXO spends the sender's UTXOs and creates the recipient and change outputs,
+// stamped with the height of the block they appear in, and returns what was spent and created so
+// the caller can undo it later. Staking transactions have no recipient output: bonded funds leave
+// the set until an unbond matures.
+func (tx *Transaction) applyUTXO(utxoSet *UTXOSet, height int) ([]UTXO, []UTXO, error) {
+	needed := tx.lockedAmount() + tx.Fee
+	utxos, total := utxoSet.FindUTXOs(tx.Sender, needed)
+	if total < needed {
+		return nil, nil, errors.New("insufficient UTXOs")
 	}
 
 	utxoSet.SpendUTXOs(utxos)
 
-	// Add a new UTXO for the recipient.
-	newUTXO := UTXO{
-		TxID:   tx.Hash(),
-		Index:  0,
-		Amount: tx.Amount,
-		Owner:  tx.Recipient,
+	var created []UTXO
+	if !tx.IsStaking() {
+		// Add a new UTXO for the recipient.
+		created = append(created, UTXO{
+			TxID:   tx.Hash(),
+			Index:  0,
+			Amount: tx.Amount,
+			Owner:  tx.Recipient,
+			Height: height,
+		})
 	}
-	utxoSet.AddUTXO(newUTXO)
 
 	// If there's change, create a UTXO for the sender.
-	if change := total - (tx.Amount + tx.Fee); change > 0 {
-		changeUTXO := UTXO{
+	if change := total - needed; change > 0 {
+		created = append(created, UTXO{
 			TxID:   tx.Hash(),
 			Index:  1,
 			Amount: change,
 			Owner:  tx.Sender,
-		}
-		utxoSet.AddUTXO(changeUTXO)
+			Height: height,
+		})
 	}
 
-	return nil
+	for _, utxo := range created {
+		utxoSet.AddUTXO(utxo)
+	}
+	return utxos, created, nil
 }
 
 // DistributeFees assigns the transaction fees to the miner.
@@ -0,0 +1,75 @@
+// transport.go
+package main
+
+import (
+	"crypto/tls"
+	"net"
+)
+
+// Transport is how a node reaches its peers. Connections it returns are already secured, or don't
+// need to be, so the node only runs its own version handshake on top.
+type Transport interface {
+	Dial(address string) (net.Conn, error)
+	Listen(address string) (net.Listener, error)
+	// Secure finishes setting up a connection taken from the listener. It runs in the connection's
+	// own goroutine, so a slow peer can't hold up the accept loop.
+	Secure(conn net.Conn) (net.Conn, error)
+}
+
+// tlsTransport secures TCP connections with the node's TLS identity.
+type tlsTransport struct {
+	node *Node
+}
+
+func (t tlsTransport) Dial(address string) (net.Conn, error) {
+	tlsConfig, err := t.node.transportConfig()
+	if err != nil {
+		return nil, err
+	}
+	return tls.Dial("tcp", address, tlsConfig)
+}
+
+func (t tlsTransport) Listen(address string) (net.Listener, error) {
+	tlsConfig, err := t.node.transportConfig()
+	if err != nil {
+		return nil, err
+	}
+	return tls.Listen("tcp", address, tlsConfig)
+}
+
+// Secure leaves the TLS handshake to the connection's first read or write.
+func (t tlsTransport) Secure(conn net.Conn) (net.Conn, error) {
+	return conn, nil
+}
+
+// noiseTransport secures TCP connections with the Noise handshake and the node's identity key.
+type noiseTransport struct {
+	node *Node
+}
+
+func (t noiseTransport) Dial(address string) (net.Conn, error) {
+	conn, err := net.DialTimeout("tcp", address, HandshakeTimeout)
+	if err != nil {
+		return nil, err
+	}
+	return t.node.noiseHandshake(conn, true)
+}
+
+func (t noiseTransport) Listen(address string) (net.Listener, error) {
+	return net.Listen("tcp", address)
+}
+
+func (t noiseTransport) Secure(conn net.Conn) (net.Conn, error) {
+	return t.node.noiseHandshake(conn, false)
+}
+
+// transport returns the node's Transport, or the TCP transport for its Encryption if none is set.
+func (n *Node) transport() Transport {
+	if n.Transport != nil {
+		return n.Transport
+	}
+	if n.Encryption == EncryptionNoise {
+		return noiseTransport{node: n}
+	}
+	return tlsTransport{node: n}
+}
@@ -2,6 +2,9 @@
 package main
 
 import (
+	"errors"
+	"fmt"
+	"sort"
 	"sync"
 )
 
@@ -11,41 +14,70 @@ type UTXO struct {
 	Index  int    // Index of the UTXO in the transaction.
 	Amount int    // Amount of value this UTXO represents.
 	Owner  string // Address of the UTXO owner.
+	Height int    // Height of the block that created this UTXO.
+}
+
+// outpoint identifies a UTXO by the transaction that created it and its index.
+type outpoint struct {
+	TxID  string
+	Index int
 }
 
 // UTXOSet maintains a set of all unspent transaction outputs.
 type UTXOSet struct {
-	UTXOs map[string]map[int]UTXO // Nested map for quick lookup by TxID and Index.
-	lock  sync.RWMutex            // RWMutex for thread-safe access to the UTXO set.
+	UTXOs      map[string]map[int]UTXO          // Nested map for quick lookup by TxID and Index.
+	lock       sync.RWMutex                     // RWMutex for thread-safe access to the UTXO set.
+	commitment *MuHash                          // Rolling multiset hash over every unspent output.
+	byOwner    map[string]map[outpoint]struct{} // Secondary index from owner to their outpoints.
+	confirmed  map[string]bool                  // Hashes of the transactions applied, so none is applied twice.
+}
+
+// ErrOutpointExists is returned when an output would replace one already in the set.
+var ErrOutpointExists = errors.New("output already exists")
+
+// UTXOUndo records the outputs a block spent and created so the changes can be reverted.
+type UTXOUndo struct {
+	Spent       []UTXO
+	Created     []UTXO
+	Staking     *StakingState   // Staking ledger before the block, if the block was applied with one.
+	Authorities *AuthorityState // PoA authority set before the block, if the block was applied with one.
+	Forks       *forkTracker    // Fork deployment states before the block, once it is connected.
+	Confirmed   []string        // Hashes of the transactions the block confirmed.
 }
 
 func NewUTXOSet() *UTXOSet {
 	return &UTXOSet{
-		UTXOs: make(map[string]map[int]UTXO),
+		UTXOs:      make(map[string]map[int]UTXO),
+		commitment: NewMuHash(),
+		byOwner:    make(map[string]map[outpoint]struct{}),
+		confirmed:  make(map[string]bool),
 	}
 }
 
 // FindUTXOs finds unspent transaction outputs (UTXOs) for a given owner and amount.
+// Selection is deterministic so every node spends the same outputs for the same transaction.
 func (u *UTXOSet) FindUTXOs(owner string, amount int) ([]UTXO, int) {
-	u.lock.RLock()
-	defer u.lock.RUnlock()
+	return u.SelectUTXOs(owner, amount, CoinSelectionLargestFirst)
+}
 
-	var accumulated []UTXO
-	accumulatedValue := 0
-
-	for _, outputs := range u.UTXOs {
-		for _, utxo := range outputs {
-			if utxo.Owner == owner {
-				accumulated = append(accumulated, utxo)
-				accumulatedValue += utxo.Amount
-				if accumulatedValue >= amount {
-					return accumulated, accumulatedValue
-				}
-			}
-		}
+// ownerUTXOs returns the owner's UTXOs in a stable order. Callers must hold the lock.
+func (u *UTXOSet) ownerUTXOs(owner string) []UTXO {
+	utxos := make([]UTXO, 0, len(u.byOwner[owner]))
+	for op := range u.byOwner[owner] {
+		utxos = append(utxos, u.UTXOs[op.TxID][op.Index])
 	}
+	sort.Slice(utxos, func(i, j int) bool {
+		return utxoLess(utxos[i], utxos[j])
+	})
+	return utxos
+}
 
-	return accumulated, accumulatedValue
+// utxoLess orders UTXOs by TxID and then Index, the tie-breaker for every selection strategy.
+func utxoLess(a, b UTXO) bool {
+	if a.TxID != b.TxID {
+		return a.TxID < b.TxID
+	}
+	return a.Index < b.Index
 }
 
 // SpendUTXOs marks the given UTXOs as spent by removing them from the set.
@@ -54,24 +86,124 @@ func (u *UTXOSet) SpendUTXOs(utxos []UTXO) {
 	defer u.lock.Unlock()
 
 	for _, spent := range utxos {
-		if outputs, exists := u.UTXOs[spent.TxID]; exists {
-			delete(outputs, spent.Index)
-			if len(outputs) == 0 {
-				delete(u.UTXOs, spent.TxID)
-			}
-		}
+		u.removeUTXO(spent.TxID, spent.Index)
 	}
 }
 
-// AddUTXO adds a new unspent transaction output to the UTXO set.
-func (u *UTXOSet) AddUTXO(utxo UTXO) {
+// AddUTXO adds a new unspent transaction output to the UTXO set. It refuses to replace an output
+// that is already there, which would destroy its coins.
+func (u *UTXOSet) AddUTXO(utxo UTXO) error {
 	u.lock.Lock()
 	defer u.lock.Unlock()
 
+	return u.addUTXO(utxo)
+}
+
+// addUTXO inserts an output and keeps the commitment and owner index in step. Callers must hold the lock.
+func (u *UTXOSet) addUTXO(utxo UTXO) error {
+	if _, exists := u.UTXOs[utxo.TxID][utxo.Index]; exists {
+		return fmt.Errorf("%w: %s:%d", ErrOutpointExists, utxo.TxID, utxo.Index)
+	}
 	if _, exists := u.UTXOs[utxo.TxID]; !exists {
 		u.UTXOs[utxo.TxID] = make(map[int]UTXO)
 	}
+	op := outpoint{TxID: utxo.TxID, Index: utxo.Index}
 	u.UTXOs[utxo.TxID][utxo.Index] = utxo
+	u.commitment.Add(utxo.commitmentBytes())
+
+	if _, exists := u.byOwner[utxo.Owner]; !exists {
+		u.byOwner[utxo.Owner] = make(map[outpoint]struct{})
+	}
+	u.byOwner[utxo.Owner][op] = struct{}{}
+	return nil
+}
+
+// unindexOwner drops an outpoint from the owner index. Callers must hold the lock.
+func (u *UTXOSet) unindexOwner(owner string, op outpoint) {
+	delete(u.byOwner[owner], op)
+	if len(u.byOwner[owner]) == 0 {
+		delete(u.byOwner, owner)
+	}
+}
+
+// removeUTXO deletes an output if present and keeps the commitment in step. Callers must hold the lock.
+func (u *UTXOSet) removeUTXO(txID string, index int) {
+	outputs, exists := u.UTXOs[txID]
+	if !exists {
+		return
+	}
+	existing, exists := outputs[index]
+	if !exists {
+		return
+	}
+	u.commitment.Remove(existing.commitmentBytes())
+	u.unindexOwner(existing.Owner, outpoint{TxID: txID, Index: index})
+	delete(outputs, index)
+	if len(outputs) == 0 {
+		delete(u.UTXOs, txID)
+	}
+}
+
+// Revert undoes the changes recorded in undo, restoring the set to its previous state. Outputs
+// both created and spent within undo were never in that state, so they are not restored.
+func (u *UTXOSet) Revert(undo *UTXOUndo) {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+
+	created := make(map[outpoint]bool, len(undo.Created))
+	for i := len(undo.Created) - 1; i >= 0; i-- {
+		u.removeUTXO(undo.Created[i].TxID, undo.Created[i].Index)
+		created[outpoint{TxID: undo.Created[i].TxID, Index: undo.Created[i].Index}] = true
+	}
+	for i := len(undo.Spent) - 1; i >= 0; i-- {
+		if !created[outpoint{TxID: undo.Spent[i].TxID, Index: undo.Spent[i].Index}] {
+			u.addUTXO(undo.Spent[i])
+		}
+	}
+	for _, hash := range undo.Confirmed {
+		delete(u.confirmed, hash)
+	}
+}
+
+// IsConfirmed reports whether the transaction with the given hash has been applied.
+func (u *UTXOSet) IsConfirmed(hash string) bool {
+	u.lock.RLock()
+	defer u.lock.RUnlock()
+	return u.confirmed[hash]
+}
+
+// confirmedHashes returns the hashes of the transactions applied, sorted.
+func (u *UTXOSet) confirmedHashes() []string {
+	u.lock.RLock()
+	defer u.lock.RUnlock()
+	hashes := make([]string, 0, len(u.confirmed))
+	for hash := range u.confirmed {
+		hashes = append(hashes, hash)
+	}
+	sort.Strings(hashes)
+	return hashes
+}
+
+// hasOutputs reports whether any outputs of the transaction with the given hash are unspent.
+func (u *UTXOSet) hasOutputs(hash string) bool {
+	u.lock.RLock()
+	defer u.lock.RUnlock()
+	return len(u.UTXOs[hash]) > 0
+}
+
+// confirm records that a transaction has been applied. Callers must not hold the lock.
+func (u *UTXOSet) confirm(hash string, undo *UTXOUndo) {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	u.confirmed[hash] = true
+	undo.Confirmed = append(undo.Confirmed, hash)
+}
+
+// Commitment returns the hex-encoded multiset hash of the current UTXO set.
+func (u *UTXOSet) Commitment() string {
+	u.lock.RLock()
+	defer u.lock.RUnlock()
+	return u.commitment.Digest()
 }
 
 // HasUTXO checks if the given owner has any UTXOs in the set.
@@ -79,14 +211,7 @@ func (u *UTXOSet) HasUTXO(owner string) bool {
 	u.lock.RLock()
 	defer u.lock.RUnlock()
 
-	for _, outputs := range u.UTXOs {
-		for _, utxo := range outputs {
-			if utxo.Owner == owner {
-				return true
-			}
-		}
-	}
-	return false
+	return len(u.byOwner[owner]) > 0
 }
 
 // GetBalance returns the total balance for a given owner by summing all their UTXOs.
@@ -95,12 +220,59 @@ func (u *UTXOSet) GetBalance(owner string) int {
 	defer u.lock.RUnlock()
 
 	balance := 0
-	for _, outputs := range u.UTXOs {
-		for _, utxo := range outputs {
-			if utxo.Owner == owner {
-				balance += utxo.Amount
-			}
-		}
+	for op := range u.byOwner[owner] {
+		balance += u.UTXOs[op.TxID][op.Index].Amount
 	}
 	return balance
 }
+
+// ApplyTransaction moves the UTXOs for a single transaction and records the change in undo.
+// Rewards issued by "system" create outputs from nothing; everything else spends the sender's
+// outputs and pays its fee to minerAddress. A transaction can only be applied once, so a signed
+// transaction can't be replayed in a later block or repeated in the same one. A failing
+// transaction leaves the set unchanged.
+func (u *UTXOSet) ApplyTransaction(tx *Transaction, minerAddress string, height int, undo *UTXOUndo) error {
+	hash := tx.Hash()
+	if u.IsConfirmed(hash) {
+		return fmt.Errorf("transaction %s is already confirmed", hash)
+	}
+	if u.hasOutputs(hash) {
+		return fmt.Errorf("%w for transaction %s", ErrOutpointExists, hash)
+	}
+	if tx.Sender == "system" {
+		reward := UTXO{TxID: hash, Index: 0, Amount: tx.Amount, Owner: tx.Recipient, Height: height}
+		u.AddUTXO(reward)
+		undo.Created = append(undo.Created, reward)
+		u.confirm(hash, undo)
+		return nil
+	}
+
+	spent, created, err := tx.applyUTXO(u, height)
+	if err != nil {
+		return err
+	}
+	undo.Spent = append(undo.Spent, spent...)
+	undo.Created = append(undo.Created, created...)
+
+	if tx.Fee > 0 && minerAddress != "" {
+		fee := UTXO{TxID: hash, Index: 2, Amount: tx.Fee, Owner: minerAddress, Height: height}
+		u.AddUTXO(fee)
+		undo.Created = append(undo.Created, fee)
+	}
+	u.confirm(hash, undo)
+	return nil
+}
+
+// ApplyBlock applies every transaction in a block, paying fees to the block's reward recipient.
+// If any transaction fails the set is restored and the error is returned.
+func (u *UTXOSet) ApplyBlock(block *Block) (*UTXOUndo, error) {
+	minerAddress := blockRewardAddress(block)
+	undo := &UTXOUndo{}
+	for _, tx := range block.Transactions {
+		if err := u.ApplyTransaction(tx, minerAddress, block.Index, undo); err != nil {
+			u.Revert(undo)
+			return nil, fmt.Errorf("transaction %s cannot be applied: %w", tx.Hash(), err)
+		}
+	}
+	return undo, nil
+}
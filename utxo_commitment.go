@@ -0,0 +1,92 @@
+// utxo_commitment.go
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"math/big"
+)
+
+// muHashPrime is the 3072-bit safe modulus 2^3072 - 1103717 used by MuHash3072.
+var muHashPrime = func() *big.Int {
+	p := new(big.Int).Lsh(big.NewInt(1), 3072)
+	return p.Sub(p, big.NewInt(1103717))
+}()
+
+// MuHash is an incremental multiset hash. Elements can be added and removed in any order
+// and the digest only depends on the final set, which makes it cheap to keep a running
+// commitment over the UTXO set while outputs are created and spent.
+type MuHash struct {
+	numerator   *big.Int // Product of all added elements.
+	denominator *big.Int // Product of all removed elements.
+}
+
+// NewMuHash returns the hash of the empty set.
+func NewMuHash() *MuHash {
+	return &MuHash{
+		numerator:   big.NewInt(1),
+		denominator: big.NewInt(1),
+	}
+}
+
+// Add inserts an element into the multiset.
+func (m *MuHash) Add(data []byte) {
+	m.numerator.Mul(m.numerator, muHashElement(data))
+	m.numerator.Mod(m.numerator, muHashPrime)
+}
+
+// Remove deletes an element from the multiset. Removing an element that was never added
+// is not an error, but the digest will no longer match any real set.
+func (m *MuHash) Remove(data []byte) {
+	m.denominator.Mul(m.denominator, muHashElement(data))
+	m.denominator.Mod(m.denominator, muHashPrime)
+}
+
+// Clone returns an independent copy of the running hash.
+func (m *MuHash) Clone() *MuHash {
+	return &MuHash{
+		numerator:   new(big.Int).Set(m.numerator),
+		denominator: new(big.Int).Set(m.denominator),
+	}
+}
+
+// Digest collapses the running hash into a hex-encoded SHA-256 digest.
+func (m *MuHash) Digest() string {
+	inverse := new(big.Int).ModInverse(m.denominator, muHashPrime)
+	value := new(big.Int).Mul(m.numerator, inverse)
+	value.Mod(value, muHashPrime)
+
+	buf := make([]byte, 384)
+	value.FillBytes(buf)
+	hash := sha256.Sum256(buf)
+	return hex.EncodeToString(hash[:])
+}
+
+// muHashElement maps arbitrary data onto a 3072-bit field element by expanding its
+// SHA-256 hash in counter mode.
+func muHashElement(data []byte) *big.Int {
+	seed := sha256.Sum256(data)
+	buf := make([]byte, 0, 384)
+	var counter [4]byte
+	for i := uint32(0); len(buf) < 384; i++ {
+		binary.BigEndian.PutUint32(counter[:], i)
+		block := sha256.Sum256(append(seed[:], counter[:]...))
+		buf = append(buf, block[:]...)
+	}
+	element := new(big.Int).SetBytes(buf)
+	return element.Mod(element, muHashPrime)
+}
+
+// commitmentBytes encodes a UTXO into the canonical form fed to the set commitment.
+func (utxo UTXO) commitmentBytes() []byte {
+	var buf []byte
+	buf = binary.BigEndian.AppendUint32(buf, uint32(len(utxo.TxID)))
+	buf = append(buf, utxo.TxID...)
+	buf = binary.BigEndian.AppendUint64(buf, uint64(utxo.Index))
+	buf = binary.BigEndian.AppendUint64(buf, uint64(utxo.Amount))
+	buf = binary.BigEndian.AppendUint32(buf, uint32(len(utxo.Owner)))
+	buf = append(buf, utxo.Owner...)
+	buf = binary.BigEndian.AppendUint64(buf, uint64(utxo.Height))
+	return buf
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestAddUTXORefusesToOverwrite(t *testing.T) {
+	u := NewUTXOSet()
+	if err := u.AddUTXO(UTXO{TxID: "tx", Index: 0, Amount: 5, Owner: "alice"}); err != nil {
+		t.Fatal(err)
+	}
+	commitment := u.Commitment()
+	if err := u.AddUTXO(UTXO{TxID: "tx", Index: 0, Amount: 1, Owner: "mallory"}); !errors.Is(err, ErrOutpointExists) {
+		t.Fatalf("overwrote an existing output: %v", err)
+	}
+	if u.GetBalance("alice") != 5 || u.GetBalance("mallory") != 0 || u.Commitment() != commitment {
+		t.Fatal("refused output changed the set")
+	}
+}
+
+func TestRevertForgetsConfirmedTransactions(t *testing.T) {
+	u := NewUTXOSet()
+	reward := &Transaction{Sender: "system", Recipient: "alice", Amount: 50}
+	undo := &UTXOUndo{}
+	if err := u.ApplyTransaction(reward, "", 1, undo); err != nil {
+		t.Fatal(err)
+	}
+	tx := &Transaction{Sender: "alice", Recipient: "bob", Amount: 10, Fee: 1, Nonce: 1}
+	if err := u.ApplyTransaction(tx, "miner", 1, undo); err != nil {
+		t.Fatal(err)
+	}
+	if err := u.ApplyTransaction(tx, "miner", 1, &UTXOUndo{}); err == nil {
+		t.Fatal("applied the same transaction twice")
+	}
+
+	// Once its block is disconnected the transaction may be confirmed again, e.g. on another branch
+	u.Revert(undo)
+	if u.IsConfirmed(tx.Hash()) || u.GetBalance("alice") != 0 {
+		t.Fatal("revert left the block's transactions in place")
+	}
+	if err := u.ApplyTransaction(reward, "", 1, &UTXOUndo{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := u.ApplyTransaction(tx, "miner", 1, &UTXOUndo{}); err != nil {
+		t.Fatalf("transaction of a disconnected block could not be applied again: %v", err)
+	}
+}
+
+func TestCommitmentDependsOnlyOnTheSet(t *testing.T) {
+	a := UTXO{TxID: "a", Index: 0, Amount: 5, Owner: "alice", Height: 1}
+	b := UTXO{TxID: "b", Index: 1, Amount: 7, Owner: "bob", Height: 2}
+
+	built := NewUTXOSet()
+	for _, utxo := range []UTXO{a, b} {
+		if err := built.AddUTXO(utxo); err != nil {
+			t.Fatal(err)
+		}
+	}
+	built.SpendUTXOs([]UTXO{a})
+
+	direct := NewUTXOSet()
+	if err := direct.AddUTXO(b); err != nil {
+		t.Fatal(err)
+	}
+	if built.Commitment() != direct.Commitment() {
+		t.Fatal("a set reached by adding and spending commits differently from the same set built directly")
+	}
+
+	// Any difference in an output changes the commitment
+	changed := NewUTXOSet()
+	b.Amount++
+	if err := changed.AddUTXO(b); err != nil {
+		t.Fatal(err)
+	}
+	if changed.Commitment() == direct.Commitment() || NewUTXOSet().Commitment() == direct.Commitment() {
+		t.Fatal("different sets share a commitment")
+	}
+}
+
+func TestOwnerIndexFollowsSpends(t *testing.T) {
+	u := NewUTXOSet()
+	outputs := []UTXO{
+		{TxID: "a", Index: 0, Amount: 5, Owner: "alice"},
+		{TxID: "a", Index: 1, Amount: 3, Owner: "bob"},
+		{TxID: "b", Index: 0, Amount: 2, Owner: "alice"},
+	}
+	for _, utxo := range outputs {
+		if err := u.AddUTXO(utxo); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if u.GetBalance("alice") != 7 || u.GetBalance("bob") != 3 {
+		t.Fatalf("balances are %d and %d, want 7 and 3", u.GetBalance("alice"), u.GetBalance("bob"))
+	}
+
+	u.SpendUTXOs(outputs[:2])
+	if u.GetBalance("alice") != 2 || u.HasUTXO("bob") {
+		t.Fatal("owner index still holds spent outputs")
+	}
+	if selected, total := u.FindUTXOs("alice", 5); len(selected) != 1 || total != 2 {
+		t.Fatalf("found %d outputs worth %d for alice, want her one output worth 2", len(selected), total)
+	}
+}
@@ -25,7 +25,8 @@ func (cli *WalletCLI) Run() {
 		fmt.Println("2. Send Transaction")
 		fmt.Println("3. View Blockchain")
 		fmt.Println("4. View Transaction")
-		fmt.Println("5. Exit")
+		fmt.Println("5. View Address History")
+		fmt.Println("6. Exit")
 		fmt.Print("Enter choice: ")
 
 		var choice int
@@ -41,6 +42,8 @@ func (cli *WalletCLI) Run() {
 		case 4:
 			cli.handleViewTransaction()
 		case 5:
+			cli.handleViewAddressHistory()
+		case 6:
 			return
 		default:
 			fmt.Println("Invalid choice")
@@ -133,3 +136,28 @@ func (cli *WalletCLI) handleViewTransaction() {
 	fmt.Printf("Timestamp: %d\n", tx.Timestamp)
 	fmt.Println()
 }
+
+// handleViewAddressHistory prompts for an address and page and displays its confirmed transactions.
+func (cli *WalletCLI) handleViewAddressHistory() {
+	fmt.Print("Enter address: ")
+	var address string
+	fmt.Scanln(&address)
+	fmt.Print("Enter page: ")
+	var page int
+	fmt.Scanln(&page)
+	if page < 1 {
+		page = 1
+	}
+
+	history, err := cli.API.GetAddressHistory(address, page, DefaultHistoryPageSize)
+	if err != nil {
+		log.Printf("Failed to retrieve address history: %v", err)
+		return
+	}
+
+	fmt.Printf("History of %s (page %d, %d transactions in total)\n", history.Address, history.Page, history.Total)
+	for _, entry := range history.Entries {
+		fmt.Printf("Block %d, position %d: %s %+d\n", entry.BlockHeight, entry.Position, entry.TxHash, entry.Amount)
+	}
+	fmt.Println()
+}
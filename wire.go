@@ -0,0 +1,82 @@
+// wire.go
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+const (
+	NetworkMagic    = 0x676f6263       // "gobc", marks the start of every frame.
+	FrameHeaderSize = 16               // Magic, type, payload length and checksum, 4 bytes each.
+	MaxFrameSize    = 32 * 1024 * 1024 // Largest payload accepted from a peer.
+)
+
+// ErrMalformedFrame is wrapped by readFrame errors caused by a corrupt frame rather than the
+// connection failing.
+var ErrMalformedFrame = errors.New("malformed frame")
+
+// writeFrame encodes a message as a length-prefixed, checksummed frame:
+//
+//	magic (4) | type (4) | payload length (4) | checksum (4) | payload
+//
+// The checksum is the first four bytes of the payload's SHA-256. The whole frame goes out in a
+// single Write so it is never interleaved with, or partially delivered alongside, another frame.
+func writeFrame(w io.Writer, msg Message) error {
+	if len(msg.Payload) > MaxFrameSize {
+		return fmt.Errorf("payload of %d bytes exceeds the %d byte frame limit", len(msg.Payload), MaxFrameSize)
+	}
+
+	frame := make([]byte, FrameHeaderSize, FrameHeaderSize+len(msg.Payload))
+	binary.BigEndian.PutUint32(frame[0:4], NetworkMagic)
+	binary.BigEndian.PutUint32(frame[4:8], uint32(msg.Type))
+	binary.BigEndian.PutUint32(frame[8:12], uint32(len(msg.Payload)))
+	copy(frame[12:16], frameChecksum(msg.Payload))
+	frame = append(frame, msg.Payload...)
+
+	_, err := w.Write(frame)
+	return err
+}
+
+// readFrame reads the next frame and checks its magic, type, size and checksum. The payload length
+// is checked against the limit for its message type before anything is allocated, so a peer can't
+// make us buffer an oversized message.
+func readFrame(r io.Reader) (Message, error) {
+	var header [FrameHeaderSize]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return Message{}, err
+	}
+
+	if magic := binary.BigEndian.Uint32(header[0:4]); magic != NetworkMagic {
+		return Message{}, fmt.Errorf("%w: bad magic %08x", ErrMalformedFrame, magic)
+	}
+	msgType := MessageType(binary.BigEndian.Uint32(header[4:8]))
+	maxSize, known := maxMessageSize(msgType)
+	if !known {
+		return Message{}, fmt.Errorf("%w: unknown message type %d", ErrMalformedFrame, msgType)
+	}
+	length := binary.BigEndian.Uint32(header[8:12])
+	if length > uint32(maxSize) {
+		return Message{}, fmt.Errorf("%w: %d byte payload exceeds the %d byte limit for message type %d", ErrMalformedFrame, length, maxSize, msgType)
+	}
+
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return Message{}, err
+	}
+	if !bytes.Equal(header[12:16], frameChecksum(payload)) {
+		return Message{}, fmt.Errorf("%w: checksum mismatch", ErrMalformedFrame)
+	}
+
+	return Message{Type: msgType, Payload: payload}, nil
+}
+
+// frameChecksum returns the first four bytes of the payload's SHA-256.
+func frameChecksum(payload []byte) []byte {
+	hash := sha256.Sum256(payload)
+	return hash[:4]
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestFramesRoundTrip(t *testing.T) {
+	var buf bytes.Buffer
+	sent := []Message{
+		{Type: MessageTypePing, Payload: []byte("12345678")},
+		{Type: MessageTypeVerack},
+		{Type: MessageTypeTransaction, Payload: []byte(`{"Amount":5}`)},
+	}
+	for _, msg := range sent {
+		if err := writeFrame(&buf, msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, want := range sent {
+		got, err := readFrame(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.Type != want.Type || !bytes.Equal(got.Payload, want.Payload) {
+			t.Fatalf("read %+v, want %+v", got, want)
+		}
+	}
+	if _, err := readFrame(&buf); err != io.EOF {
+		t.Fatalf("reading past the last frame gave %v, want EOF", err)
+	}
+}
+
+func TestReadFrameRejectsMalformedFrames(t *testing.T) {
+	frame := func(change func([]byte)) []byte {
+		var buf bytes.Buffer
+		if err := writeFrame(&buf, Message{Type: MessageTypePing, Payload: []byte("12345678")}); err != nil {
+			t.Fatal(err)
+		}
+		data := buf.Bytes()
+		change(data)
+		return data
+	}
+	for name, data := range map[string][]byte{
+		"bad magic":    frame(func(f []byte) { f[0] ^= 0xff }),
+		"unknown type": frame(func(f []byte) { binary.BigEndian.PutUint32(f[4:8], 9999) }),
+		"oversized":    frame(func(f []byte) { binary.BigEndian.PutUint32(f[8:12], MaxFrameSize) }),
+		"checksum":     frame(func(f []byte) { f[FrameHeaderSize] ^= 0xff }),
+	} {
+		if _, err := readFrame(bytes.NewReader(data)); !errors.Is(err, ErrMalformedFrame) {
+			t.Errorf("%s: got %v, want ErrMalformedFrame", name, err)
+		}
+	}
+
+	// A connection cut mid-frame is a network failure, not misbehavior
+	data := frame(func([]byte) {})
+	if _, err := readFrame(bytes.NewReader(data[:len(data)-1])); err == nil || errors.Is(err, ErrMalformedFrame) {
+		t.Fatalf("truncated frame gave %v, want a read error", err)
+	}
+}
+
+func TestPeerSessionCarriesManyMessages(t *testing.T) {
+	n := newTestNode(t)
+	local, remote := net.Pipe()
+	defer remote.Close()
+	peer := newPeer(n, local, &VersionMessage{}, "peer", false)
+	peer.run()
+	defer peer.Close()
+
+	// The session answers pings itself and stays open for the messages queued after
+	remote.SetDeadline(time.Now().Add(5 * time.Second))
+	if err := writeFrame(remote, Message{Type: MessageTypePing, Payload: []byte("12345678")}); err != nil {
+		t.Fatal(err)
+	}
+	if msg, err := readFrame(remote); err != nil || msg.Type != MessageTypePong || string(msg.Payload) != "12345678" {
+		t.Fatalf("got %+v, %v in answer to a ping, want its pong", msg, err)
+	}
+	for i := 0; i < 3; i++ {
+		if !peer.Send(Message{Type: MessageTypeGetAddr}) {
+			t.Fatal("session closed after one exchange")
+		}
+		if msg, err := readFrame(remote); err != nil || msg.Type != MessageTypeGetAddr {
+			t.Fatalf("message %d arrived as %+v, %v", i, msg, err)
+		}
+	}
+}